@@ -3,56 +3,257 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 type Agent struct {
-	Name           string           `toml:"name"`
-	Description    string           `toml:"description"`
-	Functions      []FunctionConfig `toml:"functions"`
-	Ask            string           `toml:"ask"`
-	SystemPrompt   string           `toml:"system_prompt"`
-	InitialMessage string           `toml:"initial_message"`
-	DefaultModel   string           `toml:"default_model"`
+	Name           string           `toml:"name" yaml:"name"`
+	Description    string           `toml:"description" yaml:"description"`
+	Functions      []FunctionConfig `toml:"functions" yaml:"functions"`
+	Ask            string           `toml:"ask" yaml:"ask"`
+	SystemPrompt   string           `toml:"system_prompt" yaml:"system_prompt"`
+	InitialMessage string           `toml:"initial_message" yaml:"initial_message"`
+	DefaultModel   string           `toml:"default_model" yaml:"default_model"`
+
+	// FallbackModels are tried in order when a request to the model
+	// fails, over the ones set in the config
+	FallbackModels []string `toml:"fallback_models,omitempty" yaml:"fallback_models,omitempty"`
+
+	// FrequencyPenalty and PresencePenalty discourage the model from
+	// repeating itself, they are left to the provider when not set
+	FrequencyPenalty *float32 `toml:"frequency_penalty,omitempty" yaml:"frequency_penalty,omitempty"`
+	PresencePenalty  *float32 `toml:"presence_penalty,omitempty" yaml:"presence_penalty,omitempty"`
+
+	// Variables can be referenced as {{var:name}} in the system prompt,
+	// initial message and function templates
+	Variables map[string]string `toml:"variables" yaml:"variables"`
+
+	// RequiredEnv lists environment variables the agent cannot work
+	// without, checked before the first request
+	RequiredEnv []string `toml:"required_env,omitempty" yaml:"required_env,omitempty"`
+
+	// OutputFilter is a shell command the final answer is piped
+	// through before it is shown, e.g. to strip <think> blocks
+	OutputFilter string `toml:"output_filter,omitempty" yaml:"output_filter,omitempty"`
+
+	// Examples are requests the agent is meant for, shown by
+	// --show-agent. PromptExamples also adds them to the system prompt.
+	Examples       []string `toml:"examples,omitempty" yaml:"examples,omitempty"`
+	PromptExamples bool     `toml:"prompt_examples,omitempty" yaml:"prompt_examples,omitempty"`
+
+	// AskUser adds the ask_user tool, which lets the model ask the user
+	// a question and use the answer
+	AskUser bool `toml:"ask_user,omitempty" yaml:"ask_user,omitempty"`
+
+	// ExtraBody holds extra fields added to the body of requests to any
+	// provider. ProviderOptions does the same for a single provider and
+	// takes precedence, both are set over the options in the config.
+	ExtraBody       map[string]any            `toml:"extra_body,omitempty" yaml:"extra_body,omitempty"`
+	ProviderOptions map[string]map[string]any `toml:"provider_options,omitempty" yaml:"provider_options,omitempty"`
 }
 
 type FunctionConfig struct {
-	Name        string            `toml:"name"`
-	Description string            `toml:"description"`
-	Command     string            `toml:"command"`
-	Parameters  []ParameterConfig `toml:"parameters"`
-	Safe        bool              `toml:"safe"`
-	Stdin       string            `toml:"stdin,omitempty"`
-	Output      string            `toml:"output"`
-	OutputType  string            `toml:"output_type,omitempty"` // e.g. "image/png", "image/jpeg"
-	Pwd         string            `toml:"pwd,omitempty"`
-	Timeout     int               `toml:"timeout"`
+	Name            string            `toml:"name" yaml:"name"`
+	Description     string            `toml:"description" yaml:"description"`
+	DescriptionFile string            `toml:"description_file,omitempty" yaml:"description_file,omitempty"` // used in place of description, relative to the agent file
+	Command         string            `toml:"command" yaml:"command"`
+	CommandDarwin   string            `toml:"command_darwin,omitempty" yaml:"command_darwin,omitempty"`     // used in place of command on macOS
+	CommandLinux    string            `toml:"command_linux,omitempty" yaml:"command_linux,omitempty"`       // used in place of command on Linux
+	Preview         string            `toml:"preview,omitempty" yaml:"preview,omitempty"`                   // read-only command whose output is shown before confirmation
+	ProgressMessage string            `toml:"progress_message,omitempty" yaml:"progress_message,omitempty"` // shown while the function runs, e.g. "Searching for {{query}}..."
+	Parameters      []ParameterConfig `toml:"parameters" yaml:"parameters"`
+	Safe            bool              `toml:"safe" yaml:"safe"`
+	Stdin           string            `toml:"stdin,omitempty" yaml:"stdin,omitempty"`
+	Output          string            `toml:"output" yaml:"output"`
+	OutputType      string            `toml:"output_type,omitempty" yaml:"output_type,omitempty"` // e.g. "image/png", "image/jpeg"
+	Pwd             string            `toml:"pwd,omitempty" yaml:"pwd,omitempty"`
+	Timeout         int               `toml:"timeout" yaml:"timeout"`
+	Retries         int               `toml:"retries,omitempty" yaml:"retries,omitempty"`           // extra attempts when the command fails
+	MaxOutput       int               `toml:"max_output,omitempty" yaml:"max_output,omitempty"`     // bytes, defaults to defaultMaxToolOutput
+	Background      bool              `toml:"background,omitempty" yaml:"background,omitempty"`     // start the command and return a job ID right away
+	Interactive     bool              `toml:"interactive,omitempty" yaml:"interactive,omitempty"`   // takes over the terminal, e.g. an editor or fzf
+	ParseOutput     string            `toml:"parse_output,omitempty" yaml:"parse_output,omitempty"` // path of the part of JSON output sent to the model, e.g. items[].name
+
+	// run implements built-in tools such as check_job in-process, with
+	// the background jobs of the conversation
+	run func(args map[string]any, jobs *jobRegistry) (string, error)
+}
+
+// commandFor returns the command of the function for the operating
+// system goos, preferring the variant for it over command
+func (fc FunctionConfig) commandFor(goos string) string {
+	var command string
+	switch goos {
+	case "darwin":
+		command = fc.CommandDarwin
+	case "linux":
+		command = fc.CommandLinux
+	}
+	if command == "" {
+		return fc.Command
+	}
+	return command
 }
 
 type ParameterConfig struct {
-	Name        string   `toml:"name"`
-	Type        string   `toml:"type"`
-	Description string   `toml:"description"`
-	Required    bool     `toml:"required"`
-	Format      string   `toml:"format,omitempty"`
-	Options     []string `toml:"options,omitempty"`
-	Default     any      `toml:"default,omitempty"`
+	Name        string   `toml:"name" yaml:"name"`
+	Type        string   `toml:"type" yaml:"type"`
+	Description string   `toml:"description" yaml:"description"`
+	Required    bool     `toml:"required" yaml:"required"`
+	Format      string   `toml:"format,omitempty" yaml:"format,omitempty"`
+	Options     []string `toml:"options,omitempty" yaml:"options,omitempty"`
+	Default     any      `toml:"default,omitempty" yaml:"default,omitempty"`
 }
 
 func loadAgent(agentPath string) (Agent, error) {
+	return loadAgentWith(agentPath, validateAgent)
+}
+
+// loadAgentDefinition loads an agent file without running the shell
+// blocks of its variables, for agents that are only listed or shown
+func loadAgentDefinition(agentPath string) (Agent, error) {
+	return loadAgentWith(agentPath, validateAgentDefinition)
+}
+
+// loadAgentWith loads an agent file and checks it with validate
+func loadAgentWith(agentPath string, validate func(Agent) (Agent, error)) (Agent, error) {
 	var agent Agent
-	_, err := toml.DecodeFile(agentPath, &agent)
+	var err error
+	switch filepath.Ext(agentPath) {
+	case ".yaml", ".yml":
+		err = decodeYAMLAgent(agentPath, &agent)
+	default:
+		_, err = toml.DecodeFile(agentPath, &agent)
+	}
 	if err != nil {
 		return agent, err
 	}
 
-	return validateAgent(agent)
+	if err := loadDescriptionFiles(&agent, filepath.Dir(agentPath)); err != nil {
+		return agent, err
+	}
+
+	return validate(agent)
+}
+
+// decodeYAMLAgent decodes a YAML agent file, which uses the same keys
+// as the TOML format
+func decodeYAMLAgent(agentPath string, agent *Agent) error {
+	data, err := os.ReadFile(agentPath)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, agent)
+}
+
+// agentFileExtensions are the extensions of agent files in the order
+// they are looked up in when resolving an agent by name
+var agentFileExtensions = []string{".toml", ".yaml", ".yml"}
+
+// isAgentFile reports whether name has the extension of an agent file
+func isAgentFile(name string) bool {
+	return slices.Contains(agentFileExtensions, filepath.Ext(name))
+}
+
+// agentNameFromPath returns the name of the agent defined in the file at
+// path, which is the file name without the extension
+func agentNameFromPath(path string) string {
+	base := filepath.Base(path)
+	if isAgentFile(base) {
+		return strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return base
+}
+
+// userAgentPath returns the path of the user agent with the given name.
+// Directories are searched in the order of agentDirs, and within one
+// TOML files take precedence over YAML ones. The TOML path in agentsDir
+// is returned when the agent does not exist.
+func userAgentPath(name string) string {
+	for _, agentDir := range agentDirs() {
+		for _, ext := range agentFileExtensions {
+			path := filepath.Join(agentDir, name+ext)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return filepath.Join(agentsDir(), name+".toml")
+}
+
+// loadDescriptionFiles replaces the description of functions that set
+// description_file with the contents of that file. A missing file is
+// reported and the inline description is used instead.
+func loadDescriptionFiles(agent *Agent, agentDir string) error {
+	for i, fc := range agent.Functions {
+		if fc.DescriptionFile == "" {
+			continue
+		}
+
+		path := expandHomePath(fc.DescriptionFile)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(agentDir, path)
+		}
+
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: description_file %s of function '%s' in agent '%s' not found, using inline description\n",
+				fc.DescriptionFile, fc.Name, agent.Name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("function '%s' in agent '%s': %w", fc.Name, agent.Name, wrapFileError("read", path, err))
+		}
+
+		agent.Functions[i].Description = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// checkRequiredEnv reports the environment variables listed in the
+// required_env of the agent that are not set or empty
+func checkRequiredEnv(agent Agent) error {
+	var missing []string
+	for _, name := range agent.RequiredEnv {
+		if os.Getenv(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	name := agent.Name
+	if name == "" {
+		name = "default"
+	}
+	return fmt.Errorf("agent '%s' needs environment variables that are not set: %s (set them or add them to ~/.config/esa/.env)",
+		name, strings.Join(missing, ", "))
 }
 
 // validateAgent performs validation on an agent configuration
 // to ensure all required fields are present and properly formatted.
 func validateAgent(agent Agent) (Agent, error) {
+	return validateAgentWith(agent, processShellBlocks)
+}
+
+// validateAgentDefinition validates an agent like validateAgent but
+// leaves its {{$...}} and {{#...}} blocks as they are instead of
+// running them, for definitions that are only checked or displayed
+func validateAgentDefinition(agent Agent) (Agent, error) {
+	return validateAgentWith(agent, func(s string) (string, error) { return s, nil })
+}
+
+// validateAgentWith validates agent, resolving the blocks in its
+// variables and descriptions with resolveBlocks
+func validateAgentWith(agent Agent, resolveBlocks func(string) (string, error)) (Agent, error) {
 	var err error
 
 	// Validate ask level
@@ -61,8 +262,24 @@ func validateAgent(agent Agent) (Agent, error) {
 		return agent, fmt.Errorf("agent '%s' has invalid ask level: %q (must be one of: none, unsafe, all)", agent.Name, agent.Ask)
 	}
 
+	if err := validatePenalty("frequency_penalty", agent.FrequencyPenalty); err != nil {
+		return agent, fmt.Errorf("agent '%s' has %v", agent.Name, err)
+	}
+	if err := validatePenalty("presence_penalty", agent.PresencePenalty); err != nil {
+		return agent, fmt.Errorf("agent '%s' has %v", agent.Name, err)
+	}
+
+	// Resolve variables first as they can be computed using shell blocks
+	for name, value := range agent.Variables {
+		agent.Variables[name], err = resolveBlocks(value)
+		if err != nil {
+			return agent, fmt.Errorf("error processing shell blocks in variable %s: %v", name, err)
+		}
+	}
+
 	// Check function name uniqueness
 	funcNames := make(map[string]bool)
+	hasBackground := false
 
 	// Validate each function configuration
 	for i, fc := range agent.Functions {
@@ -74,14 +291,38 @@ func validateAgent(agent Agent) (Agent, error) {
 		}
 		funcNames[fc.Name] = true
 
-		if fc.Command == "" {
-			return agent, fmt.Errorf("function %s in agent '%s' has no command defined", fc.Name, agent.Name)
+		if fc.commandFor(runtime.GOOS) == "" {
+			return agent, fmt.Errorf("function %s in agent '%s' has no command defined for %s", fc.Name, agent.Name, runtime.GOOS)
 		}
 		if fc.Timeout < 0 || fc.Timeout > 3600 {
 			return agent, fmt.Errorf("function '%s' in agent '%s' has invalid timeout %d (must be 0-3600)", fc.Name, agent.Name, fc.Timeout)
 		}
+		if fc.Retries < 0 || fc.Retries > maxFunctionRetries {
+			return agent, fmt.Errorf("function '%s' in agent '%s' has invalid retries %d (must be 0-%d)", fc.Name, agent.Name, fc.Retries, maxFunctionRetries)
+		}
+		if fc.Background && fc.OutputType == "image" {
+			return agent, fmt.Errorf("function '%s' in agent '%s' cannot run in the background with output_type image", fc.Name, agent.Name)
+		}
+		if fc.Background && fc.Interactive {
+			return agent, fmt.Errorf("function '%s' in agent '%s' cannot be interactive and run in the background", fc.Name, agent.Name)
+		}
+		if fc.ParseOutput != "" {
+			if fc.OutputType == "image" || fc.Background {
+				return agent, fmt.Errorf("function '%s' in agent '%s' cannot use parse_output with output_type image or in the background", fc.Name, agent.Name)
+			}
+			if _, err := parseOutputPath(fc.ParseOutput); err != nil {
+				return agent, fmt.Errorf("function '%s' in agent '%s' has invalid parse_output: %v", fc.Name, agent.Name, err)
+			}
+		}
+		if fc.Background {
+			hasBackground = true
+		}
 
-		agent.Functions[i].Description, err = processShellBlocks(fc.Description)
+		if err := expandFunctionVariables(&agent.Functions[i], agent.Variables); err != nil {
+			return agent, fmt.Errorf("function %s in agent '%s': %v", fc.Name, agent.Name, err)
+		}
+
+		agent.Functions[i].Description, err = resolveBlocks(agent.Functions[i].Description)
 		if err != nil {
 			return agent, fmt.Errorf("error processing shell blocks in function %s: %v", fc.Name, err)
 		}
@@ -112,7 +353,7 @@ func validateAgent(agent Agent) (Agent, error) {
 				return agent, fmt.Errorf("parameter %s in function '%s' has invalid type: %s", param.Name, fc.Name, param.Type)
 			}
 
-			agent.Functions[i].Parameters[j].Description, err = processShellBlocks(param.Description)
+			agent.Functions[i].Parameters[j].Description, err = resolveBlocks(param.Description)
 			if err != nil {
 				return agent, fmt.Errorf("error processing shell blocks in parameter %s of function %s: %v",
 					param.Name, fc.Name, err)
@@ -120,9 +361,147 @@ func validateAgent(agent Agent) (Agent, error) {
 		}
 	}
 
+	// Jobs started by background functions are followed using
+	// check_job, unless the agent defines a function with that name
+	if hasBackground {
+		if funcNames[checkJobToolName] {
+			fmt.Fprintf(os.Stderr, "Warning: function '%s' in agent '%s' replaces the built-in tool used to check on background jobs\n",
+				checkJobToolName, agent.Name)
+		} else {
+			agent.Functions = append(agent.Functions, checkJobFunction())
+		}
+	}
+
+	if agent.AskUser {
+		if funcNames[askUserToolName] {
+			fmt.Fprintf(os.Stderr, "Warning: function '%s' in agent '%s' replaces the built-in tool used to ask the user questions\n",
+				askUserToolName, agent.Name)
+		} else {
+			agent.Functions = append(agent.Functions, askUserFunction())
+		}
+	}
+
 	return agent, nil
 }
 
+var variableRegex = regexp.MustCompile(`{{var:([^{}]+)}}`)
+
+// expandVariables replaces {{var:name}} references in input with the
+// value of the named variable. Referencing an undefined variable is an
+// error.
+func expandVariables(input string, variables map[string]string) (string, error) {
+	var missing string
+	result := variableRegex.ReplaceAllStringFunc(input, func(match string) string {
+		name := strings.TrimSpace(variableRegex.FindStringSubmatch(match)[1])
+		value, ok := variables[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable %q", missing)
+	}
+	return result, nil
+}
+
+// placeholderRegex matches {{name}} parameter placeholders. Names have
+// to start with a letter so that templates of other tools such as
+// docker's {{.Names}} are not taken for placeholders.
+var placeholderRegex = regexp.MustCompile(`{{([A-Za-z_][A-Za-z0-9_-]*)}}`)
+
+// placeholderRef is an undefined placeholder found in a function and
+// the field it was found in
+type placeholderRef struct {
+	name  string
+	field string
+}
+
+// warnUndefinedPlaceholders warns about the undefined placeholders in
+// the functions of agent. It is called when an agent is run or shown
+// rather than on every load, so that listing agents stays quiet.
+func warnUndefinedPlaceholders(agent Agent) {
+	for _, fc := range agent.Functions {
+		for _, ref := range undefinedPlaceholders(fc) {
+			fmt.Fprintf(os.Stderr, "Warning: function '%s' in agent '%s' references undefined parameter {{%s}} in %s\n",
+				fc.Name, agent.Name, ref.name, ref.field)
+		}
+	}
+}
+
+// undefinedPlaceholders returns the {{name}} placeholders in the
+// templates of a function that are neither one of its parameters nor
+// {{last_output}}, as they would be left in the command as they are.
+// Other templates such as {{$...}} and {{output:...}} are not matched.
+func undefinedPlaceholders(fc FunctionConfig) []placeholderRef {
+	params := map[string]bool{"last_output": true}
+	for _, param := range fc.Parameters {
+		params[param.Name] = true
+	}
+
+	fields := []struct {
+		name, value string
+	}{
+		{"command", fc.Command},
+		{"command_darwin", fc.CommandDarwin},
+		{"command_linux", fc.CommandLinux},
+		{"preview", fc.Preview},
+		{"progress_message", fc.ProgressMessage},
+		{"stdin", fc.Stdin},
+		{"output", fc.Output},
+		{"pwd", fc.Pwd},
+	}
+
+	var refs []placeholderRef
+	for _, field := range fields {
+		seen := make(map[string]bool)
+		for _, match := range placeholderRegex.FindAllStringSubmatch(field.value, -1) {
+			name := match[1]
+			if params[name] || seen[name] {
+				continue
+			}
+			seen[name] = true
+			refs = append(refs, placeholderRef{name: name, field: field.name})
+		}
+	}
+	return refs
+}
+
+// expandFunctionVariables replaces variable references in all the
+// templated fields of a function. Variables are expanded when the agent
+// is loaded, before parameters are substituted on each call.
+func expandFunctionVariables(fc *FunctionConfig, variables map[string]string) error {
+	fields := []*string{
+		&fc.Description, &fc.Command, &fc.CommandDarwin, &fc.CommandLinux,
+		&fc.Preview, &fc.ProgressMessage, &fc.Stdin, &fc.Output, &fc.Pwd,
+	}
+	for _, field := range fields {
+		expanded, err := expandVariables(*field, variables)
+		if err != nil {
+			return err
+		}
+		*field = expanded
+	}
+	return nil
+}
+
+// promptWithExamples returns the resolved system prompt with the
+// examples of the agent added when prompt_examples is set
+func (agent Agent) promptWithExamples(prompt string) string {
+	if !agent.PromptExamples || len(agent.Examples) == 0 {
+		return prompt
+	}
+
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\nExamples of requests you are expected to handle:\n")
+	for _, example := range agent.Examples {
+		fmt.Fprintf(&b, "- %s\n", example)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
 func loadConfiguration(opts *CLIOptions) (Agent, error) {
 	if conf, exists := builtinAgents[opts.AgentName]; exists {
 		var agent Agent
@@ -135,7 +514,12 @@ func loadConfiguration(opts *CLIOptions) (Agent, error) {
 	agentPath := expandHomePath(opts.AgentPath)
 	_, err := os.Stat(agentPath)
 	if err != nil {
-		if os.IsNotExist(err) && opts.AgentName == "" && opts.AgentPath == DefaultAgentPath {
+		if os.IsNotExist(err) && opts.AgentName == "" && opts.AgentPath == defaultAgentPath() {
+			// The default agent can also be written in YAML
+			if path := userAgentPath("default"); path != agentPath {
+				return loadAgent(path)
+			}
+
 			var agent Agent
 			if _, err := toml.Decode(defaultAgentToml, &agent); err != nil {
 				return Agent{}, fmt.Errorf("error loading embedded new agent config: %v", err)
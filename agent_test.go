@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -8,6 +13,11 @@ import (
 )
 
 func TestValidateAgent(t *testing.T) {
+	otherOS := "darwin"
+	if runtime.GOOS == "darwin" {
+		otherOS = "linux"
+	}
+
 	tests := []struct {
 		name        string
 		agentConfig string
@@ -54,6 +64,19 @@ description = "Function without command"
 			wantErr:     true,
 			errContains: "has no command defined",
 		},
+		{
+			name: "function with a command for another os only",
+			agentConfig: fmt.Sprintf(`
+name = "test-agent"
+
+[[functions]]
+name = "hello"
+description = "Say hello"
+command_%s = "echo Hello"
+`, otherOS),
+			wantErr:     true,
+			errContains: "has no command defined for " + runtime.GOOS,
+		},
 		{
 			name: "parameter with invalid type",
 			agentConfig: `
@@ -166,6 +189,22 @@ timeout = 300
 `,
 			wantErr: false,
 		},
+		{
+			name: "undefined variable",
+			agentConfig: `
+name = "test-agent"
+
+[variables]
+repo = "/src/esa"
+
+[[functions]]
+name = "hello"
+description = "Say hello"
+command = "ls {{var:repo_path}}"
+`,
+			wantErr:     true,
+			errContains: "undefined variable \"repo_path\"",
+		},
 	}
 
 	for _, tt := range tests {
@@ -189,3 +228,479 @@ timeout = 300
 		})
 	}
 }
+
+func TestValidateAgent_Variables(t *testing.T) {
+	agentConfig := `
+name = "test-agent"
+
+[variables]
+repo = "/src/esa"
+greeting = "{{$echo hello}}"
+
+[[functions]]
+name = "list"
+description = "List files in {{var:repo}}"
+command = "ls {{var:repo}}/{{dir}}"
+pwd = "{{var:repo}}"
+output = "{{var:greeting}}"
+
+[[functions.parameters]]
+name = "dir"
+type = "string"
+description = "Directory to list"
+`
+	var agent Agent
+	if _, err := toml.Decode(agentConfig, &agent); err != nil {
+		t.Fatalf("Failed to decode agent config: %v", err)
+	}
+
+	agent, err := validateAgent(agent)
+	if err != nil {
+		t.Fatalf("validateAgent() error = %v", err)
+	}
+
+	fc := agent.Functions[0]
+	tests := []struct {
+		field string
+		got   string
+		want  string
+	}{
+		{field: "description", got: fc.Description, want: "List files in /src/esa"},
+		{field: "command", got: fc.Command, want: "ls /src/esa/{{dir}}"},
+		{field: "pwd", got: fc.Pwd, want: "/src/esa"},
+		{field: "output", got: fc.Output, want: "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.field, tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadAgent_DescriptionFile(t *testing.T) {
+	dir := t.TempDir()
+	docsDir := filepath.Join(dir, "docs")
+	if err := os.MkdirAll(docsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docsDir, "search.md"), []byte("Search the {{var:repo}} repo for {{$echo code}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		descriptionFile string
+		wantDescription string
+	}{
+		{
+			name:            "relative to agent file",
+			descriptionFile: "docs/search.md",
+			wantDescription: "Search the esa repo for code",
+		},
+		{
+			name:            "absolute path",
+			descriptionFile: filepath.Join(docsDir, "search.md"),
+			wantDescription: "Search the esa repo for code",
+		},
+		{
+			name:            "missing file falls back to inline description",
+			descriptionFile: "docs/missing.md",
+			wantDescription: "Inline description",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agentPath := filepath.Join(dir, "search.toml")
+			agentConfig := fmt.Sprintf(`
+name = "search"
+
+[variables]
+repo = "esa"
+
+[[functions]]
+name = "search"
+description = "Inline description"
+description_file = %q
+command = "rg foo"
+`, tt.descriptionFile)
+			if err := os.WriteFile(agentPath, []byte(agentConfig), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			agent, err := loadAgent(agentPath)
+			if err != nil {
+				t.Fatalf("loadAgent() error = %v", err)
+			}
+			if got := agent.Functions[0].Description; got != tt.wantDescription {
+				t.Errorf("description = %q, want %q", got, tt.wantDescription)
+			}
+		})
+	}
+}
+
+func TestLoadAgent_YAML(t *testing.T) {
+	tomlAgent := `
+name = "search"
+description = "Search code"
+system_prompt = """
+You search code.
+Be brief."""
+ask = "unsafe"
+
+[[functions]]
+name = "grep"
+description = "Search for a pattern"
+command = "rg {{pattern}}"
+safe = true
+
+[[functions.parameters]]
+name = "pattern"
+type = "string"
+description = "Pattern to search for"
+required = true
+`
+	yamlAgent := `
+name: search
+description: Search code
+system_prompt: |-
+  You search code.
+  Be brief.
+ask: unsafe
+functions:
+  - name: grep
+    description: Search for a pattern
+    command: rg {{pattern}}
+    safe: true
+    parameters:
+      - name: pattern
+        type: string
+        description: Pattern to search for
+        required: true
+`
+
+	dir := t.TempDir()
+	tomlPath := filepath.Join(dir, "search.toml")
+	if err := os.WriteFile(tomlPath, []byte(tomlAgent), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := loadAgent(tomlPath)
+	if err != nil {
+		t.Fatalf("loadAgent(%q) error = %v", tomlPath, err)
+	}
+
+	tests := []struct {
+		name     string
+		fileName string
+	}{
+		{name: "yaml extension", fileName: "search.yaml"},
+		{name: "yml extension", fileName: "search.yml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.fileName)
+			if err := os.WriteFile(path, []byte(yamlAgent), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadAgent(path)
+			if err != nil {
+				t.Fatalf("loadAgent(%q) error = %v", path, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loadAgent(%q) = %+v, want %+v", path, got, want)
+			}
+		})
+	}
+}
+
+func TestGetUserAgents_YAML(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	agentDir := filepath.Join(home, ".config", "esa", "agents")
+	if err := os.MkdirAll(agentDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"both.toml":  "name = \"both\"\ndescription = \"from toml\"\n",
+		"both.yaml":  "name: both\ndescription: from yaml\n",
+		"only.yml":   "name: only\ndescription: from yml\n",
+		"notes.txt":  "not an agent",
+		"plain.toml": "name = \"plain\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(agentDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	agents, names, found := getUserAgents(false)
+	if !found {
+		t.Fatal("getUserAgents() found no agents")
+	}
+
+	wantNames := []string{"both", "only", "plain"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("names = %v, want %v", names, wantNames)
+	}
+	if agents[0].Description != "from toml" {
+		t.Errorf("both description = %q, want the TOML file to take precedence", agents[0].Description)
+	}
+
+	if got := userAgentPath("only"); got != filepath.Join(agentDir, "only.yml") {
+		t.Errorf("userAgentPath(only) = %q, want the yml file", got)
+	}
+}
+
+func TestAgentsDirOverride(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	envDir := filepath.Join(home, "env-agents")
+	flagDir := filepath.Join(home, "flag-agents")
+	t.Cleanup(func() { configureAgentsDir("") })
+
+	tests := []struct {
+		name    string
+		env     string
+		flag    string
+		wantDir string
+	}{
+		{name: "default", wantDir: filepath.Join(home, ".config", "esa", "agents")},
+		{name: "environment", env: envDir, wantDir: envDir},
+		{name: "flag over environment", env: envDir, flag: flagDir, wantDir: flagDir},
+		{name: "home relative", env: "~/agents", wantDir: filepath.Join(home, "agents")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(agentsDirEnvar, tt.env)
+			configureAgentsDir(tt.flag)
+
+			if got := agentsDir(); got != tt.wantDir {
+				t.Errorf("agentsDir() = %q, want %q", got, tt.wantDir)
+			}
+			if _, path := ParseAgentString("+reviewer"); path != filepath.Join(tt.wantDir, "reviewer.toml") {
+				t.Errorf("ParseAgentString(+reviewer) path = %q, want it in %q", path, tt.wantDir)
+			}
+		})
+	}
+}
+
+func TestGetUserAgents_ProjectDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(agentsDirEnvar, "")
+	configureAgentsDir("")
+
+	globalDir := filepath.Join(home, ".config", "esa", "agents")
+	project := filepath.Join(home, "project")
+	projectDir := filepath.Join(project, ".esa", "agents")
+	files := map[string]string{
+		filepath.Join(globalDir, "shared.toml"):  "description = \"global\"\n",
+		filepath.Join(globalDir, "global.toml"):  "description = \"global only\"\n",
+		filepath.Join(projectDir, "shared.yaml"): "description: project\n",
+		filepath.Join(projectDir, "local.toml"):  "description = \"project only\"\n",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The project directory is found from anywhere inside the project
+	subdir := filepath.Join(project, "src")
+	if err := os.MkdirAll(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(subdir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	// Agents of a project that is not trusted are not loaded
+	configureTrustedProjects(nil)
+	_, names, _ := getUserAgents(false)
+	if want := []string{"global", "shared"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("untrusted names = %v, want %v", names, want)
+	}
+
+	configureTrustedProjects([]string{project})
+	t.Cleanup(func() { configureTrustedProjects(nil) })
+	agents, names, _ := getUserAgents(false)
+	wantNames := []string{"global", "local", "shared"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("names = %v, want %v", names, wantNames)
+	}
+	if agents[2].Description != "project" {
+		t.Errorf("shared description = %q, want the project agent to take precedence", agents[2].Description)
+	}
+
+	tests := []struct {
+		name     string
+		wantPath string
+	}{
+		{name: "shared", wantPath: filepath.Join(projectDir, "shared.yaml")},
+		{name: "global", wantPath: filepath.Join(globalDir, "global.toml")},
+		{name: "missing", wantPath: filepath.Join(globalDir, "missing.toml")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := userAgentPath(tt.name); got != tt.wantPath {
+				t.Errorf("userAgentPath(%q) = %q, want %q", tt.name, got, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestCheckRequiredEnv(t *testing.T) {
+	t.Setenv("ESA_TEST_TOKEN", "secret")
+	t.Setenv("ESA_TEST_EMPTY", "")
+
+	tests := []struct {
+		name        string
+		requiredEnv []string
+		wantMissing string
+	}{
+		{name: "nothing required", requiredEnv: nil},
+		{name: "all set", requiredEnv: []string{"ESA_TEST_TOKEN"}},
+		{name: "unset", requiredEnv: []string{"ESA_TEST_TOKEN", "ESA_TEST_UNSET"}, wantMissing: "ESA_TEST_UNSET"},
+		{name: "empty counts as unset", requiredEnv: []string{"ESA_TEST_EMPTY", "ESA_TEST_UNSET"}, wantMissing: "ESA_TEST_EMPTY, ESA_TEST_UNSET"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRequiredEnv(Agent{Name: "github", RequiredEnv: tt.requiredEnv})
+			if tt.wantMissing == "" {
+				if err != nil {
+					t.Errorf("checkRequiredEnv() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "not set: "+tt.wantMissing+" ") {
+				t.Errorf("checkRequiredEnv() error = %v, want it to name %s", err, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestFunctionCommandFor(t *testing.T) {
+	fc := FunctionConfig{
+		Command:       "xdg-open {{url}}",
+		CommandDarwin: "open {{url}}",
+	}
+
+	tests := []struct {
+		name        string
+		goos        string
+		wantCommand string
+	}{
+		{name: "variant for the os", goos: "darwin", wantCommand: "open {{url}}"},
+		{name: "no variant for the os", goos: "linux", wantCommand: "xdg-open {{url}}"},
+		{name: "unknown os", goos: "plan9", wantCommand: "xdg-open {{url}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fc.commandFor(tt.goos); got != tt.wantCommand {
+				t.Errorf("commandFor(%q) = %q, want %q", tt.goos, got, tt.wantCommand)
+			}
+		})
+	}
+}
+
+func TestUndefinedPlaceholders(t *testing.T) {
+	tests := []struct {
+		name string
+		fc   FunctionConfig
+		want []placeholderRef
+	}{
+		{
+			name: "all defined",
+			fc: FunctionConfig{
+				Command:    "grep {{pattern}} {{path}} | head -n {{$echo 10}}",
+				Stdin:      "{{last_output}}",
+				Parameters: []ParameterConfig{{Name: "pattern"}, {Name: "path"}},
+			},
+		},
+		{
+			name: "typo in command",
+			fc: FunctionConfig{
+				Command:    "cat {{flie}} {{flie}}",
+				Parameters: []ParameterConfig{{Name: "file"}},
+			},
+			want: []placeholderRef{{name: "flie", field: "command"}},
+		},
+		{
+			name: "other fields",
+			fc: FunctionConfig{
+				Command:         "curl {{url}}",
+				ProgressMessage: "Fetching {{link}}",
+				Output:          "{{body}}",
+				Parameters:      []ParameterConfig{{Name: "url"}},
+			},
+			want: []placeholderRef{{name: "link", field: "progress_message"}, {name: "body", field: "output"}},
+		},
+		{
+			name: "other templates",
+			fc: FunctionConfig{
+				Command: "docker ps --format '{{.Names}}' {{output:list}} {{#Name?}} {{?env:DEBUG}}-v{{/?}}",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := undefinedPlaceholders(tt.fc)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("undefinedPlaceholders() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptWithExamples(t *testing.T) {
+	examples := []string{"list open pull requests", "review {{$git diff}}"}
+
+	tests := []struct {
+		name  string
+		agent Agent
+		want  string
+	}{
+		{
+			name:  "examples not in the prompt by default",
+			agent: Agent{Examples: examples},
+			want:  "You are a git helper.",
+		},
+		{
+			name:  "prompt_examples adds them",
+			agent: Agent{Examples: examples, PromptExamples: true},
+			want:  "You are a git helper.\n\nExamples of requests you are expected to handle:\n- list open pull requests\n- review {{$git diff}}",
+		},
+		{
+			name:  "no examples",
+			agent: Agent{PromptExamples: true},
+			want:  "You are a git helper.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.agent.promptWithExamples("You are a git helper."); got != tt.want {
+				t.Errorf("promptWithExamples() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
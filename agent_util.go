@@ -1,14 +1,13 @@
 package main
 
 import (
-	"fmt"
 	"strings"
 )
 
 // ParseAgentString handles all agent string formats:
 // - +name (built-in or user agent by name)
 // - name (without + prefix, treated as agent name)
-// - /path/to/agent.toml (direct file path)
+// - /path/to/agent.toml or /path/to/agent.yaml (direct file path)
 // - builtin:name (builtin agent specification)
 //
 // Returns agentName and agentPath. If the input is a direct path,
@@ -25,12 +24,12 @@ func ParseAgentString(input string) (agentName, agentPath string) {
 		}
 
 		// Otherwise treat as user agent name
-		agentPath = expandHomePath(fmt.Sprintf("%s/%s.toml", DefaultAgentsDir, agentName))
+		agentPath = userAgentPath(agentName)
 		return
 	}
 
-	// Handle direct path (contains / or ends with .toml)
-	if strings.Contains(input, "/") || strings.HasSuffix(input, ".toml") {
+	// Handle direct path (contains / or has an agent file extension)
+	if strings.Contains(input, "/") || isAgentFile(input) {
 		agentPath = input
 		if !strings.HasPrefix(agentPath, "/") {
 			agentPath = expandHomePath(agentPath)
@@ -48,6 +47,6 @@ func ParseAgentString(input string) (agentName, agentPath string) {
 	}
 
 	// Treat as user agent name
-	agentPath = expandHomePath(fmt.Sprintf("%s/%s.toml", DefaultAgentsDir, agentName))
+	agentPath = userAgentPath(agentName)
 	return
 }
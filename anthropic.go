@@ -39,12 +39,13 @@ func newAnthropicLLMClient(apiKey, baseURL string, httpClient *http.Client) LLMC
 // -- Anthropic request types --
 
 type anthropicRequest struct {
-	Model     string             `json:"model"`
-	MaxTokens int                `json:"max_tokens"`
-	System    string             `json:"system,omitempty"`
-	Messages  []anthropicMessage `json:"messages"`
-	Tools     []anthropicTool    `json:"tools,omitempty"`
-	Stream    bool               `json:"stream"`
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	Stream      bool               `json:"stream"`
 }
 
 type anthropicMessage struct {
@@ -108,6 +109,36 @@ type anthropicContentDeltaBody struct {
 	PartialJSON string `json:"partial_json,omitempty"`
 }
 
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicMessageStart struct {
+	Type    string `json:"type"`
+	Message struct {
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+}
+
+type anthropicMessageDelta struct {
+	Type  string `json:"type"`
+	Delta struct {
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+}
+
+// anthropicFinishReasons maps Anthropic stop reasons to the OpenAI
+// finish reasons used by LLMStreamDelta
+var anthropicFinishReasons = map[string]openai.FinishReason{
+	"end_turn":      openai.FinishReasonStop,
+	"stop_sequence": openai.FinishReasonStop,
+	"max_tokens":    openai.FinishReasonLength,
+	"tool_use":      openai.FinishReasonToolCalls,
+	"refusal":       openai.FinishReasonContentFilter,
+}
+
 type anthropicErrorEvent struct {
 	Type  string `json:"type"`
 	Error struct {
@@ -125,11 +156,21 @@ func convertOpenAIMessagesToAnthropic(messages []openai.ChatCompletionMessage) (
 	for _, msg := range messages {
 		switch msg.Role {
 		case "system":
-			system = msg.Content
+			// Notes added to continued conversations follow the
+			// system prompt
+			if system != "" {
+				system += "\n\n"
+			}
+			system += msg.Content
 		case "user":
+			// Messages with attached images hold their text in parts
+			var content any = msg.Content
+			if len(msg.MultiContent) > 0 {
+				content = convertOpenAIPartsToAnthropic(msg.MultiContent)
+			}
 			anthropicMsgs = append(anthropicMsgs, anthropicMessage{
 				Role:    "user",
-				Content: msg.Content,
+				Content: content,
 			})
 		case "assistant":
 			if len(msg.ToolCalls) > 0 {
@@ -174,24 +215,10 @@ func convertOpenAIMessagesToAnthropic(messages []openai.ChatCompletionMessage) (
 			var block anthropicContentBlock
 			if len(msg.MultiContent) > 0 {
 				// Image tool result — convert image_url parts to Anthropic image blocks.
-				var imageBlocks []anthropicContentBlock
-				for _, part := range msg.MultiContent {
-					if part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil {
-						mime, data := parseDataURI(part.ImageURL.URL)
-						imageBlocks = append(imageBlocks, anthropicContentBlock{
-							Type: "image",
-							Source: &anthropicImageSource{
-								Type:      "base64",
-								MediaType: mime,
-								Data:      data,
-							},
-						})
-					}
-				}
 				block = anthropicContentBlock{
 					Type:      "tool_result",
 					ToolUseID: msg.ToolCallID,
-					Content:   imageBlocks,
+					Content:   convertOpenAIPartsToAnthropic(msg.MultiContent),
 				}
 			} else {
 				content := msg.Content
@@ -222,6 +249,29 @@ func convertOpenAIMessagesToAnthropic(messages []openai.ChatCompletionMessage) (
 	return system, anthropicMsgs
 }
 
+// convertOpenAIPartsToAnthropic converts the text and image parts of a
+// message to Anthropic content blocks
+func convertOpenAIPartsToAnthropic(parts []openai.ChatMessagePart) []anthropicContentBlock {
+	var blocks []anthropicContentBlock
+	for _, part := range parts {
+		switch {
+		case part.Type == openai.ChatMessagePartTypeText:
+			blocks = append(blocks, anthropicContentBlock{Type: "text", Text: part.Text})
+		case part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil:
+			mime, data := parseDataURI(part.ImageURL.URL)
+			blocks = append(blocks, anthropicContentBlock{
+				Type: "image",
+				Source: &anthropicImageSource{
+					Type:      "base64",
+					MediaType: mime,
+					Data:      data,
+				},
+			})
+		}
+	}
+	return blocks
+}
+
 // parseDataURI splits a data URI of the form "data:<mime>;base64,<data>"
 // into its MIME type and base64 data components.
 func parseDataURI(uri string) (mime, data string) {
@@ -265,17 +315,22 @@ func (c *anthropicLLMClient) CreateChatCompletionStream(
 	model string,
 	messages []openai.ChatCompletionMessage,
 	tools []openai.Tool,
+	opts RequestOptions,
 ) (LLMStream, error) {
 	system, anthropicMsgs := convertOpenAIMessagesToAnthropic(messages)
 	anthropicTools := convertOpenAIToolsToAnthropic(tools)
 
 	reqBody := anthropicRequest{
-		Model:     model,
-		MaxTokens: anthropicDefaultMaxTok,
-		System:    system,
-		Messages:  anthropicMsgs,
-		Tools:     anthropicTools,
-		Stream:    true,
+		Model:       model,
+		MaxTokens:   anthropicDefaultMaxTok,
+		Temperature: opts.Temperature,
+		System:      system,
+		Messages:    anthropicMsgs,
+		Tools:       anthropicTools,
+		Stream:      true,
+	}
+	if opts.MaxTokens > 0 {
+		reqBody.MaxTokens = opts.MaxTokens
 	}
 
 	bodyBytes, err := json.Marshal(reqBody)
@@ -304,7 +359,7 @@ func (c *anthropicLLMClient) CreateChatCompletionStream(
 		if resp.StatusCode == 429 {
 			return nil, fmt.Errorf("429 Too Many Requests: %s", string(body))
 		}
-		return nil, fmt.Errorf("anthropic API error (status %d): %s", resp.StatusCode, string(body))
+		return nil, &anthropicAPIError{statusCode: resp.StatusCode, body: string(body)}
 	}
 
 	return &anthropicLLMStream{
@@ -315,6 +370,16 @@ func (c *anthropicLLMClient) CreateChatCompletionStream(
 	}, nil
 }
 
+// anthropicAPIError is a request rejected by the Anthropic API
+type anthropicAPIError struct {
+	statusCode int
+	body       string
+}
+
+func (e *anthropicAPIError) Error() string {
+	return fmt.Sprintf("anthropic API error (status %d): %s", e.statusCode, e.body)
+}
+
 // -- Stream implementation --
 
 type anthropicLLMStream struct {
@@ -323,6 +388,7 @@ type anthropicLLMStream struct {
 	done           bool
 	activeToolCall *openai.ToolCall // Currently accumulating tool call
 	toolCallIndex  int
+	inputTokens    int // Reported by message_start, used with message_delta
 }
 
 func (s *anthropicLLMStream) Close() {
@@ -411,11 +477,26 @@ func (s *anthropicLLMStream) Recv() (LLMStreamDelta, error) {
 			return LLMStreamDelta{}, io.EOF
 
 		case "message_delta":
-			// May contain stop_reason, usage info — ignore for streaming
-			continue
+			// Contains the stop reason and the final output token count
+			var event anthropicMessageDelta
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				continue
+			}
+			return LLMStreamDelta{
+				Usage: &openai.Usage{
+					PromptTokens:     s.inputTokens,
+					CompletionTokens: event.Usage.OutputTokens,
+					TotalTokens:      s.inputTokens + event.Usage.OutputTokens,
+				},
+				FinishReason: anthropicFinishReasons[event.Delta.StopReason],
+			}, nil
 
 		case "message_start":
-			// Initial message metadata — ignore for streaming
+			// Initial message metadata, only the input token count is used
+			var event anthropicMessageStart
+			if err := json.Unmarshal([]byte(data), &event); err == nil {
+				s.inputTokens = event.Message.Usage.InputTokens
+			}
 			continue
 
 		case "ping":
@@ -28,6 +28,19 @@ func TestConvertOpenAIMessagesToAnthropic(t *testing.T) {
 			wantMsgCount:  1,
 			wantFirstRole: "user",
 		},
+		{
+			name: "notes follow the system prompt",
+			messages: []openai.ChatCompletionMessage{
+				{Role: "system", Content: "You are helpful"},
+				{Role: "user", Content: "Hello"},
+				{Role: "assistant", Content: "Hi there"},
+				{Role: "system", Content: "Be brief"},
+				{Role: "user", Content: "Explain CRDTs"},
+			},
+			wantSystem:    "You are helpful\n\nBe brief",
+			wantMsgCount:  3,
+			wantFirstRole: "user",
+		},
 		{
 			name: "user and assistant messages",
 			messages: []openai.ChatCompletionMessage{
@@ -102,6 +115,31 @@ func TestConvertOpenAIMessagesToAnthropic(t *testing.T) {
 	}
 }
 
+func TestConvertUserMessageWithImage(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{{
+		Role: "user",
+		MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: "describe @pixel.png"},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png;base64,AAAA"}},
+		},
+	}}
+
+	_, msgs := convertOpenAIMessagesToAnthropic(messages)
+	if len(msgs) != 1 {
+		t.Fatalf("message count = %d, want 1", len(msgs))
+	}
+	blocks, ok := msgs[0].Content.([]anthropicContentBlock)
+	if !ok || len(blocks) != 2 {
+		t.Fatalf("content = %#v, want a text and an image block", msgs[0].Content)
+	}
+	if blocks[0].Type != "text" || blocks[0].Text != "describe @pixel.png" {
+		t.Errorf("first block = %+v, want the text of the message", blocks[0])
+	}
+	if blocks[1].Type != "image" || blocks[1].Source == nil || blocks[1].Source.MediaType != "image/png" || blocks[1].Source.Data != "AAAA" {
+		t.Errorf("second block = %+v, want the PNG image", blocks[1])
+	}
+}
+
 func TestConvertOpenAIToolsToAnthropic(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -522,3 +560,54 @@ func TestStreamParseMultipleToolCalls(t *testing.T) {
 func newBufioReader(s string) *bufio.Reader {
 	return bufio.NewReader(strings.NewReader(s))
 }
+
+func TestStreamReportsUsage(t *testing.T) {
+	sseData := strings.Join([]string{
+		"event: message_start",
+		`data: {"type":"message_start","message":{"id":"msg_01","type":"message","role":"assistant","content":[],"usage":{"input_tokens":25,"output_tokens":1}}}`,
+		"",
+		"event: content_block_delta",
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}`,
+		"",
+		"event: message_delta",
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":12}}`,
+		"",
+		"event: message_stop",
+		`data: {"type":"message_stop"}`,
+		"",
+	}, "\n")
+
+	stream := &anthropicLLMStream{
+		reader: newBufioReader(sseData),
+		body:   io.NopCloser(strings.NewReader("")),
+	}
+
+	var usage *openai.Usage
+	var finishReason openai.FinishReason
+	for {
+		delta, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected stream error: %v", err)
+		}
+		if delta.Usage != nil {
+			usage = delta.Usage
+		}
+		if delta.FinishReason != "" {
+			finishReason = delta.FinishReason
+		}
+	}
+
+	if finishReason != openai.FinishReasonStop {
+		t.Errorf("finish reason = %q, want %q", finishReason, openai.FinishReasonStop)
+	}
+
+	if usage == nil {
+		t.Fatal("usage was not reported")
+	}
+	if usage.PromptTokens != 25 || usage.CompletionTokens != 12 || usage.TotalTokens != 37 {
+		t.Errorf("usage = %+v, want 25 prompt, 12 completion and 37 total tokens", *usage)
+	}
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,6 +31,15 @@ const (
 	maxRetryDelay        = 1 * time.Minute
 )
 
+const (
+	// maxAutoContinues caps how many times --auto-continue asks for the
+	// rest of a single truncated response
+	maxAutoContinues = 5
+	// continuePrompt is sent to get the rest of a truncated response
+	continuePrompt = "Your previous response was cut off. Continue exactly where it ended, " +
+		"without repeating anything or adding any preamble."
+)
+
 // Common error messages
 const (
 	errFailedToLoadConfig    = "failed to load global config"
@@ -37,23 +51,42 @@ const (
 )
 
 type Application struct {
-	agent           Agent
-	agentPath       string
-	client          LLMClient
-	debug           bool
-	historyFile     string
-	messages        []openai.ChatCompletionMessage
-	debugPrint      func(section string, v ...any)
-	showCommands    bool
-	showToolCalls   bool
-	showProgress    bool
-	lastProgressLen int
-	modelFlag       string
-	config          *Config
-	cliAskLevel     string
-	prettyOutput    bool
-	startTime       time.Time
-	maxTurns        int
+	agent          Agent
+	agentPath      string
+	agentPrompt    string // the agent's own system prompt, used when the model alias has none
+	jobs           *jobRegistry
+	client         LLMClient
+	debug          bool
+	historyFile    string
+	messages       []openai.ChatCompletionMessage
+	debugPrint     func(section string, v ...any)
+	showCommands   bool
+	showToolCalls  bool
+	showProgress   bool
+	spinner        *spinner
+	modelFlag      string
+	config         *Config
+	cliAskLevel    string
+	safeMode       bool
+	prettyOutput   bool
+	startTime      time.Time
+	maxTurns       int
+	toolOutputs    *toolOutputs
+	messageModels  map[int]string
+	noSave         bool
+	encryptHistory bool
+	transcript     *transcriptLogger
+	repl           bool
+	usage          sessionUsage
+	highlighter    *codeHighlighter
+	headers        map[string]string
+	autoContinue   bool
+	stripThinking  bool     // keep <think> blocks out of responses
+	showThinking   bool     // show the stripped thinking dimmed
+	showReasoning  bool     // show reasoning streamed apart from the response dimmed
+	saveReasoning  bool     // keep that reasoning in the history
+	temperature    *float32 // set with /temp in the REPL, overrides the model alias
+	fallbackModels []string // tried in order when a request fails
 }
 
 // providerInfo contains provider-specific configuration
@@ -62,6 +95,8 @@ type providerInfo struct {
 	apiKeyEnvar       string
 	apiKeyCanBeEmpty  bool
 	additionalHeaders map[string]string
+	options           map[string]any // extra fields for the request body
+	streamUsage       bool           // ask for token usage when streaming
 }
 
 // parseModel parses model string in format "provider/model" and
@@ -82,8 +117,88 @@ func isRateLimitError(err error) bool {
 		strings.Contains(errStr, "rate limit")
 }
 
-// createChatCompletionWithRetry creates a chat completion stream with retry logic for rate limiting
+// errorStatusCode returns the HTTP status code of a failed request to
+// a provider, or 0 when the request got no response
+func errorStatusCode(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode
+	}
+	var anthropicErr *anthropicAPIError
+	if errors.As(err, &anthropicErr) {
+		return anthropicErr.statusCode
+	}
+	return 0
+}
+
+// isFallbackError reports whether a failed request is worth sending to
+// a fallback model: the provider is rate limiting, failing or cannot be
+// reached. Other errors, such as an invalid API key or a conversation
+// that is too long, are about the request and are returned as they are.
+func isFallbackError(err error) bool {
+	if isRateLimitError(err) {
+		return true
+	}
+	if status := errorStatusCode(err); status != 0 {
+		return status >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// createChatCompletionWithRetry creates a chat completion stream with
+// retry logic for rate limiting. When the request still fails because
+// the provider is unavailable, the fallback models are tried in order
+// and the first one that works is used for the rest of the session.
 func (app *Application) createChatCompletionWithRetry(tools []openai.Tool) (LLMStream, error) {
+	stream, err := app.retryChatCompletion(tools)
+	if err == nil || !isFallbackError(err) {
+		return stream, err
+	}
+
+	// The model is only switched once a fallback works, so that later
+	// turns and the history name the model that answered
+	primaryModel, primaryClient := app.modelFlag, app.client
+	var fallbackErrs []string
+	tried := map[string]bool{app.currentModelString(): true}
+	for _, modelStr := range app.fallbackModels {
+		resolved := resolveModelString(modelStr, app.agent, app.config)
+		if tried[resolved] {
+			continue
+		}
+		tried[resolved] = true
+
+		client, setupErr := setupLLMClient(modelStr, app.agent, app.config, app.headers)
+		if setupErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: skipping fallback model %s: %v\n", resolved, setupErr)
+			fallbackErrs = append(fallbackErrs, fmt.Sprintf("%s: %v", resolved, setupErr))
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Warning: request to %s failed: %v; falling back to %s\n",
+			app.currentModelString(), err, resolved)
+		app.modelFlag, app.client = modelStr, client
+
+		fallbackStream, fallbackErr := app.retryChatCompletion(tools)
+		if fallbackErr == nil {
+			return fallbackStream, nil
+		}
+		fallbackErrs = append(fallbackErrs, fmt.Sprintf("%s: %v", resolved, fallbackErr))
+	}
+
+	app.modelFlag, app.client = primaryModel, primaryClient
+	if len(fallbackErrs) > 0 {
+		return nil, fmt.Errorf("%w (fallback models failed too: %s)", err, strings.Join(fallbackErrs, "; "))
+	}
+	return nil, err
+}
+
+// retryChatCompletion creates a chat completion stream with the current
+// model, retrying with backoff while the provider is rate limiting
+func (app *Application) retryChatCompletion(tools []openai.Tool) (LLMStream, error) {
 	var stream LLMStream
 	var err error
 
@@ -91,12 +206,15 @@ func (app *Application) createChatCompletionWithRetry(tools []openai.Tool) (LLMS
 	_ = ctx // context threaded through client when supported
 	defer cancel()
 
+	messages := app.contextMessages()
+
 	// Retry logic for rate limiting
 	for attempt := 0; attempt <= maxRetryCount; attempt++ {
 		stream, err = app.client.CreateChatCompletionStream(
 			app.getModel(),
-			app.messages,
+			messages,
 			tools,
+			app.requestOptions(),
 		)
 
 		if err == nil {
@@ -125,7 +243,9 @@ func (app *Application) createChatCompletionWithRetry(tools []openai.Tool) (LLMS
 }
 
 // prepareRetryMessages prepares messages for retry mode by keeping all messages
-// up to the last user message, optionally replacing its content.
+// up to the last user message. With a new command string the last user
+// message is dropped as well, so that the command is added the same way
+// as fresh input.
 func prepareRetryMessages(allMessages []openai.ChatCompletionMessage, commandStr string) []openai.ChatCompletionMessage {
 	if len(allMessages) == 0 {
 		return nil
@@ -146,24 +266,60 @@ func prepareRetryMessages(allMessages []openai.ChatCompletionMessage, commandStr
 	}
 
 	// Keep all messages up to and including the last user message
-	messages := allMessages[:lastUserIdx+1]
 	if commandStr != "" {
-		messages[lastUserIdx].Content = commandStr
+		return allMessages[:lastUserIdx]
 	}
-	return messages
+	return allMessages[:lastUserIdx+1]
+}
+
+// withNote adds note as a system message for the next turn of a
+// continued conversation. It goes at the end, before the new input, or
+// when retrying just before the user message being retried.
+func withNote(messages []openai.ChatCompletionMessage, note string, retry bool) []openai.ChatCompletionMessage {
+	at := len(messages)
+	if retry && messages[at-1].Role == openai.ChatMessageRoleUser {
+		at--
+	}
+	return slices.Insert(messages, at, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: note,
+	})
+}
+
+// truncateMessages keeps at most the first n messages. The cut is moved
+// back to just before a user message so that the conversation does not
+// end with a pending user message or with tool calls missing results.
+func truncateMessages(messages []openai.ChatCompletionMessage, n int) []openai.ChatCompletionMessage {
+	if n >= len(messages) {
+		return messages
+	}
+
+	for n > 1 && messages[n].Role != openai.ChatMessageRoleUser {
+		n--
+	}
+	return messages[:n]
 }
 
 // loadHistoryMessages loads and processes messages from conversation history.
-// Returns the messages, and updates opts with agent path and model from history.
-func loadHistoryMessages(opts *CLIOptions, historyFile string, debugPrint func(string, ...any)) ([]openai.ChatCompletionMessage, error) {
-	data, err := os.ReadFile(historyFile)
+// Returns the messages along with the model that produced each assistant
+// message, and updates opts with agent path and model from history. A
+// model given with -m takes precedence over the one stored in history.
+func loadHistoryMessages(opts *CLIOptions, historyFile string, debugPrint func(string, ...any)) ([]openai.ChatCompletionMessage, map[int]string, error) {
+	data, err := readHistoryData(historyFile)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", errFailedToLoadHistory, err)
+		return nil, nil, fmt.Errorf("%s: %w", errFailedToLoadHistory, err)
 	}
 
 	var history ConversationHistory
 	if err := json.Unmarshal(data, &history); err != nil {
-		return nil, fmt.Errorf("%s: %w", errFailedToUnmarshalHist, err)
+		return nil, nil, fmt.Errorf("%s: %w", errFailedToUnmarshalHist, err)
+	}
+
+	if opts.From > 0 {
+		history.Messages = truncateMessages(history.Messages, opts.From)
+		debugPrint("Backtrack",
+			fmt.Sprintf("Continuing from the first %d messages", len(history.Messages)),
+		)
 	}
 
 	var messages []openai.ChatCompletionMessage
@@ -190,22 +346,39 @@ func loadHistoryMessages(opts *CLIOptions, historyFile string, debugPrint func(s
 		opts.Model = history.Model
 	}
 
-	return messages, nil
+	messageModels := make(map[int]string)
+	for idx, model := range history.MessageModels {
+		if idx < len(messages) {
+			messageModels[idx] = model
+		}
+	}
+
+	return messages, messageModels, nil
 }
 
 func NewApplication(opts *CLIOptions) (*Application, error) {
 	// Load global config first
-	config, err := LoadConfig(opts.ConfigPath)
+	config, err := loadConfigWithAliases(opts)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", errFailedToLoadConfig, err)
 	}
 
+	// Load API keys and other variables from .env files before
+	// anything reads the environment
+	loadEnvFiles(opts.ConfigPath, config)
+	configureShellBlocks(config.Settings)
+
+	if config.Settings.EncryptHistory && os.Getenv(historyPassphraseEnvar) == "" {
+		return nil, fmt.Errorf("encrypt_history is enabled but %s is not set", historyPassphraseEnvar)
+	}
+
 	cacheDir, err := setupCacheDir()
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", errFailedToSetupCache, err)
 	}
 
 	var messages []openai.ChatCompletionMessage
+	messageModels := make(map[int]string)
 
 	// If conversation index is set without retry, also set continue chat
 	if len(opts.Conversation) > 0 && !opts.RetryChat {
@@ -214,6 +387,28 @@ func NewApplication(opts *CLIOptions) (*Application, error) {
 		}
 	}
 
+	// Resuming picks up the most recent REPL session, with the given
+	// agent if there is one
+	if opts.Resume && !opts.RetryChat && opts.Conversation == "" {
+		if index, err := findReplHistoryIndex(cacheDir, opts.AgentName); err == nil {
+			opts.Conversation = strconv.Itoa(index)
+			opts.ContinueChat = true
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: no previous REPL session to resume, starting a new one\n")
+		}
+	}
+
+	// When an agent is given, continue the most recent conversation
+	// with that agent rather than the most recent one overall
+	if opts.ContinueChat && !opts.RetryChat && opts.Conversation == "" && opts.AgentName != "" {
+		if index, err := findHistoryIndexForAgent(cacheDir, opts.AgentName); err == nil {
+			opts.Conversation = strconv.Itoa(index)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: no previous conversation with +%s, starting a new one\n", opts.AgentName)
+			opts.ContinueChat = false
+		}
+	}
+
 	if opts.ContinueChat || opts.RetryChat {
 		if opts.Conversation == "" {
 			opts.Conversation = "1"
@@ -223,14 +418,37 @@ func NewApplication(opts *CLIOptions) (*Application, error) {
 	historyFile, hasHistory := getHistoryFilePath(cacheDir, opts)
 	if hasHistory && (opts.ContinueChat || opts.RetryChat) {
 		debugPrint := createDebugPrinter(opts.DebugMode)
-		messages, err = loadHistoryMessages(opts, historyFile, debugPrint)
+		messages, messageModels, err = loadHistoryMessages(opts, historyFile, debugPrint)
 		if err != nil {
 			return nil, err
 		}
+
+		// Continuing from an earlier point starts a new conversation so
+		// that the original one is kept intact
+		if opts.From > 0 {
+			_, agentName, _ := parseHistoryFilename(filepath.Base(historyFile))
+			historyFile = createNewHistoryFile(filepath.Dir(historyFile), agentName, "")
+		}
 	}
 
+	if opts.Note != "" {
+		if len(messages) > 0 {
+			messages = withNote(messages, opts.Note, opts.RetryChat)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: no conversation to continue, ignoring --note\n")
+		}
+	}
+
+	// The agent from the environment is used when none is given on the
+	// command line or by the conversation being continued
+	agentFromEnv := false
 	if opts.AgentPath == "" {
-		opts.AgentPath = DefaultAgentPath
+		if agentStr := os.Getenv(agentEnvar); agentStr != "" {
+			opts.AgentName, opts.AgentPath = ParseAgentString(agentStr)
+			agentFromEnv = true
+		} else {
+			opts.AgentPath = defaultAgentPath()
+		}
 	}
 
 	if strings.HasPrefix(opts.AgentPath, "builtin:") {
@@ -239,42 +457,101 @@ func NewApplication(opts *CLIOptions) (*Application, error) {
 
 	agent, err := loadConfiguration(opts)
 	if err != nil {
+		if agentFromEnv {
+			return nil, fmt.Errorf("%s set in %s: %w", errFailedToLoadAgent, agentEnvar, err)
+		}
 		return nil, fmt.Errorf("%s: %w", errFailedToLoadAgent, err)
 	}
+	if err := checkRequiredEnv(agent); err != nil {
+		return nil, err
+	}
+	warnUndefinedPlaceholders(agent)
+
+	// A model alias can carry its own system prompt, which is in turn
+	// overridden by one given on the command line
+	agentPrompt := agent.SystemPrompt
+	agent.SystemPrompt = modelSystemPrompt(opts.Model, agent, config, agentPrompt)
+
+	if opts.FrequencyPenalty != nil {
+		agent.FrequencyPenalty = opts.FrequencyPenalty
+	}
+	if opts.PresencePenalty != nil {
+		agent.PresencePenalty = opts.PresencePenalty
+	}
 
 	// If SystemPrompt is set in CLI options, override agent's SystemPrompt
 	if opts.SystemPrompt != "" {
 		agent.SystemPrompt = opts.SystemPrompt
 	}
 
-	client, err := setupLLMClient(opts.Model, agent, config)
+	if err := validateModelString(opts.Model, agent, config); err != nil {
+		return nil, err
+	}
+
+	headers, err := parseHeaders(opts.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := setupLLMClient(opts.Model, agent, config, headers)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", errFailedToSetupClient, err)
 	}
 
+	fallbackModels := agent.FallbackModels
+	if len(fallbackModels) == 0 {
+		fallbackModels = config.Settings.FallbackModels
+	}
+	for _, modelStr := range fallbackModels {
+		if err := validateModelString(modelStr, agent, config); err != nil {
+			return nil, fmt.Errorf("invalid fallback model: %w", err)
+		}
+	}
+
 	showCommands := opts.ShowCommands || config.Settings.ShowCommands
 	showToolCalls := opts.ShowToolCalls || config.Settings.ShowToolCalls
 
 	app := &Application{
 		agent:        agent,
 		agentPath:    opts.AgentPath,
+		agentPrompt:  agentPrompt,
 		client:       client,
 		historyFile:  historyFile,
 		messages:     messages,
 		modelFlag:    opts.Model,
 		config:       config,
 		cliAskLevel:  opts.AskLevel,
+		safeMode:     opts.SafeMode,
 		prettyOutput: opts.Pretty,
 		startTime:    time.Now(),
+		usage:        sessionUsage{started: time.Now()},
 		maxTurns:     resolveMaxTurns(opts.MaxTurns, config.Settings.MaxTurns),
-
-		debug:         opts.DebugMode,
-		showCommands:  showCommands && !showToolCalls && !opts.DebugMode,
-		showToolCalls: showToolCalls && !opts.DebugMode,
-		showProgress:  !opts.HideProgress && !opts.DebugMode && !(showCommands || showToolCalls),
+		toolOutputs:  newToolOutputs(messages),
+		jobs:         newJobRegistry(),
+		spinner:      newSpinner(config.Settings.ProgressStyle),
+
+		messageModels:  messageModels,
+		noSave:         opts.NoSave,
+		encryptHistory: config.Settings.EncryptHistory,
+		transcript:     newTranscriptLogger(resolveLogFile(opts.LogFile, config.Settings.LogFile)),
+		repl:           opts.ReplMode,
+		headers:        headers,
+		autoContinue:   opts.AutoContinue,
+		stripThinking:  config.Settings.StripThinking || opts.ShowThinking,
+		showThinking:   opts.ShowThinking,
+		showReasoning:  opts.ShowReasoning,
+		saveReasoning:  config.Settings.SaveReasoning,
+		fallbackModels: fallbackModels,
+		debug:          opts.DebugMode,
+		showCommands:   showCommands && !showToolCalls && !opts.DebugMode,
+		showToolCalls:  showToolCalls && !opts.DebugMode,
+		showProgress:   !opts.HideProgress && !opts.DebugMode && !(showCommands || showToolCalls),
 	}
 
 	app.debugPrint = createDebugPrinter(app.debug)
+	if shouldHighlightCode(opts, config.Settings) {
+		app.highlighter = newCodeHighlighter(os.Stdout)
+	}
 	provider, model, info := app.parseModel()
 
 	app.debugPrint("Configuration",
@@ -288,11 +565,26 @@ func NewApplication(opts *CLIOptions) (*Application, error) {
 		fmt.Sprintf("Show commands: %v", app.showCommands),
 		fmt.Sprintf("Show tool calls: %v", app.showToolCalls),
 		fmt.Sprintf("Show progress: %v", app.showProgress),
+		fmt.Sprintf("Safe mode: %v", app.safeMode),
+		fmt.Sprintf("No save: %v", app.noSave),
 	)
 
 	return app, nil
 }
 
+// resetConversation clears the conversation state so that the
+// application can be reused for a new conversation saved to historyFile
+func (app *Application) resetConversation(historyFile string) {
+	app.historyFile = historyFile
+	app.messages = nil
+	app.messageModels = make(map[int]string)
+	app.toolOutputs = newToolOutputs(nil)
+	app.startTime = time.Now()
+	if app.transcript != nil {
+		app.transcript.logged = 0
+	}
+}
+
 // initializeRuntime sets up the system prompt.
 // Returns a cleanup function that should be deferred by the caller.
 func (app *Application) initializeRuntime() (cleanup func(), err error) {
@@ -320,6 +612,7 @@ func (app *Application) Run(opts CLIOptions) {
 		log.Fatalf("%v", err)
 	}
 	defer cleanup()
+	defer app.jobs.stopAll()
 
 	input := readStdin()
 	app.debugPrint("Input State",
@@ -327,12 +620,7 @@ func (app *Application) Run(opts CLIOptions) {
 		fmt.Sprintf("Stdin: %q", input),
 	)
 
-	// If in retry mode and a command string was provided,
-	// it means we replaced the last user message content during loading.
-	// Don't process input again.
-	if !(opts.RetryChat && opts.CommandStr != "") {
-		app.processInput(opts.CommandStr, input)
-	}
+	app.processInput(opts.CommandStr, input)
 
 	app.runConversationLoop(opts)
 }
@@ -346,10 +634,7 @@ func (app *Application) processInput(commandStr, input string) {
 	}
 
 	if len(commandStr) > 0 {
-		app.messages = append(app.messages, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: commandStr,
-		})
+		app.messages = append(app.messages, app.userMessage(commandStr))
 	}
 
 	// If no input from stdin or command line, use initial message from agent config
@@ -380,9 +665,19 @@ func resolveMaxTurns(cliFlag, configVal int) int {
 	return configVal
 }
 
+// resolveLogFile returns the transcript log file to use, with the CLI
+// flag taking priority over config
+func resolveLogFile(cliFlag, configVal string) string {
+	if cliFlag != "" {
+		return cliFlag
+	}
+	return configVal
+}
+
 func (app *Application) runConversationLoop(opts CLIOptions) {
 	openAITools := convertFunctionsToTools(app.agent.Functions)
 	turns := 0
+	retriedEmpty := false
 
 	for {
 		if app.maxTurns > 0 && turns >= app.maxTurns {
@@ -391,15 +686,45 @@ func (app *Application) runConversationLoop(opts CLIOptions) {
 			break
 		}
 
+		app.logRequest()
 		stream, err := app.createChatCompletionWithRetry(openAITools)
 		if err != nil {
 			log.Fatalf("ChatCompletionStream error: %v", err)
 		}
 
-		assistantMsg := app.handleStreamResponse(stream)
+		assistantMsg, usage, finishReason := app.handleStreamResponse(stream)
+		app.recordUsage(app.currentModelString(), usage)
+
+		// Providers occasionally end a response without sending
+		// anything. Retry once before telling the user, and keep the
+		// empty message out of the conversation.
+		if assistantMsg.Content == "" && len(assistantMsg.ToolCalls) == 0 {
+			if !retriedEmpty {
+				retriedEmpty = true
+				app.debugPrint("Empty Response", "Model returned an empty response, retrying")
+				continue
+			}
+			app.clearProgress()
+			color.New(color.FgYellow).Fprintln(os.Stderr, noResponseNote)
+			app.printFinishReason(finishReason)
+			break
+		}
+		retriedEmpty = false
+
 		app.messages = append(app.messages, assistantMsg)
+		app.recordMessageModel()
+		app.logResponse(assistantMsg, usage)
 		turns++
 
+		for continued := 0; app.autoContinue && finishReason == openai.FinishReasonLength &&
+			len(assistantMsg.ToolCalls) == 0 && continued < maxAutoContinues; continued++ {
+			finishReason = app.continueResponse(openAITools)
+			assistantMsg = app.messages[len(app.messages)-1]
+		}
+
+		app.showFilteredResponse(assistantMsg)
+		app.printFinishReason(finishReason)
+
 		// Save history after each assistant response
 		app.saveConversationHistory()
 
@@ -470,15 +795,36 @@ func (app *Application) runOnComplete() {
 	}
 }
 
+// requestOptions returns the request parameters set by the agent, the
+// model alias in use and the REPL
+func (app *Application) requestOptions() RequestOptions {
+	opts := RequestOptions{
+		FrequencyPenalty: app.agent.FrequencyPenalty,
+		PresencePenalty:  app.agent.PresencePenalty,
+	}
+	if _, alias, ok := resolveModelAlias(app.modelFlag, app.agent, app.config); ok {
+		opts.Temperature = alias.Temperature
+		opts.MaxTokens = alias.MaxTokens
+	}
+	if app.temperature != nil {
+		opts.Temperature = app.temperature
+	}
+	return opts
+}
+
 func (app *Application) getModel() string {
 	_, model, _ := app.parseModel()
 	return model
 }
 
-// getEffectiveAskLevel returns the ask level to use, with CLI flag taking priority over agent config
+// getEffectiveAskLevel returns the ask level to use, with safe mode and
+// then the CLI flag taking priority over agent config
 func (app *Application) getEffectiveAskLevel() string {
 	effectiveLevel := ""
-	if app.cliAskLevel != "" {
+	if app.safeMode {
+		effectiveLevel = "all"
+		app.debugPrint("Ask Level", "Using ask level all because safe mode is enabled")
+	} else if app.cliAskLevel != "" {
 		effectiveLevel = app.cliAskLevel
 		app.debugPrint("Ask Level", fmt.Sprintf("Using CLI ask level: %s", effectiveLevel))
 	} else if app.agent.Ask != "" {
@@ -491,13 +837,55 @@ func (app *Application) getEffectiveAskLevel() string {
 	return effectiveLevel
 }
 
-func (app *Application) handleStreamResponse(stream LLMStream) openai.ChatCompletionMessage {
+func (app *Application) handleStreamResponse(stream LLMStream) (openai.ChatCompletionMessage, *openai.Usage, openai.FinishReason) {
 	defer stream.Close()
 
 	var assistantMsg openai.ChatCompletionMessage
+	var usage *openai.Usage
+	var finishReason openai.FinishReason
 	var fullContent strings.Builder
 	hasContent := false
 
+	// Thinking is kept out of the response, and shown dimmed on stderr
+	// when asked for, as is reasoning streamed separately from it
+	var thinking *thinkingFilter
+	if app.stripThinking {
+		thinking = newThinkingFilter(app.config.Settings.ThinkingTags)
+	}
+	var reasoning strings.Builder
+	thoughtShown := false
+	showThought := func(thought string) {
+		if thought != "" {
+			color.New(color.Faint).Fprint(os.Stderr, thought)
+			thoughtShown = true
+		}
+	}
+	writeContent := func(text, thought string) {
+		if app.showThinking {
+			showThought(thought)
+		}
+		if text == "" {
+			return
+		}
+		if thoughtShown && !hasContent {
+			fmt.Fprint(os.Stderr, "\n\n")
+		}
+
+		hasContent = true
+		switch {
+		case app.prettyOutput:
+			// Written once the response is complete
+		case app.agent.OutputFilter != "":
+			// Written by showFilteredResponse once it is known whether
+			// this is the final answer
+		case app.highlighter != nil:
+			app.highlighter.Write(text)
+		default:
+			fmt.Print(text)
+		}
+		fullContent.WriteString(text)
+	}
+
 	for {
 		delta, err := stream.Recv()
 		if err == io.EOF {
@@ -507,42 +895,208 @@ func (app *Application) handleStreamResponse(stream LLMStream) openai.ChatComple
 			log.Fatalf("Stream error: %v", err)
 		}
 
+		if delta.Usage != nil {
+			usage = delta.Usage
+		}
+		if delta.FinishReason != "" {
+			finishReason = delta.FinishReason
+		}
+
 		if len(delta.ToolCalls) > 0 {
 			for _, toolCall := range delta.ToolCalls {
-				if toolCall.ID != "" {
-					assistantMsg.ToolCalls = append(assistantMsg.ToolCalls, toolCall)
-				} else {
-					lastToolCall := assistantMsg.ToolCalls[len(assistantMsg.ToolCalls)-1]
-					lastToolCall.Function.Arguments += toolCall.Function.Arguments
-					assistantMsg.ToolCalls[len(assistantMsg.ToolCalls)-1] = lastToolCall
-				}
+				assistantMsg.ToolCalls = appendToolCallDelta(assistantMsg.ToolCalls, toolCall)
 			}
 		} else {
 			app.clearProgress()
 
+			if delta.ReasoningContent != "" {
+				reasoning.WriteString(delta.ReasoningContent)
+				if app.showReasoning {
+					showThought(delta.ReasoningContent)
+				}
+			}
 			if delta.Content != "" {
-				hasContent = true
-				if !app.prettyOutput {
-					fmt.Print(delta.Content)
+				text, thought := delta.Content, ""
+				if thinking != nil {
+					text, thought = thinking.Write(text)
 				}
-				fullContent.WriteString(delta.Content)
+				writeContent(text, thought)
 			}
 		}
 	}
+	if thinking != nil {
+		writeContent(thinking.Flush())
+	}
 
-	if hasContent {
+	content := fullContent.String()
+	if hasContent && app.agent.OutputFilter == "" {
 		if app.prettyOutput {
 			// TODO: Add support for rendering pretty markdown in a
 			// streming manner (charmbracelet/glow/issues/601)
-			printPrettyOutput(fullContent.String())
+			printPrettyOutput(content)
 		} else {
+			if app.highlighter != nil {
+				app.highlighter.Flush()
+			}
 			fmt.Println()
 		}
 	}
 
+	if thoughtShown && !hasContent {
+		fmt.Fprintln(os.Stderr)
+	}
+
+	completeToolCalls(assistantMsg.ToolCalls)
 	assistantMsg.Role = "assistant"
-	assistantMsg.Content = fullContent.String()
-	return assistantMsg
+	assistantMsg.Content = content
+	if app.saveReasoning {
+		assistantMsg.ReasoningContent = reasoning.String()
+	}
+	return assistantMsg, usage, finishReason
+}
+
+// showFilteredResponse writes a response that was held back because the
+// agent has an output_filter. Only the final answer, one without tool
+// calls, is piped through the filter; the text of the turns in between
+// is shown as it is. The conversation keeps the unfiltered response.
+func (app *Application) showFilteredResponse(msg openai.ChatCompletionMessage) {
+	if app.agent.OutputFilter == "" || msg.Content == "" {
+		return
+	}
+
+	content := msg.Content
+	if len(msg.ToolCalls) == 0 {
+		content = app.filterOutput(content)
+	}
+	switch {
+	case app.prettyOutput:
+		printPrettyOutput(content)
+	case app.highlighter != nil:
+		app.highlighter.Write(content)
+		app.highlighter.Flush()
+		fmt.Println()
+	default:
+		fmt.Println(content)
+	}
+}
+
+// outputFilterTimeout is how long the output_filter of an agent may run
+// before the unfiltered response is used
+const outputFilterTimeout = 30 * time.Second
+
+// filterOutput pipes a response through the output_filter command of
+// the agent and returns what it writes to stdout. The response is
+// returned as is when the filter fails, so that nothing is lost.
+func (app *Application) filterOutput(content string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), outputFilterTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", expandHomePath(app.agent.OutputFilter))
+	cmd.Stdin = strings.NewReader(content)
+	cmd.Stderr = os.Stderr
+	filtered, err := cmd.Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: output_filter failed, showing the response unfiltered: %v\n", err)
+		return content
+	}
+	return strings.TrimRight(string(filtered), "\n")
+}
+
+// continueResponse asks the model to carry on with the last assistant
+// message, which was cut off, and appends the continuation to it so
+// that history holds a single message. The nudge sent to the model is
+// not kept in the conversation.
+func (app *Application) continueResponse(tools []openai.Tool) openai.FinishReason {
+	messages := app.messages
+	app.messages = append(slices.Clip(messages), openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: continuePrompt,
+	})
+
+	app.logRequest()
+	stream, err := app.createChatCompletionWithRetry(tools)
+	app.messages = messages
+	if err != nil {
+		log.Fatalf("ChatCompletionStream error: %v", err)
+	}
+
+	continuation, usage, finishReason := app.handleStreamResponse(stream)
+	app.recordUsage(app.currentModelString(), usage)
+
+	last := &app.messages[len(app.messages)-1]
+	last.Content += continuation.Content
+	last.ToolCalls = append(last.ToolCalls, continuation.ToolCalls...)
+	app.logResponse(continuation, usage)
+
+	return finishReason
+}
+
+// continueLastResponse continues the last response of the conversation
+// after it was cut off, running any tool calls the continuation makes
+func (app *Application) continueLastResponse(opts CLIOptions) error {
+	if err := checkContinuable(app.messages); err != nil {
+		return err
+	}
+
+	cutOff := len(app.messages[len(app.messages)-1].Content)
+	finishReason := app.continueResponse(convertFunctionsToTools(app.agent.Functions))
+	last := app.messages[len(app.messages)-1]
+	app.showFilteredResponse(openai.ChatCompletionMessage{Content: last.Content[cutOff:], ToolCalls: last.ToolCalls})
+	app.printFinishReason(finishReason)
+	app.saveConversationHistory()
+
+	// A continuation that calls tools is carried on like any other turn
+	if toolCalls := app.messages[len(app.messages)-1].ToolCalls; len(toolCalls) > 0 {
+		app.handleToolCalls(toolCalls, opts)
+		app.saveConversationHistory()
+		app.runConversationLoop(opts)
+	}
+	return nil
+}
+
+// checkContinuable checks that the conversation ends with a response
+// that can be continued
+func checkContinuable(messages []openai.ChatCompletionMessage) error {
+	if len(messages) == 0 {
+		return errors.New("there is no response to continue")
+	}
+	last := messages[len(messages)-1]
+	if last.Role != openai.ChatMessageRoleAssistant || len(last.ToolCalls) > 0 {
+		return errors.New("the last message is not a response that can be continued")
+	}
+	return nil
+}
+
+// printFinishReason tells the user when a response was cut off or
+// blocked
+func (app *Application) printFinishReason(reason openai.FinishReason) {
+	note := finishReasonNote(reason)
+	if note == "" {
+		return
+	}
+
+	app.clearProgress()
+	color.New(color.FgYellow).Fprintln(os.Stderr, note)
+	if reason == openai.FinishReasonLength && app.repl {
+		color.New(color.FgYellow).Fprintln(os.Stderr, "Use /continue to get the rest of it.")
+	}
+}
+
+// noResponseNote is shown when the model still sends an empty response
+// after it was retried
+const noResponseNote = "(no response)"
+
+// finishReasonNote returns a note for the user when the model stopped
+// before finishing its response
+func finishReasonNote(reason openai.FinishReason) string {
+	switch reason {
+	case openai.FinishReasonLength:
+		return "(response cut off: the model reached its maximum output length)"
+	case openai.FinishReasonContentFilter:
+		return "(response stopped by the provider's content filter)"
+	default:
+		return ""
+	}
 }
 
 type ConversationHistory struct {
@@ -550,64 +1104,125 @@ type ConversationHistory struct {
 	Model     string                         `json:"model"`
 	WorkDir   string                         `json:"work_dir,omitempty"`
 	Messages  []openai.ChatCompletionMessage `json:"messages"`
+
+	// MessageModels maps the index of an assistant message to the model
+	// that produced it, so conversations that switch models mid-way
+	// keep track of which model wrote which turn
+	MessageModels map[int]string `json:"message_models,omitempty"`
+
+	// Repl marks conversations held in REPL mode so that --resume can
+	// find the most recent session
+	Repl bool `json:"repl,omitempty"`
 }
 
-func (app *Application) saveConversationHistory() {
+// currentModelString returns the fully qualified provider/model in use
+func (app *Application) currentModelString() string {
 	provider, model, _ := app.parseModel()
-	modelString := fmt.Sprintf("%s/%s", provider, model)
+	return fmt.Sprintf("%s/%s", provider, model)
+}
+
+// recordMessageModel notes the current model as the one that produced
+// the last message in the conversation
+func (app *Application) recordMessageModel() {
+	if len(app.messages) == 0 {
+		return
+	}
+	if app.messageModels == nil {
+		app.messageModels = make(map[int]string)
+	}
+	app.messageModels[len(app.messages)-1] = app.currentModelString()
+}
+
+func (app *Application) saveConversationHistory() {
+	// With --no-save the conversation only lives in memory
+	if app.noSave || app.historyFile == "" {
+		return
+	}
+
 	workDir, _ := os.Getwd()
+
+	// Drop annotations for messages that are no longer part of the
+	// conversation, e.g. after a retry truncated it
+	messageModels := make(map[int]string, len(app.messageModels))
+	for idx, model := range app.messageModels {
+		if idx < len(app.messages) {
+			messageModels[idx] = model
+		}
+	}
+
 	history := ConversationHistory{
-		AgentPath: app.agentPath,
-		Model:     modelString,
-		WorkDir:   workDir,
-		Messages:  app.messages,
+		AgentPath:     app.agentPath,
+		Model:         app.currentModelString(),
+		WorkDir:       workDir,
+		Messages:      app.messages,
+		MessageModels: messageModels,
+		Repl:          app.repl,
 	}
 
-	if data, err := json.Marshal(history); err == nil {
-		if err := os.WriteFile(app.historyFile, data, 0644); err != nil {
-			app.debugPrint("Error", fmt.Sprintf("Failed to save history: %v", err))
+	data, err := json.Marshal(history)
+	if err != nil {
+		return
+	}
+	if app.encryptHistory {
+		if data, err = encryptHistory(data); err != nil {
+			app.debugPrint("Error", fmt.Sprintf("Failed to encrypt history: %v", err))
+			return
 		}
 	}
+	if err := os.WriteFile(app.historyFile, data, 0644); err != nil {
+		app.debugPrint("Error", fmt.Sprintf("Failed to save history: %v", err))
+	}
 }
 
-func (app *Application) generateProgressSummary(funcName string, args string) string {
-	return fmt.Sprintf("Calling %s...", funcName)
+// generateProgressSummary returns the progress line for a call to fc,
+// using its progress_message when it has one
+func (app *Application) generateProgressSummary(fc FunctionConfig, args string) string {
+	if fc.ProgressMessage != "" {
+		var parsedArgs map[string]any
+		if err := json.Unmarshal([]byte(args), &parsedArgs); err == nil {
+			return progressMessage(fc, parsedArgs)
+		}
+	}
+	return fmt.Sprintf("Calling %s...", fc.Name)
 }
 
 // clearProgress clears the progress line from stderr if one is currently displayed
 func (app *Application) clearProgress() {
-	if app.showProgress && app.lastProgressLen > 0 {
-		fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", app.lastProgressLen))
-		app.lastProgressLen = 0
+	if app.showProgress {
+		app.spinner.clear()
 	}
 }
 
-// showToolProgress displays a progress indicator for a tool call being executed
-func (app *Application) showToolProgress(funcName string, args string) {
+// showToolProgress displays an animated progress indicator for a tool
+// call being executed. The animation keeps running until the tool
+// returns and stopToolProgress is called.
+func (app *Application) showToolProgress(fc FunctionConfig, args string) {
 	if !app.showProgress {
 		return
 	}
-	summary := app.generateProgressSummary(funcName, args)
+	summary := app.generateProgressSummary(fc, args)
 	if summary == "" {
 		return
 	}
-	// Clear previous line if exists
-	if app.lastProgressLen > 0 {
-		fmt.Fprintf(os.Stderr, "\r%s\r", strings.Repeat(" ", app.lastProgressLen))
+	app.spinner.start(summary)
+}
+
+// stopToolProgress halts the progress animation, leaving the last frame
+// on screen until the next output clears it
+func (app *Application) stopToolProgress() {
+	if app.showProgress {
+		app.spinner.stop()
 	}
-	msg := fmt.Sprintf("⋮ %s", summary)
-	color.New(color.FgBlue).Fprint(os.Stderr, msg)
-	app.lastProgressLen = len(msg)
 }
 
 // appendToolError appends an error message for a tool call to the conversation and displays it if configured
 func (app *Application) appendToolError(toolCall openai.ToolCall, err error, displayCommand string) {
 	app.clearProgress()
 	if displayCommand != "" && (app.showCommands || app.showToolCalls) {
-		color.New(toolCallErrorCommandColor).Fprintf(os.Stderr, "%s\n", displayCommand)
+		outputColor(colorError, toolCallErrorCommandColor).Fprintf(os.Stderr, "%s\n", displayCommand)
 	}
 	if app.showToolCalls {
-		color.New(toolCallErrorCommandColor).Fprintf(os.Stderr, "Error: %v\n", err)
+		outputColor(colorError, toolCallErrorCommandColor).Fprintf(os.Stderr, "Error: %v\n", err)
 	}
 	app.messages = append(app.messages, openai.ChatCompletionMessage{
 		Role:       "tool",
@@ -621,10 +1236,10 @@ func (app *Application) appendToolError(toolCall openai.ToolCall, err error, dis
 // If outputType is an image MIME type, content is treated as base64-encoded image data.
 func (app *Application) appendToolResult(toolCall openai.ToolCall, content string, displayCommand string, displayOutput string, outputType string) {
 	if app.showCommands || app.showToolCalls {
-		color.New(toolCallCommandColor).Fprintf(os.Stderr, "%s\n", displayCommand)
+		outputColor(colorCommand, toolCallCommandColor).Fprintf(os.Stderr, "%s\n", displayCommand)
 	}
 	if app.showToolCalls && displayOutput != "" {
-		color.New(toolCallOutputColor).Fprintf(os.Stderr, "%s\n", displayOutput)
+		outputColor(colorOutput, toolCallOutputColor).Fprintf(os.Stderr, "%s\n", displayOutput)
 	}
 
 	msg := openai.ChatCompletionMessage{
@@ -666,9 +1281,21 @@ func (app *Application) handleToolCalls(toolCalls []openai.ToolCall, opts CLIOpt
 		if matchedFunc.Name == "" {
 			log.Fatalf("No matching function found for: %s", toolCall.Function.Name)
 		}
+		app.usage.toolCalls++
 
-		if len(matchedFunc.Output) == 0 {
-			app.showToolProgress(matchedFunc.Name, toolCall.Function.Arguments)
+		if err := checkSafeMode(app.safeMode, matchedFunc); err != nil {
+			app.logToolCall(toolCall, "", false, "", 0, err)
+			app.appendToolError(toolCall, err, "")
+			continue
+		}
+
+		askLevel := app.getEffectiveAskLevel()
+
+		// Skip the animation when a confirmation prompt will be shown
+		// or the function takes over the terminal, so that it does not
+		// draw over them
+		if len(matchedFunc.Output) == 0 && !matchedFunc.Interactive && !needsConfirmation(askLevel, matchedFunc.Safe) {
+			app.showToolProgress(matchedFunc, toolCall.Function.Arguments)
 		}
 
 		// Set the provider and model env so that nested esa calls
@@ -677,21 +1304,29 @@ func (app *Application) handleToolCalls(toolCalls []openai.ToolCall, opts CLIOpt
 		provider, model, _ := app.parseModel()
 		os.Setenv("ESA_MODEL", fmt.Sprintf("%s/%s", provider, model))
 
+		start := time.Now()
 		approved, command, stdin, result, err := executeFunction(
-			app.getEffectiveAskLevel(),
+			askLevel,
 			matchedFunc,
 			toolCall.Function.Arguments,
+			app.toolOutputs,
+			app.jobs,
 		)
+		elapsed := time.Since(start)
+		app.stopToolProgress()
 		app.debugPrint("Function Execution",
 			fmt.Sprintf("Function: %s", matchedFunc.Name),
 			fmt.Sprintf("Approved: %s", fmt.Sprint(approved)),
 			fmt.Sprintf("Command: %s", command),
 			fmt.Sprintf("Stdin: %s", stdin),
-			fmt.Sprintf("Output: %s", result))
+			fmt.Sprintf("Output: %s", result),
+			fmt.Sprintf("Elapsed: %s", elapsed))
+		app.logToolCall(toolCall, command, approved, result, elapsed, err)
 
+		displayCommand := fmt.Sprintf("$ %s (%s)", command, formatElapsed(elapsed))
 		if err != nil {
 			app.debugPrint("Function Error", err)
-			app.appendToolError(toolCall, err, fmt.Sprintf("$ %s", command))
+			app.appendToolError(toolCall, err, displayCommand)
 			continue
 		}
 
@@ -700,18 +1335,60 @@ func (app *Application) handleToolCalls(toolCalls []openai.ToolCall, opts CLIOpt
 			content = result // data URI
 		} else {
 			content = fmt.Sprintf("Command: %s\n\nOutput: \n%s", command, result)
+			if approved {
+				app.toolOutputs.record(matchedFunc.Name, result)
+			}
 		}
-		app.appendToolResult(toolCall, content, fmt.Sprintf("$ %s", command), result, matchedFunc.OutputType)
+		app.appendToolResult(toolCall, content, displayCommand, result, matchedFunc.OutputType)
 	}
 }
 
+// modelSystemPrompt returns the system prompt to use with modelStr, the
+// one of its model alias or else agentPrompt
+func modelSystemPrompt(modelStr string, agent Agent, config *Config, agentPrompt string) string {
+	if _, alias, ok := resolveModelAlias(modelStr, agent, config); ok && alias.SystemPrompt != "" {
+		return alias.SystemPrompt
+	}
+	return agentPrompt
+}
+
+// setSystemPrompt changes the system prompt of the agent along with the
+// system message of the conversation
+func (app *Application) setSystemPrompt(prompt string) error {
+	previous := app.agent.SystemPrompt
+	app.agent.SystemPrompt = prompt
+	if len(app.messages) == 0 || app.messages[0].Role != openai.ChatMessageRoleSystem {
+		return nil
+	}
+
+	content, err := app.getSystemPrompt()
+	if err != nil {
+		app.agent.SystemPrompt = previous
+		return fmt.Errorf("error processing system prompt: %w", err)
+	}
+	app.messages[0].Content = content
+	return nil
+}
+
 func (app *Application) getSystemPrompt() (string, error) {
+	prompt := systemPrompt
 	if app.agent.SystemPrompt != "" {
-		return app.processSystemPrompt(app.agent.SystemPrompt)
+		prompt = app.agent.SystemPrompt
+	}
+
+	// Examples are added after shell blocks are run so that they are
+	// sent as they are written
+	prompt, err := app.processSystemPrompt(prompt)
+	if err != nil {
+		return "", err
 	}
-	return app.processSystemPrompt(systemPrompt)
+	return app.agent.promptWithExamples(prompt), nil
 }
 
 func (app *Application) processSystemPrompt(prompt string) (string, error) {
-	return processShellBlocks(prompt)
+	prompt, err := expandVariables(prompt, app.agent.Variables)
+	if err != nil {
+		return "", err
+	}
+	return processPromptShellBlocks(prompt)
 }
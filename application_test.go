@@ -1,6 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/sashabaranov/go-openai"
@@ -97,6 +109,42 @@ func TestParseModel(t *testing.T) {
 				apiKeyEnvar: "OLLAMA_API_KEY",
 			},
 		},
+		{
+			name:         "Perplexity provider",
+			modelFlag:    "perplexity/sonar-pro",
+			config:       nil,
+			agent:        Agent{},
+			wantProvider: "perplexity",
+			wantModel:    "sonar-pro",
+			wantInfo: providerInfo{
+				baseURL:     "https://api.perplexity.ai",
+				apiKeyEnvar: "PERPLEXITY_API_KEY",
+			},
+		},
+		{
+			name:         "xAI provider",
+			modelFlag:    "xai/grok-4",
+			config:       nil,
+			agent:        Agent{},
+			wantProvider: "xai",
+			wantModel:    "grok-4",
+			wantInfo: providerInfo{
+				baseURL:     "https://api.x.ai/v1",
+				apiKeyEnvar: "XAI_API_KEY",
+			},
+		},
+		{
+			name:         "Grok alias for xAI",
+			modelFlag:    "grok/grok-3-mini",
+			config:       nil,
+			agent:        Agent{},
+			wantProvider: "grok",
+			wantModel:    "grok-3-mini",
+			wantInfo: providerInfo{
+				baseURL:     "https://api.x.ai/v1",
+				apiKeyEnvar: "XAI_API_KEY",
+			},
+		},
 		{
 			name:      "Agent default model used when no CLI model provided",
 			modelFlag: "",
@@ -285,6 +333,70 @@ func TestProviderAdditionalHeadersMerging(t *testing.T) {
 	}
 }
 
+func TestOpenAIOrganizationHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		modelStr    string
+		provider    ProviderConfig
+		orgEnv      string
+		projectEnv  string
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "no organization",
+			modelStr:    "openai/gpt-4o",
+			wantHeaders: map[string]string{},
+		},
+		{
+			name:        "from config",
+			modelStr:    "openai/gpt-4o",
+			provider:    ProviderConfig{Organization: "org-config", Project: "proj-config"},
+			orgEnv:      "org-env",
+			wantHeaders: map[string]string{"Openai-Organization": "org-config", "Openai-Project": "proj-config"},
+		},
+		{
+			name:        "from environment",
+			modelStr:    "openai/gpt-4o",
+			orgEnv:      "org-env",
+			projectEnv:  "proj-env",
+			wantHeaders: map[string]string{"Openai-Organization": "org-env", "Openai-Project": "proj-env"},
+		},
+		{
+			name:     "additional headers take precedence",
+			modelStr: "openai/gpt-4o",
+			provider: ProviderConfig{
+				Organization:      "org-config",
+				AdditionalHeaders: map[string]string{"openai-organization": "org-header"},
+			},
+			wantHeaders: map[string]string{"Openai-Organization": "org-header"},
+		},
+		{
+			name:        "other providers are not affected",
+			modelStr:    "groq/llama3",
+			orgEnv:      "org-env",
+			wantHeaders: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_ORG_ID", tt.orgEnv)
+			t.Setenv("OPENAI_PROJECT", tt.projectEnv)
+
+			cfg := &Config{Providers: map[string]ProviderConfig{"openai": tt.provider}}
+			_, _, info := parseModel(tt.modelStr, Agent{}, cfg)
+
+			got := make(map[string]string)
+			for key, value := range info.additionalHeaders {
+				got[http.CanonicalHeaderKey(key)] = value
+			}
+			if !maps.Equal(got, tt.wantHeaders) {
+				t.Errorf("additionalHeaders = %v, want %v", got, tt.wantHeaders)
+			}
+		})
+	}
+}
+
 func TestOllamaHostFromEnvironment(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -353,19 +465,19 @@ func TestEmptyApiKeyAcceptance(t *testing.T) {
 			name:             "OpenAI requires API key",
 			modelStr:         "openai/gpt-4",
 			expectError:      true,
-			errorDescription: "OPENAI_API_KEY env not found",
+			errorDescription: `no API key found for provider "openai" (model "gpt-4"): set the OPENAI_API_KEY environment variable or add it to a .env file; local Ollama models do not need a key, use the ollama/ prefix for them (e.g. ollama/llama3.2)`,
 		},
 		{
 			name:             "Anthropic requires API key",
 			modelStr:         "anthropic/claude-sonnet-4-20250514",
 			expectError:      true,
-			errorDescription: "ANTHROPIC_API_KEY env not found",
+			errorDescription: `no API key found for provider "anthropic" (model "claude-sonnet-4-20250514"): set the ANTHROPIC_API_KEY environment variable or add it to a .env file; local Ollama models do not need a key, use the ollama/ prefix for them (e.g. ollama/llama3.2)`,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := setupLLMClient(tt.modelStr, Agent{}, &Config{})
+			_, err := setupLLMClient(tt.modelStr, Agent{}, &Config{}, nil)
 
 			if (err != nil) != tt.expectError {
 				t.Errorf("Expected error: %v, got: %v", tt.expectError, err)
@@ -412,7 +524,7 @@ func TestSetupLLMClientReturnsCorrectType(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Setenv(tt.envKey, tt.envValue)
-			client, err := setupLLMClient(tt.modelStr, Agent{}, &Config{})
+			client, err := setupLLMClient(tt.modelStr, Agent{}, &Config{}, nil)
 			if err != nil {
 				t.Fatalf("setupLLMClient() error = %v", err)
 			}
@@ -443,6 +555,38 @@ func TestPrepareRetryMessages_Empty(t *testing.T) {
 	}
 }
 
+func TestPrepareRetryMessages(t *testing.T) {
+	history := []openai.ChatCompletionMessage{
+		{Role: "system", Content: "system"},
+		{Role: "user", Content: "first"},
+		{Role: "assistant", Content: "one"},
+		{Role: "user", Content: "second", MultiContent: []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: "second"}}},
+		{Role: "assistant", Content: "two"},
+	}
+
+	tests := []struct {
+		name       string
+		commandStr string
+		want       []string
+	}{
+		{name: "keeps the last user message", want: []string{"system", "first", "one", "second"}},
+		{name: "drops it for a new command", commandStr: "again", want: []string{"system", "first", "one"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := prepareRetryMessages(slices.Clone(history), tt.commandStr)
+			var got []string
+			for _, msg := range messages {
+				got = append(got, msg.Content)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("prepareRetryMessages() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSystemPromptOverrideFromCLI(t *testing.T) {
 	// Agent with default system prompt
 	agent := Agent{
@@ -466,3 +610,997 @@ func TestSystemPromptOverrideFromCLI(t *testing.T) {
 		t.Errorf("Expected system prompt to be overridden by CLI, got: %q", prompt)
 	}
 }
+
+func TestModelAliasSettings(t *testing.T) {
+	configContent := `
+[model_aliases]
+plain = "openai/gpt-4o"
+
+[model_aliases.precise]
+model = "openai/gpt-4o"
+temperature = 0.5
+max_tokens = 512
+system_prompt = "Alias system prompt"
+`
+	temperature := float32(0.5)
+
+	tests := []struct {
+		name             string
+		model            string
+		systemPrompt     string
+		wantOptions      RequestOptions
+		wantSystemPrompt string
+	}{
+		{
+			name:             "no alias",
+			model:            "openai/gpt-4o",
+			wantSystemPrompt: "Agent system prompt",
+		},
+		{
+			name:             "alias without settings",
+			model:            "plain",
+			wantSystemPrompt: "Agent system prompt",
+		},
+		{
+			name:             "alias with settings",
+			model:            "precise",
+			wantOptions:      RequestOptions{Temperature: &temperature, MaxTokens: 512},
+			wantSystemPrompt: "Alias system prompt",
+		},
+		{
+			name:             "cli system prompt wins",
+			model:            "precise",
+			systemPrompt:     "CLI system prompt",
+			wantOptions:      RequestOptions{Temperature: &temperature, MaxTokens: 512},
+			wantSystemPrompt: "CLI system prompt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CACHE_HOME", dir)
+			t.Setenv("HOME", dir)
+			t.Setenv("OPENAI_API_KEY", "test-key")
+
+			configPath := filepath.Join(dir, "config.toml")
+			if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+			agentPath := filepath.Join(dir, "agent.toml")
+			if err := os.WriteFile(agentPath, []byte(`system_prompt = "Agent system prompt"`), 0644); err != nil {
+				t.Fatalf("Failed to write agent: %v", err)
+			}
+
+			app, err := NewApplication(&CLIOptions{
+				ConfigPath:   configPath,
+				AgentPath:    agentPath,
+				Model:        tt.model,
+				SystemPrompt: tt.systemPrompt,
+			})
+			if err != nil {
+				t.Fatalf("NewApplication() error = %v", err)
+			}
+
+			if got := app.requestOptions(); !reflect.DeepEqual(got, tt.wantOptions) {
+				t.Errorf("requestOptions() = %+v, want %+v", got, tt.wantOptions)
+			}
+			if app.agent.SystemPrompt != tt.wantSystemPrompt {
+				t.Errorf("system prompt = %q, want %q", app.agent.SystemPrompt, tt.wantSystemPrompt)
+			}
+		})
+	}
+}
+
+func TestReplModelSystemPrompt(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	configPath := filepath.Join(dir, "config.toml")
+	config := "[model_aliases.precise]\nmodel = \"openai/gpt-4o\"\nsystem_prompt = \"Alias system prompt\"\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	agentPath := filepath.Join(dir, "agent.toml")
+	if err := os.WriteFile(agentPath, []byte(`system_prompt = "Agent system prompt"`), 0644); err != nil {
+		t.Fatalf("Failed to write agent: %v", err)
+	}
+
+	opts := &CLIOptions{ConfigPath: configPath, AgentPath: agentPath, Model: "openai/gpt-4o"}
+	app, err := NewApplication(opts)
+	if err != nil {
+		t.Fatalf("NewApplication() error = %v", err)
+	}
+	if _, err := app.initializeRuntime(); err != nil {
+		t.Fatalf("initializeRuntime() error = %v", err)
+	}
+
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{model: "precise", want: "Alias system prompt"},
+		{model: "openai/gpt-4o-mini", want: "Agent system prompt"},
+	}
+	for _, tt := range tests {
+		if err := validateAndSetModel(app, opts, tt.model); err != nil {
+			t.Fatalf("validateAndSetModel(%q) error = %v", tt.model, err)
+		}
+		if app.agent.SystemPrompt != tt.want {
+			t.Errorf("after /model %s system prompt = %q, want %q", tt.model, app.agent.SystemPrompt, tt.want)
+		}
+		if app.messages[0].Content != tt.want {
+			t.Errorf("after /model %s system message = %q, want %q", tt.model, app.messages[0].Content, tt.want)
+		}
+	}
+}
+
+func TestReplTemperature(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("OPENAI_API_KEY", "test-key")
+
+	configPath := filepath.Join(dir, "config.toml")
+	config := "[model_aliases.precise]\nmodel = \"openai/gpt-4o\"\ntemperature = 0.5\n"
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	agentPath := filepath.Join(dir, "agent.toml")
+	if err := os.WriteFile(agentPath, []byte(`system_prompt = "Agent system prompt"`), 0644); err != nil {
+		t.Fatalf("Failed to write agent: %v", err)
+	}
+
+	app, err := NewApplication(&CLIOptions{ConfigPath: configPath, AgentPath: agentPath, Model: "precise"})
+	if err != nil {
+		t.Fatalf("NewApplication() error = %v", err)
+	}
+
+	for _, value := range []string{"-0.1", "2.5", "warm"} {
+		if _, err := parseTemperature(value); err == nil {
+			t.Errorf("parseTemperature(%q) error = nil, want error", value)
+		}
+	}
+
+	temperature, err := parseTemperature("1.2")
+	if err != nil {
+		t.Fatalf("parseTemperature() error = %v", err)
+	}
+	app.temperature = &temperature
+	if got := app.requestOptions().Temperature; got == nil || *got != 1.2 {
+		t.Errorf("temperature = %v, want 1.2 set in the REPL over the alias", got)
+	}
+
+	app.temperature = nil
+	if got := app.requestOptions().Temperature; got == nil || *got != 0.5 {
+		t.Errorf("temperature = %v, want 0.5 from the alias after a reset", got)
+	}
+}
+
+func TestPenaltyOptions(t *testing.T) {
+	agentPenalty := float32(0.5)
+	cliPenalty := float32(0)
+
+	tests := []struct {
+		name          string
+		agent         string
+		opts          CLIOptions
+		wantFrequency *float32
+		wantPresence  *float32
+	}{
+		{
+			name: "not set",
+		},
+		{
+			name:          "from agent",
+			agent:         "frequency_penalty = 0.5\npresence_penalty = 0.5\n",
+			wantFrequency: &agentPenalty,
+			wantPresence:  &agentPenalty,
+		},
+		{
+			name:          "cli overrides agent",
+			agent:         "frequency_penalty = 0.5\npresence_penalty = 0.5\n",
+			opts:          CLIOptions{FrequencyPenalty: &cliPenalty},
+			wantFrequency: &cliPenalty,
+			wantPresence:  &agentPenalty,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CACHE_HOME", dir)
+			t.Setenv("HOME", dir)
+			t.Setenv("OPENAI_API_KEY", "test-key")
+
+			agentPath := filepath.Join(dir, "agent.toml")
+			if err := os.WriteFile(agentPath, []byte(tt.agent), 0644); err != nil {
+				t.Fatalf("Failed to write agent: %v", err)
+			}
+
+			opts := tt.opts
+			opts.ConfigPath = filepath.Join(dir, "config.toml")
+			opts.AgentPath = agentPath
+			opts.Model = "openai/gpt-4o"
+			app, err := NewApplication(&opts)
+			if err != nil {
+				t.Fatalf("NewApplication() error = %v", err)
+			}
+
+			got := app.requestOptions()
+			if !reflect.DeepEqual(got.FrequencyPenalty, tt.wantFrequency) {
+				t.Errorf("frequency penalty = %v, want %v", got.FrequencyPenalty, tt.wantFrequency)
+			}
+			if !reflect.DeepEqual(got.PresencePenalty, tt.wantPresence) {
+				t.Errorf("presence penalty = %v, want %v", got.PresencePenalty, tt.wantPresence)
+			}
+		})
+	}
+}
+
+func TestAgentFromEnvironment(t *testing.T) {
+	tests := []struct {
+		name             string
+		envAgent         string
+		cliAgent         bool
+		wantSystemPrompt string
+		wantErr          string
+	}{
+		{
+			name:             "agent from environment",
+			envAgent:         "env.toml",
+			wantSystemPrompt: "Env agent",
+		},
+		{
+			name:             "cli agent takes precedence",
+			envAgent:         "env.toml",
+			cliAgent:         true,
+			wantSystemPrompt: "CLI agent",
+		},
+		{
+			name:     "missing agent from environment",
+			envAgent: "missing.toml",
+			wantErr:  agentEnvar,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CACHE_HOME", dir)
+			t.Setenv("HOME", dir)
+			t.Setenv("OPENAI_API_KEY", "test-key")
+			t.Setenv(agentEnvar, filepath.Join(dir, tt.envAgent))
+
+			for name, prompt := range map[string]string{"env.toml": "Env agent", "cli.toml": "CLI agent"} {
+				content := fmt.Sprintf("system_prompt = %q", prompt)
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatalf("Failed to write agent: %v", err)
+				}
+			}
+
+			opts := &CLIOptions{ConfigPath: filepath.Join(dir, "config.toml")}
+			if tt.cliAgent {
+				opts.AgentPath = filepath.Join(dir, "cli.toml")
+			}
+
+			app, err := NewApplication(opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewApplication() error = %v, want it to mention %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewApplication() error = %v", err)
+			}
+			if app.agent.SystemPrompt != tt.wantSystemPrompt {
+				t.Errorf("system prompt = %q, want %q", app.agent.SystemPrompt, tt.wantSystemPrompt)
+			}
+		})
+	}
+}
+
+func TestValidateModelString(t *testing.T) {
+	config := &Config{
+		ModelAliases: map[string]ModelAlias{"local": {Model: "ollama/llama3.2"}, "broken": {Model: "llama3.2"}, "fast": {Model: "openai/"}},
+		Providers: map[string]ProviderConfig{
+			"custom": {BaseURL: "https://custom.api/v1"},
+			"openai": {DefaultModel: "gpt-4o-mini"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		modelStr    string
+		wantErr     bool
+		wantMessage string
+	}{
+		{name: "Valid builtin provider", modelStr: "openai/gpt-4o", wantErr: false},
+		{name: "Valid ollama model", modelStr: "ollama/gemma3n:latest", wantErr: false},
+		{name: "Valid custom provider", modelStr: "custom/model-1", wantErr: false},
+		{name: "Valid alias", modelStr: "local", wantErr: false},
+		{name: "Empty uses default", modelStr: "", wantErr: false},
+		{name: "Provider with default model", modelStr: "openai/", wantErr: false},
+		{name: "Provider name with default model", modelStr: "openai", wantErr: false},
+		{name: "Alias to provider with default model", modelStr: "fast", wantErr: false},
+		{
+			name:        "Provider without default model",
+			modelStr:    "groq/",
+			wantErr:     true,
+			wantMessage: `no model given for provider "groq": use groq/<model> or set default_model under [providers.groq] in the config`,
+		},
+		{
+			name:        "Missing provider suggests ollama for tagged models",
+			modelStr:    "gemma3n:latest",
+			wantErr:     true,
+			wantMessage: `invalid model "gemma3n:latest": models must be given as provider/model (e.g. ollama/gemma3n:latest); known providers: anthropic, copilot, custom, github, grok, groq, ollama, openai, openrouter, perplexity, xai`,
+		},
+		{
+			name:        "Alias resolving to an invalid model",
+			modelStr:    "broken",
+			wantErr:     true,
+			wantMessage: `invalid model "llama3.2": models must be given as provider/model (e.g. openai/llama3.2); known providers: anthropic, copilot, custom, github, grok, groq, ollama, openai, openrouter, perplexity, xai`,
+		},
+		{
+			name:        "Unknown provider",
+			modelStr:    "olama/llama3.2",
+			wantErr:     true,
+			wantMessage: `unknown provider "olama" in model "olama/llama3.2"; known providers: anthropic, copilot, custom, github, grok, groq, ollama, openai, openrouter, perplexity, xai (custom providers can be added under [providers.olama] in the config)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateModelString(tt.modelStr, Agent{}, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateModelString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && err.Error() != tt.wantMessage {
+				t.Errorf("validateModelString() error = %q, want %q", err.Error(), tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestResolveModelString_ProviderDefaultModel(t *testing.T) {
+	config := &Config{
+		ModelAliases: map[string]ModelAlias{"fast": {Model: "ollama/"}},
+		Providers: map[string]ProviderConfig{
+			"openai": {DefaultModel: "gpt-4o-mini"},
+			"ollama": {DefaultModel: "llama3.2"},
+		},
+	}
+
+	tests := []struct {
+		modelStr string
+		want     string
+	}{
+		{modelStr: "openai/", want: "openai/gpt-4o-mini"},
+		{modelStr: "openai", want: "openai/gpt-4o-mini"},
+		{modelStr: "openai/gpt-4o", want: "openai/gpt-4o"},
+		{modelStr: "fast", want: "ollama/llama3.2"},
+		{modelStr: "groq/", want: "groq/"},
+		{modelStr: "llama3.2", want: "llama3.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.modelStr, func(t *testing.T) {
+			if got := resolveModelString(tt.modelStr, Agent{}, config); got != tt.want {
+				t.Errorf("resolveModelString(%q) = %q, want %q", tt.modelStr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEffectiveAskLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		cliAskLevel string
+		agentAsk    string
+		safeMode    bool
+		want        string
+	}{
+		{name: "Safe mode overrides CLI", cliAskLevel: "none", agentAsk: "none", safeMode: true, want: "all"},
+		{name: "CLI overrides agent", cliAskLevel: "all", agentAsk: "none", want: "all"},
+		{name: "Agent ask level is used without CLI flag", cliAskLevel: "", agentAsk: "all", want: "all"},
+		{name: "Defaults to unsafe", cliAskLevel: "", agentAsk: "", want: "unsafe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{
+				cliAskLevel: tt.cliAskLevel,
+				safeMode:    tt.safeMode,
+				agent:       Agent{Ask: tt.agentAsk},
+				debugPrint:  func(string, ...any) {},
+			}
+			if got := app.getEffectiveAskLevel(); got != tt.want {
+				t.Errorf("getEffectiveAskLevel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadHistoryMessagesModelPrecedence(t *testing.T) {
+	history := ConversationHistory{
+		AgentPath: "builtin:default",
+		Model:     "openai/gpt-4o-mini",
+		Messages: []openai.ChatCompletionMessage{
+			{Role: "system", Content: "system"},
+			{Role: "user", Content: "hi"},
+			{Role: "assistant", Content: "hello"},
+		},
+		MessageModels: map[int]string{2: "openai/gpt-4o-mini"},
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyFile := filepath.Join(t.TempDir(), "history.json")
+	if err := os.WriteFile(historyFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		modelFlag string
+		wantModel string
+	}{
+		{name: "model flag overrides history", modelFlag: "anthropic/claude-3-5-sonnet", wantModel: "anthropic/claude-3-5-sonnet"},
+		{name: "history model used without flag", modelFlag: "", wantModel: "openai/gpt-4o-mini"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &CLIOptions{Model: tt.modelFlag, ContinueChat: true}
+			messages, messageModels, err := loadHistoryMessages(opts, historyFile, func(string, ...any) {})
+			if err != nil {
+				t.Fatalf("loadHistoryMessages() error = %v", err)
+			}
+			if opts.Model != tt.wantModel {
+				t.Errorf("opts.Model = %q, want %q", opts.Model, tt.wantModel)
+			}
+			if len(messages) != 3 {
+				t.Errorf("len(messages) = %d, want 3", len(messages))
+			}
+			if messageModels[2] != "openai/gpt-4o-mini" {
+				t.Errorf("messageModels[2] = %q, want %q", messageModels[2], "openai/gpt-4o-mini")
+			}
+		})
+	}
+}
+
+func TestResetConversation(t *testing.T) {
+	app := &Application{
+		historyFile: "old.json",
+		messages: []openai.ChatCompletionMessage{
+			{Role: "system", Content: "system"},
+			{Role: "tool", Name: "list_files", Content: "Command: ls\n\nOutput: \na.txt"},
+		},
+		messageModels: map[int]string{1: "openai/gpt-4o"},
+	}
+	app.toolOutputs = newToolOutputs(app.messages)
+
+	app.resetConversation("new.json")
+
+	if app.historyFile != "new.json" {
+		t.Errorf("historyFile = %q, want %q", app.historyFile, "new.json")
+	}
+	if app.messages != nil {
+		t.Errorf("messages = %v, want nil", app.messages)
+	}
+	if len(app.messageModels) != 0 {
+		t.Errorf("messageModels = %v, want empty", app.messageModels)
+	}
+	if got := app.toolOutputs.substitute("{{last_output}}"); got != "''" {
+		t.Errorf("last_output = %q, want an empty quoted string", got)
+	}
+}
+
+func TestTruncateMessages(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: "system", Content: "system"},
+		{Role: "user", Content: "list files"},
+		{Role: "assistant", ToolCalls: []openai.ToolCall{{ID: "1"}}},
+		{Role: "tool", Content: "a.txt", ToolCallID: "1"},
+		{Role: "assistant", Content: "there is a.txt"},
+		{Role: "user", Content: "read it"},
+		{Role: "assistant", Content: "hello"},
+	}
+
+	tests := []struct {
+		name    string
+		n       int
+		wantLen int
+	}{
+		{name: "cut at a user message", n: 5, wantLen: 5},
+		{name: "cut inside a tool call moves back", n: 3, wantLen: 1},
+		{name: "cut after a user message drops it", n: 6, wantLen: 5},
+		{name: "count beyond the conversation keeps everything", n: 10, wantLen: 7},
+		{name: "system prompt is always kept", n: 1, wantLen: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateMessages(messages, tt.n)
+			if len(got) != tt.wantLen {
+				t.Errorf("len(truncateMessages()) = %d, want %d", len(got), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestWithNote(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: "system", Content: "system"},
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hello"},
+		{Role: "user", Content: "again"},
+	}
+
+	tests := []struct {
+		name     string
+		messages []openai.ChatCompletionMessage
+		retry    bool
+		wantAt   int
+	}{
+		{name: "continue adds the note at the end", messages: messages, wantAt: 4},
+		{name: "retry adds it before the retried message", messages: messages, retry: true, wantAt: 3},
+		{name: "retry without a user message", messages: messages[:3], retry: true, wantAt: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withNote(slices.Clone(tt.messages), "be brief", tt.retry)
+			if len(got) != len(tt.messages)+1 {
+				t.Fatalf("len(withNote()) = %d, want %d", len(got), len(tt.messages)+1)
+			}
+			if note := got[tt.wantAt]; note.Role != openai.ChatMessageRoleSystem || note.Content != "be brief" {
+				t.Errorf("message %d = %+v, want the note", tt.wantAt, note)
+			}
+		})
+	}
+}
+
+func TestOpenRouterAttributionHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+		want   map[string]string
+	}{
+		{
+			name:   "default attribution headers",
+			config: &Config{},
+			want: map[string]string{
+				"HTTP-Referer": "https://github.com/meain/esa",
+				"X-Title":      "esa",
+			},
+		},
+		{
+			name: "config overrides and extends the defaults",
+			config: &Config{
+				Providers: map[string]ProviderConfig{
+					"openrouter": {AdditionalHeaders: map[string]string{"X-Title": "my-app", "X-Extra": "foo"}},
+				},
+			},
+			want: map[string]string{
+				"HTTP-Referer": "https://github.com/meain/esa",
+				"X-Title":      "my-app",
+				"X-Extra":      "foo",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, info := parseModel("openrouter/openai/gpt-4o", Agent{}, tt.config)
+			if !reflect.DeepEqual(info.additionalHeaders, tt.want) {
+				t.Errorf("additionalHeaders = %v, want %v", info.additionalHeaders, tt.want)
+			}
+		})
+	}
+
+	// Overrides must not leak into the shared defaults
+	if got := defaultProviders["openrouter"].additionalHeaders["X-Title"]; got != "esa" {
+		t.Errorf("default X-Title = %q, want %q", got, "esa")
+	}
+}
+
+// fakeLLMClient returns a canned stream for each request
+type fakeLLMClient struct {
+	responses    [][]LLMStreamDelta
+	requests     int
+	lastMessages []openai.ChatCompletionMessage
+	lastOptions  RequestOptions
+}
+
+func (c *fakeLLMClient) CreateChatCompletionStream(model string, messages []openai.ChatCompletionMessage, tools []openai.Tool, opts RequestOptions) (LLMStream, error) {
+	c.lastMessages = slices.Clone(messages)
+	c.lastOptions = opts
+	var deltas []LLMStreamDelta
+	if c.requests < len(c.responses) {
+		deltas = c.responses[c.requests]
+	}
+	c.requests++
+	return &fakeLLMStream{deltas: deltas}, nil
+}
+
+type fakeLLMStream struct {
+	deltas []LLMStreamDelta
+}
+
+func (s *fakeLLMStream) Recv() (LLMStreamDelta, error) {
+	if len(s.deltas) == 0 {
+		return LLMStreamDelta{}, io.EOF
+	}
+	delta := s.deltas[0]
+	s.deltas = s.deltas[1:]
+	return delta, nil
+}
+
+func (s *fakeLLMStream) Close() {}
+
+func TestRunConversationLoop_EmptyResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    [][]LLMStreamDelta
+		wantRequests int
+		wantReply    string
+	}{
+		{
+			name:         "reply",
+			responses:    [][]LLMStreamDelta{{{Content: "hello"}}},
+			wantRequests: 1,
+			wantReply:    "hello",
+		},
+		{
+			name:         "empty response is retried",
+			responses:    [][]LLMStreamDelta{{{FinishReason: openai.FinishReasonStop}}, {{Content: "hello"}}},
+			wantRequests: 2,
+			wantReply:    "hello",
+		},
+		{
+			name:         "retried only once",
+			responses:    [][]LLMStreamDelta{{}, {}, {{Content: "hello"}}},
+			wantRequests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeLLMClient{responses: tt.responses}
+			app := &Application{
+				client:     client,
+				modelFlag:  "openai/gpt-4o",
+				config:     &Config{},
+				noSave:     true,
+				debugPrint: createDebugPrinter(false),
+				messages:   []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+			}
+
+			app.runConversationLoop(CLIOptions{})
+
+			if client.requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", client.requests, tt.wantRequests)
+			}
+
+			last := app.messages[len(app.messages)-1]
+			if tt.wantReply == "" {
+				if len(app.messages) != 1 {
+					t.Errorf("messages = %d, want the empty response to be left out", len(app.messages))
+				}
+			} else if last.Role != "assistant" || last.Content != tt.wantReply {
+				t.Errorf("last message = %+v, want assistant reply %q", last, tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestHandleStreamResponse_MalformedToolCalls(t *testing.T) {
+	// The first fragment has no ID, which used to panic
+	stream := &fakeLLMStream{deltas: []LLMStreamDelta{
+		{ToolCalls: []openai.ToolCall{{Function: openai.FunctionCall{Name: "ls"}}}},
+		{ToolCalls: []openai.ToolCall{{Function: openai.FunctionCall{Arguments: `{"path":`}}}},
+		{ToolCalls: []openai.ToolCall{{Function: openai.FunctionCall{Arguments: `"."}`}}}},
+		{FinishReason: openai.FinishReasonToolCalls},
+	}}
+	app := &Application{debugPrint: createDebugPrinter(false)}
+
+	msg, _, _ := app.handleStreamResponse(stream)
+
+	if len(msg.ToolCalls) != 1 {
+		t.Fatalf("tool calls = %+v, want one", msg.ToolCalls)
+	}
+	got := msg.ToolCalls[0]
+	if got.ID == "" || got.Type != openai.ToolTypeFunction {
+		t.Errorf("tool call ID = %q, type = %q, want them filled in", got.ID, got.Type)
+	}
+	if got.Function.Name != "ls" || got.Function.Arguments != `{"path":"."}` {
+		t.Errorf("tool call = %+v, want ls with the arguments joined", got.Function)
+	}
+}
+
+func TestRunConversationLoop_OutputFilter(t *testing.T) {
+	toolCall := openai.ToolCall{ID: "call_1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "check", Arguments: "{}"}}
+	responses := [][]LLMStreamDelta{
+		{{Content: "<think>first</think>Checking"}, {ToolCalls: []openai.ToolCall{toolCall}}},
+		{{Content: "<think>hmm</think>"}, {Content: "The answer is 42"}, {FinishReason: openai.FinishReasonStop}},
+	}
+
+	tests := []struct {
+		name     string
+		filter   string
+		wantRuns int
+	}{
+		{name: "no filter"},
+		{name: "filter runs on the final answer only", filter: "sed 's|<think>.*</think>||'", wantRuns: 1},
+		{name: "failing filter", filter: "exit 1", wantRuns: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := filepath.Join(t.TempDir(), "runs")
+			filter := ""
+			if tt.filter != "" {
+				filter = fmt.Sprintf("echo run >> %s; %s", runs, tt.filter)
+			}
+			app := &Application{
+				client:      &fakeLLMClient{responses: responses},
+				modelFlag:   "openai/gpt-4o",
+				config:      &Config{},
+				noSave:      true,
+				cliAskLevel: "none",
+				debugPrint:  createDebugPrinter(false),
+				toolOutputs: newToolOutputs(nil),
+				messages:    []openai.ChatCompletionMessage{{Role: "user", Content: "what is the answer?"}},
+				agent: Agent{
+					OutputFilter: filter,
+					Functions:    []FunctionConfig{{Name: "check", Command: "true", Safe: true}},
+				},
+			}
+
+			app.runConversationLoop(CLIOptions{})
+
+			// The model gets its responses back as it wrote them
+			if got := app.messages[1].Content; got != "<think>first</think>Checking" {
+				t.Errorf("tool call turn = %q, want it unfiltered", got)
+			}
+			if got := app.messages[len(app.messages)-1].Content; got != "<think>hmm</think>The answer is 42" {
+				t.Errorf("final answer = %q, want it unfiltered", got)
+			}
+
+			data, _ := os.ReadFile(runs)
+			if got := strings.Count(string(data), "run"); got != tt.wantRuns {
+				t.Errorf("filter ran %d times, want %d", got, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestHandleStreamResponse_Reasoning(t *testing.T) {
+	for _, saveReasoning := range []bool{false, true} {
+		stream := &fakeLLMStream{deltas: []LLMStreamDelta{
+			{ReasoningContent: "Six times "},
+			{ReasoningContent: "seven."},
+			{Content: "The answer is 42"},
+			{FinishReason: openai.FinishReasonStop},
+		}}
+		app := &Application{debugPrint: createDebugPrinter(false), saveReasoning: saveReasoning}
+
+		msg, _, _ := app.handleStreamResponse(stream)
+		if msg.Content != "The answer is 42" {
+			t.Errorf("content = %q, want the reasoning kept out", msg.Content)
+		}
+
+		wantReasoning := ""
+		if saveReasoning {
+			wantReasoning = "Six times seven."
+		}
+		if msg.ReasoningContent != wantReasoning {
+			t.Errorf("save reasoning %v: reasoning = %q, want %q", saveReasoning, msg.ReasoningContent, wantReasoning)
+		}
+	}
+}
+
+func TestWithoutReasoning(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "What is six times seven?"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "42", ReasoningContent: "Six times seven."},
+	}
+
+	got := withoutReasoning(messages)
+	if got[1].ReasoningContent != "" || got[1].Content != "42" {
+		t.Errorf("message = %+v, want the reasoning removed", got[1])
+	}
+	if messages[1].ReasoningContent == "" {
+		t.Error("withoutReasoning() changed the messages it was given")
+	}
+}
+
+func TestFinishReasonNote(t *testing.T) {
+	tests := []struct {
+		reason   openai.FinishReason
+		wantNote bool
+	}{
+		{reason: openai.FinishReasonStop, wantNote: false},
+		{reason: openai.FinishReasonToolCalls, wantNote: false},
+		{reason: "", wantNote: false},
+		{reason: openai.FinishReasonLength, wantNote: true},
+		{reason: openai.FinishReasonContentFilter, wantNote: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.reason), func(t *testing.T) {
+			if got := finishReasonNote(tt.reason) != ""; got != tt.wantNote {
+				t.Errorf("finishReasonNote(%q) returned a note = %v, want %v", tt.reason, got, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestRunConversationLoop_AutoContinue(t *testing.T) {
+	truncated := []LLMStreamDelta{{Content: "more "}, {FinishReason: openai.FinishReasonLength}}
+
+	tests := []struct {
+		name         string
+		autoContinue bool
+		responses    [][]LLMStreamDelta
+		wantRequests int
+		wantReply    string
+	}{
+		{
+			name:         "disabled",
+			responses:    [][]LLMStreamDelta{truncated, {{Content: "end"}}},
+			wantRequests: 1,
+			wantReply:    "more ",
+		},
+		{
+			name:         "continued until done",
+			autoContinue: true,
+			responses:    [][]LLMStreamDelta{truncated, truncated, {{Content: "end"}, {FinishReason: openai.FinishReasonStop}}},
+			wantRequests: 3,
+			wantReply:    "more more end",
+		},
+		{
+			name:         "limited number of continuations",
+			autoContinue: true,
+			responses:    slices.Repeat([][]LLMStreamDelta{truncated}, 10),
+			wantRequests: 1 + maxAutoContinues,
+			wantReply:    strings.Repeat("more ", 1+maxAutoContinues),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeLLMClient{responses: tt.responses}
+			app := &Application{
+				client:       client,
+				modelFlag:    "openai/gpt-4o",
+				config:       &Config{},
+				noSave:       true,
+				autoContinue: tt.autoContinue,
+				debugPrint:   createDebugPrinter(false),
+				messages:     []openai.ChatCompletionMessage{{Role: "user", Content: "write a lot"}},
+			}
+
+			app.runConversationLoop(CLIOptions{})
+
+			if client.requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", client.requests, tt.wantRequests)
+			}
+			if len(app.messages) != 2 {
+				t.Fatalf("messages = %d, want the continuation to be merged into one reply", len(app.messages))
+			}
+			if got := app.messages[1].Content; got != tt.wantReply {
+				t.Errorf("reply = %q, want %q", got, tt.wantReply)
+			}
+			if tt.wantRequests > 1 {
+				if nudge := client.lastMessages[len(client.lastMessages)-1]; nudge.Content != continuePrompt {
+					t.Errorf("last request ended with %+v, want the continue prompt", nudge)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckContinuable(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  []openai.ChatCompletionMessage
+		wantError bool
+	}{
+		{name: "empty conversation", wantError: true},
+		{name: "ends with user message", messages: []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}}, wantError: true},
+		{
+			name:      "ends with tool calls",
+			messages:  []openai.ChatCompletionMessage{{Role: "assistant", ToolCalls: []openai.ToolCall{{ID: "1"}}}},
+			wantError: true,
+		},
+		{name: "ends with response", messages: []openai.ChatCompletionMessage{{Role: "assistant", Content: "partial"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkContinuable(tt.messages); (err != nil) != tt.wantError {
+				t.Errorf("checkContinuable() error = %v, wantError %v", err, tt.wantError)
+			}
+		})
+	}
+}
+
+type failingLLMClient struct {
+	err error
+}
+
+func (c *failingLLMClient) CreateChatCompletionStream(string, []openai.ChatCompletionMessage, []openai.Tool, RequestOptions) (LLMStream, error) {
+	return nil, c.err
+}
+
+func TestCreateChatCompletionWithRetry_FallbackModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"choices":[{"index":0,"delta":{"content":"from fallback"}}]}` + "\n\ndata: [DONE]\n\n"))
+	}))
+	defer server.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("GROQ_API_KEY", "")
+	t.Setenv("FALLBACK_TEST_API_KEY", "test-key")
+	badGateway := &openai.APIError{HTTPStatusCode: http.StatusBadGateway, Message: "Bad Gateway"}
+	app := &Application{
+		client:     &failingLLMClient{err: badGateway},
+		modelFlag:  "openai/gpt-4o",
+		debugPrint: createDebugPrinter(false),
+		config: &Config{
+			Providers: map[string]ProviderConfig{
+				"custom": {BaseURL: server.URL, APIKeyEnvar: "FALLBACK_TEST_API_KEY"},
+				"down":   {BaseURL: down.URL, APIKeyEnvar: "FALLBACK_TEST_API_KEY"},
+			},
+		},
+		// The current model is not tried again and groq has no API key
+		fallbackModels: []string{"openai/gpt-4o", "groq/llama3-70b-8192", "custom/backup"},
+	}
+
+	stream, err := app.createChatCompletionWithRetry(nil)
+	if err != nil {
+		t.Fatalf("createChatCompletionWithRetry() error = %v", err)
+	}
+	delta, err := stream.Recv()
+	stream.Close()
+	if err != nil || delta.Content != "from fallback" {
+		t.Errorf("Recv() = %q, %v, want the response of the fallback model", delta.Content, err)
+	}
+	if got := app.currentModelString(); got != "custom/backup" {
+		t.Errorf("model = %q, want custom/backup to be used from now on", got)
+	}
+
+	// Errors about the request itself are not sent to fallback models
+	unauthorized := &openai.APIError{HTTPStatusCode: http.StatusUnauthorized, Message: "invalid key"}
+	app.modelFlag = "openai/gpt-4o"
+	app.client = &failingLLMClient{err: unauthorized}
+	if _, err := app.createChatCompletionWithRetry(nil); !errors.Is(err, unauthorized) {
+		t.Errorf("createChatCompletionWithRetry() error = %v, want %v", err, unauthorized)
+	}
+	if got := app.currentModelString(); got != "openai/gpt-4o" {
+		t.Errorf("model = %q, want no fallback for a client error", got)
+	}
+
+	// Once every fallback fails, the primary model and its error are kept
+	primary := &failingLLMClient{err: badGateway}
+	app.client = primary
+	app.fallbackModels = []string{"groq/llama3-70b-8192", "down/backup"}
+	_, err = app.createChatCompletionWithRetry(nil)
+	if !errors.Is(err, badGateway) || !strings.Contains(err.Error(), "down/backup") {
+		t.Errorf("createChatCompletionWithRetry() error = %v, want the primary error with the fallback errors", err)
+	}
+	if got := app.currentModelString(); got != "openai/gpt-4o" || app.client != primary {
+		t.Errorf("model = %q, want the primary model to be restored", got)
+	}
+}
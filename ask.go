@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// askUserToolName is the name of the tool added to agents with ask_user
+// set, letting the model ask the user a question mid-conversation
+const askUserToolName = "ask_user"
+
+// askUserFunction returns the tool added to agents with ask_user set. It
+// is run in-process and, like other interactive functions, needs a
+// terminal to read the answer from.
+func askUserFunction() FunctionConfig {
+	return FunctionConfig{
+		Name: askUserToolName,
+		Description: "Ask the user a question and wait for their answer. " +
+			"Use this to clarify what the user wants instead of guessing.",
+		Command:     askUserToolName + " {{question}}",
+		Safe:        true,
+		Interactive: true,
+		Parameters: []ParameterConfig{
+			{Name: "question", Type: "string", Description: "The question to ask the user", Required: true},
+		},
+		run: func(args map[string]any, _ *jobRegistry) (string, error) {
+			return askUser(args)
+		},
+	}
+}
+
+// askUser asks the user the question from the model and returns their
+// answer
+func askUser(args map[string]any) (string, error) {
+	question := strings.TrimSpace(fmt.Sprint(args["question"]))
+	if question == "" {
+		return "", fmt.Errorf("no question to ask")
+	}
+
+	answer, err := readUserInput(question, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to read answer: %w", err)
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return "The user did not answer.", nil
+	}
+	return answer, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestValidateAgent_AskUser(t *testing.T) {
+	tests := []struct {
+		name          string
+		askUser       bool
+		functions     []FunctionConfig
+		wantAskUser   bool
+		wantFunctions int
+	}{
+		{
+			name:          "enabled",
+			askUser:       true,
+			functions:     []FunctionConfig{{Name: "status", Command: "git status"}},
+			wantAskUser:   true,
+			wantFunctions: 2,
+		},
+		{
+			name:          "not enabled",
+			functions:     []FunctionConfig{{Name: "status", Command: "git status"}},
+			wantAskUser:   false,
+			wantFunctions: 1,
+		},
+		{
+			name:          "agent defines its own ask_user",
+			askUser:       true,
+			functions:     []FunctionConfig{{Name: "ask_user", Command: "read -r answer; echo $answer"}},
+			wantAskUser:   false,
+			wantFunctions: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, err := validateAgent(Agent{Name: "helper", AskUser: tt.askUser, Functions: tt.functions})
+			if err != nil {
+				t.Fatalf("validateAgent() error = %v", err)
+			}
+			if len(agent.Functions) != tt.wantFunctions {
+				t.Fatalf("functions = %d, want %d", len(agent.Functions), tt.wantFunctions)
+			}
+
+			last := agent.Functions[len(agent.Functions)-1]
+			if gotAskUser := last.run != nil; gotAskUser != tt.wantAskUser {
+				t.Errorf("built-in ask_user added = %v, want %v", gotAskUser, tt.wantAskUser)
+			}
+			if tt.wantAskUser && !last.Interactive {
+				t.Error("built-in ask_user is not interactive")
+			}
+		})
+	}
+}
+
+func TestAskUser_NoQuestion(t *testing.T) {
+	if _, err := askUser(map[string]any{"question": "  "}); err == nil {
+		t.Error("askUser() error = nil, want error for an empty question")
+	}
+}
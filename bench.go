@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/sashabaranov/go-openai"
+)
+
+// BenchResult is the response of one model to the prompt sent with
+// --bench
+type BenchResult struct {
+	Model            string  `json:"model"`
+	Response         string  `json:"response"`
+	LatencyMs        int64   `json:"latency_ms"`
+	PromptTokens     int     `json:"prompt_tokens,omitempty"`
+	CompletionTokens int     `json:"completion_tokens,omitempty"`
+	Cost             float64 `json:"cost,omitempty"` // USD, when the price of the model is known
+	Priced           bool    `json:"-"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// parseBenchModels splits the comma separated models given to --bench
+func parseBenchModels(value string) ([]string, error) {
+	var models []string
+	for _, model := range strings.Split(value, ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			models = append(models, model)
+		}
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("--bench needs a comma separated list of models")
+	}
+	return models, nil
+}
+
+// handleBench sends the prompt to each of the models given with --bench
+// and prints their responses along with latency, tokens and cost. Tools
+// are left out so that only the answers are compared.
+func handleBench(opts *CLIOptions) error {
+	models, err := parseBenchModels(opts.Bench)
+	if err != nil {
+		return err
+	}
+
+	input := readStdin()
+	if opts.CommandStr == "" && input == "" {
+		return fmt.Errorf("--bench needs a prompt: pass it as arguments or on stdin")
+	}
+
+	// Applications are set up one at a time as loading the agent runs
+	// its shell blocks, only the requests are sent concurrently
+	apps := make([]*Application, len(models))
+	for i, model := range models {
+		benchOpts := *opts
+		benchOpts.Model = model
+		benchOpts.NoSave = true
+		app, err := NewApplication(&benchOpts)
+		if err != nil {
+			return fmt.Errorf("failed to initialize %s: %v", model, err)
+		}
+		// A fallback would answer in place of the model being compared
+		app.fallbackModels = nil
+		if _, err := app.initializeRuntime(); err != nil {
+			return err
+		}
+		app.processInput(opts.CommandStr, input)
+		apps[i] = app
+	}
+
+	results := runBench(apps)
+	if opts.OutputFormat == "json" {
+		return printJSON(results)
+	}
+	printBenchResults(os.Stdout, results)
+	return nil
+}
+
+// runBench sends the conversation of each application to its model
+// concurrently, returning the results in the same order
+func runBench(apps []*Application) []BenchResult {
+	results := make([]BenchResult, len(apps))
+	var wg sync.WaitGroup
+	for i, app := range apps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = app.benchResponse()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// benchResponse sends the conversation without tools and collects the
+// response without printing it
+func (app *Application) benchResponse() BenchResult {
+	modelStr := app.currentModelString()
+	result := BenchResult{Model: modelStr}
+
+	start := time.Now()
+	stream, err := app.createChatCompletionWithRetry(nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer stream.Close()
+
+	var response strings.Builder
+	var usage *openai.Usage
+	for {
+		delta, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.Error = err.Error()
+			break
+		}
+		response.WriteString(delta.Content)
+		if delta.Usage != nil {
+			usage = delta.Usage
+		}
+	}
+
+	result.LatencyMs = time.Since(start).Milliseconds()
+	result.Response = strings.TrimSpace(response.String())
+	if usage != nil {
+		result.PromptTokens = usage.PromptTokens
+		result.CompletionTokens = usage.CompletionTokens
+		result.Cost, result.Priced = responseCost(app.config, modelStr, usage)
+	}
+	return result
+}
+
+// printBenchResults prints the response of each model followed by a
+// table comparing them
+func printBenchResults(w io.Writer, results []BenchResult) {
+	header := color.New(color.FgCyan, color.Bold)
+	for _, result := range results {
+		header.Fprintf(w, "=== %s ===\n", result.Model)
+		if result.Error != "" {
+			outputColor(colorError, color.FgRed).Fprintf(w, "Error: %s\n\n", result.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\n\n", result.Response)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tLATENCY\tPROMPT\tCOMPLETION\tCOST")
+	for _, result := range results {
+		if result.Error != "" {
+			fmt.Fprintf(tw, "%s\tfailed\t-\t-\t-\n", result.Model)
+			continue
+		}
+
+		prompt, completion, cost := "-", "-", "-"
+		if result.PromptTokens+result.CompletionTokens > 0 {
+			prompt, completion = fmt.Sprint(result.PromptTokens), fmt.Sprint(result.CompletionTokens)
+		}
+		if result.Priced {
+			cost = fmt.Sprintf("$%.4f", result.Cost)
+		}
+		latency := formatElapsed(time.Duration(result.LatencyMs) * time.Millisecond)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Model, latency, prompt, completion, cost)
+	}
+	tw.Flush()
+}
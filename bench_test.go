@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestParseBenchModels(t *testing.T) {
+	models, err := parseBenchModels(" openai/gpt-4o, mini,,anthropic/claude-haiku-4-5 ")
+	if err != nil {
+		t.Fatalf("parseBenchModels() error = %v", err)
+	}
+	want := []string{"openai/gpt-4o", "mini", "anthropic/claude-haiku-4-5"}
+	if strings.Join(models, " ") != strings.Join(want, " ") {
+		t.Errorf("models = %v, want %v", models, want)
+	}
+
+	if _, err := parseBenchModels(" , "); err == nil {
+		t.Error("parseBenchModels() error = nil, want error for no models")
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	newApp := func(model string, deltas []LLMStreamDelta) (*Application, *fakeLLMClient) {
+		client := &fakeLLMClient{responses: [][]LLMStreamDelta{deltas}}
+		return &Application{
+			client:     client,
+			modelFlag:  model,
+			config:     &Config{},
+			debugPrint: createDebugPrinter(false),
+			messages:   []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		}, client
+	}
+
+	priced, pricedClient := newApp("openai/gpt-4o", []LLMStreamDelta{
+		{Content: "Hello"},
+		{Content: " there"},
+		{Usage: &openai.Usage{PromptTokens: 1000, CompletionTokens: 100}},
+	})
+	unpriced, _ := newApp("openai/some-new-model", []LLMStreamDelta{{Content: "Hi"}})
+
+	results := runBench([]*Application{priced, unpriced})
+	if len(results) != 2 {
+		t.Fatalf("results = %d, want 2", len(results))
+	}
+
+	got := results[0]
+	if got.Model != "openai/gpt-4o" || got.Response != "Hello there" {
+		t.Errorf("result = %+v, want the response of openai/gpt-4o", got)
+	}
+	if !got.Priced || got.PromptTokens != 1000 || got.CompletionTokens != 100 {
+		t.Errorf("result = %+v, want tokens and a cost", got)
+	}
+	if pricedClient.requests != 1 {
+		t.Errorf("requests = %d, want 1", pricedClient.requests)
+	}
+
+	if results[1].Model != "openai/some-new-model" || results[1].Priced {
+		t.Errorf("result = %+v, want the unpriced model second", results[1])
+	}
+
+	var out strings.Builder
+	printBenchResults(&out, results)
+	for _, want := range []string{"=== openai/gpt-4o ===", "Hello there", "MODEL", "$0.0035"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output = %q, want it to contain %q", out.String(), want)
+		}
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -15,20 +21,159 @@ import (
 	"github.com/spf13/cobra"
 )
 
-// DefaultAgentsDir is the default directory for agent configuration files
-const DefaultAgentsDir = "~/.config/esa/agents"
+// defaultAgentsDir returns the default directory for agent
+// configuration files
+func defaultAgentsDir() string {
+	return filepath.Join(configHome(), "agents")
+}
+
+// agentEnvar names the agent to use when none is given on the command
+// line, e.g. +coder or a path to an agent file
+const agentEnvar = "ESA_AGENT"
+
+// agentsDirEnvar names a directory to load user agents from instead of
+// defaultAgentsDir
+const agentsDirEnvar = "ESA_AGENTS_DIR"
+
+// agentsDirOverride is the directory given with --agents-dir or
+// ESA_AGENTS_DIR, empty when user agents come from defaultAgentsDir
+var agentsDirOverride string
+
+// configureAgentsDir sets the directory user agents are loaded from,
+// with the flag taking precedence over the environment
+func configureAgentsDir(flagDir string) {
+	agentsDirOverride = flagDir
+	if agentsDirOverride == "" {
+		agentsDirOverride = os.Getenv(agentsDirEnvar)
+	}
+}
 
-// DefaultAgentPath is the default location for the agent configuration file
-const DefaultAgentPath = DefaultAgentsDir + "/default.toml"
+// agentsDir returns the directory user agents are loaded from
+func agentsDir() string {
+	if agentsDirOverride != "" {
+		return expandHomePath(agentsDirOverride)
+	}
+	return defaultAgentsDir()
+}
+
+// projectAgentsDir is where agents kept with a project live, relative
+// to the root of the project
+const projectAgentsDir = ".esa/agents"
+
+// trustedProjects are the roots of the projects whose agents are used,
+// from trusted_projects in the config. Loading an agent runs the shell
+// blocks of its variables, so the agents that come with a cloned
+// repository are left alone until the user trusts it.
+var trustedProjects []string
+
+// warnUntrustedProject makes sure an untrusted project is only reported
+// once per run
+var warnUntrustedProject sync.Once
+
+// loadSettings applies the colors and trusted projects from the config.
+// It is set up by configureSettings and only reads the config the first
+// time a color or the trusted projects are needed.
+var loadSettings = func() {}
+
+// configureSettings sets up loadSettings for the config at configPath.
+// A missing config file is left alone rather than created, so that
+// commands such as --list-agents do not write one.
+func configureSettings(configPath, profile string) {
+	loadSettings = sync.OnceFunc(func() {
+		if configPath == "" {
+			configPath = defaultConfigPath()
+		}
+		if _, err := os.Stat(expandHomePath(configPath)); err != nil {
+			return
+		}
+		if config, err := LoadConfigWithProfile(configPath, profile); err == nil {
+			configureColors(config.Settings.Colors)
+			configureTrustedProjects(config.Settings.TrustedProjects)
+		}
+	})
+}
+
+// configureTrustedProjects sets the projects whose agents are used
+func configureTrustedProjects(projects []string) {
+	trustedProjects = nil
+	for _, project := range projects {
+		trustedProjects = append(trustedProjects, resolvedDir(expandHomePath(project)))
+	}
+}
+
+// resolvedDir returns dir with symlinks resolved, so that a project is
+// recognized however its path is written
+func resolvedDir(dir string) string {
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		return resolved
+	}
+	return filepath.Clean(dir)
+}
+
+// isTrustedProject reports whether root is listed in trusted_projects
+func isTrustedProject(root string) bool {
+	loadSettings()
+	return slices.Contains(trustedProjects, resolvedDir(root))
+}
+
+// agentDirs returns the directories user agents are loaded from, in
+// order of precedence: the project agents directory found in the
+// working directory or one of its parents when the project is trusted,
+// then agentsDir.
+func agentDirs() []string {
+	dirs := []string{}
+	if dir := findProjectAgentsDir(); dir != "" && dir != agentsDir() {
+		root := filepath.Dir(filepath.Dir(dir))
+		if isTrustedProject(root) {
+			dirs = append(dirs, dir)
+		} else {
+			warnUntrustedProject.Do(func() {
+				fmt.Fprintf(os.Stderr, "Warning: not using the agents in %s as the project is not trusted, add %q to trusted_projects under [settings] in the config to use them\n",
+					dir, root)
+			})
+		}
+	}
+	return append(dirs, agentsDir())
+}
+
+// findProjectAgentsDir looks for the project agents directory in the
+// working directory and its parents, returning an empty string when
+// there is none
+func findProjectAgentsDir() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		candidate := filepath.Join(dir, projectAgentsDir)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// defaultAgentPath returns the location of the default agent file
+func defaultAgentPath() string {
+	return filepath.Join(agentsDir(), "default.toml")
+}
 
 type CLIOptions struct {
 	DebugMode       bool
+	DumpRequest     bool // Print requests sent to the provider
 	ContinueChat    bool
 	Conversation    string // continue non-last one
 	RetryChat       bool
 	ReplMode        bool // Flag for REPL mode
+	Resume          bool // Resume the most recent REPL session
 	AgentPath       string
+	AgentsDir       string // Directory to load user agents from
 	AskLevel        string
+	SafeMode        bool // Only allow functions marked safe and confirm all of them
 	ShowCommands    bool
 	ShowToolCalls   bool
 	HideProgress    bool
@@ -36,8 +181,13 @@ type CLIOptions struct {
 	AgentName       string
 	Model           string
 	ConfigPath      string
+	Profile         string // Named config profile to merge over the base config
 	OutputFormat    string // Output format for show-history (text, markdown, json, html)
 	ShowAgent       bool   // Flag for showing agent details
+	ShowPrompt      bool   // Flag for showing the resolved system prompt of an agent
+	ShowConfig      bool   // Flag for showing the resolved global config
+	CountTokens     bool   // Flag for counting the tokens of the input
+	File            string // File to count tokens of instead of stdin
 	ListAgents      bool   // Flag for listing agents
 	ListUserAgents  bool   // Flag for listing only user agents
 	ListHistory     bool   // Flag for listing history
@@ -47,15 +197,46 @@ type CLIOptions struct {
 	ShowAll         bool   // Flag for showing both stats and history
 	SystemPrompt    string // System prompt override from CLI
 	Pretty          bool   // Pretty print markdown output using glow
+	NoHighlight     bool   // Do not highlight code blocks while streaming
+	ShowThinking    bool   // Show the thinking of reasoning models dimmed
+	ShowReasoning   bool   // Show reasoning streamed apart from the response dimmed
+	Bench           string // Comma separated models to compare on the prompt
 	IgnoreToolCalls bool   // Flag for ignoring tool calls in history display
+	Range           string // Messages to show with --show-history, e.g. 3-6
+	Last            int    // Show only the last N messages with --show-history
+	Note            string // System message added when continuing a conversation
+	TruncateTools   int    // Characters of tool results shown with --show-history (0 = all)
 	ServeMode       bool   // Flag for starting web server mode
 	ServePort       int    // Port for the web server
+	ServeHost       string // Address the web server listens on
 	ServeWorkDir    string // Working directory for the web server
+	AccessToken     string // Token for full access to the web server
+	ViewToken       string // Token for read-only access to the web server
 	MaxTurns        int    // Maximum number of conversation turns (0 = unlimited)
+	From            int    // Continue from the first N messages of the conversation
+	NoSave          bool   // Keep the conversation in memory only
+	ImportHistory   string // Path of a conversation JSON file to import into history
+	LogFile         string // Path of a file to append a JSONL transcript to
+	PickAgent       bool   // Choose the agent from a list before starting
+	AutoContinue    bool   // Ask for the rest of responses cut off at the length limit
+
+	// Headers are extra headers sent with requests to the model, given
+	// as key=value with --header
+	Headers []string
+
+	// ModelAliases are aliases for this run only, given as
+	// name=provider/model with --model-alias
+	ModelAliases []string
+
+	// FrequencyPenalty and PresencePenalty override the penalties of the
+	// agent, they are nil unless given on the command line
+	FrequencyPenalty *float32
+	PresencePenalty  *float32
 }
 
 func createRootCommand() *cobra.Command {
 	opts := &CLIOptions{}
+	var frequencyPenalty, presencePenalty float32
 
 	rootCmd := &cobra.Command{
 		Use:          "esa [text]",
@@ -67,31 +248,89 @@ func createRootCommand() *cobra.Command {
   esa +coder How do I write a function in Go
   esa --repl
   esa --repl "initial query"
+  esa --resume
   esa --list-agents
   esa --show-agent +coder
   esa --show-agent ~/.config/esa/agents/custom.toml
+  esa --show-agent +coder --show-prompt
+  esa --show-agent +coder --output json
   esa --list-history
   esa --show-history 1
   esa --show-history 1 --output json
   esa --show-output 1
   esa --show-stats`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.AskLevel != "" &&
+				!slices.Contains([]string{"none", "unsafe", "all"}, opts.AskLevel) {
+				return fmt.Errorf(
+					"invalid ask level: %s. Must be one of: none, unsafe, all",
+					opts.AskLevel,
+				)
+			}
+
+			if _, err := parseHeaders(opts.Headers); err != nil {
+				return err
+			}
+			if _, err := parseModelAliases(opts.ModelAliases); err != nil {
+				return err
+			}
+
+			if cmd.Flags().Changed("frequency-penalty") {
+				opts.FrequencyPenalty = &frequencyPenalty
+			}
+			if cmd.Flags().Changed("presence-penalty") {
+				opts.PresencePenalty = &presencePenalty
+			}
+			if err := validatePenalty("--frequency-penalty", opts.FrequencyPenalty); err != nil {
+				return err
+			}
+			if err := validatePenalty("--presence-penalty", opts.PresencePenalty); err != nil {
+				return err
+			}
+
+			configureAgentsDir(opts.AgentsDir)
+			if opts.DumpRequest {
+				requestDumpWriter = os.Stderr
+			}
+
+			// Colors and trusted projects are read from the config when
+			// first used, so that they also apply to the list and show flags
+			configureSettings(opts.ConfigPath, opts.Profile)
+			migrateHistory()
+
+			if opts.From < 0 {
+				return fmt.Errorf("invalid --from %d: must be a positive message count", opts.From)
+			}
+			if opts.From > 0 && !opts.ContinueChat && opts.Conversation == "" {
+				return fmt.Errorf("--from can only be used when continuing a conversation with -c or -C")
+			}
+			if opts.Note != "" && !opts.ContinueChat && !opts.RetryChat && !opts.Resume && opts.Conversation == "" {
+				return fmt.Errorf("--note can only be used when continuing a conversation with -c or -C")
+			}
+
 			// Handle serve mode
 			if opts.ServeMode {
 				return runServeMode(opts)
 			}
 
-			// Handle REPL mode first
-			if opts.ReplMode {
-				return runReplMode(opts, args)
+			// The picked agent is passed on as +agent so that it goes
+			// through the same parsing as one given on the command line
+			if opts.PickAgent {
+				if opts.AgentPath != "" || strings.HasPrefix(strings.Join(args, " "), "+") {
+					return fmt.Errorf("--pick-agent cannot be used along with --agent or +agent")
+				}
+
+				agentStr, err := pickAgent()
+				if err != nil {
+					return err
+				}
+				args = append([]string{agentStr}, args...)
 			}
 
-			if opts.AskLevel != "" &&
-				!slices.Contains([]string{"none", "unsafe", "all"}, opts.AskLevel) {
-				return fmt.Errorf(
-					"invalid ask level: %s. Must be one of: none, unsafe, all",
-					opts.AskLevel,
-				)
+			// Handle REPL mode first
+			if opts.ReplMode || opts.Resume {
+				opts.ReplMode = true
+				return runReplMode(opts, args)
 			}
 
 			if opts.OutputFormat != "" &&
@@ -104,6 +343,9 @@ func createRootCommand() *cobra.Command {
 
 			// Handle list/show flags first
 			if opts.ListAgents {
+				if opts.OutputFormat == "json" {
+					return printJSON(agentInfos())
+				}
 				listAgents()
 				return nil
 			}
@@ -114,6 +356,9 @@ func createRootCommand() *cobra.Command {
 			}
 
 			if opts.ListHistory {
+				if opts.OutputFormat == "json" {
+					return listHistoryJSON(opts.ShowAll)
+				}
 				listHistory(opts.ShowAll)
 				return nil
 			}
@@ -124,7 +369,14 @@ func createRootCommand() *cobra.Command {
 					return fmt.Errorf("history index must be provided as argument: esa --show-history <index>")
 				}
 
-				handleShowHistory(args[0], opts.OutputFormat, opts.IgnoreToolCalls)
+				selection, err := parseMessageRange(opts.Range, opts.Last)
+				if err != nil {
+					return err
+				}
+				if opts.TruncateTools < 0 {
+					return fmt.Errorf("invalid --truncate-tools %d: must be a positive number of characters or 0 to show everything", opts.TruncateTools)
+				}
+				handleShowHistory(args[0], opts.OutputFormat, opts.IgnoreToolCalls, selection, opts.TruncateTools)
 				return nil
 			}
 
@@ -143,14 +395,26 @@ func createRootCommand() *cobra.Command {
 				return nil
 			}
 
-			if opts.ShowAgent {
+			if opts.ImportHistory != "" {
+				return handleImportHistory(opts.ImportHistory, opts.ConfigPath)
+			}
+
+			if opts.ShowConfig {
+				return handleShowConfig(opts.ConfigPath, opts.Profile, opts.OutputFormat)
+			}
+
+			if opts.CountTokens {
+				return handleCountTokens(opts)
+			}
+
+			if opts.ShowAgent || opts.ShowPrompt {
 				// Require positional argument for agent
 				if len(args) == 0 {
 					return fmt.Errorf("agent must be provided as argument: esa --show-agent <agent> or esa --show-agent +<agent>")
 				}
 
-				_, agentPath := ParseAgentString(args[0])
-				handleShowAgent(agentPath)
+				agentName, agentPath := ParseAgentString(args[0])
+				handleShowAgent(agentName, agentPath, opts.ShowPrompt, opts.OutputFormat)
 				return nil
 			}
 
@@ -162,6 +426,10 @@ func createRootCommand() *cobra.Command {
 				parseAgentCommand(opts)
 			}
 
+			if opts.Bench != "" {
+				return handleBench(opts)
+			}
+
 			app, err := NewApplication(opts)
 			if err != nil {
 				return fmt.Errorf("failed to initialize application: %v", err)
@@ -174,34 +442,65 @@ func createRootCommand() *cobra.Command {
 
 	// Add flags
 	rootCmd.Flags().BoolVar(&opts.DebugMode, "debug", false, "Enable debug mode")
+	rootCmd.Flags().BoolVar(&opts.DumpRequest, "dump-request", false, "Print the requests sent to the model provider to stderr")
 	rootCmd.Flags().BoolVarP(&opts.ContinueChat, "continue", "c", false, "Continue last conversation")
 	rootCmd.Flags().StringVarP(&opts.Conversation, "conversation", "C", "", "Specify the conversation to continue or retry")
 	rootCmd.Flags().BoolVarP(&opts.RetryChat, "retry", "r", false, "Retry last command")
+	rootCmd.Flags().IntVar(&opts.From, "from", 0, "Continue from the first N messages of the conversation, dropping the rest")
+	rootCmd.Flags().BoolVar(&opts.NoSave, "no-save", false, "Do not save the conversation to history")
+	rootCmd.Flags().StringVar(&opts.LogFile, "log-file", "", "Append a JSONL transcript of requests, responses and tool calls to this file")
 	rootCmd.Flags().BoolVar(&opts.ReplMode, "repl", false, "Start in REPL mode for interactive conversation")
+	rootCmd.Flags().BoolVar(&opts.Resume, "resume", false, "Resume the most recent REPL session")
 	rootCmd.Flags().StringVar(&opts.AgentPath, "agent", "", "Path to agent config file")
+	rootCmd.Flags().StringVar(&opts.AgentsDir, "agents-dir", "", "Directory to load user agents from (default: ~/.config/esa/agents)")
+	rootCmd.Flags().BoolVar(&opts.PickAgent, "pick-agent", false, "Choose the agent to use from a list of available agents")
 	rootCmd.Flags().StringVar(&opts.ConfigPath, "config", "", "Path to the global config file (default: ~/.config/esa/config.toml)")
+	rootCmd.Flags().StringVar(&opts.Profile, "profile", "", "Named profile from the global config to use")
 	rootCmd.Flags().StringVarP(&opts.Model, "model", "m", "", "Model to use (e.g., openai/gpt-4)")
 	rootCmd.Flags().StringVar(&opts.AskLevel, "ask", "", "Ask level (none, unsafe, all)")
+	rootCmd.Flags().BoolVar(&opts.SafeMode, "safe", false, "Refuse to run functions not marked safe and confirm all others")
+	rootCmd.Flags().BoolVar(&opts.SafeMode, "read-only", false, "Alias for --safe")
 	rootCmd.Flags().BoolVar(&opts.ShowCommands, "show-commands", false, "Show executed commands during run")
 	rootCmd.Flags().BoolVar(&opts.ShowToolCalls, "show-tool-calls", false, "Show executed commands and their outputs during run")
 	rootCmd.Flags().BoolVar(&opts.HideProgress, "hide-progress", false, "Disable progress info for each function")
-	rootCmd.Flags().StringVar(&opts.OutputFormat, "output", "text", "Output format for --show-history (text, markdown, json, html)")
+	rootCmd.Flags().StringVar(&opts.OutputFormat, "output", "text", "Output format for --show-history (text, markdown, json, html), --show-agent, --show-config, --count-tokens, --list-agents, --list-history and --bench (text, json)")
 	rootCmd.Flags().BoolVarP(&opts.Pretty, "pretty", "p", false, "Pretty print markdown output (disables streaming)")
+	rootCmd.Flags().BoolVar(&opts.AutoContinue, "auto-continue", false, "Automatically continue responses cut off at the model's output limit")
+	rootCmd.Flags().BoolVar(&opts.NoHighlight, "no-highlight", false, "Do not syntax highlight code blocks in streamed output")
+	rootCmd.Flags().BoolVar(&opts.ShowReasoning, "show-reasoning", false, "Show the reasoning some providers send apart from the response, dimmed")
+	rootCmd.Flags().BoolVar(&opts.ShowThinking, "show-thinking", false, "Show the <think> blocks of reasoning models dimmed, keeping them out of the saved response")
+	rootCmd.Flags().StringArrayVar(&opts.Headers, "header", nil, "Add a header to requests sent to the model as key=value (can be repeated)")
+	rootCmd.Flags().StringArrayVar(&opts.ModelAliases, "model-alias", nil, "Add a model alias for this run as name=provider/model (can be repeated)")
 	rootCmd.Flags().StringVar(&opts.SystemPrompt, "system-prompt", "", "Override the system prompt for the agent")
+	rootCmd.Flags().Float32Var(&frequencyPenalty, "frequency-penalty", 0, "Penalize tokens by how often they already appear (-2 to 2)")
+	rootCmd.Flags().Float32Var(&presencePenalty, "presence-penalty", 0, "Penalize tokens that already appear at all (-2 to 2)")
 
 	// List/show flags
 	rootCmd.Flags().BoolVar(&opts.ListAgents, "list-agents", false, "List all available agents")
 	rootCmd.Flags().BoolVar(&opts.ListUserAgents, "list-user-agents", false, "List only user agents")
 	rootCmd.Flags().BoolVar(&opts.ListHistory, "list-history", false, "List all saved conversation histories")
 	rootCmd.Flags().BoolVar(&opts.ShowAgent, "show-agent", false, "Show agent details (requires agent name/path as argument)")
+	rootCmd.Flags().BoolVar(&opts.ShowPrompt, "show-prompt", false, "Show agent details along with the fully resolved system prompt")
+	rootCmd.Flags().BoolVar(&opts.ShowConfig, "show-config", false, "Show the resolved global config with secrets redacted")
+	rootCmd.Flags().StringVar(&opts.Bench, "bench", "", "Send the prompt to each of these comma separated models, without tools, and compare the responses")
+	rootCmd.Flags().BoolVar(&opts.CountTokens, "count-tokens", false, "Count the tokens of stdin or --file for the model given with -m")
+	rootCmd.Flags().StringVar(&opts.File, "file", "", "File to read for --count-tokens instead of stdin")
 	rootCmd.Flags().BoolVar(&opts.ShowHistory, "show-history", false, "Show conversation history (requires history index as argument)")
 	rootCmd.Flags().BoolVar(&opts.ShowOutput, "show-output", false, "Show just the output from a history entry (requires history index as argument)")
 	rootCmd.Flags().BoolVar(&opts.ShowStats, "show-stats", false, "Show usage statistics based on conversation history")
+	rootCmd.Flags().StringVar(&opts.ImportHistory, "import-history", "", "Import a conversation from a JSON file (as written by --show-history --output json)")
 	rootCmd.Flags().BoolVar(&opts.ShowAll, "all", false, "Show all items when used with --list-history or --show-stats")
 	rootCmd.Flags().BoolVar(&opts.IgnoreToolCalls, "ignore-tool-calls", false, "Ignore tool calls when displaying history (only show system, user, and agent messages)")
+	rootCmd.Flags().StringVar(&opts.Range, "range", "", "Show only the messages in this range with --show-history, counted from 1 (e.g. 3-6, 3-)")
+	rootCmd.Flags().IntVar(&opts.Last, "last", 0, "Show only the last N messages with --show-history")
+	rootCmd.Flags().IntVar(&opts.TruncateTools, "truncate-tools", defaultTruncateTools, "Shorten tool results longer than this many characters with --show-history, 0 shows them in full (JSON output is never shortened)")
 	rootCmd.Flags().BoolVar(&opts.ServeMode, "serve", false, "Start web server mode")
 	rootCmd.Flags().IntVar(&opts.ServePort, "port", 8080, "Port for the web server (used with --serve)")
+	rootCmd.Flags().StringVar(&opts.ServeHost, "host", "127.0.0.1", "Address for the web server to listen on, e.g. 0.0.0.0 for all interfaces (used with --serve)")
 	rootCmd.Flags().StringVar(&opts.ServeWorkDir, "work-dir", "", "Working directory for the web server (used with --serve)")
+	rootCmd.Flags().StringVar(&opts.AccessToken, "access-token", "", "Require this token for access to the web server, defaults to $ESA_ACCESS_TOKEN (used with --serve)")
+	rootCmd.Flags().StringVar(&opts.ViewToken, "view-token", "", "Token for read-only access to history, agents and stats on the web server, without chat, defaults to $ESA_VIEW_TOKEN (used with --serve and --access-token)")
+	rootCmd.Flags().StringVar(&opts.Note, "note", "", "Add guidance as a system message when continuing a conversation, before the new input")
 	rootCmd.Flags().IntVar(&opts.MaxTurns, "max-turns", 0, "Maximum number of conversation turns (0 = unlimited)")
 
 	// Make history-index required when show-history is used
@@ -240,50 +539,56 @@ func parseAgentCommand(opts *CLIOptions) {
 
 	// Check if this is a user agent that overrides a builtin
 	if strings.HasPrefix(agentPath, "builtin:") && opts.DebugMode {
-		userAgentPath := expandHomePath(fmt.Sprintf("%s/%s.toml", DefaultAgentsDir, agentName))
-		if _, err := os.Stat(userAgentPath); err == nil {
+		userPath := userAgentPath(agentName)
+		if _, err := os.Stat(userPath); err == nil {
 			fmt.Printf("Note: Using user agent '%s' which overrides the built-in agent with the same name\n", agentName)
-			opts.AgentPath = userAgentPath
+			opts.AgentPath = userPath
 		}
 	}
 }
 
-// getUserAgents gets a list of user agents from the default config directory
+// getUserAgents gets a list of user agents from the agent directories,
+// sorted by name. An agent in more than one directory is loaded from
+// the first one, as with userAgentPath.
 func getUserAgents(showErrors bool) ([]Agent, []string, bool) {
-	var agents []Agent
-	var names []string
-
-	// Expand the default config directory
-	agentDir := expandHomePath(DefaultAgentsDir)
+	byName := make(map[string]Agent)
+	userAgentsFound := false
+	dirFound := false
+	seen := make(map[string]bool)
 
-	// Check if the directory exists
-	if _, err := os.Stat(agentDir); os.IsNotExist(err) {
-		if showErrors {
-			color.Red("Agent directory does not exist: %s\n", agentDir)
+	for _, agentDir := range agentDirs() {
+		// Read all agent files in the directory
+		files, err := os.ReadDir(agentDir)
+		if os.IsNotExist(err) {
+			continue
 		}
-		return agents, names, false
-	}
-
-	// Read all .toml files in the directory
-	files, err := os.ReadDir(agentDir)
-	if err != nil {
-		if showErrors {
-			color.Red("Error reading agent directory: %v\n", err)
+		dirFound = true
+		if err != nil {
+			if showErrors {
+				color.Red("Error reading agent directory: %v\n", err)
+			}
+			continue
 		}
-		return agents, names, false
-	}
 
-	userAgentsFound := false
-
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".toml") {
+		for _, file := range files {
+			if file.IsDir() || !isAgentFile(file.Name()) {
+				continue
+			}
 			userAgentsFound = true
-			agentName := strings.TrimSuffix(file.Name(), ".toml")
-			names = append(names, agentName)
+			agentName := agentNameFromPath(file.Name())
 
-			// Load the agent config to get the description
+			// Earlier directories take precedence and files are sorted
+			// by name, so an agent defined in both formats is loaded
+			// from the TOML file like userAgentPath
+			if seen[agentName] {
+				continue
+			}
+			seen[agentName] = true
+
+			// Load the agent config to get the description. The
+			// agents are only listed, so their shell blocks are not run.
 			agentPath := filepath.Join(agentDir, file.Name())
-			agent, err := loadAgent(agentPath)
+			agent, err := loadAgentDefinition(agentPath)
 
 			if err != nil {
 				if showErrors {
@@ -292,14 +597,24 @@ func getUserAgents(showErrors bool) ([]Agent, []string, bool) {
 				continue
 			}
 
-			agents = append(agents, agent)
+			byName[agentName] = agent
 		}
 	}
 
+	if !dirFound && showErrors {
+		color.Red("Agent directory does not exist: %s\n", agentsDir())
+	}
+
+	// Agents from different directories are listed together
+	names := slices.Sorted(maps.Keys(byName))
+	agents := make([]Agent, len(names))
+	for i, name := range names {
+		agents[i] = byName[name]
+	}
 	return agents, names, userAgentsFound
 }
 
-// listUserAgents lists only user agents in the default config directory
+// listUserAgents lists only user agents in the agents directory
 func listUserAgents() {
 	builtinStyle := color.New(color.FgHiMagenta, color.Bold).SprintFunc()
 	fmt.Println(builtinStyle("User Agents:"))
@@ -307,7 +622,7 @@ func listUserAgents() {
 	agents, names, userAgentsFound := getUserAgents(true)
 
 	for i := range agents {
-		printAgentInfo(agents[i], names[i])
+		printAgentInfo(agents[i], names[i], filepath.Dir(userAgentPath(names[i])))
 	}
 
 	if !userAgentsFound {
@@ -315,7 +630,7 @@ func listUserAgents() {
 	}
 }
 
-// listAgents lists all available agents in the default config directory and built-in agents
+// listAgents lists all available agents in the agents directory and built-in agents
 func listAgents() {
 	builtinStyle := color.New(color.FgHiMagenta, color.Bold).SprintFunc()
 	foundAgents := false
@@ -332,7 +647,7 @@ func listAgents() {
 			continue
 		}
 
-		printAgentInfo(agent, name)
+		printAgentInfo(agent, name, "")
 	}
 
 	fmt.Println()
@@ -342,7 +657,7 @@ func listAgents() {
 
 	for i := range agents {
 		foundAgents = true
-		printAgentInfo(agents[i], names[i])
+		printAgentInfo(agents[i], names[i], filepath.Dir(userAgentPath(names[i])))
 	}
 
 	if !userAgentsFound {
@@ -354,6 +669,183 @@ func listAgents() {
 	}
 }
 
+// agentChoice is an agent that can be picked with --pick-agent
+type agentChoice struct {
+	name        string
+	description string
+}
+
+// agentChoices returns the built-in agents followed by the user agents,
+// each sorted by name. User agents with the name of a built-in agent
+// are left out as +name refers to the built-in one.
+func agentChoices() []agentChoice {
+	var choices []agentChoice
+
+	builtinNames := slices.Sorted(maps.Keys(builtinAgents))
+	for _, name := range builtinNames {
+		var agent Agent
+		if _, err := toml.Decode(builtinAgents[name], &agent); err != nil {
+			continue
+		}
+		choices = append(choices, agentChoice{name: name, description: agent.Description})
+	}
+
+	agents, names, _ := getUserAgents(false)
+	for i := range agents {
+		if _, exists := builtinAgents[names[i]]; exists {
+			continue
+		}
+		choices = append(choices, agentChoice{name: names[i], description: agents[i].Description})
+	}
+
+	return choices
+}
+
+// pickAgent asks the user to choose one of the available agents and
+// returns it in +agent form
+func pickAgent() (string, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return "", fmt.Errorf("--pick-agent needs an interactive terminal: %w", err)
+	}
+	defer tty.Close()
+
+	return selectAgent(agentChoices(), tty, os.Stderr)
+}
+
+// selectAgent prints a numbered list of agents to out and reads the
+// number of the chosen one from in
+func selectAgent(choices []agentChoice, in io.Reader, out io.Writer) (string, error) {
+	if len(choices) == 0 {
+		return "", fmt.Errorf("no agents found")
+	}
+
+	nameStyle := color.New(color.FgHiCyan, color.Bold).SprintFunc()
+	for i, choice := range choices {
+		fmt.Fprintf(out, "%3d. %s", i+1, nameStyle("+"+choice.name))
+		if choice.description != "" {
+			fmt.Fprintf(out, " - %s", choice.description)
+		}
+		fmt.Fprintln(out)
+	}
+
+	cyan := color.New(color.FgCyan).SprintFunc()
+	fmt.Fprintf(out, "%s Select an agent (1-%d): ", cyan("[?]"), len(choices))
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("no agent selected")
+	}
+
+	index, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || index < 1 || index > len(choices) {
+		return "", fmt.Errorf("invalid selection %q: must be a number between 1 and %d", strings.TrimSpace(line), len(choices))
+	}
+
+	return "+" + choices[index-1].name, nil
+}
+
+// parseHeaders parses headers given as key=value with --header
+func parseHeaders(values []string) (map[string]string, error) {
+	headers := make(map[string]string, len(values))
+	for _, value := range values {
+		key, val, ok := strings.Cut(value, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid header %q: must be in the form key=value", value)
+		}
+		headers[key] = strings.TrimSpace(val)
+	}
+	return headers, nil
+}
+
+// parseModelAliases parses aliases given as name=provider/model with
+// --model-alias
+func parseModelAliases(values []string) (map[string]ModelAlias, error) {
+	aliases := make(map[string]ModelAlias, len(values))
+	for _, value := range values {
+		name, model, ok := strings.Cut(value, "=")
+		name, model = strings.TrimSpace(name), strings.TrimSpace(model)
+		if !ok || name == "" || model == "" || strings.ContainsAny(name, "/ ") {
+			return nil, fmt.Errorf("invalid model alias %q: must be in the form name=provider/model", value)
+		}
+		aliases[name] = ModelAlias{Model: model}
+	}
+	return aliases, nil
+}
+
+// loadConfigWithAliases loads the config as LoadConfigWithProfile does
+// and adds the aliases given with --model-alias over the configured ones
+func loadConfigWithAliases(opts *CLIOptions) (*Config, error) {
+	config, err := LoadConfigWithProfile(opts.ConfigPath, opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := parseModelAliases(opts.ModelAliases)
+	if err != nil {
+		return nil, err
+	}
+	if len(aliases) == 0 {
+		return config, nil
+	}
+
+	if config.ModelAliases == nil {
+		config.ModelAliases = make(map[string]ModelAlias, len(aliases))
+	}
+	for name, alias := range aliases {
+		config.ModelAliases[name] = alias
+	}
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid --model-alias: %w", err)
+	}
+	return config, nil
+}
+
+// validatePenalty checks that a frequency or presence penalty is within
+// the range accepted by the API
+func validatePenalty(name string, value *float32) error {
+	if value != nil && (*value < -2 || *value > 2) {
+		return fmt.Errorf("invalid %s %v: must be between -2 and 2", name, *value)
+	}
+	return nil
+}
+
+// listHistoryLimit is the number of conversations listed by
+// --list-history unless --all is given
+const listHistoryLimit = 15
+
+// listHistoryJSON prints the conversations listed by --list-history as
+// JSON, in the same shape as the web API
+func listHistoryJSON(showAll bool) error {
+	sortedFiles, _, err := getSortedHistoryFiles()
+	if err != nil {
+		if strings.Contains(err.Error(), "no history files found") {
+			return printJSON([]HistoryInfo{})
+		}
+		return err
+	}
+	if !showAll && len(sortedFiles) > listHistoryLimit {
+		sortedFiles = sortedFiles[:listHistoryLimit]
+	}
+
+	cacheDir, err := setupCacheDir()
+	if err != nil {
+		return err
+	}
+	return printJSON(historyInfos(cacheDir, sortedFiles))
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v any) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
 // listHistory lists available history files in the cache directory
 func listHistory(showAll bool) {
 	sortedFiles, _, err := getSortedHistoryFiles() // Use blank identifier for unused historyItems
@@ -376,14 +868,14 @@ func listHistory(showAll bool) {
 	// Determine how many items to show
 	itemsToShow := sortedFiles
 	if !showAll {
-		if len(sortedFiles) > 15 {
-			itemsToShow = sortedFiles[:15]
+		if len(sortedFiles) > listHistoryLimit {
+			itemsToShow = sortedFiles[:listHistoryLimit]
 		}
 	}
 
 	for i, fileName := range itemsToShow {
 		conversation, agentName, timestampStr := parseHistoryFilename(fileName)
-		if parsedTime, err := time.Parse("20060102-150405", timestampStr); err == nil {
+		if parsedTime, err := time.Parse(historyTimeFormat, timestampStr); err == nil {
 			timestampStr = parsedTime.Format("2006-01-02 15:04:05")
 		}
 
@@ -391,7 +883,7 @@ func listHistory(showAll bool) {
 		cacheDir, _ := setupCacheDir()
 		historyFilePath := filepath.Join(cacheDir, fileName)
 		var query string
-		if historyData, err := os.ReadFile(historyFilePath); err == nil {
+		if historyData, err := readHistoryData(historyFilePath); err == nil {
 			var history ConversationHistory
 			if err := json.Unmarshal(historyData, &history); err == nil {
 				prevMessage := ""
@@ -404,7 +896,7 @@ func listHistory(showAll bool) {
 						break
 					}
 
-					prevMessage = msg.Content
+					prevMessage = messageText(msg)
 				}
 			}
 		}
@@ -425,7 +917,7 @@ func listHistory(showAll bool) {
 }
 
 // handleShowHistory displays the content of a specific history file in the specified format.
-func handleShowHistory(conversation string, outputFormat string, ignoreToolCalls bool) {
+func handleShowHistory(conversation string, outputFormat string, ignoreToolCalls bool, selection messageRange, truncateTools int) {
 	historyFilePath, history, ok := readHistoryFile(conversation)
 	if !ok {
 		return
@@ -434,6 +926,11 @@ func handleShowHistory(conversation string, outputFormat string, ignoreToolCalls
 	if ignoreToolCalls {
 		history = filterToolCalls(history)
 	}
+	history = selection.apply(history)
+	// JSON output keeps the full results as it is also used for export
+	if outputFormat != "json" {
+		history = truncateToolResults(history, truncateTools)
+	}
 
 	switch outputFormat {
 	case "json":
@@ -447,15 +944,119 @@ func handleShowHistory(conversation string, outputFormat string, ignoreToolCalls
 	}
 }
 
+// messageRange selects the messages of a conversation to show, counted
+// from 1 as they are shown. A zero value selects all of them.
+type messageRange struct {
+	start, end int // inclusive, an end of 0 is the last message
+	last       int // the last N messages, in place of start and end
+}
+
+// parseMessageRange parses the --range and --last flags. Ranges are
+// given as 3-6, as 3- for everything from the third message on, or as
+// a single message number.
+func parseMessageRange(value string, last int) (messageRange, error) {
+	if last < 0 {
+		return messageRange{}, fmt.Errorf("invalid --last %d: must be a positive message count", last)
+	}
+	if value == "" {
+		return messageRange{last: last}, nil
+	}
+	if last > 0 {
+		return messageRange{}, fmt.Errorf("--range and --last cannot be used together")
+	}
+
+	invalid := fmt.Errorf("invalid --range %q: must be a message range such as 3-6 or 3-", value)
+	startStr, endStr, isRange := strings.Cut(value, "-")
+	start, err := strconv.Atoi(startStr)
+	if err != nil || start < 1 {
+		return messageRange{}, invalid
+	}
+	if !isRange {
+		return messageRange{start: start, end: start}, nil
+	}
+	if endStr == "" {
+		return messageRange{start: start}, nil
+	}
+	end, err := strconv.Atoi(endStr)
+	if err != nil || end < start {
+		return messageRange{}, invalid
+	}
+	return messageRange{start: start, end: end}, nil
+}
+
+// apply returns the history with only the selected messages, keeping
+// model annotations pointing at the same messages
+func (r messageRange) apply(history ConversationHistory) ConversationHistory {
+	total := len(history.Messages)
+	from, to := 0, total
+	switch {
+	case r.last > 0:
+		from = max(0, total-r.last)
+	case r.start > 0:
+		from = min(r.start-1, total)
+		if r.end > 0 {
+			to = min(r.end, total)
+		}
+	default:
+		return history
+	}
+
+	selected := history
+	selected.Messages = history.Messages[from:to]
+	selected.MessageModels = make(map[int]string)
+	for idx, model := range history.MessageModels {
+		if idx >= from && idx < to {
+			selected.MessageModels[idx-from] = model
+		}
+	}
+	return selected
+}
+
+// defaultTruncateTools is the number of characters of a tool result
+// shown by --show-history unless --truncate-tools is given
+const defaultTruncateTools = 2000
+
+// truncateToolResults shortens tool results longer than limit
+// characters, noting how much was left out. A limit of 0 keeps them.
+func truncateToolResults(history ConversationHistory, limit int) ConversationHistory {
+	if limit <= 0 {
+		return history
+	}
+
+	truncated := history
+	truncated.Messages = slices.Clone(history.Messages)
+	for i, msg := range truncated.Messages {
+		if msg.Role != openai.ChatMessageRoleTool {
+			continue
+		}
+		runes := []rune(msg.Content)
+		if len(runes) <= limit {
+			continue
+		}
+		truncated.Messages[i].Content = fmt.Sprintf("%s\n[... truncated %d characters]", string(runes[:limit]), len(runes)-limit)
+	}
+	return truncated
+}
+
 // filterToolCalls removes tool-related messages from history
 func filterToolCalls(history ConversationHistory) ConversationHistory {
 	filtered := ConversationHistory{
 		AgentPath: history.AgentPath,
 		Model:     history.Model,
 		Messages:  []openai.ChatCompletionMessage{},
+
+		MessageModels: make(map[int]string),
 	}
 
-	for _, msg := range history.Messages {
+	for idx, msg := range history.Messages {
+		// Keep model annotations pointing at the same messages
+		keep := func(m openai.ChatCompletionMessage) {
+			if model, ok := history.MessageModels[idx]; ok {
+				filtered.MessageModels[len(filtered.Messages)] = model
+			}
+			filtered.Messages = append(filtered.Messages, m)
+		}
+
 		// Skip tool messages
 		if msg.Role == openai.ChatMessageRoleTool {
 			continue
@@ -465,12 +1066,12 @@ func filterToolCalls(history ConversationHistory) ConversationHistory {
 			msgCopy := msg
 			msgCopy.ToolCalls = nil
 			if msgCopy.Content != "" {
-				filtered.Messages = append(filtered.Messages, msgCopy)
+				keep(msgCopy)
 			}
 			continue
 		}
 		// Include all other messages (system, user, assistant without tool calls)
-		filtered.Messages = append(filtered.Messages, msg)
+		keep(msg)
 	}
 
 	return filtered
@@ -493,9 +1094,9 @@ func readHistoryFile(conversation string) (string, ConversationHistory, bool) {
 		return "", ConversationHistory{}, false
 	}
 
-	historyData, err := os.ReadFile(historyFilePath)
+	historyData, err := readHistoryData(historyFilePath)
 	if err != nil {
-		printError(fmt.Sprintf("Error reading history file for %s", conversation))
+		printError(fmt.Sprintf("Error reading history file for %s: %v", conversation, err))
 		return "", ConversationHistory{}, false
 	}
 
@@ -521,8 +1122,7 @@ func handleShowOutput(conversation string, pretty bool) {
 
 // handleShowStats analyzes history files and displays usage statistics
 func handleShowStats(showAll bool) {
-	// Get all history files
-	sortedFiles, fileInfo, err := getSortedHistoryFiles()
+	collector, err := collectStats(time.Time{}, time.Time{})
 	if err != nil {
 		if strings.Contains(err.Error(), "no history files found") || strings.Contains(err.Error(), "cache directory does not exist") {
 			color.Yellow(err.Error())
@@ -532,29 +1132,223 @@ func handleShowStats(showAll bool) {
 		return
 	}
 
-	cacheDir, _ := setupCacheDir()
-	collector := NewStatsCollector()
+	for _, skipped := range collector.errors {
+		fmt.Fprintf(os.Stderr, "Warning: skipped history file %s\n", skipped)
+	}
+	collector.PrintStatistics(showAll)
+}
 
-	// Process each history file
-	for _, fileName := range sortedFiles {
-		historyFilePath := filepath.Join(cacheDir, fileName)
-		fileModTime := fileInfo[fileName].ModTime()
+// handleImportHistory copies a conversation from a JSON file into the
+// history directory under a new name so that it can be listed and
+// continued like any other conversation
+func handleImportHistory(path string, configPath string) error {
+	data, err := readHistoryData(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var history ConversationHistory
+	if err := json.Unmarshal(data, &history); err != nil {
+		return fmt.Errorf("invalid conversation file %s: %w", path, err)
+	}
+	if err := validateImportedHistory(history); err != nil {
+		return fmt.Errorf("invalid conversation file %s: %w", path, err)
+	}
+
+	if history.AgentPath != "" && !agentExists(history.AgentPath) {
+		printWarning(fmt.Sprintf("Agent %s does not exist locally, continuing this conversation will need --agent or +agent", history.AgentPath))
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errFailedToLoadConfig, err)
+	}
+	loadEnvFiles(configPath, config)
 
-		if err := collector.ProcessHistoryFile(historyFilePath, fileName, fileModTime); err != nil {
-			color.Red("Error processing history file %s: %v", fileName, err)
+	cacheDir, err := setupCacheDir()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errFailedToSetupCache, err)
+	}
+
+	agentName := agentNameFromPath(history.AgentPath)
+	agentName = strings.TrimPrefix(agentName, "builtin:")
+	historyFile := createNewHistoryFile(cacheDir, agentName, "")
+
+	data, err = json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	if config.Settings.EncryptHistory {
+		if data, err = encryptHistory(data); err != nil {
+			return err
 		}
 	}
+	if err := os.WriteFile(historyFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to save imported conversation: %w", err)
+	}
 
-	collector.PrintStatistics(showAll)
+	printInfo(fmt.Sprintf("Imported conversation as %s (continue it with: esa -C 1)", filepath.Base(historyFile)))
+	return nil
 }
 
-// handleShowAgent displays the details of the agent specified by the agentPath.
-func handleShowAgent(agentPath string) {
-	agent, err := loadAgent(agentPath)
+// validateImportedHistory checks that a conversation read from a file
+// has the structure of one saved by esa
+func validateImportedHistory(history ConversationHistory) error {
+	if len(history.Messages) == 0 {
+		return fmt.Errorf("conversation has no messages")
+	}
+
+	validRoles := map[string]bool{
+		openai.ChatMessageRoleSystem:    true,
+		openai.ChatMessageRoleUser:      true,
+		openai.ChatMessageRoleAssistant: true,
+		openai.ChatMessageRoleTool:      true,
+	}
+	for i, msg := range history.Messages {
+		if !validRoles[msg.Role] {
+			return fmt.Errorf("message %d has invalid role %q", i+1, msg.Role)
+		}
+	}
+
+	return nil
+}
+
+// agentExists reports whether the agent at agentPath is available
+func agentExists(agentPath string) bool {
+	if name, ok := strings.CutPrefix(agentPath, "builtin:"); ok {
+		_, exists := builtinAgents[name]
+		return exists
+	}
+	_, err := os.Stat(expandHomePath(agentPath))
+	return err == nil
+}
+
+// handleShowConfig prints the global config after the defaults, the
+// config file and the profile have been applied, with secrets redacted
+func handleShowConfig(configPath, profile, outputFormat string) error {
+	config, err := LoadConfigWithProfile(configPath, profile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errFailedToLoadConfig, err)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(resolvedConfig(config)); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	if outputFormat == "json" {
+		// Going through TOML keeps the keys the same as in the config file
+		var data map[string]any
+		if _, err := toml.Decode(buf.String(), &data); err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		out, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+	fmt.Printf("# Config: %s\n", configPath)
+	if profile != "" {
+		fmt.Printf("# Profile: %s\n", profile)
+	}
+	fmt.Println()
+	fmt.Print(buf.String())
+	return nil
+}
+
+// TokenCount is the output of --count-tokens
+type TokenCount struct {
+	Model         string `json:"model"`
+	Tokens        int    `json:"tokens"`
+	ContextWindow int    `json:"context_window,omitempty"`
+	Estimated     bool   `json:"estimated"` // no tokenizer is known for the model
+}
+
+// countInputTokens counts the tokens of text for the model, given as
+// provider/model
+func countInputTokens(text, modelStr string) TokenCount {
+	window, _ := lookupContextWindow(modelStr)
+	return TokenCount{
+		Model:         modelStr,
+		Tokens:        tokenCounter(modelStr)(text),
+		ContextWindow: window,
+		Estimated:     tokenizerFor(modelStr) == nil,
+	}
+}
+
+// handleCountTokens prints the number of tokens in stdin or the file
+// given with --file for the model in use
+func handleCountTokens(opts *CLIOptions) error {
+	config, err := loadConfigWithAliases(opts)
+	if err != nil {
+		return fmt.Errorf("%s: %w", errFailedToLoadConfig, err)
+	}
+
+	var text string
+	if opts.File != "" {
+		data, err := os.ReadFile(expandHomePath(opts.File))
+		if err != nil {
+			return wrapFileError("read", opts.File, err)
+		}
+		text = string(data)
+	} else {
+		stat, err := os.Stdin.Stat()
+		if err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("--count-tokens needs input: pipe it to esa or use --file")
+		}
+		text = readStdin()
+	}
+
+	count := countInputTokens(text, resolveModelString(opts.Model, Agent{}, config))
+	if opts.OutputFormat == "json" {
+		out, err := json.MarshalIndent(count, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode token count: %w", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	fmt.Println(count.Tokens)
+	return nil
+}
+
+// handleShowAgent displays the details of the agent specified by the
+// agentPath. agentName is empty for agents given as a path.
+func handleShowAgent(agentName, agentPath string, showPrompt bool, outputFormat string) {
+	// Builtin agents are resolved by name rather than loaded from disk
+	builtinName := ""
+	if strings.HasPrefix(agentPath, "builtin:") {
+		builtinName = strings.TrimPrefix(agentPath, "builtin:")
+	}
+
+	agent, err := loadConfiguration(&CLIOptions{AgentName: builtinName, AgentPath: agentPath})
 	if err != nil {
 		printError(fmt.Sprintf("Error loading agent: %v", err))
 		return
 	}
+	warnUndefinedPlaceholders(agent)
+
+	// Emit the tool definitions exactly as they are sent to the model
+	if outputFormat == "json" {
+		tools := convertFunctionsToTools(agent.Functions)
+		if tools == nil {
+			tools = []openai.Tool{}
+		}
+		data, err := json.MarshalIndent(tools, "", "  ")
+		if err != nil {
+			printError(fmt.Sprintf("Error encoding tools: %v", err))
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
 
 	labelStyle := color.New(color.FgHiCyan, color.Bold).SprintFunc()
 
@@ -570,6 +1364,19 @@ func handleShowAgent(agentPath string) {
 	}
 	fmt.Println()
 
+	if len(agent.Examples) > 0 {
+		// Agents loaded from a path can't be selected with +name
+		invocation := "esa --agent " + agentPath
+		if agentName != "" {
+			invocation = "esa +" + agentName
+		}
+		fmt.Printf("%s\n", labelStyle("Examples:"))
+		for _, example := range agent.Examples {
+			fmt.Printf("  %s %s\n", invocation, example)
+		}
+		fmt.Println()
+	}
+
 	// Print available functions
 	if len(agent.Functions) > 0 {
 		fmt.Printf("%s\n", labelStyle("Functions:"))
@@ -582,4 +1389,27 @@ func handleShowAgent(agentPath string) {
 		noFuncStyle := color.New(color.FgYellow, color.Italic).SprintFunc()
 		fmt.Printf("%s\n", noFuncStyle("No functions available."))
 	}
+
+	if showPrompt {
+		prompt := agent.SystemPrompt
+		if prompt == "" {
+			prompt = systemPrompt
+		}
+
+		prompt, err := expandVariables(prompt, agent.Variables)
+		if err != nil {
+			printError(fmt.Sprintf("Error resolving system prompt: %v", err))
+			return
+		}
+
+		resolved, err := resolvePromptForDisplay(prompt)
+		if err != nil {
+			printError(fmt.Sprintf("Error resolving system prompt: %v", err))
+			return
+		}
+
+		fmt.Println()
+		fmt.Printf("%s\n", labelStyle("System Prompt:"))
+		fmt.Println(agent.promptWithExamples(resolved))
+	}
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestValidateImportedHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		history ConversationHistory
+		wantErr bool
+	}{
+		{
+			name: "valid conversation",
+			history: ConversationHistory{Messages: []openai.ChatCompletionMessage{
+				{Role: "system", Content: "system"},
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "hello"},
+			}},
+			wantErr: false,
+		},
+		{
+			name:    "no messages",
+			history: ConversationHistory{AgentPath: "builtin:default"},
+			wantErr: true,
+		},
+		{
+			name: "invalid role",
+			history: ConversationHistory{Messages: []openai.ChatCompletionMessage{
+				{Role: "robot", Content: "beep"},
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateImportedHistory(tt.history)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateImportedHistory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAgentExists(t *testing.T) {
+	tests := []struct {
+		name      string
+		agentPath string
+		want      bool
+	}{
+		{name: "builtin agent", agentPath: "builtin:default", want: true},
+		{name: "unknown builtin agent", agentPath: "builtin:nope", want: false},
+		{name: "missing agent file", agentPath: t.TempDir() + "/missing.toml", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := agentExists(tt.agentPath); got != tt.want {
+				t.Errorf("agentExists(%q) = %v, want %v", tt.agentPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectAgent(t *testing.T) {
+	choices := []agentChoice{
+		{name: "auto", description: "Automatic agent"},
+		{name: "coder", description: "Coding agent"},
+		{name: "custom"},
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "first agent", input: "1\n", want: "+auto"},
+		{name: "last agent without newline", input: "3", want: "+custom"},
+		{name: "surrounding whitespace", input: "  2 \n", want: "+coder"},
+		{name: "out of range", input: "4\n", wantErr: true},
+		{name: "zero", input: "0\n", wantErr: true},
+		{name: "not a number", input: "coder\n", wantErr: true},
+		{name: "no input", input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			got, err := selectAgent(choices, strings.NewReader(tt.input), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectAgent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("selectAgent() = %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(out.String(), "Coding agent") {
+				t.Errorf("selectAgent() output = %q, want it to list agent descriptions", out.String())
+			}
+		})
+	}
+
+	if _, err := selectAgent(nil, strings.NewReader("1\n"), io.Discard); err == nil {
+		t.Error("selectAgent() with no agents should fail")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      []string
+		wantHeaders map[string]string
+		wantError   bool
+	}{
+		{name: "no headers", values: nil, wantHeaders: map[string]string{}},
+		{
+			name:        "multiple headers",
+			values:      []string{"OpenAI-Organization=org-123", "anthropic-beta = tools-2024"},
+			wantHeaders: map[string]string{"OpenAI-Organization": "org-123", "anthropic-beta": "tools-2024"},
+		},
+		{name: "value containing equals", values: []string{"X-Route=a=b"}, wantHeaders: map[string]string{"X-Route": "a=b"}},
+		{name: "empty value", values: []string{"X-Empty="}, wantHeaders: map[string]string{"X-Empty": ""}},
+		{name: "missing equals", values: []string{"X-Org"}, wantError: true},
+		{name: "missing key", values: []string{"=value"}, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHeaders(tt.values)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("parseHeaders() error = %v, wantError %v", err, tt.wantError)
+			}
+			if !tt.wantError && !maps.Equal(got, tt.wantHeaders) {
+				t.Errorf("parseHeaders() = %v, want %v", got, tt.wantHeaders)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithAliases(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	config := `
+[model_aliases]
+fast = "openai/gpt-4o-mini"
+smart = { model = "openai/gpt-4o", temperature = 0.2 }
+`
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		aliases     []string
+		wantAliases map[string]string
+		wantError   bool
+	}{
+		{
+			name:        "no aliases",
+			wantAliases: map[string]string{"fast": "openai/gpt-4o-mini", "smart": "openai/gpt-4o"},
+		},
+		{
+			name:        "new and replaced aliases",
+			aliases:     []string{"fast=groq/llama3-70b-8192", "local = ollama/qwen3:8b"},
+			wantAliases: map[string]string{"fast": "groq/llama3-70b-8192", "smart": "openai/gpt-4o", "local": "ollama/qwen3:8b"},
+		},
+		{name: "missing model", aliases: []string{"fast="}, wantError: true},
+		{name: "name with a slash", aliases: []string{"openai/fast=openai/gpt-4o"}, wantError: true},
+		{name: "circular", aliases: []string{"a=b", "b=a"}, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadConfigWithAliases(&CLIOptions{ConfigPath: configPath, ModelAliases: tt.aliases})
+			if (err != nil) != tt.wantError {
+				t.Fatalf("loadConfigWithAliases() error = %v, wantError %v", err, tt.wantError)
+			}
+			if tt.wantError {
+				return
+			}
+			models := make(map[string]string, len(got.ModelAliases))
+			for name, alias := range got.ModelAliases {
+				models[name] = alias.Model
+			}
+			if !maps.Equal(models, tt.wantAliases) {
+				t.Errorf("model aliases = %v, want %v", models, tt.wantAliases)
+			}
+		})
+	}
+}
+
+func TestCountInputTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		model string
+		want  TokenCount
+	}{
+		{
+			name:  "tokenizer",
+			text:  "tiktoken is great!",
+			model: "openai/gpt-4o",
+			want:  TokenCount{Model: "openai/gpt-4o", Tokens: 6, ContextWindow: 128000},
+		},
+		{
+			name:  "estimate",
+			text:  "tiktoken is great!",
+			model: "anthropic/claude-sonnet-4",
+			want:  TokenCount{Model: "anthropic/claude-sonnet-4", Tokens: 5, ContextWindow: 200000, Estimated: true},
+		},
+		{
+			name:  "unknown context window",
+			text:  "",
+			model: "ollama/llama3",
+			want:  TokenCount{Model: "ollama/llama3", Estimated: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countInputTokens(tt.text, tt.model); got != tt.want {
+				t.Errorf("countInputTokens() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMessageRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		last    int
+		want    messageRange
+		wantErr bool
+	}{
+		{name: "none", want: messageRange{}},
+		{name: "range", value: "3-6", want: messageRange{start: 3, end: 6}},
+		{name: "open range", value: "3-", want: messageRange{start: 3}},
+		{name: "single message", value: "4", want: messageRange{start: 4, end: 4}},
+		{name: "last", last: 2, want: messageRange{last: 2}},
+		{name: "reversed", value: "6-3", wantErr: true},
+		{name: "zero", value: "0-3", wantErr: true},
+		{name: "not a number", value: "a-b", wantErr: true},
+		{name: "negative last", last: -1, wantErr: true},
+		{name: "range and last", value: "1-2", last: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMessageRange(tt.value, tt.last)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMessageRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseMessageRange() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageRangeApply(t *testing.T) {
+	history := ConversationHistory{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "1"},
+			{Role: openai.ChatMessageRoleUser, Content: "2"},
+			{Role: openai.ChatMessageRoleAssistant, Content: "3"},
+			{Role: openai.ChatMessageRoleUser, Content: "4"},
+			{Role: openai.ChatMessageRoleAssistant, Content: "5"},
+		},
+		MessageModels: map[int]string{2: "openai/gpt-4o", 4: "anthropic/claude-sonnet-4-5"},
+	}
+
+	tests := []struct {
+		name       string
+		selection  messageRange
+		wantMsgs   string
+		wantModels map[int]string
+	}{
+		{name: "all", selection: messageRange{}, wantMsgs: "12345", wantModels: history.MessageModels},
+		{name: "range", selection: messageRange{start: 2, end: 3}, wantMsgs: "23", wantModels: map[int]string{1: "openai/gpt-4o"}},
+		{name: "open range", selection: messageRange{start: 4}, wantMsgs: "45", wantModels: map[int]string{1: "anthropic/claude-sonnet-4-5"}},
+		{name: "past the end", selection: messageRange{start: 4, end: 10}, wantMsgs: "45", wantModels: map[int]string{1: "anthropic/claude-sonnet-4-5"}},
+		{name: "last", selection: messageRange{last: 3}, wantMsgs: "345", wantModels: map[int]string{0: "openai/gpt-4o", 2: "anthropic/claude-sonnet-4-5"}},
+		{name: "more than all", selection: messageRange{last: 10}, wantMsgs: "12345", wantModels: history.MessageModels},
+		{name: "start past the end", selection: messageRange{start: 9}, wantMsgs: "", wantModels: map[int]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.selection.apply(history)
+			var msgs strings.Builder
+			for _, msg := range got.Messages {
+				msgs.WriteString(msg.Content)
+			}
+			if msgs.String() != tt.wantMsgs {
+				t.Errorf("messages = %q, want %q", msgs.String(), tt.wantMsgs)
+			}
+			if !maps.Equal(got.MessageModels, tt.wantModels) {
+				t.Errorf("message models = %v, want %v", got.MessageModels, tt.wantModels)
+			}
+		})
+	}
+}
+
+func TestTruncateToolResults(t *testing.T) {
+	history := ConversationHistory{
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("u", 20)},
+			{Role: openai.ChatMessageRoleTool, Content: "short"},
+			{Role: openai.ChatMessageRoleTool, Content: strings.Repeat("é", 15)},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "long results are shortened",
+			limit: 10,
+			want:  []string{strings.Repeat("u", 20), "short", strings.Repeat("é", 10) + "\n[... truncated 5 characters]"},
+		},
+		{
+			name:  "zero shows everything",
+			limit: 0,
+			want:  []string{strings.Repeat("u", 20), "short", strings.Repeat("é", 15)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateToolResults(history, tt.limit)
+			for i, msg := range got.Messages {
+				if msg.Content != tt.want[i] {
+					t.Errorf("message %d = %q, want %q", i, msg.Content, tt.want[i])
+				}
+			}
+		})
+	}
+
+	if history.Messages[2].Content != strings.Repeat("é", 15) {
+		t.Error("truncateToolResults() modified the original history")
+	}
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	mathrand "math/rand/v2"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sashabaranov/go-openai"
@@ -14,50 +24,230 @@ import (
 // setupLLMClient creates the appropriate LLMClient for the given model/provider.
 // For the "anthropic" provider it returns a native Anthropic client;
 // for all other providers it returns an OpenAI-compatible client.
-func setupLLMClient(modelStr string, agent Agent, config *Config) (LLMClient, error) {
-	provider, _, info := parseModel(modelStr, agent, config)
+// Headers are added to every request, over the ones of the provider.
+func setupLLMClient(modelStr string, agent Agent, config *Config, headers map[string]string) (LLMClient, error) {
+	provider, model, info := parseModel(modelStr, agent, config)
+	info.additionalHeaders = mergeHeaders(info.additionalHeaders, headers)
 
 	configuredAPIKey := os.Getenv(info.apiKeyEnvar)
 	// Key name can be empty if we don't need any keys
 	if info.apiKeyEnvar != "" && configuredAPIKey == "" && !info.apiKeyCanBeEmpty {
-		return nil, fmt.Errorf(info.apiKeyEnvar + " env not found")
-	}
-
-	if provider == "anthropic" {
-		var httpClient *http.Client
-		if len(info.additionalHeaders) != 0 {
-			httpClient = &http.Client{
-				Transport: &transportWithCustomHeaders{
-					headers: info.additionalHeaders,
-					base:    http.DefaultTransport,
-				},
-			}
-		}
-		return newAnthropicLLMClient(configuredAPIKey, info.baseURL, httpClient), nil
+		return nil, missingAPIKeyError(provider, model, info.apiKeyEnvar)
 	}
 
-	// Default: OpenAI-compatible provider
-	return setupOpenAIClient(configuredAPIKey, info)
+	// Clients are cached per provider configuration so that long running
+	// processes such as the web server reuse pooled connections
+	key := clientCacheKey(provider, configuredAPIKey, info)
+	return llmClients.getOrCreate(key, func() LLMClient {
+		httpClient := newHTTPClient(info.additionalHeaders, info.options)
+		if provider == "anthropic" {
+			return newAnthropicLLMClient(configuredAPIKey, info.baseURL, httpClient)
+		}
+
+		// Default: OpenAI-compatible provider
+		return setupOpenAIClient(configuredAPIKey, info, httpClient)
+	}), nil
+}
+
+// missingAPIKeyError builds an actionable error for a provider whose
+// API key environment variable is not set
+func missingAPIKeyError(provider, model, apiKeyEnvar string) error {
+	return fmt.Errorf(
+		"no API key found for provider %q (model %q): set the %s environment variable "+
+			"or add it to a .env file; local Ollama models do not need a key, "+
+			"use the ollama/ prefix for them (e.g. ollama/llama3.2)",
+		provider, model, apiKeyEnvar,
+	)
 }
 
-func setupOpenAIClient(apiKey string, info providerInfo) (LLMClient, error) {
+func setupOpenAIClient(apiKey string, info providerInfo, httpClient *http.Client) LLMClient {
 	llmConfig := openai.DefaultConfig(apiKey)
 	llmConfig.BaseURL = info.baseURL
+	llmConfig.HTTPClient = httpClient
+
+	client := openai.NewClientWithConfig(llmConfig)
+
+	return newOpenAILLMClient(client, info.streamUsage)
+}
+
+// mergeHeaders returns base with the headers in extra set over it.
+// Header names are compared case-insensitively, as in HTTP.
+func mergeHeaders(base, extra map[string]string) map[string]string {
+	if len(extra) == 0 {
+		return base
+	}
+
+	merged := make(map[string]string, len(base)+len(extra))
+	for key, value := range base {
+		merged[http.CanonicalHeaderKey(key)] = value
+	}
+	for key, value := range extra {
+		merged[http.CanonicalHeaderKey(key)] = value
+	}
+	return merged
+}
+
+// sharedTransport is used by all LLM clients. It keeps idle connections
+// to providers alive so that subsequent requests skip the TCP and TLS
+// handshakes.
+var sharedTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	MaxIdleConnsPerHost:   10,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// mergeOptions returns base with the options in extra set over it.
+// Tables set in both are merged so that e.g. an agent can change one
+// of the ollama options without repeating the others.
+func mergeOptions(base, extra map[string]any) map[string]any {
+	if len(extra) == 0 {
+		return base
+	}
 
-	if len(info.additionalHeaders) != 0 {
-		httpClient := &http.Client{
-			Transport: &transportWithCustomHeaders{
-				headers: info.additionalHeaders,
-				base:    http.DefaultTransport,
-			},
+	merged := make(map[string]any, len(base)+len(extra))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		baseTable, baseOK := merged[key].(map[string]any)
+		extraTable, extraOK := value.(map[string]any)
+		if baseOK && extraOK {
+			value = mergeOptions(baseTable, extraTable)
 		}
+		merged[key] = value
+	}
+	return merged
+}
 
-		llmConfig.HTTPClient = httpClient
+// newHTTPClient returns an HTTP client using the shared transport that
+// adds the given headers to every request and the given options to the
+// body of every JSON request
+func newHTTPClient(headers map[string]string, options map[string]any) *http.Client {
+	var base http.RoundTripper = &requestDumpTransport{base: sharedTransport}
+	if len(options) > 0 {
+		base = &transportWithBodyOptions{options: options, base: base}
+	}
+	if len(headers) > 0 {
+		base = &transportWithCustomHeaders{headers: headers, base: base}
 	}
+	return &http.Client{Transport: base}
+}
 
-	client := openai.NewClientWithConfig(llmConfig)
+// requestDumpWriter receives the requests sent to providers, as asked
+// for with --dump-request. Requests are not dumped when it is nil.
+var requestDumpWriter io.Writer
+
+// requestDumpTransport writes out requests before sending them on
+type requestDumpTransport struct {
+	base http.RoundTripper
+}
+
+func (t *requestDumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if requestDumpWriter == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	dumpRequest(requestDumpWriter, req, body)
+
+	return t.base.RoundTrip(req)
+}
+
+// dumpRequest writes the method, URL, headers and body of a request,
+// with secrets redacted. JSON bodies are indented.
+func dumpRequest(w io.Writer, req *http.Request, body []byte) {
+	// Some providers take the API key as a query parameter
+	u := *req.URL
+	query := u.Query()
+	for name := range query {
+		if isSecretHeader(name) {
+			query.Set(name, redactedValue)
+		}
+	}
+	u.RawQuery = query.Encode()
+	fmt.Fprintf(w, "--- Request: %s %s\n", req.Method, u.Redacted())
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(req.Header.Values(name), ", ")
+		if isSecretHeader(name) {
+			value = redactedValue
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, value)
+	}
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, body, "", "  ") == nil {
+		body = indented.Bytes()
+	}
+	fmt.Fprintf(w, "\n%s\n\n", body)
+}
+
+// llmClientCache holds LLM clients keyed by their provider configuration
+type llmClientCache struct {
+	mu      sync.Mutex
+	clients map[string]LLMClient
+}
+
+var llmClients = &llmClientCache{clients: make(map[string]LLMClient)}
+
+// getOrCreate returns the client cached under key, calling create to
+// build it if there is none yet
+func (c *llmClientCache) getOrCreate(key string, create func() LLMClient) LLMClient {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if client, ok := c.clients[key]; ok {
+		return client
+	}
+	client := create()
+	c.clients[key] = client
+	return client
+}
+
+// clientCacheKey identifies a provider configuration. The API key is
+// hashed so that it is not kept around as part of the key.
+func clientCacheKey(provider, apiKey string, info providerInfo) string {
+	sum := sha256.Sum256([]byte(apiKey))
+
+	headers := make([]string, 0, len(info.additionalHeaders))
+	for name, value := range info.additionalHeaders {
+		headers = append(headers, name+"="+value)
+	}
+	sort.Strings(headers)
+
+	// Map keys are sorted when encoding
+	options, _ := json.Marshal(info.options)
 
-	return newOpenAILLMClient(client), nil
+	return strings.Join([]string{
+		provider,
+		info.baseURL,
+		hex.EncodeToString(sum[:]),
+		strings.Join(headers, "\n"),
+		string(options),
+		strconv.FormatBool(info.streamUsage),
+	}, "\x00")
 }
 
 type transportWithCustomHeaders struct {
@@ -72,6 +262,51 @@ func (t *transportWithCustomHeaders) RoundTrip(req *http.Request) (*http.Respons
 	return t.base.RoundTrip(req)
 }
 
+// transportWithBodyOptions sets provider specific fields in the JSON
+// body of requests, over the ones set by esa
+type transportWithBodyOptions struct {
+	options map[string]any
+	base    http.RoundTripper
+}
+
+func (t *transportWithBodyOptions) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = withBodyOptions(body, t.options)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// withBodyOptions returns the JSON object body with options set in it.
+// Bodies that are not JSON objects are returned as they are.
+func withBodyOptions(body []byte, options map[string]any) []byte {
+	// Numbers are kept as they are written rather than as float64
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var fields map[string]any
+	if decoder.Decode(&fields) != nil || fields == nil {
+		return body
+	}
+
+	updated, err := json.Marshal(mergeOptions(fields, options))
+	if err != nil {
+		return body
+	}
+	return updated
+}
+
 // calculateRetryDelay calculates exponential backoff delay with jitter
 func calculateRetryDelay(attempt int) time.Duration {
 	// Exponential backoff: baseDelay * 2^attempt
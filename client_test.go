@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/sashabaranov/go-openai"
 )
 
 func TestCalculateRetryDelay_Jitter(t *testing.T) {
@@ -43,3 +50,321 @@ func TestCalculateRetryDelay_Cap(t *testing.T) {
 		t.Errorf("delay %v exceeds max expected %v for high attempt", d, maxExpected)
 	}
 }
+
+func TestSetupLLMClientCache(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "test-key")
+	config := &Config{
+		Providers: map[string]ProviderConfig{
+			"custom": {BaseURL: "https://custom.example.com/v1", APIKeyEnvar: "OPENAI_API_KEY"},
+		},
+	}
+
+	first, err := setupLLMClient("openai/gpt-4o", Agent{}, config, nil)
+	if err != nil {
+		t.Fatalf("setupLLMClient() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		modelStr string
+		apiKey   string
+		wantSame bool
+	}{
+		{name: "same provider with another model", modelStr: "openai/gpt-4o-mini", apiKey: "test-key", wantSame: true},
+		{name: "different provider", modelStr: "custom/gpt-4o", apiKey: "test-key", wantSame: false},
+		{name: "different api key", modelStr: "openai/gpt-4o", apiKey: "other-key", wantSame: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_API_KEY", tt.apiKey)
+			client, err := setupLLMClient(tt.modelStr, Agent{}, config, nil)
+			if err != nil {
+				t.Fatalf("setupLLMClient() error = %v", err)
+			}
+			if got := client == first; got != tt.wantSame {
+				t.Errorf("client reused = %v, want %v", got, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestSetupLLMClientHeaders(t *testing.T) {
+	gotHeaders := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeaders <- r.Header.Clone()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	t.Setenv("HEADERS_TEST_API_KEY", "test-key")
+	config := &Config{
+		Providers: map[string]ProviderConfig{
+			"custom": {
+				BaseURL:           server.URL,
+				APIKeyEnvar:       "HEADERS_TEST_API_KEY",
+				AdditionalHeaders: map[string]string{"x-org": "from-config", "X-Keep": "kept"},
+			},
+		},
+	}
+
+	client, err := setupLLMClient("custom/model", Agent{}, config, map[string]string{"X-Org": "from-cli", "X-Beta": "on"})
+	if err != nil {
+		t.Fatalf("setupLLMClient() error = %v", err)
+	}
+	stream, err := client.CreateChatCompletionStream("model", nil, nil, RequestOptions{})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v", err)
+	}
+	stream.Close()
+
+	headers := <-gotHeaders
+	tests := []struct {
+		name      string
+		header    string
+		wantValue string
+	}{
+		{name: "cli header overrides config", header: "X-Org", wantValue: "from-cli"},
+		{name: "config header is kept", header: "X-Keep", wantValue: "kept"},
+		{name: "cli only header", header: "X-Beta", wantValue: "on"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := headers.Values(tt.header); len(got) != 1 || got[0] != tt.wantValue {
+				t.Errorf("header %s = %q, want %q", tt.header, got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestSetupLLMClientProviderOptions(t *testing.T) {
+	gotBody := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		gotBody <- string(data)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	t.Setenv("PROVIDER_OPTIONS_TEST_API_KEY", "test-key")
+	config := &Config{
+		Providers: map[string]ProviderConfig{
+			"custom": {BaseURL: server.URL, APIKeyEnvar: "PROVIDER_OPTIONS_TEST_API_KEY"},
+		},
+		ProviderOptions: map[string]map[string]any{
+			"custom": {
+				"keep_alive": "30m",
+				"options":    map[string]any{"num_ctx": int64(8192), "num_gpu": int64(1)},
+			},
+			"other": {"ignored": true},
+		},
+	}
+	agent := Agent{
+		ExtraBody: map[string]any{
+			"keep_alive": "5m",
+			"transforms": []any{"middle-out"},
+			"options":    map[string]any{"num_ctx": int64(16384)},
+		},
+		ProviderOptions: map[string]map[string]any{
+			"custom": {"options": map[string]any{"num_ctx": int64(32768)}},
+		},
+	}
+
+	client, err := setupLLMClient("custom/model", agent, config, nil)
+	if err != nil {
+		t.Fatalf("setupLLMClient() error = %v", err)
+	}
+	stream, err := client.CreateChatCompletionStream("model", nil, nil, RequestOptions{})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v", err)
+	}
+	stream.Close()
+
+	body := <-gotBody
+	for _, want := range []string{
+		`"keep_alive":"5m"`,
+		`"transforms":["middle-out"]`,
+		`"options":{"num_ctx":32768,"num_gpu":1}`,
+		`"model":"model"`,
+		`"stream":true`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body = %s, want it to contain %s", body, want)
+		}
+	}
+	if strings.Contains(body, "ignored") {
+		t.Errorf("body = %s, want no options of other providers", body)
+	}
+}
+
+func TestSetupLLMClientStreamUsage(t *testing.T) {
+	gotBody := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		gotBody <- string(data)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	t.Setenv("STREAM_USAGE_TEST_API_KEY", "test-key")
+	enabled, disabled := true, false
+
+	tests := []struct {
+		name        string
+		provider    string
+		streamUsage *bool
+		want        bool
+	}{
+		{name: "known provider", provider: "openai", want: true},
+		{name: "known provider turned off", provider: "groq", streamUsage: &disabled, want: false},
+		{name: "custom provider", provider: "custom", want: false},
+		{name: "custom provider turned on", provider: "custom", streamUsage: &enabled, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				Providers: map[string]ProviderConfig{
+					tt.provider: {
+						BaseURL:     server.URL,
+						APIKeyEnvar: "STREAM_USAGE_TEST_API_KEY",
+						StreamUsage: tt.streamUsage,
+					},
+				},
+			}
+			client, err := setupLLMClient(tt.provider+"/model", Agent{}, config, nil)
+			if err != nil {
+				t.Fatalf("setupLLMClient() error = %v", err)
+			}
+			stream, err := client.CreateChatCompletionStream("model", nil, nil, RequestOptions{})
+			if err != nil {
+				t.Fatalf("CreateChatCompletionStream() error = %v", err)
+			}
+			stream.Close()
+
+			body := <-gotBody
+			if got := strings.Contains(body, `"stream_options":{"include_usage":true}`); got != tt.want {
+				t.Errorf("body = %s, want stream_options sent = %v", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIRequestOptions(t *testing.T) {
+	zero := float32(0)
+	half := float32(0.5)
+
+	tests := []struct {
+		name       string
+		opts       RequestOptions
+		wantFields map[string]bool // field name to whether it is sent
+	}{
+		{
+			name:       "unset",
+			opts:       RequestOptions{},
+			wantFields: map[string]bool{"frequency_penalty": false, "presence_penalty": false, "temperature": false},
+		},
+		{
+			name:       "explicit zero is sent",
+			opts:       RequestOptions{FrequencyPenalty: &zero, Temperature: &zero},
+			wantFields: map[string]bool{"frequency_penalty": true, "presence_penalty": false, "temperature": true},
+		},
+		{
+			name:       "penalties",
+			opts:       RequestOptions{FrequencyPenalty: &half, PresencePenalty: &half},
+			wantFields: map[string]bool{"frequency_penalty": true, "presence_penalty": true, "temperature": false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotBody := make(chan map[string]any, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body map[string]any
+				data, _ := io.ReadAll(r.Body)
+				json.Unmarshal(data, &body)
+				gotBody <- body
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.Write([]byte("data: [DONE]\n\n"))
+			}))
+			defer server.Close()
+
+			t.Setenv("OPTIONS_TEST_API_KEY", "test-key")
+			config := &Config{
+				Providers: map[string]ProviderConfig{
+					"custom": {BaseURL: server.URL, APIKeyEnvar: "OPTIONS_TEST_API_KEY"},
+				},
+			}
+			client, err := setupLLMClient("custom/model", Agent{}, config, nil)
+			if err != nil {
+				t.Fatalf("setupLLMClient() error = %v", err)
+			}
+			stream, err := client.CreateChatCompletionStream("model", nil, nil, tt.opts)
+			if err != nil {
+				t.Fatalf("CreateChatCompletionStream() error = %v", err)
+			}
+			stream.Close()
+
+			body := <-gotBody
+			for field, want := range tt.wantFields {
+				if _, got := body[field]; got != want {
+					t.Errorf("%s sent = %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestDump(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"model":"gpt-4o"`) {
+			t.Errorf("request body = %s, want it to reach the provider intact", body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	var dump strings.Builder
+	requestDumpWriter = &dump
+	defer func() { requestDumpWriter = nil }()
+
+	t.Setenv("DUMP_TEST_API_KEY", "sk-secret")
+	config := &Config{
+		Providers: map[string]ProviderConfig{
+			"custom": {BaseURL: server.URL, APIKeyEnvar: "DUMP_TEST_API_KEY"},
+		},
+	}
+	client, err := setupLLMClient("custom/gpt-4o", Agent{}, config, nil)
+	if err != nil {
+		t.Fatalf("setupLLMClient() error = %v", err)
+	}
+	messages := []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hello"}}
+	stream, err := client.CreateChatCompletionStream("gpt-4o", messages, nil, RequestOptions{})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v", err)
+	}
+	stream.Close()
+
+	got := dump.String()
+	for _, want := range []string{"--- Request: POST", "Authorization: [redacted]", `"model": "gpt-4o"`, `"content": "hello"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dump = %q, want to contain %q", got, want)
+		}
+	}
+	if strings.Contains(got, "sk-secret") {
+		t.Errorf("dump = %q, want the API key redacted", got)
+	}
+
+	dump.Reset()
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/v1/models?key=query-secret&alt=sse", nil)
+	dumpRequest(&dump, req, nil)
+	if got := dump.String(); strings.Contains(got, "query-secret") || !strings.Contains(got, "alt=sse") {
+		t.Errorf("dump = %q, want only the key parameter redacted", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// ColorSettings holds the names of the colors used for parts of the
+// output. Empty or unknown names keep the default color.
+type ColorSettings struct {
+	Command   string `toml:"command"`   // commands run for tool calls
+	Output    string `toml:"output"`    // output of tool calls
+	Progress  string `toml:"progress"`  // progress spinner
+	User      string `toml:"user"`      // user messages
+	Assistant string `toml:"assistant"` // assistant messages
+	Error     string `toml:"error"`     // errors
+}
+
+// colorNames maps the names accepted in ColorSettings to colors
+var colorNames = map[string]color.Attribute{
+	"black":          color.FgBlack,
+	"red":            color.FgRed,
+	"green":          color.FgGreen,
+	"yellow":         color.FgYellow,
+	"blue":           color.FgBlue,
+	"magenta":        color.FgMagenta,
+	"cyan":           color.FgCyan,
+	"white":          color.FgWhite,
+	"gray":           color.FgHiBlack,
+	"grey":           color.FgHiBlack,
+	"bright-black":   color.FgHiBlack,
+	"bright-red":     color.FgHiRed,
+	"bright-green":   color.FgHiGreen,
+	"bright-yellow":  color.FgHiYellow,
+	"bright-blue":    color.FgHiBlue,
+	"bright-magenta": color.FgHiMagenta,
+	"bright-cyan":    color.FgHiCyan,
+	"bright-white":   color.FgHiWhite,
+}
+
+// outputColors holds the colors set in the config
+var outputColors ColorSettings
+
+// configureColors applies the colors set in the config, warning about
+// names that are not known
+func configureColors(settings ColorSettings) {
+	names := map[string]string{
+		"command":   settings.Command,
+		"output":    settings.Output,
+		"progress":  settings.Progress,
+		"user":      settings.User,
+		"assistant": settings.Assistant,
+		"error":     settings.Error,
+	}
+	for key, name := range names {
+		if _, ok := colorNames[strings.ToLower(name)]; name != "" && !ok {
+			fmt.Fprintf(os.Stderr, "Warning: unknown color %q for colors.%s, using the default\n", name, key)
+		}
+	}
+	outputColors = settings
+}
+
+// pickColor returns the color with the given name, or fallback when the
+// name is empty or not known
+func pickColor(name string, fallback color.Attribute) color.Attribute {
+	if c, ok := colorNames[strings.ToLower(name)]; ok {
+		return c
+	}
+	return fallback
+}
+
+// colorPart is a part of the output whose color can be set in the config
+type colorPart int
+
+const (
+	colorCommand colorPart = iota
+	colorOutput
+	colorProgress
+	colorUser
+	colorAssistant
+	colorError
+)
+
+// name returns the color name set for part
+func (s ColorSettings) name(part colorPart) string {
+	switch part {
+	case colorCommand:
+		return s.Command
+	case colorOutput:
+		return s.Output
+	case colorProgress:
+		return s.Progress
+	case colorUser:
+		return s.User
+	case colorAssistant:
+		return s.Assistant
+	case colorError:
+		return s.Error
+	}
+	return ""
+}
+
+// outputColor returns the color for part of the output, the one set in
+// the config or fallback, with attrs added
+func outputColor(part colorPart, fallback color.Attribute, attrs ...color.Attribute) *color.Color {
+	loadSettings()
+	c := color.New(pickColor(outputColors.name(part), fallback))
+	return c.Add(attrs...)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestPickColor(t *testing.T) {
+	tests := []struct {
+		name      string
+		colorName string
+		want      color.Attribute
+	}{
+		{name: "empty keeps default", colorName: "", want: color.FgCyan},
+		{name: "named color", colorName: "magenta", want: color.FgMagenta},
+		{name: "bright color", colorName: "bright-yellow", want: color.FgHiYellow},
+		{name: "case insensitive", colorName: "Blue", want: color.FgBlue},
+		{name: "unknown keeps default", colorName: "chartreuse", want: color.FgCyan},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickColor(tt.colorName, color.FgCyan); got != tt.want {
+				t.Errorf("pickColor(%q) = %v, want %v", tt.colorName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Colors(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	content := `
+[settings.colors]
+command = "yellow"
+output = "gray"
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	want := ColorSettings{Command: "yellow", Output: "gray"}
+	if config.Settings.Colors != want {
+		t.Errorf("colors = %+v, want %+v", config.Settings.Colors, want)
+	}
+}
+
+func TestConfigureSettings(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		loadSettings = func() {}
+		configureColors(ColorSettings{})
+		configureTrustedProjects(nil)
+	})
+
+	missing := filepath.Join(dir, "missing", "config.toml")
+	configureSettings(missing, "")
+	outputColor(colorCommand, color.FgCyan)
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("config file was created by reading the settings: %v", err)
+	}
+
+	configPath := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(configPath, []byte("[settings.colors]\ncommand = \"yellow\"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	configureSettings(configPath, "")
+	if outputColors.Command != "" {
+		t.Errorf("colors were loaded before they were needed")
+	}
+	want := color.New(color.FgYellow, color.Bold)
+	if got := outputColor(colorCommand, color.FgCyan, color.Bold); !got.Equals(want) {
+		t.Errorf("outputColor() = %v, want %v", got, want)
+	}
+}
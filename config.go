@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
 )
 
-// DefaultConfigPath is the default location for the global config file
-const DefaultConfigPath = "~/.config/esa/config.toml"
+// defaultConfigPath returns the default location for the global config
+// file
+func defaultConfigPath() string {
+	return filepath.Join(configHome(), "config.toml")
+}
 
 // Settings represents global settings that can be overridden by CLI flags
 type Settings struct {
@@ -19,13 +26,80 @@ type Settings struct {
 	DefaultModel  string `toml:"default_model"`
 	OnComplete    string `toml:"on_complete"`
 	MaxTurns      int    `toml:"max_turns"`
+	ProgressStyle string `toml:"progress_style"`
+
+	// ShellCacheTTL is the number of seconds the output of {{$...}}
+	// blocks is reused for. Zero disables caching.
+	ShellCacheTTL     int  `toml:"shell_cache_ttl"`
+	ShellCachePersist bool `toml:"shell_cache_persist"`
+
+	// ShellBlockTimeout is the number of seconds a {{$...}} block may
+	// run before it is killed. Zero uses the default of 10 seconds.
+	ShellBlockTimeout int `toml:"shell_block_timeout"`
+
+	// EncryptHistory encrypts saved conversations using the passphrase
+	// in ESA_HISTORY_PASSPHRASE
+	EncryptHistory bool `toml:"encrypt_history"`
+
+	// LogFile is a file that a JSONL transcript of all requests,
+	// responses and tool calls is appended to
+	LogFile string `toml:"log_file"`
+
+	// NoHighlight disables syntax highlighting of code blocks in
+	// streamed responses
+	NoHighlight bool `toml:"no_highlight"`
+
+	// ReplSubmit decides when a message typed in the REPL is sent:
+	// single-enter (default), double-enter or ctrl-d
+	ReplSubmit string `toml:"repl_submit"`
+
+	// FileMarker starts a reference to a local file in a message, which
+	// attaches the file. It defaults to "@".
+	FileMarker string `toml:"file_marker"`
+	// NoFileReferences turns off attaching files referenced in messages
+	NoFileReferences bool `toml:"no_file_references"`
+
+	// TrustedProjects are the roots of the projects whose .esa/agents
+	// directory agents are loaded from
+	TrustedProjects []string `toml:"trusted_projects"`
+
+	// StripThinking keeps the thinking reasoning models write between
+	// tags such as <think> and </think> out of displayed and saved
+	// responses. ThinkingTags lists the tag names, "think" by default.
+	StripThinking bool     `toml:"strip_thinking"`
+	ThinkingTags  []string `toml:"thinking_tags"`
+
+	// SaveReasoning keeps the reasoning some providers stream apart
+	// from the response in the history
+	SaveReasoning bool `toml:"save_reasoning"`
+
+	// FallbackModels are tried in order when a request to the model
+	// fails even after retrying, unless the agent sets its own
+	FallbackModels []string `toml:"fallback_models"`
+
+	// Colors overrides the colors used for parts of the output
+	Colors ColorSettings `toml:"colors"`
 }
 
 // Config represents the global configuration structure
 type Config struct {
-	ModelAliases map[string]string         `toml:"model_aliases"`
+	ModelAliases map[string]ModelAlias     `toml:"model_aliases"`
 	Providers    map[string]ProviderConfig `toml:"providers"`
 	Settings     Settings                  `toml:"settings"`
+
+	// ModelPrices overrides the built-in prices used to estimate the
+	// cost of a session, keyed by provider/model or model name
+	ModelPrices map[string]ModelPrice `toml:"model_prices,omitempty"`
+
+	// ProviderOptions are extra fields added to the body of requests,
+	// keyed by provider, e.g. keep_alive and options.num_ctx for ollama
+	ProviderOptions map[string]map[string]any `toml:"provider_options,omitempty"`
+
+	// Profiles are named overlays using the same layout as the base
+	// config. They are decoded lazily when selected with --profile.
+	Profiles map[string]toml.Primitive `toml:"profiles,omitempty"`
+
+	meta toml.MetaData
 }
 
 // ProviderConfig represents the configuration for a model provider
@@ -33,35 +107,55 @@ type ProviderConfig struct {
 	BaseURL           string            `toml:"base_url"`
 	APIKeyEnvar       string            `toml:"api_key_envar"`
 	AdditionalHeaders map[string]string `toml:"additional_headers"`
+
+	// DefaultModel is used when a model is given as just the provider,
+	// e.g. "openai/" or "openai"
+	DefaultModel string `toml:"default_model,omitempty"`
+
+	// Organization and Project are sent as the OpenAI-Organization and
+	// OpenAI-Project headers. They are only used by the openai provider.
+	Organization string `toml:"organization,omitempty"`
+	Project      string `toml:"project,omitempty"`
+
+	// StreamUsage asks the provider to report token usage at the end of
+	// streamed responses. Providers that are known to support it have
+	// it on by default, as others may reject the request.
+	StreamUsage *bool `toml:"stream_usage,omitempty"`
 }
 
+// noConfigWriteEnvar, when set, stops esa from creating the config file
+// and its directory on first run, for read-only environments such as
+// immutable containers. Defaults are used in memory instead.
+const noConfigWriteEnvar = "ESA_NO_CONFIG_WRITE"
+
 // LoadConfig loads the configuration from the specified path
 func LoadConfig(configPath string) (*Config, error) {
 	config := &Config{
-		ModelAliases: make(map[string]string),
+		ModelAliases: make(map[string]ModelAlias),
 		Providers:    make(map[string]ProviderConfig),
 	}
 
 	// Expand home directory if needed
 	if configPath == "" {
-		configPath = DefaultConfigPath
+		configPath = defaultConfigPath()
 	}
 	configPath = expandHomePath(configPath)
 
-	// Create default config directory if it doesn't exist
-	configDir := filepath.Dir(configPath)
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return nil, err
-	}
-
 	// Check if config file exists
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		// Create default config file
 		defaultConfig := Config{
-			ModelAliases: map[string]string{},
+			ModelAliases: map[string]ModelAlias{},
 			Providers:    map[string]ProviderConfig{},
 			Settings:     Settings{ShowCommands: false, ShowToolCalls: false, DefaultModel: ""},
 		}
+		if os.Getenv(noConfigWriteEnvar) != "" {
+			return &defaultConfig, nil
+		}
+
+		// Create default config directory and file
+		if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+			return nil, err
+		}
 		file, err := os.Create(configPath)
 		if err != nil {
 			return nil, err
@@ -75,9 +169,11 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 
 	// Load existing config file
-	if _, err := toml.DecodeFile(configPath, config); err != nil {
+	meta, err := toml.DecodeFile(configPath, config)
+	if err != nil {
 		return nil, err
 	}
+	config.meta = meta
 
 	if err := validateConfig(config); err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
@@ -86,6 +182,160 @@ func LoadConfig(configPath string) (*Config, error) {
 	return config, nil
 }
 
+// LoadConfigWithProfile loads the configuration from the specified
+// path and merges the named profile over it. An empty profile name
+// returns the base configuration.
+func LoadConfigWithProfile(configPath string, profile string) (*Config, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.applyProfile(profile); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// applyProfile merges the named profile over the base configuration.
+// Only keys set in the profile are changed: settings are overridden
+// individually while model aliases and providers are merged by name,
+// with a provider defined in the profile replacing the base one.
+func (c *Config) applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("profile %q not found in config", name)
+	}
+
+	if err := c.meta.PrimitiveDecode(profile, c); err != nil {
+		return fmt.Errorf("failed to load profile %q: %w", name, err)
+	}
+
+	if err := validateConfig(c); err != nil {
+		return fmt.Errorf("invalid profile %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// ModelAlias is a shortcut for a model. In the config it is either just
+// the provider/model string or a table that also sets parameters for
+// requests made with the alias:
+//
+//	[model_aliases.creative]
+//	model = "openai/gpt-4o"
+//	temperature = 1.2
+type ModelAlias struct {
+	Model        string   `toml:"model"`
+	Temperature  *float32 `toml:"temperature,omitempty"`
+	MaxTokens    int      `toml:"max_tokens,omitzero"`
+	SystemPrompt string   `toml:"system_prompt,omitempty"`
+}
+
+// UnmarshalTOML decodes an alias given either as a string or a table
+func (a *ModelAlias) UnmarshalTOML(data any) error {
+	switch value := data.(type) {
+	case string:
+		*a = ModelAlias{Model: value}
+		return nil
+	case map[string]any:
+		*a = ModelAlias{}
+		for key, v := range value {
+			var ok bool
+			switch key {
+			case "model":
+				a.Model, ok = v.(string)
+			case "system_prompt":
+				a.SystemPrompt, ok = v.(string)
+			case "max_tokens":
+				var maxTokens int64
+				maxTokens, ok = v.(int64)
+				a.MaxTokens = int(maxTokens)
+			case "temperature":
+				var temperature float64
+				switch t := v.(type) {
+				case float64:
+					temperature, ok = t, true
+				case int64:
+					temperature, ok = float64(t), true
+				}
+				t := float32(temperature)
+				a.Temperature = &t
+			default:
+				return fmt.Errorf("unknown model alias setting %q", key)
+			}
+			if !ok {
+				return fmt.Errorf("invalid value for model alias setting %q: %v", key, v)
+			}
+		}
+		if a.Model == "" {
+			return fmt.Errorf("model alias is missing the model")
+		}
+		return nil
+	default:
+		return fmt.Errorf("model alias must be a string or a table, got %T", data)
+	}
+}
+
+// redactedValue replaces secrets when showing the config
+const redactedValue = "[redacted]"
+
+// resolvedConfig returns the config as it is used: every known provider
+// is listed with the builtin defaults and the overrides from the config
+// applied. Header values that look like credentials and passwords in
+// base URLs are redacted so that the result can be shared.
+func resolvedConfig(config *Config) *Config {
+	resolved := &Config{
+		ModelAliases: config.ModelAliases,
+		Providers:    make(map[string]ProviderConfig),
+		Settings:     config.Settings,
+		ModelPrices:  config.ModelPrices,
+
+		ProviderOptions: config.ProviderOptions,
+	}
+
+	for _, name := range knownProviders(config) {
+		info := lookupProvider(name, config)
+		provider := ProviderConfig{
+			BaseURL:      info.baseURL,
+			APIKeyEnvar:  info.apiKeyEnvar,
+			DefaultModel: config.Providers[name].DefaultModel,
+			StreamUsage:  &info.streamUsage,
+		}
+		if u, err := url.Parse(info.baseURL); err == nil && u.User != nil {
+			provider.BaseURL = u.Redacted()
+		}
+		if len(info.additionalHeaders) > 0 {
+			provider.AdditionalHeaders = make(map[string]string, len(info.additionalHeaders))
+			for key, value := range info.additionalHeaders {
+				if isSecretHeader(key) {
+					value = redactedValue
+				}
+				provider.AdditionalHeaders[key] = value
+			}
+		}
+		resolved.Providers[name] = provider
+	}
+
+	return resolved
+}
+
+// isSecretHeader reports whether a header is likely to hold a credential
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range []string{"auth", "key", "token", "secret", "password", "cookie"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
 // validateConfig validates the loaded configuration for common errors.
 func validateConfig(config *Config) error {
 	// Detect circular model aliases
@@ -94,10 +344,11 @@ func validateConfig(config *Config) error {
 		current := alias
 		for {
 			visited[current] = true
-			next, ok := config.ModelAliases[current]
+			target, ok := config.ModelAliases[current]
 			if !ok {
 				break // resolved to a non-alias, good
 			}
+			next := target.Model
 			if visited[next] {
 				return fmt.Errorf("circular model alias detected: %s", alias)
 			}
@@ -105,6 +356,44 @@ func validateConfig(config *Config) error {
 		}
 	}
 
+	for name, alias := range config.ModelAliases {
+		if alias.Temperature != nil && (*alias.Temperature < 0 || *alias.Temperature > 2) {
+			return fmt.Errorf("model alias %q has invalid temperature %v: must be between 0 and 2", name, *alias.Temperature)
+		}
+		if alias.MaxTokens < 0 {
+			return fmt.Errorf("model alias %q has invalid max_tokens %d: must not be negative", name, alias.MaxTokens)
+		}
+	}
+
+	if style := config.Settings.ProgressStyle; style != "" {
+		if _, ok := spinnerStyles[style]; !ok {
+			return fmt.Errorf("invalid progress_style %q: must be one of dots, line, braille", style)
+		}
+	}
+
+	if submit := config.Settings.ReplSubmit; submit != "" &&
+		!slices.Contains([]string{replSubmitSingleEnter, replSubmitDoubleEnter, replSubmitCtrlD}, submit) {
+		return fmt.Errorf("invalid repl_submit %q: must be one of single-enter, double-enter, ctrl-d", submit)
+	}
+
+	if marker := config.Settings.FileMarker; strings.ContainsFunc(marker, unicode.IsSpace) {
+		return fmt.Errorf("invalid file_marker %q: must not contain spaces", marker)
+	}
+
+	for _, tag := range config.Settings.ThinkingTags {
+		if tag == "" || strings.ContainsFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == '<' || r == '>' }) {
+			return fmt.Errorf("invalid thinking_tags entry %q: must be a tag name such as think", tag)
+		}
+	}
+
+	if config.Settings.ShellBlockTimeout < 0 {
+		return fmt.Errorf("invalid shell_block_timeout %d: must not be negative", config.Settings.ShellBlockTimeout)
+	}
+
+	if config.Settings.ShellCacheTTL < 0 {
+		return fmt.Errorf("invalid shell_cache_ttl %d: must not be negative", config.Settings.ShellCacheTTL)
+	}
+
 	// Validate provider BaseURLs
 	for name, provider := range config.Providers {
 		if provider.BaseURL != "" &&
@@ -116,3 +405,87 @@ func validateConfig(config *Config) error {
 
 	return nil
 }
+
+// loadEnvFiles loads variables from a .env file in the current
+// directory and in the directory of the config file. Variables already
+// set in the process take precedence over both files, and the file in
+// the current directory takes precedence over the one in the config
+// directory. The current directory may be a project that is not the
+// user's, so only the API keys of providers are read from its file
+// rather than variables such as PATH that change how commands run.
+func loadEnvFiles(configPath string, config *Config) {
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+	configDir := filepath.Dir(expandHomePath(configPath))
+
+	files := []struct {
+		path    string
+		allowed map[string]bool // nil allows every variable
+	}{
+		{".env", providerKeyEnvars(config)},
+		{filepath.Join(configDir, ".env"), nil},
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file.path)
+		if err != nil {
+			continue // missing .env files are not an error
+		}
+
+		for key, value := range parseEnvFile(string(data)) {
+			if file.allowed != nil && !file.allowed[key] {
+				continue
+			}
+			if _, exists := os.LookupEnv(key); !exists {
+				os.Setenv(key, value)
+			}
+		}
+	}
+}
+
+// providerKeyEnvars returns the names of the variables holding the API
+// keys of the known providers
+func providerKeyEnvars(config *Config) map[string]bool {
+	envars := make(map[string]bool)
+	for _, provider := range knownProviders(config) {
+		if envar := lookupProvider(provider, config).apiKeyEnvar; envar != "" {
+			envars[envar] = true
+		}
+	}
+	return envars
+}
+
+// parseEnvFile parses the contents of a .env file. It supports
+// KEY=value lines with an optional "export " prefix, single or double
+// quoted values and # comments. Malformed lines are ignored.
+func parseEnvFile(content string) map[string]string {
+	env := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+			if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+				value = value[1 : end+1]
+			}
+		} else if idx := strings.Index(value, " #"); idx >= 0 {
+			value = strings.TrimSpace(value[:idx])
+		}
+
+		env[key] = value
+	}
+
+	return env
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// defaultFileMarker starts a reference to a local file in a message,
+// e.g. "summarize @notes.md", unless file_marker is set in the config
+const defaultFileMarker = "@"
+
+const (
+	// maxReferencedFileSize is the largest text file attached to a
+	// message through a file reference
+	maxReferencedFileSize = 1 << 20
+	// maxReferencedImageSize is the largest image attached to a message
+	// through a file reference
+	maxReferencedImageSize = 10 << 20
+)
+
+// fileReferenceTrailer holds characters that end a sentence rather than
+// a path, e.g. the full stop in "look at @main.go."
+const fileReferenceTrailer = ".,;:!?)]}'\""
+
+// userMessage returns the message for text typed by the user, with the
+// local files it references attached
+func (app *Application) userMessage(content string) openai.ChatCompletionMessage {
+	if app.config == nil || app.config.Settings.NoFileReferences {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: content}
+	}
+
+	marker := app.config.Settings.FileMarker
+	if marker == "" {
+		marker = defaultFileMarker
+	}
+	return expandFileReferences(content, marker)
+}
+
+// expandFileReferences attaches the files referenced in content as
+// marker followed by a path. Text files are added to the message after
+// the text and images are sent as image parts. References to paths that
+// are not files are left alone so that mentions such as @someone do not
+// need escaping, while files that are too large or binary are skipped
+// with a warning.
+func expandFileReferences(content, marker string) openai.ChatCompletionMessage {
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: content}
+
+	referenceRegex := regexp.MustCompile(`(?:^|\s)` + regexp.QuoteMeta(marker) + `(\S+)`)
+	var text strings.Builder
+	var images []openai.ChatMessagePart
+	seen := map[string]bool{}
+
+	for _, match := range referenceRegex.FindAllStringSubmatch(content, -1) {
+		path := referencedFile(match[1])
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		data, err := os.ReadFile(expandHomePath(path))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not read %s: %v\n", path, err)
+			continue
+		}
+
+		if mime := http.DetectContentType(data); strings.HasPrefix(mime, "image/") {
+			if len(data) > maxReferencedImageSize {
+				fmt.Fprintf(os.Stderr, "Warning: not attaching %s as it is larger than %d bytes\n", path, maxReferencedImageSize)
+				continue
+			}
+			images = append(images, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(data)},
+			})
+			continue
+		}
+
+		if len(data) > maxReferencedFileSize {
+			fmt.Fprintf(os.Stderr, "Warning: not attaching %s as it is larger than %d bytes\n", path, maxReferencedFileSize)
+			continue
+		}
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			fmt.Fprintf(os.Stderr, "Warning: not attaching %s as it is not a text file\n", path)
+			continue
+		}
+		fmt.Fprintf(&text, "\n\nContents of %s:\n```\n%s\n```", path, strings.TrimRight(string(data), "\n"))
+	}
+
+	msg.Content += text.String()
+	if len(images) > 0 {
+		msg.MultiContent = append([]openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: msg.Content},
+		}, images...)
+		msg.Content = ""
+	}
+	return msg
+}
+
+// messageText returns the text of a message. Messages with attached
+// images hold it in the text parts of MultiContent instead of Content.
+func messageText(msg openai.ChatCompletionMessage) string {
+	if len(msg.MultiContent) == 0 {
+		return msg.Content
+	}
+	var texts []string
+	for _, part := range msg.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// referencedFile returns the path of the file a reference points to,
+// dropping punctuation that follows it, or an empty string when it does
+// not point to a file
+func referencedFile(reference string) string {
+	for path := reference; path != ""; path = path[:len(path)-1] {
+		if info, err := os.Stat(expandHomePath(path)); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+		if !strings.ContainsRune(fileReferenceTrailer, rune(path[len(path)-1])) {
+			return ""
+		}
+	}
+	return ""
+}
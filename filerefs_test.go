@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestExpandFileReferences(t *testing.T) {
+	dir := t.TempDir()
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(oldWd) })
+
+	files := map[string][]byte{
+		"notes.md":   []byte("remember the milk\n"),
+		"binary.dat": {0x01, 0x00, 0x02},
+		"large.txt":  []byte(strings.Repeat("a", maxReferencedFileSize+1)),
+		"pixel.png":  append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		marker      string
+		wantContent string
+		wantImages  int
+	}{
+		{
+			name:        "no references",
+			content:     "summarize this",
+			marker:      "@",
+			wantContent: "summarize this",
+		},
+		{
+			name:        "text file",
+			content:     "summarize @notes.md",
+			marker:      "@",
+			wantContent: "summarize @notes.md\n\nContents of notes.md:\n```\nremember the milk\n```",
+		},
+		{
+			name:        "trailing punctuation",
+			content:     "what is in @notes.md?",
+			marker:      "@",
+			wantContent: "what is in @notes.md?\n\nContents of notes.md:\n```\nremember the milk\n```",
+		},
+		{
+			name:        "repeated reference",
+			content:     "@notes.md and @notes.md",
+			marker:      "@",
+			wantContent: "@notes.md and @notes.md\n\nContents of notes.md:\n```\nremember the milk\n```",
+		},
+		{
+			name:        "not a file",
+			content:     "ask @someone or mail me@notes.md",
+			marker:      "@",
+			wantContent: "ask @someone or mail me@notes.md",
+		},
+		{
+			name:        "binary file skipped",
+			content:     "read @binary.dat",
+			marker:      "@",
+			wantContent: "read @binary.dat",
+		},
+		{
+			name:        "large file skipped",
+			content:     "read @large.txt",
+			marker:      "@",
+			wantContent: "read @large.txt",
+		},
+		{
+			name:        "custom marker",
+			content:     "summarize @notes.md and file:notes.md",
+			marker:      "file:",
+			wantContent: "summarize @notes.md and file:notes.md\n\nContents of notes.md:\n```\nremember the milk\n```",
+		},
+		{
+			name:        "image",
+			content:     "describe @pixel.png",
+			marker:      "@",
+			wantContent: "describe @pixel.png",
+			wantImages:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := expandFileReferences(tt.content, tt.marker)
+
+			content := msg.Content
+			var images []openai.ChatMessagePart
+			if len(msg.MultiContent) > 0 {
+				content = msg.MultiContent[0].Text
+				images = msg.MultiContent[1:]
+			}
+			if content != tt.wantContent {
+				t.Errorf("content = %q, want %q", content, tt.wantContent)
+			}
+			if got := messageText(msg); got != tt.wantContent {
+				t.Errorf("messageText() = %q, want %q", got, tt.wantContent)
+			}
+			if len(images) != tt.wantImages {
+				t.Fatalf("images = %d, want %d", len(images), tt.wantImages)
+			}
+			for _, image := range images {
+				if !strings.HasPrefix(image.ImageURL.URL, "data:image/png;base64,") {
+					t.Errorf("image URL = %q, want a PNG data URI", image.ImageURL.URL)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -8,8 +9,11 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -46,11 +50,18 @@ func convertToOpenAIFunction(fc FunctionConfig) openai.FunctionDefinition {
 		}
 	}
 
-	desc := fmt.Sprintf(
-		"%s\n\nThe templated cli command that will be ran is: `%s`",
-		fc.Description,
-		fc.Command,
-	)
+	desc := fc.Description
+	if fc.run == nil {
+		desc = fmt.Sprintf(
+			"%s\n\nThe templated cli command that will be ran is: `%s`",
+			fc.Description,
+			fc.commandFor(runtime.GOOS),
+		)
+	}
+	if fc.Background {
+		desc += fmt.Sprintf("\n\nThe command runs in the background and a job ID is returned right away. "+
+			"Use the %s tool to follow its progress.", checkJobToolName)
+	}
 
 	return openai.FunctionDefinition{
 		Name:        fc.Name,
@@ -67,13 +78,15 @@ func executeFunction(
 	askLevel string,
 	fc FunctionConfig,
 	args string,
+	outputs *toolOutputs,
+	jobs *jobRegistry,
 ) (bool, string, string, string, error) {
 	parsedArgs, err := parseAndValidateArgs(fc, args)
 	if err != nil {
 		return false, "", "", "", err
 	}
 
-	command, err := prepareCommand(fc, parsedArgs)
+	command, err := prepareCommand(fc, parsedArgs, outputs)
 	if err != nil {
 		return false, "", "", "", err
 	}
@@ -83,6 +96,9 @@ func executeFunction(
 
 	// Check if confirmation is needed
 	if needsConfirmation(askLevel, fc.Safe) {
+		if fc.Preview != "" {
+			showPreview(runPreview(fc, parsedArgs, outputs))
+		}
 		response := confirm(fmt.Sprintf("Execute `%s`?", command))
 		if !response.approved {
 			if response.message != "" {
@@ -92,16 +108,28 @@ func executeFunction(
 		}
 	}
 
-	output, stdinContent, err := executeShellCommand(command, fc, parsedArgs)
+	result, stdinContent, err := runFunction(command, fc, parsedArgs, jobs)
+	return true, origCommand, stdinContent, result, err
+}
+
+// runFunction runs the command of a function and returns the result to
+// send to the model along with what was passed to the command on stdin.
+// Image output is returned as a data URI, other output is trimmed and
+// narrowed down to its parse_output path when the function has one.
+func runFunction(command string, fc FunctionConfig, args map[string]any, jobs *jobRegistry) (result string, stdinContent string, err error) {
+	output, stdinContent, err := runFunctionCommand(command, fc, args, jobs)
 	if err != nil {
-		return true, origCommand, stdinContent, strings.TrimSpace(string(output)), err
+		return strings.TrimSpace(string(output)), stdinContent, err
 	}
 	if fc.OutputType == "image" {
 		mime := detectImageMIME(output)
-		dataURI := "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(output)
-		return true, origCommand, stdinContent, dataURI, nil
+		return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(output), stdinContent, nil
 	}
-	return true, origCommand, stdinContent, strings.TrimSpace(string(output)), nil
+	result = strings.TrimSpace(string(output))
+	if fc.ParseOutput != "" {
+		result = parseFunctionOutput(fc, result)
+	}
+	return result, stdinContent, nil
 }
 
 // detectImageMIME sniffs the MIME type of image bytes from magic bytes.
@@ -149,8 +177,8 @@ func parseAndValidateArgs(fc FunctionConfig, args string) (map[string]any, error
 	return parsedArgs, nil
 }
 
-func prepareCommand(fc FunctionConfig, parsedArgs map[string]any) (string, error) {
-	command := fc.Command
+func prepareCommand(fc FunctionConfig, parsedArgs map[string]any, outputs *toolOutputs) (string, error) {
+	command := fc.commandFor(runtime.GOOS)
 
 	// First, process any shell command blocks in the command
 	var err error
@@ -181,35 +209,136 @@ func prepareCommand(fc FunctionConfig, parsedArgs map[string]any) (string, error
 	}
 
 	// Clean up any extra spaces from removed optional parameters
-	return strings.Join(strings.Fields(command), " "), nil
+	command = strings.Join(strings.Fields(command), " ")
+
+	// Substitute outputs of previous tool calls last so that
+	// multi-line outputs are not collapsed by the cleanup above
+	return outputs.substitute(command), nil
+}
+
+// toolOutputs tracks the outputs of tool calls made in the current
+// conversation so that later commands can reference them using
+// {{last_output}} or {{output:function_name}}.
+type toolOutputs struct {
+	last   string
+	byName map[string]string
+}
+
+// References wrapped in quotes are matched along with the quotes, which
+// are replaced by the quoting of the output.
+var toolOutputRegex = regexp.MustCompile(`'{{(last_output|output:[^{}]+)}}'|"{{(last_output|output:[^{}]+)}}"|{{(last_output|output:[^{}]+)}}`)
+
+// newToolOutputs creates a toolOutputs seeded with the tool results
+// already present in the conversation messages.
+func newToolOutputs(messages []openai.ChatCompletionMessage) *toolOutputs {
+	outputs := &toolOutputs{byName: make(map[string]string)}
+	for _, msg := range messages {
+		if msg.Role != openai.ChatMessageRoleTool || strings.HasPrefix(msg.Content, "Error:") {
+			continue
+		}
+
+		// Tool results are stored as "Command: ...\n\nOutput: \n<output>"
+		content := msg.Content
+		if idx := strings.Index(content, "\n\nOutput: \n"); idx >= 0 {
+			content = content[idx+len("\n\nOutput: \n"):]
+		}
+		outputs.record(msg.Name, content)
+	}
+	return outputs
+}
+
+// record stores the output of a tool call
+func (t *toolOutputs) record(name, output string) {
+	t.last = output
+	t.byName[name] = output
+}
+
+// substitute replaces references to previous tool outputs in command.
+// Outputs are single-quoted as they come from the model and from other
+// commands, and unknown references are replaced with an empty string.
+func (t *toolOutputs) substitute(command string) string {
+	if t == nil {
+		return command
+	}
+
+	return toolOutputRegex.ReplaceAllStringFunc(command, func(match string) string {
+		groups := toolOutputRegex.FindStringSubmatch(match)
+		ref := groups[1] + groups[2] + groups[3]
+		if ref == "last_output" {
+			return shellQuote(t.last)
+		}
+		return shellQuote(t.byName[strings.TrimSpace(strings.TrimPrefix(ref, "output:"))])
+	})
+}
+
+// shellQuote quotes s so that sh reads it as a single word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// conditionalRegex matches {{?env:VAR}}...{{/?}} blocks
+var conditionalRegex = regexp.MustCompile(`(?s){{\?env:([A-Za-z_][A-Za-z0-9_]*)}}(.*?){{/\?}}`)
+
+// processConditionals keeps the content of {{?env:VAR}}...{{/?}}
+// blocks when VAR is set to a non-empty value and drops it otherwise
+func processConditionals(input string) string {
+	return conditionalRegex.ReplaceAllStringFunc(input, func(match string) string {
+		parts := conditionalRegex.FindStringSubmatch(match)
+		if os.Getenv(parts[1]) == "" {
+			return ""
+		}
+		return parts[2]
+	})
 }
 
 // processShellBlocks processes special blocks in a string:
+// {{?env:VAR}}...{{/?}} blocks are kept only if VAR is set
 // {{$...}} blocks are executed as shell commands and replaced with output
 // {{#...}} blocks prompt for user input with the text as prompt
 func processShellBlocks(input string) (string, error) {
+	return processBlocks(input, nil)
+}
+
+// processPromptShellBlocks processes the blocks of a system prompt like
+// processShellBlocks, taking the output of {{$...}} blocks from the
+// shell cache when it is enabled. {{$!...}} blocks always run.
+func processPromptShellBlocks(input string) (string, error) {
+	return processBlocks(input, shellCache)
+}
+
+// processBlocks processes the blocks of input, caching the output of
+// {{$...}} blocks in cache unless it is nil
+func processBlocks(input string, cache *shellBlockCache) (string, error) {
+	// Process conditionals first so that blocks inside a dropped
+	// section are never executed
+	input = processConditionals(input)
+
 	// Process shell command blocks {{$...}}
 	shellRegex := regexp.MustCompile(`{{\$(.*?)}}`)
 	result := shellRegex.ReplaceAllStringFunc(input, func(match string) string {
 		command := match[3 : len(match)-2] // Extract command without {{$ and }}
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		cmd := exec.CommandContext(ctx, "sh", "-c", command)
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Sprintf("Error: %v", err)
+
+		// {{$!...}} always runs the command, bypassing the cache
+		if strings.HasPrefix(command, "!") {
+			return runShellBlock(command[1:])
+		}
+		if cache == nil {
+			return runShellBlock(command)
 		}
-		// Truncate output to 1MB
-		const maxOutput = 1 << 20
-		if len(output) > maxOutput {
-			output = output[:maxOutput]
+
+		key := shellCacheKey(command)
+		if output, ok := cache.get(key); ok {
+			return output
 		}
-		return strings.TrimSpace(string(output))
+		output := runShellBlock(command)
+		if !strings.HasPrefix(output, "Error: ") {
+			cache.set(key, output)
+		}
+		return output
 	})
 
 	// Process user input blocks {{#...}}
-	inputRegex := regexp.MustCompile(`{{#(.*?)}}`)
-	result = inputRegex.ReplaceAllStringFunc(result, func(match string) string {
+	result = inputBlockRegex.ReplaceAllStringFunc(result, func(match string) string {
 		prompt := match[3 : len(match)-2] // Extract prompt without {{# and }}
 		input, err := readUserInput(prompt, true)
 		if err != nil {
@@ -222,6 +351,67 @@ func processShellBlocks(input string) (string, error) {
 	return result, nil
 }
 
+// defaultMaxToolOutput is the number of bytes of output a function
+// command may produce before it is stopped, unless max_output is set
+const defaultMaxToolOutput = 10 << 20
+
+// defaultShellBlockTimeout is how long a {{$...}} block may run unless
+// shell_block_timeout is set in the config
+const defaultShellBlockTimeout = 10 * time.Second
+
+// shellBlockTimeout holds the configured {{$...}} block timeout in
+// nanoseconds. It is atomic as the web server reconfigures it per
+// session while other sessions may be running blocks.
+var shellBlockTimeout atomic.Int64
+
+func init() {
+	shellBlockTimeout.Store(int64(defaultShellBlockTimeout))
+}
+
+// inputBlockRegex matches {{#...}} user input blocks
+var inputBlockRegex = regexp.MustCompile(`{{#(.*?)}}`)
+
+// resolvePromptForDisplay resolves a prompt the same way as
+// processPromptShellBlocks but replaces {{#...}} input blocks with a
+// placeholder instead of prompting the user
+func resolvePromptForDisplay(prompt string) (string, error) {
+	masked := inputBlockRegex.ReplaceAllString(prompt, "<user input: $1>")
+	return processPromptShellBlocks(masked)
+}
+
+// runShellBlock runs the command of a {{$...}} block and returns its
+// trimmed output, or an error string if the command failed or did not
+// finish within the shell block timeout
+func runShellBlock(command string) string {
+	timeout := time.Duration(shellBlockTimeout.Load())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	// Kill the whole process group on timeout and stop waiting for
+	// output shortly after, so that background children holding the
+	// output pipe open cannot hang the caller
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Sprintf("Error: command timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	// Truncate output to 1MB
+	const maxOutput = 1 << 20
+	if len(output) > maxOutput {
+		output = output[:maxOutput]
+	}
+	return strings.TrimSpace(string(output))
+}
+
 func getParameterReplacement(param ParameterConfig, value any) (string, error) {
 	switch {
 	case param.Format == "boolean":
@@ -245,6 +435,48 @@ func getParameterReplacement(param ParameterConfig, value any) (string, error) {
 	}
 }
 
+// checkSafeMode returns an error if safe mode is enabled and the
+// function is not marked as safe
+func checkSafeMode(safeMode bool, fc FunctionConfig) error {
+	if safeMode && !fc.Safe {
+		return fmt.Errorf("function %s is not marked safe and cannot be run in safe mode", fc.Name)
+	}
+	return nil
+}
+
+// defaultFunctionTimeout is the number of seconds a function command
+// may run for when no timeout is set
+const defaultFunctionTimeout = 60
+
+// previewMaxOutput caps the output of preview commands as it is only
+// meant to be read before approving a call
+const previewMaxOutput = 64 << 10
+
+// runPreview runs the preview command of a function with the arguments
+// of the call and returns its output. Preview commands are expected to
+// be read-only as they run before the user approves the call.
+func runPreview(fc FunctionConfig, parsedArgs map[string]any, outputs *toolOutputs) string {
+	previewFc := fc
+	previewFc.Command = fc.Preview
+	previewFc.CommandDarwin, previewFc.CommandLinux = "", ""
+	previewFc.Output = ""
+	previewFc.MaxOutput = previewMaxOutput
+
+	command, err := prepareCommand(previewFc, parsedArgs, outputs)
+	if err != nil {
+		return fmt.Sprintf("Preview failed: %v", err)
+	}
+
+	// Commands like diff exit with a non-zero status when there is
+	// something to show, so only report errors without output
+	output, _, err := executeShellCommand(expandHomePath(command), previewFc, parsedArgs)
+	preview := strings.TrimRight(string(output), "\n")
+	if err != nil && preview == "" {
+		return fmt.Sprintf("Preview failed: %s", strings.SplitN(err.Error(), "\n", 2)[0])
+	}
+	return preview
+}
+
 func needsConfirmation(askLevel string, isSafe bool) bool {
 	if askLevel == "" {
 		askLevel = "unsafe"
@@ -252,13 +484,63 @@ func needsConfirmation(askLevel string, isSafe bool) bool {
 	return askLevel == "all" || (askLevel == "unsafe" && !isSafe)
 }
 
-func executeShellCommand(
+// maxFunctionRetries is the largest number of retries a function can
+// be configured with
+const maxFunctionRetries = 10
+
+// functionRetryDelay returns the delay before retrying a failed command
+var functionRetryDelay = calculateRetryDelay
+
+// executeShellCommandWithRetries runs a command, retrying it up to
+// fc.Retries times with backoff when it fails. The function timeout is
+// shared by all attempts rather than applied to each one.
+func executeShellCommandWithRetries(
 	command string,
 	fc FunctionConfig,
 	args map[string]any,
 ) ([]byte, string, error) {
-	var stdinContent string
+	timeout := fc.Timeout
+	if timeout <= 0 {
+		timeout = defaultFunctionTimeout
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	// The first attempt has the whole timeout and the retries get what
+	// is left of it
+	output, stdinContent, err := executeShellCommand(command, fc, args)
+	if err == nil || fc.Retries <= 0 {
+		return output, stdinContent, err
+	}
+
+	// The output template has already been shown on the first attempt
+	retryFc := fc
+	retryFc.Output = ""
+
+	attempts := 1
+	for attempt := 0; attempt < fc.Retries; attempt++ {
+		delay := functionRetryDelay(attempt)
+		remaining := time.Until(deadline) - delay
+		if remaining < time.Second {
+			break
+		}
+		time.Sleep(delay)
 
+		retryFc.Timeout = int(remaining / time.Second)
+		output, stdinContent, err = executeShellCommand(command, retryFc, args)
+		attempts++
+		if err == nil {
+			return output, stdinContent, nil
+		}
+	}
+
+	return output, stdinContent, fmt.Errorf("failed after %d attempts: %w", attempts, err)
+}
+
+func executeShellCommand(
+	command string,
+	fc FunctionConfig,
+	args map[string]any,
+) ([]byte, string, error) {
 	if fc.Output != "" {
 		// Process output template similar to command
 		formattedOutput, err := processShellBlocks(fc.Output)
@@ -281,11 +563,12 @@ func executeShellCommand(
 		fmt.Print(formattedOutput)
 	}
 
-	// Set up context with timeout
+	// Set up context with timeout. Interactive commands wait on the
+	// user, so they only time out when a timeout is set.
 	ctx := context.Background()
 	timeout := fc.Timeout
-	if timeout <= 0 {
-		timeout = 60 // default to 60 seconds if not set
+	if timeout <= 0 && !fc.Interactive {
+		timeout = defaultFunctionTimeout
 	}
 
 	var cancel context.CancelFunc
@@ -294,11 +577,80 @@ func executeShellCommand(
 		defer cancel()
 	}
 
-	// Create command with context
+	// Runaway commands are stopped once they produce more output than
+	// the cap instead of filling up memory
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	maxOutput := fc.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultMaxToolOutput
+	}
+	output := &cappedWriter{limit: maxOutput, onExceed: stop}
+
+	cmd, stdinContent, err := newShellCommand(ctx, command, fc, args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Run the command and capture output
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if fc.Interactive {
+		// The command draws on and reads from the terminal, only what
+		// it writes to stdout is passed back to the model
+		tty, err := openTTY()
+		if err != nil {
+			return nil, "", fmt.Errorf("interactive function %s needs a terminal: %w", fc.Name, err)
+		}
+		defer tty.Close()
+		if fc.Stdin == "" {
+			cmd.Stdin = tty
+		}
+		cmd.Stderr = tty
+	}
+	cmdErr := cmd.Run()
+
+	// Check if the context timed out or was cancelled
+	if ctx.Err() != nil {
+		// Kill the entire process group to clean up child processes
+		if cmd.Process != nil && !fc.Interactive {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		if output.exceeded() {
+			truncated := output.bytes()
+			return truncated, stdinContent, fmt.Errorf("command was stopped after producing more than %d bytes of output: %s\nOutput (truncated): %s", maxOutput, command, string(truncated))
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, "", fmt.Errorf("command timed out after %d seconds: %s", timeout, command)
+		}
+		return nil, "", fmt.Errorf("command was cancelled: %s", command)
+	}
+
+	if cmdErr != nil {
+		return output.bytes(), stdinContent, fmt.Errorf("%v\nCommand: %s\nOutput: %s", cmdErr, command, string(output.bytes()))
+	}
+	return output.bytes(), stdinContent, nil
+}
+
+// newShellCommand creates the command that runs a function in its own
+// process group, so that child processes can be killed along with it,
+// with the working directory and stdin set up from the function config.
+// It returns the command and the content passed to stdin.
+func newShellCommand(ctx context.Context, command string, fc FunctionConfig, args map[string]any) (*exec.Cmd, string, error) {
+	var stdinContent string
 	cmd := exec.CommandContext(ctx, "sh", "-c", command)
 
-	// Set process group so we can kill child processes on timeout
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// Set process group so we can kill child processes on timeout or
+	// when the output cap is hit. Interactive commands stay in the
+	// foreground process group, as reading from the terminal outside
+	// of it would stop them.
+	if !fc.Interactive {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+	cmd.WaitDelay = time.Second
 
 	// Set working directory if specified
 	if fc.Pwd != "" {
@@ -324,25 +676,73 @@ func executeShellCommand(
 	} else {
 		cmd.Stdin = os.Stdin
 	}
-	// Run the command and capture output
-	output, cmdErr := cmd.CombinedOutput()
 
-	// Check if the context timed out or was cancelled
-	if ctx.Err() != nil {
-		// Kill the entire process group to clean up child processes
-		if cmd.Process != nil {
-			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
-		}
-		if ctx.Err() == context.DeadlineExceeded {
-			return nil, "", fmt.Errorf("command timed out after %d seconds: %s", timeout, command)
+	return cmd, stdinContent, nil
+}
+
+// cappedWriter collects command output up to limit bytes. Once the
+// limit is hit the rest is discarded and onExceed is called so that the
+// command can be stopped.
+type cappedWriter struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	limit    int
+	over     bool
+	onExceed func()
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.over {
+		return len(p), nil
+	}
+
+	if remaining := w.limit - w.buf.Len(); len(p) > remaining {
+		w.buf.Write(p[:remaining])
+		w.over = true
+		if w.onExceed != nil {
+			w.onExceed()
 		}
-		return nil, "", fmt.Errorf("command was cancelled: %s", command)
+		return len(p), nil
 	}
 
-	if cmdErr != nil {
-		return output, stdinContent, fmt.Errorf("%v\nCommand: %s\nOutput: %s", cmdErr, command, string(output))
+	return w.buf.Write(p)
+}
+
+// bytes returns a copy of the output collected so far, which may be
+// read while the command is still writing to it
+func (w *cappedWriter) bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return bytes.Clone(w.buf.Bytes())
+}
+
+func (w *cappedWriter) exceeded() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.over
+}
+
+// progressMessage returns the progress message of the function with
+// parameters replaced by their values, or an empty string when the
+// function has none. Shell blocks are not run as the message is only
+// for display.
+func progressMessage(fc FunctionConfig, args map[string]any) string {
+	message := fc.ProgressMessage
+	for _, param := range fc.Parameters {
+		placeholder := fmt.Sprintf("{{%s}}", param.Name)
+		value, exists := args[param.Name]
+		if !exists {
+			value = param.Default
+		}
+		if value == nil {
+			value = ""
+		}
+		message = strings.ReplaceAll(message, placeholder, fmt.Sprintf("%v", value))
 	}
-	return output, stdinContent, nil
+	return message
 }
 
 func prepareStdinContent(stdinTemplate string, args map[string]any) string {
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
 )
 
 func TestProcessShellBlocks_Timeout(t *testing.T) {
@@ -16,3 +22,370 @@ func TestProcessShellBlocks_Timeout(t *testing.T) {
 		t.Errorf("processShellBlocks() = %q, want to contain 'world'", result)
 	}
 }
+
+func TestToolOutputsSubstitute(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: "system", Content: "system prompt"},
+		{Role: "tool", Name: "list_files", Content: "Command: ls\n\nOutput: \na.txt\nb.txt"},
+		{Role: "tool", Name: "broken", Content: "Error: command failed"},
+		{Role: "tool", Name: "read_file", Content: "Command: cat a.txt\n\nOutput: \nhello"},
+	}
+
+	tests := []struct {
+		name    string
+		outputs *toolOutputs
+		command string
+		want    string
+	}{
+		{
+			name:    "last output",
+			outputs: newToolOutputs(messages),
+			command: "echo {{last_output}}",
+			want:    "echo 'hello'",
+		},
+		{
+			name:    "output by function name",
+			outputs: newToolOutputs(messages),
+			command: "echo {{output:list_files}}",
+			want:    "echo 'a.txt\nb.txt'",
+		},
+		{
+			name:    "errors are not recorded",
+			outputs: newToolOutputs(messages),
+			command: "echo {{output:broken}}",
+			want:    "echo ''",
+		},
+		{
+			name: "outputs are quoted for the shell",
+			outputs: &toolOutputs{
+				last:   "it's $(rm -rf ~)",
+				byName: map[string]string{},
+			},
+			command: "echo {{last_output}}",
+			want:    `echo 'it'\''s $(rm -rf ~)'`,
+		},
+		{
+			name:    "quotes around references are replaced",
+			outputs: newToolOutputs(messages),
+			command: `echo '{{last_output}}' "{{output:list_files}}"`,
+			want:    "echo 'hello' 'a.txt\nb.txt'",
+		},
+		{
+			name:    "nil outputs leave command untouched",
+			outputs: nil,
+			command: "echo '{{last_output}}'",
+			want:    "echo '{{last_output}}'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.outputs.substitute(tt.command); got != tt.want {
+				t.Errorf("substitute() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSafeMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		safeMode bool
+		safe     bool
+		wantErr  bool
+	}{
+		{name: "safe mode disabled allows unsafe function", safeMode: false, safe: false, wantErr: false},
+		{name: "safe mode allows safe function", safeMode: true, safe: true, wantErr: false},
+		{name: "safe mode refuses unsafe function", safeMode: true, safe: false, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSafeMode(tt.safeMode, FunctionConfig{Name: "rm_file", Safe: tt.safe})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSafeMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessConditionals(t *testing.T) {
+	t.Setenv("ESA_TEST_SET", "1")
+	t.Setenv("ESA_TEST_EMPTY", "")
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "set variable keeps content",
+			input: "a {{?env:ESA_TEST_SET}}b{{/?}} c",
+			want:  "a b c",
+		},
+		{
+			name:  "empty variable drops content",
+			input: "a {{?env:ESA_TEST_EMPTY}}b{{/?}} c",
+			want:  "a  c",
+		},
+		{
+			name:  "unset variable drops multiline content",
+			input: "a\n{{?env:ESA_TEST_UNSET}}\nb\n{{/?}}\nc",
+			want:  "a\n\nc",
+		},
+		{
+			name:  "multiple blocks",
+			input: "{{?env:ESA_TEST_SET}}x{{/?}}{{?env:ESA_TEST_UNSET}}y{{/?}}",
+			want:  "x",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := processConditionals(tt.input); got != tt.want {
+				t.Errorf("processConditionals() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessShellBlocks_SkipsDroppedConditional(t *testing.T) {
+	marker := t.TempDir() + "/ran"
+	input := "{{?env:ESA_TEST_UNSET}}{{$touch " + marker + "}}{{/?}}done"
+
+	result, err := processShellBlocks(input)
+	if err != nil {
+		t.Fatalf("processShellBlocks() error = %v", err)
+	}
+	if result != "done" {
+		t.Errorf("processShellBlocks() = %q, want %q", result, "done")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("shell block inside a dropped conditional was executed")
+	}
+}
+
+func TestRunShellBlock_TimeoutWithBackgroundChild(t *testing.T) {
+	shellBlockTimeout.Store(int64(200 * time.Millisecond))
+	t.Cleanup(func() { shellBlockTimeout.Store(int64(defaultShellBlockTimeout)) })
+
+	start := time.Now()
+	result := runShellBlock("sleep 30 | cat")
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("runShellBlock() took %s, want it to stop after the timeout", elapsed)
+	}
+	if !strings.HasPrefix(result, "Error: command timed out") {
+		t.Errorf("runShellBlock() = %q, want a timeout error", result)
+	}
+}
+
+func TestResolvePromptForDisplay(t *testing.T) {
+	got, err := resolvePromptForDisplay("Hi {{$echo there}}, {{#Enter your name:}}")
+	if err != nil {
+		t.Fatalf("resolvePromptForDisplay() error = %v", err)
+	}
+	want := "Hi there, <user input: Enter your name:>"
+	if got != want {
+		t.Errorf("resolvePromptForDisplay() = %q, want %q", got, want)
+	}
+}
+
+func TestExecuteShellCommand_OutputCap(t *testing.T) {
+	tests := []struct {
+		name      string
+		command   string
+		maxOutput int
+		wantLen   int
+		wantErr   bool
+	}{
+		{name: "output under the cap", command: "printf hello", maxOutput: 100, wantLen: 5, wantErr: false},
+		{name: "runaway output is stopped", command: "yes", maxOutput: 1024, wantLen: 1024, wantErr: true},
+		{name: "runaway pipeline is stopped", command: "yes | cat", maxOutput: 1024, wantLen: 1024, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := FunctionConfig{Name: "test", Stdin: " ", MaxOutput: tt.maxOutput, Timeout: 10}
+			start := time.Now()
+			output, _, err := executeShellCommand(tt.command, fc, nil)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("executeShellCommand() took %s, want it to stop at the cap", elapsed)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("executeShellCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(output) != tt.wantLen {
+				t.Errorf("len(output) = %d, want %d", len(output), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestRunPreview(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(file, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params := []ParameterConfig{
+		{Name: "path", Type: "string", Required: true},
+		{Name: "content", Type: "string", Required: true},
+	}
+
+	tests := []struct {
+		name         string
+		preview      string
+		wantContains string
+	}{
+		{
+			name:         "diff against stdin",
+			preview:      "diff -u {{path}} -",
+			wantContains: "+new",
+		},
+		{
+			name:         "parameters are substituted",
+			preview:      "echo writing to {{path}}",
+			wantContains: "writing to " + file,
+		},
+		{
+			name:         "failure without output",
+			preview:      "exit 3",
+			wantContains: "Preview failed: exit status 3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := FunctionConfig{
+				Name:       "write_file",
+				Command:    "tee {{path}}",
+				Preview:    tt.preview,
+				Stdin:      "{{content}}",
+				Parameters: params,
+			}
+			args := map[string]any{"path": file, "content": "new"}
+
+			got := runPreview(fc, args, newToolOutputs(nil))
+			if !strings.Contains(got, tt.wantContains) {
+				t.Errorf("runPreview() = %q, want to contain %q", got, tt.wantContains)
+			}
+		})
+	}
+
+	// The preview must not run the command itself
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old\n" {
+		t.Errorf("file content = %q, want it unchanged", data)
+	}
+}
+
+func TestExecuteShellCommandWithRetries(t *testing.T) {
+	originalDelay := functionRetryDelay
+	defer func() { functionRetryDelay = originalDelay }()
+	functionRetryDelay = func(attempt int) time.Duration { return 10 * time.Millisecond }
+
+	tests := []struct {
+		name         string
+		failures     int // number of times the command fails before succeeding
+		retries      int
+		wantErr      bool
+		wantAttempts int
+	}{
+		{name: "succeeds first time", failures: 0, retries: 3, wantErr: false, wantAttempts: 1},
+		{name: "succeeds after retries", failures: 2, retries: 3, wantErr: false, wantAttempts: 3},
+		{name: "runs out of retries", failures: 5, retries: 2, wantErr: true, wantAttempts: 3},
+		{name: "no retries configured", failures: 1, retries: 0, wantErr: true, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := filepath.Join(t.TempDir(), "attempts")
+			command := fmt.Sprintf(`echo x >> %s; [ "$(wc -l < %s)" -gt %d ]`, counter, counter, tt.failures)
+
+			fc := FunctionConfig{Name: "flaky", Stdin: " ", Retries: tt.retries, Timeout: 10}
+			_, _, err := executeShellCommandWithRetries(command, fc, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("executeShellCommandWithRetries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			data, err := os.ReadFile(counter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempts := strings.Count(string(data), "\n"); attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestExecuteShellCommandWithRetries_SharedTimeout(t *testing.T) {
+	originalDelay := functionRetryDelay
+	defer func() { functionRetryDelay = originalDelay }()
+	functionRetryDelay = func(attempt int) time.Duration { return 10 * time.Millisecond }
+
+	// The first attempt uses up the whole timeout so there is no time
+	// left to retry
+	fc := FunctionConfig{Name: "slow", Stdin: " ", Retries: 5, Timeout: 1}
+	start := time.Now()
+	_, _, err := executeShellCommandWithRetries("sleep 5", fc, nil)
+	if err == nil {
+		t.Fatal("executeShellCommandWithRetries() error = nil, want timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("executeShellCommandWithRetries() took %s, want the timeout to be shared by all attempts", elapsed)
+	}
+}
+
+func TestExecuteShellCommandWithRetries_SlowFirstAttempt(t *testing.T) {
+	originalDelay := functionRetryDelay
+	defer func() { functionRetryDelay = originalDelay }()
+	functionRetryDelay = func(attempt int) time.Duration { return 10 * time.Millisecond }
+
+	// The first attempt fails after using most of the timeout, and a
+	// retry would succeed if it were given a timeout of its own
+	marker := filepath.Join(t.TempDir(), "attempted")
+	command := fmt.Sprintf("if [ -f %[1]s ]; then exit 0; fi; touch %[1]s; sleep 1.5; exit 1", marker)
+	fc := FunctionConfig{Name: "flaky", Stdin: " ", Retries: 3, Timeout: 2}
+	start := time.Now()
+	_, _, err := executeShellCommandWithRetries(command, fc, nil)
+	if err == nil {
+		t.Error("executeShellCommandWithRetries() error = nil, want the first attempt to count against the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("executeShellCommandWithRetries() took %s, want at most the 2s timeout", elapsed)
+	}
+}
+
+func TestProgressMessage(t *testing.T) {
+	fc := FunctionConfig{
+		Name:            "search",
+		ProgressMessage: "Searching {{registry}} for {{query}}...",
+		Parameters: []ParameterConfig{
+			{Name: "query", Type: "string", Required: true},
+			{Name: "registry", Type: "string", Default: "npm"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		args map[string]any
+		want string
+	}{
+		{name: "all given", args: map[string]any{"query": "left-pad", "registry": "jsr"}, want: "Searching jsr for left-pad..."},
+		{name: "default used", args: map[string]any{"query": "left-pad"}, want: "Searching npm for left-pad..."},
+		{name: "missing value", args: map[string]any{}, want: "Searching npm for ..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := progressMessage(fc, tt.args); got != tt.want {
+				t.Errorf("progressMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
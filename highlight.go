@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+// codeHighlightStyle is the chroma style used for code blocks
+const codeHighlightStyle = "monokai"
+
+// codeHighlighter writes streamed markdown as is, except for fenced code
+// blocks which are syntax highlighted. Code is highlighted a line at a
+// time, so the response keeps streaming without waiting for the block
+// to end.
+type codeHighlighter struct {
+	out         io.Writer
+	pending     string // start of a line that may still turn out to be a fence
+	passthrough bool   // the rest of the current line is plain text
+	inCode      bool
+	fence       string
+	lexer       chroma.Lexer
+}
+
+func newCodeHighlighter(out io.Writer) *codeHighlighter {
+	return &codeHighlighter{out: out}
+}
+
+// shouldHighlightCode reports whether code blocks in streamed output
+// should be highlighted. Highlighting is only done when writing to a
+// terminal and colors are not disabled.
+func shouldHighlightCode(opts *CLIOptions, settings Settings) bool {
+	if opts.NoHighlight || settings.NoHighlight || opts.Pretty || color.NoColor {
+		return false
+	}
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// Write writes a chunk of the streamed response
+func (h *codeHighlighter) Write(text string) {
+	for text != "" {
+		part := text
+		complete := false
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			part, text = text[:i+1], text[i+1:]
+			complete = true
+		} else {
+			text = ""
+		}
+
+		if h.passthrough {
+			io.WriteString(h.out, part)
+			h.passthrough = !complete
+			continue
+		}
+
+		h.pending += part
+		if complete {
+			h.writeLine(h.pending)
+			h.pending = ""
+			continue
+		}
+
+		// Text outside of code blocks is written as soon as it is clear
+		// that the line does not start a code block
+		if !h.inCode && !mayBeFence(h.pending) {
+			io.WriteString(h.out, h.pending)
+			h.pending = ""
+			h.passthrough = true
+		}
+	}
+}
+
+// Flush writes out anything held back and resets the state for the
+// next response
+func (h *codeHighlighter) Flush() {
+	if h.pending != "" {
+		h.writeLine(h.pending)
+	}
+	*h = codeHighlighter{out: h.out}
+}
+
+// writeLine writes a complete line, tracking the start and end of code
+// blocks
+func (h *codeHighlighter) writeLine(line string) {
+	trimmed := strings.TrimSpace(line)
+	dim := color.New(color.Faint)
+
+	switch {
+	case !h.inCode && isFence(trimmed):
+		h.inCode = true
+		h.fence = trimmed[:3]
+		h.lexer = lexers.Get(strings.TrimSpace(strings.TrimLeft(trimmed, h.fence[:1])))
+		dim.Fprint(h.out, line)
+	case h.inCode && strings.HasPrefix(trimmed, h.fence) && strings.Trim(trimmed, h.fence[:1]) == "":
+		h.inCode = false
+		h.lexer = nil
+		dim.Fprint(h.out, line)
+	case h.inCode:
+		h.writeCode(line)
+	default:
+		io.WriteString(h.out, line)
+	}
+}
+
+// writeCode highlights a line of code, falling back to an accent color
+// when the language is not known
+func (h *codeHighlighter) writeCode(line string) {
+	if h.lexer != nil {
+		iterator, err := chroma.Coalesce(h.lexer).Tokenise(nil, line)
+		if err == nil && formatters.TTY256.Format(h.out, styles.Get(codeHighlightStyle), iterator) == nil {
+			return
+		}
+	}
+
+	code, newline := strings.CutSuffix(line, "\n")
+	color.New(color.FgCyan).Fprint(h.out, code)
+	if newline {
+		io.WriteString(h.out, "\n")
+	}
+}
+
+// isFence reports whether a trimmed line opens or closes a code block
+func isFence(line string) bool {
+	return strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~")
+}
+
+// mayBeFence reports whether the start of a line could still turn into
+// a code fence once more of it has been streamed
+func mayBeFence(start string) bool {
+	trimmed := strings.TrimLeft(start, " \t")
+	return isFence(trimmed) || strings.HasPrefix("```", trimmed) || strings.HasPrefix("~~~", trimmed)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestCodeHighlighter(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		wantHighlight bool
+	}{
+		{
+			name:  "plain text",
+			input: "Use `ls -la` to list files.\nThat is all.",
+		},
+		{
+			name:          "go code block",
+			input:         "Here:\n\n```go\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n```\n\nDone.",
+			wantHighlight: true,
+		},
+		{
+			name:          "unknown language",
+			input:         "```nosuchlang\nsome code\n```\n",
+			wantHighlight: false,
+		},
+		{
+			name:          "indented tilde fence",
+			input:         "  ~~~python\n  print(1)\n  ~~~\n",
+			wantHighlight: true,
+		},
+		{
+			name:  "unterminated code block",
+			input: "```sh\necho hi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stream the input a few bytes at a time to split fences
+			// and lines across chunks
+			for _, chunkSize := range []int{1, 2, 5, len(tt.input)} {
+				var out strings.Builder
+				h := newCodeHighlighter(&out)
+				for i := 0; i < len(tt.input); i += chunkSize {
+					h.Write(tt.input[i:min(i+chunkSize, len(tt.input))])
+				}
+				h.Flush()
+
+				got := out.String()
+				if plain := ansiEscape.ReplaceAllString(got, ""); plain != tt.input {
+					t.Errorf("chunk size %d: output = %q, want %q", chunkSize, plain, tt.input)
+				}
+				if tt.wantHighlight && !ansiEscape.MatchString(got) {
+					t.Errorf("chunk size %d: output = %q, want highlighted code", chunkSize, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCodeHighlighterPassesTextThrough(t *testing.T) {
+	var out strings.Builder
+	h := newCodeHighlighter(&out)
+
+	h.Write("Hello")
+	if got := out.String(); got != "Hello" {
+		t.Errorf("output = %q, want text written before the line ends", got)
+	}
+
+	h.Write("\n``")
+	if got := out.String(); got != "Hello\n" {
+		t.Errorf("output = %q, want a possible fence to be held back", got)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// historyPassphraseEnvar holds the passphrase used to encrypt history
+// files when encrypt_history is enabled
+const historyPassphraseEnvar = "ESA_HISTORY_PASSPHRASE"
+
+// historyMagic prefixes encrypted history files so that they can be told
+// apart from plaintext ones
+const historyMagic = "ESAENC1\n"
+
+const (
+	historySaltSize   = 16
+	historyKeySize    = 32 // AES-256
+	historyIterations = 200000
+)
+
+// historyKeys caches derived keys by salt and passphrase as deriving a
+// key is deliberately slow and history is saved after every response
+var historyKeys = struct {
+	sync.Mutex
+	salt []byte // salt used for files written by this process
+	keys map[string][]byte
+}{keys: make(map[string][]byte)}
+
+// readHistoryData reads a history file, decrypting it if needed
+func readHistoryData(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decryptHistory(data)
+}
+
+// encryptHistory encrypts history data with AES-GCM using a key derived
+// from the passphrase in ESA_HISTORY_PASSPHRASE. The output consists of
+// the magic header, the salt, the nonce and the sealed data.
+func encryptHistory(data []byte) ([]byte, error) {
+	passphrase := os.Getenv(historyPassphraseEnvar)
+	if passphrase == "" {
+		return nil, fmt.Errorf("history encryption is enabled but %s is not set", historyPassphraseEnvar)
+	}
+
+	historyKeys.Lock()
+	if historyKeys.salt == nil {
+		salt := make([]byte, historySaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			historyKeys.Unlock()
+			return nil, err
+		}
+		historyKeys.salt = salt
+	}
+	salt := historyKeys.salt
+	historyKeys.Unlock()
+
+	gcm, err := historyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(historyMagic)+len(salt)+len(nonce)+len(data)+gcm.Overhead())
+	out = append(out, historyMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, []byte(historyMagic)), nil
+}
+
+// decryptHistory returns plaintext history data as is and decrypts data
+// written by encryptHistory
+func decryptHistory(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(historyMagic)) {
+		return data, nil
+	}
+
+	passphrase := os.Getenv(historyPassphraseEnvar)
+	if passphrase == "" {
+		return nil, fmt.Errorf("history file is encrypted: set %s to read it", historyPassphraseEnvar)
+	}
+
+	data = data[len(historyMagic):]
+	if len(data) < historySaltSize {
+		return nil, fmt.Errorf("encrypted history file is truncated")
+	}
+	salt, data := data[:historySaltSize], data[historySaltSize:]
+
+	gcm, err := historyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted history file is truncated")
+	}
+	nonce, sealed := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, sealed, []byte(historyMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt history file: wrong passphrase or corrupted file")
+	}
+	return plain, nil
+}
+
+// historyCipher returns the AES-GCM cipher for passphrase and salt
+func historyCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	cacheKey := string(salt) + "\x00" + passphrase
+
+	historyKeys.Lock()
+	key, ok := historyKeys.keys[cacheKey]
+	if !ok {
+		key = pbkdf2.Key([]byte(passphrase), salt, historyIterations, historyKeySize, sha256.New)
+		historyKeys.keys[cacheKey] = key
+	}
+	historyKeys.Unlock()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
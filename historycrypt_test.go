@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHistoryCipher(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	sealer, err := historyCipher("secret", salt)
+	if err != nil {
+		t.Fatalf("historyCipher() error = %v", err)
+	}
+	nonce := make([]byte, sealer.NonceSize())
+	sealed := sealer.Seal(nil, nonce, []byte("hello"), nil)
+
+	// Derive the key again instead of reusing the cached one
+	historyKeys.Lock()
+	clear(historyKeys.keys)
+	historyKeys.Unlock()
+
+	tests := []struct {
+		name       string
+		passphrase string
+		salt       []byte
+		wantErr    bool
+	}{
+		{name: "same passphrase and salt", passphrase: "secret", salt: salt},
+		{name: "different passphrase", passphrase: "wrong", salt: salt, wantErr: true},
+		{name: "different salt", passphrase: "secret", salt: []byte("fedcba9876543210"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gcm, err := historyCipher(tt.passphrase, tt.salt)
+			if err != nil {
+				t.Fatalf("historyCipher() error = %v", err)
+			}
+			got, err := gcm.Open(nil, nonce, sealed, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != "hello" {
+				t.Errorf("Open() = %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestHistoryEncryption(t *testing.T) {
+	plain := []byte(`{"agent_path":"builtin:default","messages":[]}`)
+
+	t.Setenv(historyPassphraseEnvar, "secret")
+	encrypted, err := encryptHistory(plain)
+	if err != nil {
+		t.Fatalf("encryptHistory() error = %v", err)
+	}
+	if bytes.Contains(encrypted, []byte("builtin:default")) {
+		t.Fatal("encryptHistory() output contains plaintext")
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		data       []byte
+		want       []byte
+		wantErr    bool
+	}{
+		{name: "decrypts with the passphrase", passphrase: "secret", data: encrypted, want: plain},
+		{name: "plaintext is returned as is", passphrase: "", data: plain, want: plain},
+		{name: "wrong passphrase", passphrase: "wrong", data: encrypted, wantErr: true},
+		{name: "missing passphrase", passphrase: "", data: encrypted, wantErr: true},
+		{name: "truncated file", passphrase: "secret", data: encrypted[:len(historyMagic)+4], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(historyPassphraseEnvar, tt.passphrase)
+			got, err := decryptHistory(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decryptHistory() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("decryptHistory() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkJobToolName is the name of the tool added to agents with
+// background functions to check on the jobs they start
+const checkJobToolName = "check_job"
+
+const (
+	// checkJobOutputTail is the number of bytes of job output returned
+	// by check_job, counted from the end
+	checkJobOutputTail = 16 << 10
+	// maxCheckJobWait is the longest check_job waits for a job to finish
+	maxCheckJobWait = 60
+)
+
+// backgroundJob is a command started by a background function
+type backgroundJob struct {
+	id       string
+	name     string
+	command  string
+	pid      int
+	started  time.Time
+	output   *cappedWriter
+	cancel   context.CancelFunc
+	done     chan struct{}
+	finished time.Time // set before done is closed
+	err      error     // set before done is closed
+}
+
+// jobRegistry keeps track of background jobs. Each conversation has its
+// own, so that check_job only sees the jobs started in it: the CLI and
+// the REPL have one per run and the web server one per session.
+type jobRegistry struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[string]*backgroundJob
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*backgroundJob)}
+}
+
+// start runs command in the background and returns the started job.
+// The function timeout is only applied when it is set explicitly.
+func (r *jobRegistry) start(command string, fc FunctionConfig, args map[string]any) (*backgroundJob, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if fc.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(fc.Timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	maxOutput := fc.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultMaxToolOutput
+	}
+
+	cmd, _, err := newShellCommand(ctx, command, fc, args)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Background jobs must not read from the terminal
+	if fc.Stdin == "" {
+		cmd.Stdin = nil
+	}
+
+	output := &cappedWriter{limit: maxOutput, onExceed: cancel}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.nextID++
+	job := &backgroundJob{
+		id:      strconv.Itoa(r.nextID),
+		name:    fc.Name,
+		command: command,
+		pid:     cmd.Process.Pid,
+		started: time.Now(),
+		output:  output,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	r.jobs[job.id] = job
+	r.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			switch {
+			case output.exceeded():
+				err = fmt.Errorf("stopped after producing more than %d bytes of output", maxOutput)
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				err = fmt.Errorf("timed out after %d seconds", fc.Timeout)
+			default:
+				err = errors.New("stopped")
+			}
+		}
+		job.finished = time.Now()
+		job.err = err
+		cancel()
+		close(job.done)
+	}()
+
+	return job, nil
+}
+
+// get returns the job with the given ID
+func (r *jobRegistry) get(id string) (*backgroundJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	return job, ok
+}
+
+// stopAll stops all running jobs and waits for them to exit
+func (r *jobRegistry) stopAll() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	jobs := make([]*backgroundJob, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		jobs = append(jobs, job)
+	}
+	r.mu.Unlock()
+
+	for _, job := range jobs {
+		job.cancel()
+	}
+	for _, job := range jobs {
+		<-job.done
+	}
+}
+
+// startBackgroundJob starts a background function and returns the
+// message telling the model how to check on it
+func startBackgroundJob(jobs *jobRegistry, command string, fc FunctionConfig, args map[string]any) (string, error) {
+	job, err := jobs.start(command, fc, args)
+	if err != nil {
+		return "", fmt.Errorf("failed to start background job: %w", err)
+	}
+
+	return fmt.Sprintf("Started background job %s (pid %d). Use the %s tool with job_id %q to check its status and output.",
+		job.id, job.pid, checkJobToolName, job.id), nil
+}
+
+// checkJobFunction returns the tool added to agents with background
+// functions. It is run in-process rather than as a shell command.
+func checkJobFunction() FunctionConfig {
+	return FunctionConfig{
+		Name: checkJobToolName,
+		Description: "Check the status and output of a job started by a background function. " +
+			"Use wait to block until the job finishes, up to the given number of seconds.",
+		Command: checkJobToolName + " {{job_id}}",
+		Safe:    true,
+		Parameters: []ParameterConfig{
+			{Name: "job_id", Type: "string", Description: "ID of the job to check", Required: true},
+			{Name: "wait", Type: "number", Description: fmt.Sprintf("Seconds to wait for the job to finish (max %d)", maxCheckJobWait)},
+		},
+		run: checkJob,
+	}
+}
+
+// checkJob reports the status of a background job along with the end of
+// its output
+func checkJob(args map[string]any, jobs *jobRegistry) (string, error) {
+	id := strings.TrimSpace(fmt.Sprint(args["job_id"]))
+	job, ok := jobs.get(id)
+	if !ok {
+		return "", fmt.Errorf("no background job with id %q", id)
+	}
+
+	if wait, ok := args["wait"].(float64); ok && wait > 0 {
+		wait = min(wait, maxCheckJobWait)
+		select {
+		case <-job.done:
+		case <-time.After(time.Duration(wait * float64(time.Second))):
+		}
+	}
+
+	var status string
+	select {
+	case <-job.done:
+		elapsed := job.finished.Sub(job.started).Round(time.Second)
+		var exitErr *exec.ExitError
+		switch {
+		case job.err == nil:
+			status = fmt.Sprintf("finished successfully after %s", elapsed)
+		case errors.As(job.err, &exitErr):
+			status = fmt.Sprintf("failed with exit code %d after %s", exitErr.ExitCode(), elapsed)
+		default:
+			status = fmt.Sprintf("failed after %s: %v", elapsed, job.err)
+		}
+	default:
+		status = fmt.Sprintf("running for %s", time.Since(job.started).Round(time.Second))
+	}
+
+	output := job.output.bytes()
+	outputHeader := "Output:"
+	if len(output) > checkJobOutputTail {
+		output = output[len(output)-checkJobOutputTail:]
+		outputHeader = fmt.Sprintf("Output (last %d bytes):", checkJobOutputTail)
+	}
+
+	return fmt.Sprintf("Job %s (%s): %s\nCommand: %s\n\n%s\n%s",
+		job.id, job.name, status, job.command, outputHeader, strings.TrimSpace(string(output))), nil
+}
+
+// runFunctionCommand runs the command of a function: in-process for
+// built-in tools, in the background for background functions and as a
+// shell command with retries otherwise
+func runFunctionCommand(command string, fc FunctionConfig, args map[string]any, jobs *jobRegistry) ([]byte, string, error) {
+	switch {
+	case fc.run != nil:
+		result, err := fc.run(args, jobs)
+		return []byte(result), "", err
+	case fc.Background:
+		result, err := startBackgroundJob(jobs, command, fc, args)
+		return []byte(result), "", err
+	default:
+		return executeShellCommandWithRetries(command, fc, args)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackgroundJobs(t *testing.T) {
+	tests := []struct {
+		name         string
+		command      string
+		wait         float64
+		wantContains []string
+	}{
+		{
+			name:         "running job",
+			command:      "echo started; sleep 5",
+			wait:         0.2,
+			wantContains: []string{"running for", "started"},
+		},
+		{
+			name:         "finished job",
+			command:      "echo done",
+			wait:         5,
+			wantContains: []string{"finished successfully", "done"},
+		},
+		{
+			name:         "failed job",
+			command:      "echo oops; exit 3",
+			wait:         5,
+			wantContains: []string{"failed with exit code 3", "oops"},
+		},
+	}
+
+	jobs := newJobRegistry()
+	defer jobs.stopAll()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := FunctionConfig{Name: "build", Background: true}
+			result, _, err := runFunctionCommand(tt.command, fc, nil, jobs)
+			if err != nil {
+				t.Fatalf("runFunctionCommand() error = %v", err)
+			}
+			if !strings.Contains(string(result), "Started background job") {
+				t.Fatalf("runFunctionCommand() = %q, want a started job", result)
+			}
+
+			id := strings.Fields(strings.TrimPrefix(string(result), "Started background job "))[0]
+			status, err := checkJob(map[string]any{"job_id": id, "wait": tt.wait}, jobs)
+			if err != nil {
+				t.Fatalf("checkJob() error = %v", err)
+			}
+			for _, want := range tt.wantContains {
+				if !strings.Contains(status, want) {
+					t.Errorf("checkJob() = %q, want to contain %q", status, want)
+				}
+			}
+		})
+	}
+
+	if _, err := checkJob(map[string]any{"job_id": "999"}, jobs); err == nil {
+		t.Error("checkJob() with an unknown job should fail")
+	}
+	if _, err := checkJob(map[string]any{"job_id": "1"}, newJobRegistry()); err == nil {
+		t.Error("checkJob() found a job started in another conversation")
+	}
+}
+
+func TestBackgroundJobsStopAll(t *testing.T) {
+	jobs := newJobRegistry()
+	job, err := jobs.start("sleep 30", FunctionConfig{Name: "sleep"}, nil)
+	if err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	start := time.Now()
+	jobs.stopAll()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("stopAll() took %s, want running jobs to be stopped", elapsed)
+	}
+
+	select {
+	case <-job.done:
+	default:
+		t.Fatal("job is still running after stopAll()")
+	}
+}
+
+func TestValidateAgent_BackgroundAddsCheckJob(t *testing.T) {
+	tests := []struct {
+		name          string
+		functions     []FunctionConfig
+		wantCheckJob  bool
+		wantFunctions int
+	}{
+		{
+			name:          "background function",
+			functions:     []FunctionConfig{{Name: "deploy", Command: "make deploy", Background: true}},
+			wantCheckJob:  true,
+			wantFunctions: 2,
+		},
+		{
+			name:          "no background function",
+			functions:     []FunctionConfig{{Name: "status", Command: "make status"}},
+			wantCheckJob:  false,
+			wantFunctions: 1,
+		},
+		{
+			name: "agent defines its own check_job",
+			functions: []FunctionConfig{
+				{Name: "deploy", Command: "make deploy", Background: true},
+				{Name: "check_job", Command: "jobs"},
+			},
+			wantCheckJob:  false,
+			wantFunctions: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, err := validateAgent(Agent{Name: "ops", Functions: tt.functions})
+			if err != nil {
+				t.Fatalf("validateAgent() error = %v", err)
+			}
+			if len(agent.Functions) != tt.wantFunctions {
+				t.Fatalf("functions = %d, want %d", len(agent.Functions), tt.wantFunctions)
+			}
+
+			last := agent.Functions[len(agent.Functions)-1]
+			if gotCheckJob := last.run != nil; gotCheckJob != tt.wantCheckJob {
+				t.Errorf("built-in check_job added = %v, want %v", gotCheckJob, tt.wantCheckJob)
+			}
+		})
+	}
+}
+
+func TestValidateAgent_InteractiveBackground(t *testing.T) {
+	agent := Agent{
+		Name:      "ops",
+		Functions: []FunctionConfig{{Name: "edit", Command: "vi", Background: true, Interactive: true}},
+	}
+	if _, err := validateAgent(agent); err == nil {
+		t.Error("validateAgent() error = nil, want error for an interactive background function")
+	}
+}
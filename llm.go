@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"slices"
 
 	"github.com/sashabaranov/go-openai"
 )
@@ -19,10 +22,31 @@ type LLMStream interface {
 type LLMStreamDelta struct {
 	// Content is a text fragment from the assistant's response.
 	Content string
+	// ReasoningContent is a fragment of the reasoning that some
+	// providers stream separately from the response.
+	ReasoningContent string
 	// ToolCalls contains tool call fragments being streamed.
-	// A tool call with a non-empty ID signals a new tool call;
-	// subsequent deltas with empty ID append to the last tool call's arguments.
+	// Fragments with an Index belong to the tool call with that index,
+	// which lets providers interleave parallel tool calls. Without an
+	// Index, a tool call with a non-empty ID signals a new tool call and
+	// subsequent deltas with empty ID append to the last tool call's
+	// arguments. See appendToolCallDelta.
 	ToolCalls []openai.ToolCall
+	// Usage is the token usage of the whole request. Providers send it
+	// once, usually with the last chunk.
+	Usage *openai.Usage
+	// FinishReason is why the model stopped, using the OpenAI values.
+	// It is only set on the chunk that ends the response.
+	FinishReason openai.FinishReason
+}
+
+// RequestOptions holds optional parameters of a chat completion
+// request. Unset values are left to the provider.
+type RequestOptions struct {
+	Temperature      *float32
+	MaxTokens        int
+	FrequencyPenalty *float32
+	PresencePenalty  *float32
 }
 
 // LLMClient abstracts an LLM provider for creating streaming chat completions.
@@ -32,36 +56,78 @@ type LLMClient interface {
 		model string,
 		messages []openai.ChatCompletionMessage,
 		tools []openai.Tool,
+		opts RequestOptions,
 	) (LLMStream, error)
 }
 
 // openAILLMClient wraps the go-openai client to implement LLMClient.
+// streamUsage asks for the token usage with stream_options, which not
+// every OpenAI-compatible provider accepts.
 type openAILLMClient struct {
-	client *openai.Client
+	client      *openai.Client
+	streamUsage bool
+}
+
+func newOpenAILLMClient(client *openai.Client, streamUsage bool) LLMClient {
+	return &openAILLMClient{client: client, streamUsage: streamUsage}
 }
 
-func newOpenAILLMClient(client *openai.Client) LLMClient {
-	return &openAILLMClient{client: client}
+// nonZeroFloat32 returns the smallest value above zero in place of zero.
+// Zero values are dropped from the request as the fields are omitempty,
+// which would leave an explicit zero to the provider's default.
+func nonZeroFloat32(v float32) float32 {
+	if v == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return v
 }
 
 func (c *openAILLMClient) CreateChatCompletionStream(
 	model string,
 	messages []openai.ChatCompletionMessage,
 	tools []openai.Tool,
+	opts RequestOptions,
 ) (LLMStream, error) {
-	stream, err := c.client.CreateChatCompletionStream(
-		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:    model,
-			Messages: messages,
-			Tools:    tools,
-		})
+	request := openai.ChatCompletionRequest{
+		Model:     model,
+		Messages:  withoutReasoning(messages),
+		Tools:     tools,
+		MaxTokens: opts.MaxTokens,
+	}
+	if c.streamUsage {
+		request.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	if opts.Temperature != nil {
+		request.Temperature = nonZeroFloat32(*opts.Temperature)
+	}
+	if opts.FrequencyPenalty != nil {
+		request.FrequencyPenalty = nonZeroFloat32(*opts.FrequencyPenalty)
+	}
+	if opts.PresencePenalty != nil {
+		request.PresencePenalty = nonZeroFloat32(*opts.PresencePenalty)
+	}
+
+	stream, err := c.client.CreateChatCompletionStream(context.Background(), request)
 	if err != nil {
 		return nil, err
 	}
 	return &openAILLMStream{stream: stream}, nil
 }
 
+// withoutReasoning returns messages with the reasoning saved along with
+// responses removed, as providers reject it in requests
+func withoutReasoning(messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if !slices.ContainsFunc(messages, func(m openai.ChatCompletionMessage) bool { return m.ReasoningContent != "" }) {
+		return messages
+	}
+
+	stripped := slices.Clone(messages)
+	for i := range stripped {
+		stripped[i].ReasoningContent = ""
+	}
+	return stripped
+}
+
 // openAILLMStream wraps the go-openai stream to implement LLMStream.
 type openAILLMStream struct {
 	stream *openai.ChatCompletionStream
@@ -74,12 +140,15 @@ func (s *openAILLMStream) Recv() (LLMStreamDelta, error) {
 	}
 
 	if len(response.Choices) == 0 {
-		return LLMStreamDelta{}, nil
+		return LLMStreamDelta{Usage: response.Usage}, nil
 	}
 
 	delta := LLMStreamDelta{
-		Content:   response.Choices[0].Delta.Content,
-		ToolCalls: response.Choices[0].Delta.ToolCalls,
+		Content:          response.Choices[0].Delta.Content,
+		ReasoningContent: response.Choices[0].Delta.ReasoningContent,
+		ToolCalls:        response.Choices[0].Delta.ToolCalls,
+		Usage:            response.Usage,
+		FinishReason:     response.Choices[0].FinishReason,
 	}
 	return delta, nil
 }
@@ -90,3 +159,55 @@ func (s *openAILLMStream) Close() {
 
 var _ LLMClient = (*openAILLMClient)(nil)
 var _ LLMStream = (*openAILLMStream)(nil)
+
+// appendToolCallDelta adds a streamed tool call fragment to the tool
+// calls assembled so far
+func appendToolCallDelta(toolCalls []openai.ToolCall, delta openai.ToolCall) []openai.ToolCall {
+	target := -1
+	if delta.Index != nil {
+		for i, call := range toolCalls {
+			// A different ID under the same index is a new call, as
+			// sent by providers that number every call 0
+			if call.Index != nil && *call.Index == *delta.Index &&
+				(delta.ID == "" || call.ID == "" || delta.ID == call.ID) {
+				target = i
+			}
+		}
+	} else if delta.ID == "" && len(toolCalls) > 0 {
+		target = len(toolCalls) - 1
+	}
+
+	// Anything else starts a new call, including a first fragment
+	// without an ID from a misbehaving provider. completeToolCalls
+	// fills in what such calls are missing once the stream ends.
+
+	if target < 0 {
+		return append(toolCalls, delta)
+	}
+
+	call := &toolCalls[target]
+	if call.ID == "" {
+		call.ID = delta.ID
+	}
+	if call.Type == "" {
+		call.Type = delta.Type
+	}
+	if call.Function.Name == "" {
+		call.Function.Name = delta.Function.Name
+	}
+	call.Function.Arguments += delta.Function.Arguments
+	return toolCalls
+}
+
+// completeToolCalls gives streamed tool calls that came without an ID
+// or type one, so that they can be run and answered like any other
+func completeToolCalls(toolCalls []openai.ToolCall) {
+	for i := range toolCalls {
+		if toolCalls[i].ID == "" {
+			toolCalls[i].ID = fmt.Sprintf("call_%d", i)
+		}
+		if toolCalls[i].Type == "" {
+			toolCalls[i].Type = openai.ToolTypeFunction
+		}
+	}
+}
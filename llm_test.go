@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestAppendToolCallDelta(t *testing.T) {
+	index := func(i int) *int { return &i }
+	call := func(idx *int, id, name, args string) openai.ToolCall {
+		tc := openai.ToolCall{Index: idx, ID: id, Function: openai.FunctionCall{Name: name, Arguments: args}}
+		if id != "" {
+			tc.Type = openai.ToolTypeFunction
+		}
+		return tc
+	}
+
+	tests := []struct {
+		name   string
+		deltas []openai.ToolCall
+		want   []string // name and arguments of each assembled call
+	}{
+		{
+			name: "sequential without index",
+			deltas: []openai.ToolCall{
+				call(nil, "a", "ls", `{"pa`), call(nil, "", "", `th":"."}`),
+				call(nil, "b", "cat", `{}`),
+			},
+			want: []string{`ls {"path":"."}`, `cat {}`},
+		},
+		{
+			name: "interleaved by index",
+			deltas: []openai.ToolCall{
+				call(index(0), "a", "ls", ""), call(index(1), "b", "cat", ""),
+				call(index(0), "", "", `{"path":`), call(index(1), "", "", `{"file":`),
+				call(index(1), "", "", `"x"}`), call(index(0), "", "", `"."}`),
+			},
+			want: []string{`ls {"path":"."}`, `cat {"file":"x"}`},
+		},
+		{
+			name: "same index with new ids",
+			deltas: []openai.ToolCall{
+				call(index(0), "a", "ls", `{}`), call(index(0), "b", "cat", `{"fi`),
+				call(index(0), "", "", `le":"x"}`),
+			},
+			want: []string{`ls {}`, `cat {"file":"x"}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var toolCalls []openai.ToolCall
+			for _, delta := range tt.deltas {
+				toolCalls = appendToolCallDelta(toolCalls, delta)
+			}
+
+			var got []string
+			for _, tc := range toolCalls {
+				got = append(got, tc.Function.Name+" "+tc.Function.Arguments)
+				if tc.Type != openai.ToolTypeFunction {
+					t.Errorf("tool call %s has type %q, want function", tc.ID, tc.Type)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("tool calls = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// outputPathStep is one step of a parse_output path: a field of an
+// object, an element of an array or, with all set, every element
+type outputPathStep struct {
+	field string
+	index int
+	isIdx bool
+	all   bool
+}
+
+// parseOutputPath parses the path given as parse_output. Fields are
+// separated by dots, [N] picks an element of an array and [] every
+// element, e.g. items[].name or data.results[0].id.
+func parseOutputPath(path string) ([]outputPathStep, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+
+	var steps []outputPathStep
+	for i, segment := range strings.Split(path, ".") {
+		field, rest := segment, ""
+		if bracket := strings.IndexByte(segment, '['); bracket >= 0 {
+			field, rest = segment[:bracket], segment[bracket:]
+		}
+		// Only the path as a whole may start with a bracket, as in [0].id
+		if field == "" && (i > 0 || rest == "") {
+			return nil, fmt.Errorf("invalid path %q: empty field name", path)
+		}
+		if field != "" {
+			steps = append(steps, outputPathStep{field: field})
+		}
+
+		// The rest of the segment is a series of [] and [N]
+		for rest != "" {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid path %q: unclosed bracket", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+
+			if inner == "" {
+				steps = append(steps, outputPathStep{all: true})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid path %q: %q is not an array index", path, inner)
+			}
+			steps = append(steps, outputPathStep{index: index, isIdx: true})
+		}
+	}
+	return steps, nil
+}
+
+// extractOutputPath returns the part of value the steps point to.
+// Elements of an array taken with [] that do not have the rest of the
+// path are left out.
+func extractOutputPath(value any, steps []outputPathStep) (any, error) {
+	if len(steps) == 0 {
+		return value, nil
+	}
+
+	step, rest := steps[0], steps[1:]
+	switch {
+	case step.all:
+		items, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("[] used on %s, not an array", jsonKind(value))
+		}
+		results := []any{}
+		for _, item := range items {
+			if result, err := extractOutputPath(item, rest); err == nil {
+				results = append(results, result)
+			}
+		}
+		return results, nil
+
+	case step.isIdx:
+		items, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("[%d] used on %s, not an array", step.index, jsonKind(value))
+		}
+		if step.index >= len(items) {
+			return nil, fmt.Errorf("index %d out of range for %d elements", step.index, len(items))
+		}
+		return extractOutputPath(items[step.index], rest)
+
+	default:
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("field %q looked up in %s, not an object", step.field, jsonKind(value))
+		}
+		field, ok := object[step.field]
+		if !ok {
+			return nil, fmt.Errorf("no field %q", step.field)
+		}
+		return extractOutputPath(field, rest)
+	}
+}
+
+// jsonKind names the type of a decoded JSON value for error messages
+func jsonKind(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	default:
+		return "null"
+	}
+}
+
+// parseFunctionOutput returns the part of the JSON output of a function
+// selected by its parse_output path, so that the model is only sent
+// what it needs. Strings are returned as they are and other values as
+// compact JSON. When the output is not JSON or does not have the path,
+// the full output is returned with a warning.
+func parseFunctionOutput(fc FunctionConfig, output string) string {
+	steps, err := parseOutputPath(fc.ParseOutput)
+	if err != nil {
+		// Paths are checked when the agent is loaded
+		return output
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(output))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: output of function '%s' is not JSON, sending it in full: %v\n", fc.Name, err)
+		return output
+	}
+
+	result, err := extractOutputPath(value, steps)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not apply parse_output of function '%s', sending the output in full: %v\n", fc.Name, err)
+		return output
+	}
+
+	if s, ok := result.(string); ok {
+		return s
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(result); err != nil {
+		return output
+	}
+	return strings.TrimSpace(buf.String())
+}
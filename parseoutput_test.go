@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestParseOutputPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{path: "items[].name"},
+		{path: "data.results[0].id"},
+		{path: "[0].id"},
+		{path: "matrix[][1]"},
+		{path: "", wantErr: true},
+		{path: "items.", wantErr: true},
+		{path: "items[", wantErr: true},
+		{path: "items[x]", wantErr: true},
+		{path: "items.[0]", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := parseOutputPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseOutputPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseFunctionOutput(t *testing.T) {
+	output := `{"total": 12345678901234567, "items": [{"name": "a", "id": 1}, {"id": 2}, {"name": "<b>", "id": 3}], "owner": {"login": "meain"}}`
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "field of every element", path: "items[].name", want: `["a","<b>"]`},
+		{name: "element of an array", path: "items[2]", want: `{"id":3,"name":"<b>"}`},
+		{name: "strings are not quoted", path: "owner.login", want: "meain"},
+		{name: "large numbers are kept", path: "total", want: "12345678901234567"},
+		{name: "missing field falls back", path: "owner.name", want: output},
+		{name: "index out of range falls back", path: "items[5]", want: output},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := FunctionConfig{Name: "list", ParseOutput: tt.path}
+			if got := parseFunctionOutput(fc, output); got != tt.want {
+				t.Errorf("parseFunctionOutput() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	fc := FunctionConfig{Name: "list", ParseOutput: "items[].name"}
+	if got := parseFunctionOutput(fc, "not json"); got != "not json" {
+		t.Errorf("parseFunctionOutput() = %q, want the output of a command that did not print JSON", got)
+	}
+}
@@ -34,8 +34,9 @@ func printFunctionInfo(fn FunctionConfig) {
 }
 
 // printAgentInfo prints basic information about an agent (name and description)
-// Used for listing agents in CLI commands
-func printAgentInfo(agent Agent, agentName string) {
+// Used for listing agents in CLI commands. The directory a user agent was
+// loaded from is shown when dir is set.
+func printAgentInfo(agent Agent, agentName string, dir string) {
 	nameStyle := color.New(color.FgHiGreen).SprintFunc()
 	agentNameStyle := color.New(color.FgHiCyan, color.Bold).SprintFunc()
 	noDescStyle := color.New(color.FgHiBlack, color.Italic).SprintFunc()
@@ -49,10 +50,14 @@ func printAgentInfo(agent Agent, agentName string) {
 
 	// Print description
 	if agent.Description != "" {
-		fmt.Println(agent.Description)
+		fmt.Print(agent.Description)
 	} else {
-		fmt.Printf("%s\n", noDescStyle("(No description available)"))
+		fmt.Print(noDescStyle("(No description available)"))
 	}
+	if dir != "" {
+		fmt.Printf(" %s", noDescStyle("["+dir+"]"))
+	}
+	fmt.Println()
 }
 
 // printDetailedAgentInfo prints detailed information about an agent
@@ -73,12 +78,16 @@ func printDetailedAgentInfo(agent Agent, agentPath string) {
 		fmt.Printf("  %s %s\n", labelStyle("Default Model:"), agent.DefaultModel)
 	}
 
+	if len(agent.RequiredEnv) > 0 {
+		fmt.Printf("  %s %s\n", labelStyle("Required Env:"), strings.Join(agent.RequiredEnv, ", "))
+	}
+
 	fmt.Printf("  %s %d\n", labelStyle("Functions:"), len(agent.Functions))
 }
 
 // printError prints an error message with consistent formatting
 func printError(msg string) {
-	errorStyle := color.New(color.FgRed, color.Bold).SprintFunc()
+	errorStyle := outputColor(colorError, color.FgRed, color.Bold).SprintFunc()
 	fmt.Printf("%s %s\n", errorStyle("[ERROR]"), msg)
 }
 
@@ -125,7 +134,7 @@ func printHistoryJSON(history ConversationHistory) {
 func printHistoryMarkdown(fileName string, history ConversationHistory) {
 	agentName := ""
 	if history.AgentPath != "" {
-		agentName = strings.TrimSuffix(filepath.Base(history.AgentPath), ".toml")
+		agentName = agentNameFromPath(history.AgentPath)
 		agentName = strings.TrimPrefix(agentName, "builtin:")
 	}
 
@@ -138,17 +147,21 @@ func printHistoryMarkdown(fileName string, history ConversationHistory) {
 	}
 	fmt.Print("\n---\n\n")
 
-	for _, msg := range history.Messages {
+	for idx, msg := range history.Messages {
 		switch msg.Role {
 		case openai.ChatMessageRoleSystem:
 			fmt.Printf("### 🔧 System\n\n")
 			fmt.Printf("<details>\n<summary>System prompt</summary>\n\n%s\n\n</details>\n\n", msg.Content)
 
 		case openai.ChatMessageRoleUser:
-			fmt.Printf("### 👤 User\n\n%s\n\n", msg.Content)
+			fmt.Printf("### 👤 User\n\n%s\n\n", messageText(msg))
 
 		case openai.ChatMessageRoleAssistant:
-			fmt.Printf("### 🤖 Assistant\n\n")
+			if model, ok := history.MessageModels[idx]; ok {
+				fmt.Printf("### 🤖 Assistant (%s)\n\n", model)
+			} else {
+				fmt.Printf("### 🤖 Assistant\n\n")
+			}
 			if msg.Content != "" {
 				fmt.Printf("%s\n\n", msg.Content)
 			}
@@ -191,18 +204,18 @@ func printHistoryText(fileName string, history ConversationHistory) {
 	model := history.Model
 
 	systemStyle := color.New(color.FgMagenta, color.Italic).SprintFunc()
-	userStyle := color.New(color.FgGreen, color.Bold).SprintFunc()
-	assistantStyle := color.New(color.FgBlue, color.Bold).SprintFunc()
+	userStyle := outputColor(colorUser, color.FgGreen, color.Bold).SprintFunc()
+	assistantStyle := outputColor(colorAssistant, color.FgBlue, color.Bold).SprintFunc()
 	toolStyle := color.New(color.FgYellow).SprintFunc()
 	toolDataStyle := color.New(color.FgHiBlack).SprintFunc()
-	errorStyle := color.New(color.FgRed).SprintFunc()
+	errorStyle := outputColor(colorError, color.FgRed).SprintFunc()
 	labelStyle := color.New(color.FgHiCyan, color.Bold).SprintFunc()
 	dimStyle := color.New(color.FgHiBlack).SprintFunc()
 
 	// --- Print Header ---
 	fmt.Printf("%s %s\n", labelStyle("File:"), filepath.Base(fileName))
 	if agentPath != "" {
-		agentName := strings.TrimSuffix(filepath.Base(agentPath), ".toml")
+		agentName := agentNameFromPath(agentPath)
 		agentName = strings.TrimPrefix(agentName, "builtin:")
 		fmt.Printf("%s +%s\n", labelStyle("Agent:"), agentName)
 	}
@@ -212,7 +225,7 @@ func printHistoryText(fileName string, history ConversationHistory) {
 
 	fmt.Println(dimStyle(strings.Repeat("─", 60)))
 
-	for _, msg := range messages {
+	for idx, msg := range messages {
 		switch msg.Role {
 		case openai.ChatMessageRoleSystem:
 			fmt.Printf("\n%s\n", systemStyle("── system ──"))
@@ -231,10 +244,14 @@ func printHistoryText(fileName string, history ConversationHistory) {
 			}
 
 		case openai.ChatMessageRoleUser:
-			fmt.Printf("\n%s\n%s\n", userStyle("── you ──"), msg.Content)
+			fmt.Printf("\n%s\n%s\n", userStyle("── you ──"), messageText(msg))
 
 		case openai.ChatMessageRoleAssistant:
-			fmt.Printf("\n%s\n", assistantStyle("── esa ──"))
+			if msgModel, ok := history.MessageModels[idx]; ok {
+				fmt.Printf("\n%s %s\n", assistantStyle("── esa ──"), dimStyle(msgModel))
+			} else {
+				fmt.Printf("\n%s\n", assistantStyle("── esa ──"))
+			}
 			if msg.Content != "" {
 				fmt.Printf("%s\n", msg.Content)
 			}
@@ -284,7 +301,7 @@ func printHistoryText(fileName string, history ConversationHistory) {
 func printHistoryHTML(fileName string, history ConversationHistory) {
 	agentName := ""
 	if history.AgentPath != "" {
-		agentName = strings.TrimSuffix(filepath.Base(history.AgentPath), ".toml")
+		agentName = agentNameFromPath(history.AgentPath)
 		agentName = strings.TrimPrefix(agentName, "builtin:")
 	}
 
@@ -428,7 +445,7 @@ body {
 	b.WriteString(`</div></div>`)
 
 	// Messages
-	for _, msg := range history.Messages {
+	for idx, msg := range history.Messages {
 		b.WriteString(`<div class="message">`)
 
 		switch msg.Role {
@@ -441,11 +458,15 @@ body {
 		case openai.ChatMessageRoleUser:
 			b.WriteString(`<div class="message-role role-user">you</div>`)
 			b.WriteString(`<div class="message-content">`)
-			b.WriteString(html.EscapeString(msg.Content))
+			b.WriteString(html.EscapeString(messageText(msg)))
 			b.WriteString(`</div>`)
 
 		case openai.ChatMessageRoleAssistant:
-			b.WriteString(`<div class="message-role role-assistant">esa</div>`)
+			if model, ok := history.MessageModels[idx]; ok {
+				b.WriteString(fmt.Sprintf(`<div class="message-role role-assistant">esa &middot; %s</div>`, html.EscapeString(model)))
+			} else {
+				b.WriteString(`<div class="message-role role-assistant">esa</div>`)
+			}
 			if msg.Content != "" {
 				b.WriteString(`<div class="message-content">`)
 				b.WriteString(html.EscapeString(msg.Content))
@@ -5,7 +5,9 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/sashabaranov/go-openai"
@@ -35,10 +37,23 @@ func runReplMode(opts *CLIOptions, args []string) error {
 		return err
 	}
 	defer cleanup()
+	defer app.jobs.stopAll()
+	// History is saved after every response, saving again on the way
+	// out keeps anything added since, e.g. an unanswered message
+	defer saveReplSession(app)
 
 	cyan := color.New(color.FgCyan).SprintFunc()
-	green := color.New(color.FgGreen).SprintFunc()
-	red := color.New(color.FgRed).SprintFunc()
+	userStyle := outputColor(colorUser, color.FgGreen).SprintFunc()
+	assistantStyle := outputColor(colorAssistant, color.FgRed).SprintFunc()
+	faint := color.New(color.Faint).SprintFunc()
+
+	submitHint := "- Use /paste or /editor for multi line input"
+	switch app.config.Settings.ReplSubmit {
+	case replSubmitDoubleEnter:
+		submitHint = "- Press enter on an empty line to send a message"
+	case replSubmitCtrlD:
+		submitHint = "- Press ctrl+d to send a message"
+	}
 
 	fmt.Fprintf(
 		os.Stderr,
@@ -48,28 +63,30 @@ func runReplMode(opts *CLIOptions, args []string) error {
 			"Starting interactive mode",
 			"- '/exit' or '/quit' to end the session",
 			"- '/help' for available commands",
-			"- Use /editor command for multi line input",
+			submitHint,
 		}, "\n"),
 	)
+	if opts.Resume && opts.ContinueChat {
+		fmt.Fprintf(os.Stderr, "%s Resumed session with %d earlier prompts\n\n", cyan("[REPL]"), countUserMessages(app.messages))
+	}
+
 	// Handle initial query if provided
 	if initialQuery != "" {
-		fmt.Fprintf(os.Stderr, "%s %s\n", green("you>"), initialQuery)
-		app.messages = append(app.messages, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: initialQuery,
-		})
+		fmt.Fprintf(os.Stderr, "%s %s\n", userStyle("you>"), initialQuery)
+		app.messages = append(app.messages, app.userMessage(initialQuery))
 
-		fmt.Fprintf(os.Stderr, "\n%s ", red("esa>"))
+		fmt.Fprintf(os.Stderr, "\n%s ", assistantStyle("esa>"))
 		app.runConversationLoop(*opts)
 	}
 
 	// Main REPL loop
 	for {
-		fmt.Fprintf(os.Stderr, "%s ", green("you>"))
+		// The context usage is estimated again for every prompt, so it
+		// reflects the last turn as well as model and agent changes
+		usage := contextUsage(app.messages, app.currentModelString())
+		fmt.Fprintf(os.Stderr, "%s %s ", userStyle("you>"), faint(usage))
 
-		// NOTE: Will enable multi when we can do that without double
-		// enter. For now one can use /editor command
-		input, err := readUserInput("", false)
+		input, err := readReplInput(app.config.Settings.ReplSubmit)
 		if err != nil {
 			if err == io.EOF {
 				fmt.Fprintf(os.Stderr, "\n%s %s\n", cyan("[REPL]"), "Goodbye!")
@@ -91,11 +108,8 @@ func runReplMode(opts *CLIOptions, args []string) error {
 			}
 		}
 
-		fmt.Fprintf(os.Stderr, "%s ", red("esa>"))
-		app.messages = append(app.messages, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: input,
-		})
+		fmt.Fprintf(os.Stderr, "%s ", assistantStyle("esa>"))
+		app.messages = append(app.messages, app.userMessage(input))
 
 		app.runConversationLoop(*opts)
 	}
@@ -103,6 +117,27 @@ func runReplMode(opts *CLIOptions, args []string) error {
 	return nil
 }
 
+// saveReplSession saves the REPL conversation unless nothing was said
+// in it, so that quitting right away does not leave empty sessions
+// behind for --resume to pick up
+func saveReplSession(app *Application) {
+	if countUserMessages(app.messages) == 0 {
+		return
+	}
+	app.saveConversationHistory()
+}
+
+// countUserMessages returns the number of messages sent by the user
+func countUserMessages(messages []openai.ChatCompletionMessage) int {
+	count := 0
+	for _, msg := range messages {
+		if msg.Role == openai.ChatMessageRoleUser {
+			count++
+		}
+	}
+	return count
+}
+
 // handleReplCommand handles special REPL commands
 // Returns true if the command was handled (and should continue REPL loop)
 func handleReplCommand(input string, app *Application, opts *CLIOptions) bool {
@@ -121,10 +156,18 @@ func handleReplCommand(input string, app *Application, opts *CLIOptions) bool {
 		return handleConfigCommand(app)
 	case "/model":
 		return handleModelCommand(args, app, opts)
+	case "/temp":
+		return handleTempCommand(args, app)
 	case "/agent":
 		return handleAgentCommand(args, app, opts)
 	case "/editor":
 		return handleEditorCommand(app, opts)
+	case "/paste":
+		return handlePasteCommand(app, opts)
+	case "/stats", "/cost":
+		return handleStatsCommand(app)
+	case "/continue":
+		return handleContinueCommand(app, opts)
 	default:
 		return handleUnknownCommand(command)
 	}
@@ -139,8 +182,12 @@ func handleHelpCommand() bool {
 	fmt.Fprintf(os.Stderr, "  %s - Show this help message\n", green("/help"))
 	fmt.Fprintf(os.Stderr, "  %s - Show current configuration\n", green("/config"))
 	fmt.Fprintf(os.Stderr, "  %s - Show or set model (e.g., /model openai/gpt-4)\n", green("/model <provider/model>"))
+	fmt.Fprintf(os.Stderr, "  %s - Show or set the temperature for the next requests (e.g., /temp 1.2, /temp reset)\n", green("/temp <value>"))
 	fmt.Fprintf(os.Stderr, "  %s - Show or set agent (e.g., /agent +k8s, /agent myagent)\n", green("/agent <agent>"))
 	fmt.Fprintf(os.Stderr, "  %s - Open the default editor\n", green("/editor"))
+	fmt.Fprintf(os.Stderr, "  %s - Paste text spanning several lines, ending with %s on a line of its own\n", green("/paste"), pasteEndMarker)
+	fmt.Fprintf(os.Stderr, "  %s - Show token usage, tool calls and estimated cost of the session\n", green("/stats, /cost"))
+	fmt.Fprintf(os.Stderr, "  %s - Continue a response that was cut off\n", green("/continue"))
 	return true
 }
 
@@ -162,6 +209,33 @@ func handleConfigCommand(app *Application) bool {
 	return true
 }
 
+func handleContinueCommand(app *Application, opts *CLIOptions) bool {
+	errorStyle := outputColor(colorError, color.FgRed).SprintFunc()
+	assistantStyle := outputColor(colorAssistant, color.FgRed).SprintFunc()
+
+	if err := checkContinuable(app.messages); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", errorStyle("[ERROR]"), err.Error())
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "%s ", assistantStyle("esa>"))
+	if err := app.continueLastResponse(*opts); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", errorStyle("[ERROR]"), err.Error())
+	}
+	return true
+}
+
+func handleStatsCommand(app *Application) bool {
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	fmt.Fprintf(os.Stderr, "%s %s\n", cyan("[REPL]"), "Session statistics:")
+	for _, line := range formatUsageStats(app.usage, time.Now()) {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+	fmt.Fprintf(os.Stderr, "  Context: %s tokens\n", strings.Trim(contextUsage(app.messages, app.currentModelString()), "[]"))
+	return true
+}
+
 func handleModelCommand(args []string, app *Application, opts *CLIOptions) bool {
 	cyan := color.New(color.FgCyan).SprintFunc()
 
@@ -172,7 +246,7 @@ func handleModelCommand(args []string, app *Application, opts *CLIOptions) bool
 	}
 
 	if err := validateAndSetModel(app, opts, args[0]); err != nil {
-		fmt.Fprintf(os.Stderr, "%s %s\n", color.New(color.FgRed).Sprint("[ERROR]"), err.Error())
+		fmt.Fprintf(os.Stderr, "%s %s\n", outputColor(colorError, color.FgRed).Sprint("[ERROR]"), err.Error())
 		return true
 	}
 
@@ -181,6 +255,46 @@ func handleModelCommand(args []string, app *Application, opts *CLIOptions) bool
 	return true
 }
 
+// handleTempCommand handles the /temp command, which shows or sets the
+// temperature used for the rest of the session
+func handleTempCommand(args []string, app *Application) bool {
+	cyan := color.New(color.FgCyan).SprintFunc()
+
+	if len(args) == 0 {
+		current := "provider default"
+		if temperature := app.requestOptions().Temperature; temperature != nil {
+			current = strconv.FormatFloat(float64(*temperature), 'g', -1, 32)
+		}
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", cyan("[REPL]"), "Current temperature", current)
+		return true
+	}
+
+	if args[0] == "reset" {
+		app.temperature = nil
+		fmt.Fprintf(os.Stderr, "%s %s\n", cyan("[REPL]"), "Temperature reset to the model default")
+		return true
+	}
+
+	temperature, err := parseTemperature(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s\n", outputColor(colorError, color.FgRed).Sprint("[ERROR]"), err.Error())
+		return true
+	}
+	app.temperature = &temperature
+	fmt.Fprintf(os.Stderr, "%s %s: %s\n", cyan("[REPL]"), "Temperature set to", args[0])
+	return true
+}
+
+// parseTemperature parses a temperature given in the REPL, which like
+// the temperature of model aliases must be between 0 and 2
+func parseTemperature(value string) (float32, error) {
+	temperature, err := strconv.ParseFloat(value, 32)
+	if err != nil || temperature < 0 || temperature > 2 {
+		return 0, fmt.Errorf("invalid temperature %q: must be a number between 0 and 2", value)
+	}
+	return float32(temperature), nil
+}
+
 func handleAgentCommand(args []string, app *Application, opts *CLIOptions) bool {
 	cyan := color.New(color.FgCyan).SprintFunc()
 	green := color.New(color.FgGreen).SprintFunc()
@@ -195,7 +309,7 @@ func handleAgentCommand(args []string, app *Application, opts *CLIOptions) bool
 
 	agentStr := args[0]
 	if err := validateAndSetAgent(app, opts, agentStr); err != nil {
-		fmt.Fprintf(os.Stderr, "%s %s\n", color.New(color.FgRed).Sprint("[ERROR]"), err.Error())
+		fmt.Fprintf(os.Stderr, "%s %s\n", outputColor(colorError, color.FgRed).Sprint("[ERROR]"), err.Error())
 		return true
 	}
 
@@ -211,7 +325,7 @@ func handleAgentCommand(args []string, app *Application, opts *CLIOptions) bool
 // handleEditorCommand handles the /editor command to open the default text editor
 func handleEditorCommand(app *Application, opts *CLIOptions) bool {
 	cyan := color.New(color.FgCyan).SprintFunc()
-	red := color.New(color.FgRed).SprintFunc()
+	errorStyle := outputColor(colorError, color.FgRed).SprintFunc()
 
 	// Get editor from environment variable or default to nano
 	editor := os.Getenv("EDITOR")
@@ -222,7 +336,7 @@ func handleEditorCommand(app *Application, opts *CLIOptions) bool {
 	// Create a temporary file
 	tmpFile, err := os.CreateTemp("", "esa_prompt_*.txt")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s Failed to create temporary file: %v\n", red("[ERROR]"), err)
+		fmt.Fprintf(os.Stderr, "%s Failed to create temporary file: %v\n", errorStyle("[ERROR]"), err)
 		return true
 	}
 	defer os.Remove(tmpFile.Name()) // Clean up
@@ -239,14 +353,14 @@ func handleEditorCommand(app *Application, opts *CLIOptions) bool {
 	cmd.Stdin = os.Stdin
 
 	if err := cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "%s Failed to run editor: %v\n", red("[ERROR]"), err)
+		fmt.Fprintf(os.Stderr, "%s Failed to run editor: %v\n", errorStyle("[ERROR]"), err)
 		return true
 	}
 
 	// Read the content back
 	content, err := os.ReadFile(tmpFile.Name())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s Failed to read temporary file: %v\n", red("[ERROR]"), err)
+		fmt.Fprintf(os.Stderr, "%s Failed to read temporary file: %v\n", errorStyle("[ERROR]"), err)
 		return true
 	}
 
@@ -265,8 +379,41 @@ func handleEditorCommand(app *Application, opts *CLIOptions) bool {
 		Content: finalContent,
 	})
 
-	fmt.Fprintf(os.Stderr, "%s %s\n", color.New(color.FgGreen).SprintFunc()("you>"), finalContent)
-	fmt.Fprintf(os.Stderr, "%s ", color.New(color.FgRed).SprintFunc()("esa>"))
+	fmt.Fprintf(os.Stderr, "%s %s\n", outputColor(colorUser, color.FgGreen).SprintFunc()("you>"), finalContent)
+	fmt.Fprintf(os.Stderr, "%s ", outputColor(colorAssistant, color.FgRed).SprintFunc()("esa>"))
+	app.runConversationLoop(*opts)
+
+	return true
+}
+
+// handlePasteCommand handles the /paste command, which reads input up
+// to an end marker so that pasted text is sent as a single message
+func handlePasteCommand(app *Application, opts *CLIOptions) bool {
+	cyan := color.New(color.FgCyan).SprintFunc()
+	errorStyle := outputColor(colorError, color.FgRed).SprintFunc()
+	assistantStyle := outputColor(colorAssistant, color.FgRed).SprintFunc()
+
+	fmt.Fprintf(os.Stderr, "%s Paste your text and enter %s on a line of its own (or ctrl+d) to send it\n",
+		cyan("[REPL]"), pasteEndMarker)
+
+	content, err := readLinesUntil(pasteEndMarker)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s Failed to read pasted text: %v\n", errorStyle("[ERROR]"), err)
+		return true
+	}
+
+	content = strings.TrimSpace(content)
+	if content == "" {
+		fmt.Fprintf(os.Stderr, "%s No content entered, canceling.\n", cyan("[REPL]"))
+		return true
+	}
+
+	app.messages = append(app.messages, openai.ChatCompletionMessage{
+		Role:    "user",
+		Content: content,
+	})
+
+	fmt.Fprintf(os.Stderr, "%s ", assistantStyle("esa>"))
 	app.runConversationLoop(*opts)
 
 	return true
@@ -275,7 +422,7 @@ func handleEditorCommand(app *Application, opts *CLIOptions) bool {
 func handleUnknownCommand(command string) bool {
 	if strings.HasPrefix(command, "/") {
 		fmt.Fprintf(os.Stderr, "%s %s '%s'. Type /help for available commands.\n",
-			color.New(color.FgRed).Sprint("[ERROR]"), "Unknown command", command)
+			outputColor(colorError, color.FgRed).Sprint("[ERROR]"), "Unknown command", command)
 		return true
 	}
 	return false
@@ -283,14 +430,26 @@ func handleUnknownCommand(command string) bool {
 
 // validateAndSetModel validates a model string (including aliases) and sets it if valid
 func validateAndSetModel(app *Application, opts *CLIOptions, modelStr string) error {
-	app.modelFlag = modelStr
-	opts.Model = modelStr
+	if err := validateModelString(modelStr, app.agent, app.config); err != nil {
+		return err
+	}
 
-	client, err := setupLLMClient(modelStr, app.agent, app.config)
+	client, err := setupLLMClient(modelStr, app.agent, app.config, app.headers)
 	if err != nil {
 		return fmt.Errorf("failed to set model '%s': %v", modelStr, err)
 	}
 
+	// The system prompt follows the model alias as it does at startup,
+	// unless one was given on the command line
+	prompt := modelSystemPrompt(modelStr, app.agent, app.config, app.agentPrompt)
+	if opts.SystemPrompt == "" && prompt != app.agent.SystemPrompt {
+		if err := app.setSystemPrompt(prompt); err != nil {
+			return fmt.Errorf("failed to set model '%s': %v", modelStr, err)
+		}
+	}
+
+	app.modelFlag = modelStr
+	opts.Model = modelStr
 	app.client = client
 	return nil
 }
@@ -311,8 +470,16 @@ func validateAndSetAgent(app *Application, opts *CLIOptions, agentStr string) er
 	if err != nil {
 		return fmt.Errorf("failed to load agent '%s': %v", agentStr, err)
 	}
+	if err := checkRequiredEnv(agent); err != nil {
+		return err
+	}
+	warnUndefinedPlaceholders(agent)
 
 	// Update the application and options
+	app.agentPrompt = agent.SystemPrompt
+	if opts.SystemPrompt == "" {
+		agent.SystemPrompt = modelSystemPrompt(opts.Model, agent, app.config, agent.SystemPrompt)
+	}
 	app.agent = agent
 	app.agentPath = tempOpts.AgentPath // Use the resolved path from loadConfiguration
 	opts.AgentPath = tempOpts.AgentPath
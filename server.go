@@ -1,18 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gorilla/websocket"
@@ -39,6 +50,21 @@ const (
 	wsMsgHistoryList = "history_list"
 	wsMsgAbort       = "abort"
 	wsMsgAborted     = "aborted"
+	wsMsgNotice      = "notice"
+	wsMsgFork        = "fork"
+	wsMsgUsage       = "usage"
+)
+
+// Error codes sent in the code field of error messages, so that clients
+// can tell errors worth retrying from ones to show to the user. Tool
+// results for failed calls carry tool_error.
+const (
+	wsErrInvalidRequest = "invalid_request"
+	wsErrInitFailed     = "init_failed"
+	wsErrLLM            = "llm_error"
+	wsErrRateLimited    = "rate_limited"
+	wsErrStream         = "stream_error"
+	wsErrTool           = "tool_error"
 )
 
 // WSMessage represents a WebSocket message exchanged between client and server
@@ -50,9 +76,11 @@ type WSMessage struct {
 	ID      string `json:"id,omitempty"`
 	Name    string `json:"name,omitempty"`
 	Command string `json:"command,omitempty"`
+	Preview string `json:"preview,omitempty"` // output of the function's preview command
 	Safe    bool   `json:"safe,omitempty"`
 	Output  string `json:"output,omitempty"`
 	Args    string `json:"args,omitempty"`
+	Code    string `json:"code,omitempty"` // set on errors, see wsErr*
 
 	// Approval fields
 	Approved bool   `json:"approved,omitempty"`
@@ -61,6 +89,19 @@ type WSMessage struct {
 	// List payloads
 	Agents  []AgentInfo   `json:"agents,omitempty"`
 	History []HistoryInfo `json:"history,omitempty"`
+
+	// Usage payloads
+	Usage        *UsageInfo `json:"usage,omitempty"`
+	SessionUsage *UsageInfo `json:"session_usage,omitempty"`
+}
+
+// UsageInfo is the token usage and estimated cost of a response or of
+// all responses in a session
+type UsageInfo struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost,omitempty"` // USD, for models with a known price
 }
 
 // AgentInfo is a summary of an agent for listing
@@ -83,6 +124,7 @@ type FunctionInfo struct {
 type HistoryInfo struct {
 	Index          int    `json:"index"`
 	Agent          string `json:"agent"`
+	Model          string `json:"model,omitempty"`
 	Query          string `json:"query"`
 	Timestamp      string `json:"timestamp"`
 	FileName       string `json:"filename"`
@@ -90,19 +132,83 @@ type HistoryInfo struct {
 }
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Local only, no auth needed
-	},
+	CheckOrigin: isSameOrigin,
+}
+
+// isSameOrigin reports whether a request was made by a page served by
+// this server. Requests without an Origin header do not come from a
+// browser page and are allowed.
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := neturl.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// requireSameOrigin rejects requests that change state, such as
+// creating agents, when they are sent by pages of other sites. Such
+// requests can be made cross-site without a preflight, so CORS alone
+// does not stop them.
+func requireSameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !isSameOrigin(r) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-// webSession tracks the state for a single WebSocket chat session
+// sessionConn is the connection events of a chat session are sent
+// over. It is implemented by WebSocket connections and by sseConn.
+type sessionConn interface {
+	WriteJSON(v any) error
+	Close() error
+}
+
+// webSession tracks the state for a single WebSocket or SSE chat session
 type webSession struct {
-	conn       *websocket.Conn
+	id         string // set for SSE sessions, which receive input out of band
+	conn       sessionConn
 	app        *Application
+	appKey     string // agent and model the cached app was built for
+	appMu      sync.Mutex
+	runMu      sync.Mutex   // held while a conversation runs on app
+	usage      sessionUsage // all responses of the session, guarded by appMu
 	mu         sync.Mutex
 	approvalCh chan confirmResponse
+	jobs       *jobRegistry // background jobs, shared by the apps of the session
 	aborted    bool
 	abortMu    sync.RWMutex
+	done       chan struct{} // closed by stop when the server shuts down
+	stopOnce   sync.Once
+}
+
+// sessionAppKey identifies the agent and model an Application is built for
+func sessionAppKey(opts *CLIOptions) string {
+	return opts.AgentPath + "\x00" + opts.Model
+}
+
+// cachedApp returns the Application of this session if it was built for
+// the same agent and model as opts, or nil if a new one is needed
+func (s *webSession) cachedApp(opts *CLIOptions) *Application {
+	s.appMu.Lock()
+	defer s.appMu.Unlock()
+	if s.app != nil && s.appKey == sessionAppKey(opts) {
+		return s.app
+	}
+	return nil
+}
+
+// setApp caches app as the Application of this session
+func (s *webSession) setApp(app *Application, opts *CLIOptions) {
+	s.appMu.Lock()
+	defer s.appMu.Unlock()
+	app.jobs = s.jobs
+	s.app = app
+	s.appKey = sessionAppKey(opts)
 }
 
 func (s *webSession) sendJSON(msg WSMessage) error {
@@ -111,6 +217,53 @@ func (s *webSession) sendJSON(msg WSMessage) error {
 	return s.conn.WriteJSON(msg)
 }
 
+// recordUsage adds the usage of a response from app to the totals of
+// the session and sends both to the client. Nothing is sent when the
+// provider did not report usage.
+func (s *webSession) recordUsage(app *Application, usage *openai.Usage) {
+	modelStr := app.currentModelString()
+	app.recordUsage(modelStr, usage)
+
+	s.appMu.Lock()
+	s.usage.record(app.config, modelStr, usage)
+	total := s.usage
+	s.appMu.Unlock()
+
+	if usage == nil {
+		return
+	}
+	cost, _ := responseCost(app.config, modelStr, usage)
+	s.sendJSON(WSMessage{
+		Type: wsMsgUsage,
+		Usage: &UsageInfo{
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			TotalTokens:      usage.PromptTokens + usage.CompletionTokens,
+			Cost:             cost,
+		},
+		SessionUsage: &UsageInfo{
+			PromptTokens:     total.promptTokens,
+			CompletionTokens: total.completionTokens,
+			TotalTokens:      total.promptTokens + total.completionTokens,
+			Cost:             total.cost,
+		},
+	})
+}
+
+// sendError sends an error message with one of the wsErr* codes
+func (s *webSession) sendError(code string, content string) error {
+	return s.sendJSON(WSMessage{Type: wsMsgError, Code: code, Content: content})
+}
+
+// llmErrorCode returns rate_limited for rate limit errors from the
+// provider and code for any other error
+func llmErrorCode(err error, code string) string {
+	if isRateLimitError(err) {
+		return wsErrRateLimited
+	}
+	return code
+}
+
 func (s *webSession) isAborted() bool {
 	s.abortMu.RLock()
 	defer s.abortMu.RUnlock()
@@ -128,14 +281,225 @@ func (s *webSession) setAborted() {
 	}
 }
 
+// stop aborts the conversation of the session for good, also ending a
+// wait for an approval that setAborted could not deliver
+func (s *webSession) stop() {
+	s.setAborted()
+	s.stopOnce.Do(func() { close(s.done) })
+}
+
+// waitForApproval waits for the user to approve or reject a function
+// call, which is rejected when the session is stopped
+func (s *webSession) waitForApproval() confirmResponse {
+	select {
+	case approval := <-s.approvalCh:
+		return approval
+	case <-s.done:
+		return confirmResponse{approved: false, message: "aborted"}
+	}
+}
+
 func (s *webSession) resetAbort() {
 	s.abortMu.Lock()
 	s.aborted = false
 	s.abortMu.Unlock()
 }
 
+// serverShutdownTimeout is how long the server waits for in-flight
+// requests and session handlers to finish when shutting down
+const serverShutdownTimeout = 10 * time.Second
+
+// sessionRegistry tracks the active WebSocket sessions and their running
+// handlers so that they can be stopped when the server shuts down
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[*webSession]struct{}
+	handlers sync.WaitGroup
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[*webSession]struct{})}
+}
+
+func (r *sessionRegistry) add(s *webSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s] = struct{}{}
+}
+
+func (r *sessionRegistry) remove(s *webSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s)
+}
+
+// lookup returns the active session with the given id
+func (r *sessionRegistry) lookup(id string) *webSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for s := range r.sessions {
+		if s.id != "" && s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// run runs a session handler in the background, tracking it so that
+// shutdown can wait for it to finish
+func (r *sessionRegistry) run(handler func()) {
+	r.handlers.Add(1)
+	go func() {
+		defer r.handlers.Done()
+		handler()
+	}()
+}
+
+// shutdown aborts the conversations of all sessions, closes their
+// connections and waits for running handlers and background jobs until
+// ctx is done
+func (r *sessionRegistry) shutdown(ctx context.Context) error {
+	var jobs []*jobRegistry
+	r.mu.Lock()
+	for s := range r.sessions {
+		s.stop()
+		s.conn.Close()
+		jobs = append(jobs, s.jobs)
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.handlers.Wait()
+		for _, j := range jobs {
+			j.stopAll()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// accessLevel is what a client of the web server may do
+type accessLevel int
+
+const (
+	accessNone accessLevel = iota
+	accessView             // read history, agents and stats
+	accessFull             // everything, including chat
+)
+
+// tokenCookie holds the token given in the token query parameter, so
+// that the requests made by the web UI after loading it are let through
+const tokenCookie = "esa_token"
+
+// accessTokenEnvar and viewTokenEnvar set the tokens when --access-token
+// and --view-token are not given, which keeps them out of the process list
+const (
+	accessTokenEnvar = "ESA_ACCESS_TOKEN"
+	viewTokenEnvar   = "ESA_VIEW_TOKEN"
+)
+
+// serverTokens are the tokens set with --access-token and --view-token.
+// Without an access token every request is allowed, as the server
+// listens on localhost unless --host is given.
+type serverTokens struct {
+	full string
+	view string
+}
+
+// level returns the access given by token
+func (t serverTokens) level(token string) accessLevel {
+	switch {
+	case token == "":
+		return accessNone
+	case subtle.ConstantTimeCompare([]byte(token), []byte(t.full)) == 1:
+		return accessFull
+	case t.view != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t.view)) == 1:
+		return accessView
+	}
+	return accessNone
+}
+
+// requestToken returns the token sent as a bearer token, in the token
+// query parameter or in the token cookie, and whether it came from the
+// query parameter
+func requestToken(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token, false
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, true
+	}
+	if cookie, err := r.Cookie(tokenCookie); err == nil {
+		return cookie.Value, false
+	}
+	return "", false
+}
+
+// requiredAccess returns the access needed for a request. Reading is
+// enough for GET requests other than chat, which runs the agent.
+func requiredAccess(r *http.Request) accessLevel {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return accessFull
+	}
+	if r.URL.Path == "/ws" || strings.HasPrefix(r.URL.Path, "/api/chat/") {
+		return accessFull
+	}
+	return accessView
+}
+
+// requireToken lets through requests sent with a token that gives the
+// access they need. A valid token in the query parameter is stored in
+// a cookie for the requests that follow.
+func requireToken(tokens serverTokens, next http.Handler) http.Handler {
+	if tokens.full == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, fromQuery := requestToken(r)
+		level := tokens.level(token)
+		if level == accessNone {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if level < requiredAccess(r) {
+			http.Error(w, "view token cannot be used for this request", http.StatusForbidden)
+			return
+		}
+		if fromQuery {
+			http.SetCookie(w, &http.Cookie{
+				Name:     tokenCookie,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // runServeMode starts the HTTP/WebSocket server
 func runServeMode(opts *CLIOptions) error {
+	if opts.AccessToken == "" {
+		opts.AccessToken = os.Getenv(accessTokenEnvar)
+	}
+	if opts.ViewToken == "" {
+		opts.ViewToken = os.Getenv(viewTokenEnvar)
+	}
+	if opts.ViewToken != "" && opts.AccessToken == "" {
+		return fmt.Errorf("--view-token needs --access-token, otherwise chat would be open to everyone")
+	}
+	if opts.ViewToken != "" && opts.ViewToken == opts.AccessToken {
+		return fmt.Errorf("--view-token must differ from --access-token")
+	}
+
 	// Initialize server-level working directory
 	initialDir := opts.ServeWorkDir
 	if initialDir != "" {
@@ -149,16 +513,28 @@ func runServeMode(opts *CLIOptions) error {
 	swd := newServerWorkDir(initialDir)
 
 	mux := http.NewServeMux()
+	sessions := newSessionRegistry()
 
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		handleWebSocket(w, r, opts)
+		handleWebSocket(w, r, opts, sessions)
+	})
+	mux.HandleFunc("POST /api/chat/stream", func(w http.ResponseWriter, r *http.Request) {
+		handleChatStream(w, r, opts, sessions)
+	})
+	mux.HandleFunc("POST /api/chat/stream/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleChatStreamInput(w, r, sessions)
 	})
 
 	// API endpoints
 	mux.HandleFunc("/api/agents", handleListAgents)
+	mux.HandleFunc("POST /api/agents", handleCreateAgent)
 	mux.HandleFunc("/api/agents/", handleGetAgent)
 	mux.HandleFunc("/api/history", handleListHistory)
 	mux.HandleFunc("/api/history/", handleGetHistory)
+	mux.HandleFunc("POST /api/history/{id}/fork", func(w http.ResponseWriter, r *http.Request) {
+		handleForkHistory(w, r, opts)
+	})
+	mux.HandleFunc("/api/stats", handleStats)
 	mux.HandleFunc("/api/models", func(w http.ResponseWriter, r *http.Request) {
 		handleListModels(w, r, opts)
 	})
@@ -170,14 +546,68 @@ func runServeMode(opts *CLIOptions) error {
 	// Serve embedded static files
 	mux.Handle("/", http.FileServer(http.FS(webFS)))
 
-	addr := fmt.Sprintf("127.0.0.1:%d", opts.ServePort)
+	addr := net.JoinHostPort(opts.ServeHost, strconv.Itoa(opts.ServePort))
 	url := fmt.Sprintf("http://%s", addr)
 	fmt.Fprintf(os.Stderr, "esa web server listening on %s\n", url)
+	if !isLoopbackHost(opts.ServeHost) && opts.AccessToken == "" {
+		fmt.Fprintf(os.Stderr, "Warning: listening on %s without an access token, anyone who can reach it can run commands as you; set --access-token or %s\n",
+			opts.ServeHost, accessTokenEnvar)
+	}
+
+	// Open browser. The token is kept out of the command line of the
+	// opener, so the login URL is only printed.
+	browserURL := url
+	if ip := net.ParseIP(opts.ServeHost); ip != nil && ip.IsUnspecified() {
+		browserURL = fmt.Sprintf("http://%s", net.JoinHostPort("localhost", strconv.Itoa(opts.ServePort)))
+	}
+	if opts.AccessToken != "" {
+		fmt.Fprintf(os.Stderr, "Log in with %s/?token=%s\n", browserURL, neturl.QueryEscape(opts.AccessToken))
+	}
+	go exec.Command("open", browserURL).Start()
 
-	// Open browser
-	go exec.Command("open", url).Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	return http.ListenAndServe(addr, mux)
+	handler := requireToken(serverTokens{full: opts.AccessToken, view: opts.ViewToken}, requireSameOrigin(mux))
+	srv := &http.Server{Addr: addr, Handler: handler}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Fprintln(os.Stderr, "Shutting down esa web server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+
+	// WebSocket connections are hijacked and not closed by Shutdown, so
+	// the sessions are stopped first. This also aborts SSE streams, which
+	// Shutdown would otherwise wait on.
+	if err := sessions.shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("timed out waiting for sessions to finish: %w", err)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// isLoopbackHost reports whether host only accepts connections from
+// the same machine
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 // agentToFunctions converts agent functions to FunctionInfo list
@@ -195,7 +625,13 @@ func agentToFunctions(agent Agent) []FunctionInfo {
 
 // handleListAgents returns a JSON list of available agents
 func handleListAgents(w http.ResponseWriter, r *http.Request) {
-	var agents []AgentInfo
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agentInfos())
+}
+
+// agentInfos summarizes the built-in and user agents
+func agentInfos() []AgentInfo {
+	agents := []AgentInfo{}
 
 	// Built-in agents
 	for name, tomlContent := range builtinAgents {
@@ -217,15 +653,133 @@ func handleListAgents(w http.ResponseWriter, r *http.Request) {
 	for i, agent := range userAgents {
 		agents = append(agents, AgentInfo{
 			Name:        userNames[i],
-			Path:        expandHomePath(fmt.Sprintf("%s/%s.toml", DefaultAgentsDir, userNames[i])),
+			Path:        userAgentPath(userNames[i]),
 			Description: agent.Description,
 			IsBuiltin:   false,
 			Functions:   agentToFunctions(agent),
 		})
 	}
 
+	return agents
+}
+
+// maxAgentBodySize limits the size of agent definitions sent to the API
+const maxAgentBodySize = 1 << 20
+
+// agentNameRegex matches names that can be used as agent file names
+var agentNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// handleCreateAgent creates a user agent from a TOML or JSON definition.
+// The agent name is given with the name query parameter. Existing agents
+// and builtins are only replaced when force=true is passed.
+func handleCreateAgent(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !agentNameRegex.MatchString(name) {
+		http.Error(w, "invalid agent name: use letters, digits, - and _", http.StatusBadRequest)
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAgentBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read agent definition: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	content := string(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		content, err = agentJSONToTOML(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid agent JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var agent Agent
+	if _, err := toml.Decode(content, &agent); err != nil {
+		http.Error(w, fmt.Sprintf("invalid agent TOML: %v", err), http.StatusBadRequest)
+		return
+	}
+	if agent.Name == "" {
+		agent.Name = name
+	}
+	// The definition comes from the client, so its shell blocks are
+	// only checked here and run when the agent is used
+	if agent, err = validateAgentDefinition(agent); err != nil {
+		http.Error(w, fmt.Sprintf("invalid agent: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if _, isBuiltin := builtinAgents[name]; isBuiltin && !force {
+		http.Error(w, fmt.Sprintf("agent %q is a builtin agent, use force=true to override it", name), http.StatusConflict)
+		return
+	}
+
+	agentDir := agentsDir()
+	agentPath := filepath.Join(agentDir, name+".toml")
+	if _, err := os.Stat(userAgentPath(name)); err == nil && !force {
+		http.Error(w, fmt.Sprintf("agent %q already exists, use force=true to replace it", name), http.StatusConflict)
+		return
+	}
+
+	if err := os.MkdirAll(agentDir, 0755); err != nil {
+		http.Error(w, fmt.Sprintf("failed to create agent directory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(agentPath, []byte(content), 0644); err != nil {
+		http.Error(w, fmt.Sprintf("failed to write agent: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(agents)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(AgentInfo{
+		Name:        name,
+		Path:        agentPath,
+		Description: agent.Description,
+		IsBuiltin:   false,
+		Functions:   agentToFunctions(agent),
+	})
+}
+
+// agentJSONToTOML converts an agent definition given as JSON, using the
+// same keys as the TOML format, to TOML
+func agentJSONToTOML(data []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var definition map[string]any
+	if err := decoder.Decode(&definition); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(normalizeJSONNumbers(definition)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// normalizeJSONNumbers converts json.Number values to integers where
+// possible so that they decode into the integer fields of an agent
+func normalizeJSONNumbers(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeJSONNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeJSONNumbers(item)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
 }
 
 // handleGetAgent returns detailed info for a single agent
@@ -236,8 +790,16 @@ func handleGetAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The agent is only shown, so the shell blocks of its variables are
+	// not run. This endpoint is also open to view-only clients.
 	_, agentPath := ParseAgentString("+" + name)
-	agent, err := loadConfiguration(&CLIOptions{AgentName: name, AgentPath: agentPath})
+	var agent Agent
+	var err error
+	if _, isBuiltin := builtinAgents[name]; isBuiltin {
+		agent, err = loadConfiguration(&CLIOptions{AgentName: name})
+	} else {
+		agent, err = loadAgentDefinition(expandHomePath(agentPath))
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("agent not found: %v", err), http.StatusNotFound)
 		return
@@ -257,27 +819,38 @@ func handleGetAgent(w http.ResponseWriter, r *http.Request) {
 
 // handleListHistory returns a JSON list of conversation history
 func handleListHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
 	sortedFiles, _, err := getSortedHistoryFiles()
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode([]HistoryInfo{})
 		return
 	}
 
-	var histories []HistoryInfo
-	cacheDir, _ := setupCacheDir()
-
 	// List a maximum of 50 recent histories. The API was pretty slow
 	// and we will anyways only show the top 50 in the UI.
-	for i, fileName := range sortedFiles[:50] {
+	if len(sortedFiles) > 50 {
+		sortedFiles = sortedFiles[:50]
+	}
+
+	cacheDir, _ := setupCacheDir()
+	json.NewEncoder(w).Encode(historyInfos(cacheDir, sortedFiles))
+}
+
+// historyInfos summarizes the given history files, numbered from 1 in
+// the order given
+func historyInfos(cacheDir string, fileNames []string) []HistoryInfo {
+	histories := []HistoryInfo{}
+	for i, fileName := range fileNames {
 		conversationID, agentName, timestampStr := parseHistoryFilename(fileName)
 
 		// Get first user query
-		var query string
-		historyFilePath := fmt.Sprintf("%s/%s", cacheDir, fileName)
-		if historyData, err := os.ReadFile(historyFilePath); err == nil {
+		var query, model string
+		historyFilePath := filepath.Join(cacheDir, fileName)
+		if historyData, err := readHistoryData(historyFilePath); err == nil {
 			var history ConversationHistory
 			if err := json.Unmarshal(historyData, &history); err == nil {
+				model = history.Model
 				prevMessage := ""
 				for _, msg := range history.Messages {
 					if msg.Role == openai.ChatMessageRoleAssistant {
@@ -287,7 +860,7 @@ func handleListHistory(w http.ResponseWriter, r *http.Request) {
 						}
 						break
 					}
-					prevMessage = msg.Content
+					prevMessage = messageText(msg)
 				}
 			}
 		}
@@ -295,6 +868,7 @@ func handleListHistory(w http.ResponseWriter, r *http.Request) {
 		histories = append(histories, HistoryInfo{
 			Index:          i + 1,
 			Agent:          agentName,
+			Model:          model,
 			Query:          query,
 			Timestamp:      timestampStr,
 			FileName:       fileName,
@@ -302,8 +876,47 @@ func handleListHistory(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	return histories
+}
+
+// handleStats returns usage statistics computed from the history files.
+// The optional from and to query parameters (YYYY-MM-DD, inclusive)
+// limit the conversations that are counted.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	var from, to time.Time
+	if value := r.URL.Query().Get("from"); value != "" {
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from date %q: expected YYYY-MM-DD", value), http.StatusBadRequest)
+			return
+		}
+		from = date
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to date %q: expected YYYY-MM-DD", value), http.StatusBadRequest)
+			return
+		}
+		to = date.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	// Having no history yet is not an error, the stats are just empty
+	summary := NewStatsCollector().Summary()
+	collector, err := collectStats(from, to)
+	switch {
+	case err == nil:
+		summary = collector.Summary()
+		for _, skipped := range collector.errors {
+			fmt.Fprintf(os.Stderr, "Warning: skipped history file %s\n", skipped)
+		}
+	case !strings.Contains(err.Error(), "no history files found"):
+		http.Error(w, fmt.Sprintf("failed to collect stats: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(histories)
+	json.NewEncoder(w).Encode(summary)
 }
 
 // handleGetHistory returns the messages from a specific history file
@@ -324,12 +937,80 @@ func handleGetHistory(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(history)
 }
 
+// handleForkHistory copies a conversation into a new one, the same way
+// --from does on the command line, so that the web UI can branch off
+// without changing the original. The optional from query parameter
+// keeps only the first N messages. Responds with the new conversation ID.
+func handleForkHistory(w http.ResponseWriter, r *http.Request, opts *CLIOptions) {
+	from := 0
+	if value := r.URL.Query().Get("from"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid from %q: must be a positive message count", value), http.StatusBadRequest)
+			return
+		}
+		from = n
+	}
+
+	historyFile, history, ok := readHistoryFile(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "history not found", http.StatusNotFound)
+		return
+	}
+
+	encrypt := false
+	if config, err := LoadConfigWithProfile(opts.ConfigPath, opts.Profile); err == nil {
+		encrypt = config.Settings.EncryptHistory
+	}
+
+	_, agentName, _ := parseHistoryFilename(filepath.Base(historyFile))
+	convID, err := forkHistory(filepath.Dir(historyFile), agentName, history, from, encrypt)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to fork conversation: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": convID})
+}
+
+// forkHistory saves history, cut to its first from messages when from
+// is set, as a new conversation in cacheDir and returns its ID
+func forkHistory(cacheDir, agentName string, history ConversationHistory, from int, encrypt bool) (string, error) {
+	if from > 0 {
+		history.Messages = truncateMessages(history.Messages, from)
+		messageModels := make(map[int]string, len(history.MessageModels))
+		for idx, model := range history.MessageModels {
+			if idx < len(history.Messages) {
+				messageModels[idx] = model
+			}
+		}
+		history.MessageModels = messageModels
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return "", err
+	}
+	if encrypt {
+		if data, err = encryptHistory(data); err != nil {
+			return "", err
+		}
+	}
+
+	convID := generateConversationID()
+	if err := os.WriteFile(createNewHistoryFile(cacheDir, agentName, convID), data, 0644); err != nil {
+		return "", err
+	}
+	return convID, nil
+}
+
 // handleListModels returns the configured model aliases and default model
 func handleListModels(w http.ResponseWriter, r *http.Request, opts *CLIOptions) {
-	config, err := LoadConfig(opts.ConfigPath)
+	config, err := loadConfigWithAliases(opts)
 	if err != nil {
 		config = &Config{
-			ModelAliases: make(map[string]string),
+			ModelAliases: make(map[string]ModelAlias),
 		}
 	}
 
@@ -358,7 +1039,7 @@ func handleListModels(w http.ResponseWriter, r *http.Request, opts *CLIOptions)
 	for alias, model := range config.ModelAliases {
 		models = append(models, ModelInfo{
 			Alias: alias,
-			Model: model,
+			Model: model.Model,
 		})
 	}
 
@@ -436,7 +1117,7 @@ func handleListWorkDirs(w http.ResponseWriter, r *http.Request) {
 	// Count directory occurrences from history files
 	for _, fileName := range sortedFiles {
 		historyFilePath := fmt.Sprintf("%s/%s", cacheDir, fileName)
-		historyData, err := os.ReadFile(historyFilePath)
+		historyData, err := readHistoryData(historyFilePath)
 		if err != nil {
 			continue
 		}
@@ -488,21 +1169,16 @@ func handleListWorkDirs(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-// extractConversationID extracts the conversation ID from a history file path.
-// History files are named like: {conversationID}---{agent}-{timestamp}.json
-// or ---{agent}-{timestamp}.json (no conversation ID).
+// extractConversationID extracts the conversation ID from a history
+// file path, empty for files without one. See parseHistoryFilename for
+// the naming scheme.
 func extractConversationID(historyFile string) string {
-	base := filepath.Base(historyFile)
-	base = strings.TrimSuffix(base, ".json")
-	parts := strings.SplitN(base, "---", 2)
-	if len(parts) == 2 && parts[0] != "" {
-		return parts[0]
-	}
-	return ""
+	conversationID, _, _ := parseHistoryFilename(filepath.Base(historyFile))
+	return conversationID
 }
 
 // handleWebSocket handles a WebSocket connection for chat
-func handleWebSocket(w http.ResponseWriter, r *http.Request, baseOpts *CLIOptions) {
+func handleWebSocket(w http.ResponseWriter, r *http.Request, baseOpts *CLIOptions, sessions *sessionRegistry) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -513,7 +1189,12 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, baseOpts *CLIOption
 	session := &webSession{
 		conn:       conn,
 		approvalCh: make(chan confirmResponse, 1),
+		jobs:       newJobRegistry(),
+		done:       make(chan struct{}),
 	}
+	sessions.add(session)
+	defer sessions.remove(session)
+	defer session.jobs.stopAll()
 
 	for {
 		var msg WSMessage
@@ -525,12 +1206,22 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, baseOpts *CLIOption
 		}
 
 		switch msg.Type {
-		case wsMsgMessage:
-			session.resetAbort()
-			go session.handleChatMessage(msg, baseOpts)
-		case wsMsgContinue:
+		case wsMsgMessage, wsMsgContinue:
+			// The session has one Application, so only one
+			// conversation may run on it at a time
+			if !session.runMu.TryLock() {
+				session.sendError(wsErrInvalidRequest, "A response is already in progress")
+				continue
+			}
 			session.resetAbort()
-			go session.handleContinueChat(msg, baseOpts)
+			sessions.run(func() {
+				defer session.runMu.Unlock()
+				if msg.Type == wsMsgContinue {
+					session.handleContinueChat(msg, baseOpts)
+				} else {
+					session.handleChatMessage(msg, baseOpts)
+				}
+			})
 		case wsMsgApproval:
 			session.approvalCh <- confirmResponse{
 				approved: msg.Approved,
@@ -538,25 +1229,191 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, baseOpts *CLIOption
 			}
 		case wsMsgAbort:
 			session.setAborted()
+		case wsMsgFork:
+			session.handleFork()
+		}
+	}
+}
+
+// handleFork moves the conversation of the session to a new history
+// file holding a copy of its messages, so that the next continue
+// carries on from there while the original conversation is kept as it
+// is. The ID of the new conversation is sent back.
+func (s *webSession) handleFork() {
+	// Forking while a response is being added would race with it
+	if !s.runMu.TryLock() {
+		s.sendError(wsErrInvalidRequest, "Cannot fork while a response is in progress")
+		return
+	}
+	defer s.runMu.Unlock()
+
+	s.appMu.Lock()
+	app := s.app
+	s.appMu.Unlock()
+	if app == nil || len(app.messages) == 0 {
+		s.sendError(wsErrInvalidRequest, "No conversation to fork")
+		return
+	}
+
+	_, agentName, _ := parseHistoryFilename(filepath.Base(app.historyFile))
+	convID := generateConversationID()
+	app.historyFile = createNewHistoryFile(setupCacheDirWithFallback(), agentName, convID)
+	app.saveConversationHistory()
+
+	s.sendJSON(WSMessage{Type: wsMsgFork, ID: convID})
+}
+
+// wsMsgSession is sent first on SSE streams with the id to use for
+// sending approvals and aborts to the session
+const wsMsgSession = "session"
+
+// sseConn sends session events as server-sent events, using the
+// message type as the event name and the JSON message as data
+type sseConn struct {
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (c *sseConn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	event := "message"
+	if msg, ok := v.(WSMessage); ok {
+		event = msg.Type
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Close is a no-op: the stream ends when the request handler returns
+func (c *sseConn) Close() error {
+	return nil
+}
+
+// handleChatStream runs a chat message or continuation, read from the
+// JSON body of a POST request, and streams the same events as the
+// WebSocket as server-sent events. Only POST is accepted so that the
+// same-origin check applies, as a GET could be sent by any page the
+// user visits. Approvals and aborts are sent to /api/chat/stream/{id}
+// using the id of the initial session event.
+func handleChatStream(w http.ResponseWriter, r *http.Request, baseOpts *CLIOptions, sessions *sessionRegistry) {
+	var msg WSMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if msg.Type == "" {
+		msg.Type = wsMsgMessage
+	}
+	if msg.Type != wsMsgMessage && msg.Type != wsMsgContinue {
+		http.Error(w, fmt.Sprintf("unsupported message type %q", msg.Type), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	session := &webSession{
+		id:         generateConversationID(),
+		conn:       &sseConn{w: w, flusher: flusher},
+		approvalCh: make(chan confirmResponse, 1),
+		jobs:       newJobRegistry(),
+		done:       make(chan struct{}),
+	}
+	sessions.add(session)
+	defer sessions.remove(session)
+	defer session.jobs.stopAll()
+
+	// Stop the conversation if the client goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			session.setAborted()
+		case <-done:
 		}
+	}()
+
+	session.sendJSON(WSMessage{Type: wsMsgSession, ID: session.id})
+
+	if msg.Type == wsMsgContinue {
+		session.handleContinueChat(msg, baseOpts)
+	} else {
+		session.handleChatMessage(msg, baseOpts)
 	}
 }
 
+// handleChatStreamInput receives approvals and aborts for an SSE session
+func handleChatStreamInput(w http.ResponseWriter, r *http.Request, sessions *sessionRegistry) {
+	session := sessions.lookup(r.PathValue("id"))
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	var msg WSMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch msg.Type {
+	case wsMsgApproval:
+		select {
+		case session.approvalCh <- confirmResponse{approved: msg.Approved, message: msg.Message}:
+		default:
+			http.Error(w, "no approval pending", http.StatusConflict)
+			return
+		}
+	case wsMsgAbort:
+		session.setAborted()
+	default:
+		http.Error(w, fmt.Sprintf("unsupported message type %q", msg.Type), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // handleContinueChat continues an existing conversation from history
 func (s *webSession) handleContinueChat(msg WSMessage, baseOpts *CLIOptions) {
 	conversationID := msg.ID
 	if conversationID == "" {
-		s.sendJSON(WSMessage{Type: wsMsgError, Content: "No conversation ID provided"})
+		s.sendError(wsErrInvalidRequest, "No conversation ID provided")
 		return
 	}
 
 	opts := &CLIOptions{
-		Model:        msg.Model,
-		ConfigPath:   baseOpts.ConfigPath,
-		AskLevel:     "unsafe",
-		HideProgress: true,
-		ContinueChat: true,
-		Conversation: conversationID,
+		Model:            msg.Model,
+		ConfigPath:       baseOpts.ConfigPath,
+		Profile:          baseOpts.Profile,
+		Headers:          baseOpts.Headers,
+		SafeMode:         baseOpts.SafeMode,
+		AskLevel:         baseOpts.AskLevel,
+		HideProgress:     true,
+		ContinueChat:     true,
+		Conversation:     conversationID,
+		FrequencyPenalty: baseOpts.FrequencyPenalty,
+		PresencePenalty:  baseOpts.PresencePenalty,
 	}
 
 	// Parse agent from message
@@ -568,19 +1425,25 @@ func (s *webSession) handleContinueChat(msg WSMessage, baseOpts *CLIOptions) {
 	opts.AgentName = agentName
 	opts.AgentPath = agentPath
 	if opts.AgentPath == "" {
-		opts.AgentPath = DefaultAgentPath
+		opts.AgentPath = defaultAgentPath()
 	}
 
-	app, err := NewApplication(opts)
-	if err != nil {
-		s.sendJSON(WSMessage{Type: wsMsgError, Content: fmt.Sprintf("Failed to initialize: %v", err)})
-		return
+	// Keep using the session's app when continuing the conversation it
+	// is already holding, otherwise load the conversation from history
+	app := s.cachedApp(opts)
+	if app == nil || extractConversationID(app.historyFile) != conversationID {
+		var err error
+		app, err = NewApplication(opts)
+		if err != nil {
+			s.sendError(wsErrInitFailed, fmt.Sprintf("Failed to initialize: %v", err))
+			return
+		}
+		s.setApp(app, opts)
 	}
-	s.app = app
 
 	cleanup, err := app.initializeRuntime()
 	if err != nil {
-		s.sendJSON(WSMessage{Type: wsMsgError, Content: fmt.Sprintf("Failed to initialize runtime: %v", err)})
+		s.sendError(wsErrInitFailed, fmt.Sprintf("Failed to initialize runtime: %v", err))
 		return
 	}
 	defer cleanup()
@@ -601,12 +1464,17 @@ func (s *webSession) handleChatMessage(msg WSMessage, baseOpts *CLIOptions) {
 
 	// Build CLI options for this session
 	opts := &CLIOptions{
-		AgentPath:    "",
-		Model:        msg.Model,
-		ConfigPath:   baseOpts.ConfigPath,
-		AskLevel:     "unsafe", // Web uses unsafe level, approval handled in UI
-		HideProgress: true,
-		Conversation: convID,
+		AgentPath:        "",
+		Model:            msg.Model,
+		ConfigPath:       baseOpts.ConfigPath,
+		Profile:          baseOpts.Profile,
+		Headers:          baseOpts.Headers,
+		SafeMode:         baseOpts.SafeMode,
+		AskLevel:         baseOpts.AskLevel, // Empty unless --ask is set, so the agent's ask level applies
+		HideProgress:     true,
+		Conversation:     convID,
+		FrequencyPenalty: baseOpts.FrequencyPenalty,
+		PresencePenalty:  baseOpts.PresencePenalty,
 	}
 
 	// Parse agent from message
@@ -618,21 +1486,28 @@ func (s *webSession) handleChatMessage(msg WSMessage, baseOpts *CLIOptions) {
 	opts.AgentName = agentName
 	opts.AgentPath = agentPath
 	if opts.AgentPath == "" {
-		opts.AgentPath = DefaultAgentPath
+		opts.AgentPath = defaultAgentPath()
 	}
 
-	// Create application for this session
-	app, err := NewApplication(opts)
-	if err != nil {
-		s.sendJSON(WSMessage{Type: wsMsgError, Content: fmt.Sprintf("Failed to initialize: %v", err)})
-		return
+	// Reuse the session's app when the agent and model are unchanged,
+	// starting a fresh conversation on it
+	app := s.cachedApp(opts)
+	if app != nil {
+		app.resetConversation(createNewHistoryFile(setupCacheDirWithFallback(), opts.AgentName, convID))
+	} else {
+		var err error
+		app, err = NewApplication(opts)
+		if err != nil {
+			s.sendError(wsErrInitFailed, fmt.Sprintf("Failed to initialize: %v", err))
+			return
+		}
+		s.setApp(app, opts)
 	}
-	s.app = app
 
 	// Initialize runtime (MCP servers, system prompt)
 	cleanup, err := app.initializeRuntime()
 	if err != nil {
-		s.sendJSON(WSMessage{Type: wsMsgError, Content: fmt.Sprintf("Failed to initialize runtime: %v", err)})
+		s.sendError(wsErrInitFailed, fmt.Sprintf("Failed to initialize runtime: %v", err))
 		return
 	}
 	defer cleanup()
@@ -650,6 +1525,7 @@ func (s *webSession) handleChatMessage(msg WSMessage, baseOpts *CLIOptions) {
 // runWebConversationLoop is the web-adapted version of runConversationLoop
 func (s *webSession) runWebConversationLoop(app *Application, opts CLIOptions) {
 	openAITools := convertFunctionsToTools(app.agent.Functions)
+	retriedEmpty := false
 
 	for {
 		if s.isAborted() {
@@ -660,22 +1536,46 @@ func (s *webSession) runWebConversationLoop(app *Application, opts CLIOptions) {
 
 		stream, err := app.createChatCompletionWithRetry(openAITools)
 		if err != nil {
-			s.sendJSON(WSMessage{Type: wsMsgError, Content: fmt.Sprintf("LLM error: %v", err)})
+			s.sendError(llmErrorCode(err, wsErrLLM), fmt.Sprintf("LLM error: %v", err))
 			return
 		}
 
-		assistantMsg := s.handleWebStreamResponse(stream)
+		assistantMsg, usage, finishReason := s.handleWebStreamResponse(stream)
+		s.recordUsage(app, usage)
 
 		if s.isAborted() {
 			app.messages = append(app.messages, assistantMsg)
+			app.recordMessageModel()
 			app.saveConversationHistory()
 			s.sendJSON(WSMessage{Type: wsMsgAborted})
 			return
 		}
 
+		// Empty responses are retried once and kept out of the
+		// conversation, as in runConversationLoop
+		if assistantMsg.Content == "" && len(assistantMsg.ToolCalls) == 0 {
+			if !retriedEmpty {
+				retriedEmpty = true
+				app.debugPrint("Empty Response", "Model returned an empty response, retrying")
+				continue
+			}
+			s.sendJSON(WSMessage{Type: wsMsgNotice, Content: noResponseNote})
+			if note := finishReasonNote(finishReason); note != "" {
+				s.sendJSON(WSMessage{Type: wsMsgNotice, Content: note})
+			}
+			s.sendJSON(WSMessage{Type: wsMsgDone, ID: extractConversationID(app.historyFile)})
+			return
+		}
+		retriedEmpty = false
+
 		app.messages = append(app.messages, assistantMsg)
+		app.recordMessageModel()
 		app.saveConversationHistory()
 
+		if note := finishReasonNote(finishReason); note != "" {
+			s.sendJSON(WSMessage{Type: wsMsgNotice, Content: note})
+		}
+
 		if len(assistantMsg.ToolCalls) == 0 {
 			// Send back conversation ID so client can continue the thread
 			convID := extractConversationID(app.historyFile)
@@ -694,10 +1594,12 @@ func (s *webSession) runWebConversationLoop(app *Application, opts CLIOptions) {
 }
 
 // handleWebStreamResponse streams LLM tokens over WebSocket
-func (s *webSession) handleWebStreamResponse(stream LLMStream) openai.ChatCompletionMessage {
+func (s *webSession) handleWebStreamResponse(stream LLMStream) (openai.ChatCompletionMessage, *openai.Usage, openai.FinishReason) {
 	defer stream.Close()
 
 	var assistantMsg openai.ChatCompletionMessage
+	var usage *openai.Usage
+	var finishReason openai.FinishReason
 	var fullContent strings.Builder
 
 	for {
@@ -710,19 +1612,20 @@ func (s *webSession) handleWebStreamResponse(stream LLMStream) openai.ChatComple
 			break
 		}
 		if err != nil {
-			s.sendJSON(WSMessage{Type: wsMsgError, Content: fmt.Sprintf("Stream error: %v", err)})
+			s.sendError(llmErrorCode(err, wsErrStream), fmt.Sprintf("Stream error: %v", err))
 			break
 		}
 
+		if delta.FinishReason != "" {
+			finishReason = delta.FinishReason
+		}
+		if delta.Usage != nil {
+			usage = delta.Usage
+		}
+
 		if len(delta.ToolCalls) > 0 {
 			for _, toolCall := range delta.ToolCalls {
-				if toolCall.ID != "" {
-					assistantMsg.ToolCalls = append(assistantMsg.ToolCalls, toolCall)
-				} else {
-					lastToolCall := assistantMsg.ToolCalls[len(assistantMsg.ToolCalls)-1]
-					lastToolCall.Function.Arguments += toolCall.Function.Arguments
-					assistantMsg.ToolCalls[len(assistantMsg.ToolCalls)-1] = lastToolCall
-				}
+				assistantMsg.ToolCalls = appendToolCallDelta(assistantMsg.ToolCalls, toolCall)
 			}
 		} else {
 			if delta.Content != "" {
@@ -732,9 +1635,10 @@ func (s *webSession) handleWebStreamResponse(stream LLMStream) openai.ChatComple
 		}
 	}
 
+	completeToolCalls(assistantMsg.ToolCalls)
 	assistantMsg.Role = "assistant"
 	assistantMsg.Content = fullContent.String()
-	return assistantMsg
+	return assistantMsg, usage, finishReason
 }
 
 // handleWebToolCalls processes tool calls, sending approval requests over WebSocket
@@ -764,6 +1668,34 @@ func (s *webSession) handleWebToolCalls(app *Application, toolCalls []openai.Too
 				ID:     toolCall.ID,
 				Name:   toolCall.Function.Name,
 				Output: fmt.Sprintf("Error: no matching function found: %s", toolCall.Function.Name),
+				Code:   wsErrTool,
+			})
+			continue
+		}
+
+		// Interactive functions would take over the terminal of the
+		// server rather than anything the web user can see
+		if matchedFunc.Interactive {
+			err := fmt.Errorf("function %s is interactive and cannot run in the web UI", matchedFunc.Name)
+			app.appendToolError(toolCall, err, "")
+			s.sendJSON(WSMessage{
+				Type:   wsMsgToolResult,
+				ID:     toolCall.ID,
+				Name:   matchedFunc.Name,
+				Output: fmt.Sprintf("Error: %v", err),
+				Code:   wsErrTool,
+			})
+			continue
+		}
+
+		if err := checkSafeMode(app.safeMode, matchedFunc); err != nil {
+			app.appendToolError(toolCall, err, "")
+			s.sendJSON(WSMessage{
+				Type:   wsMsgToolResult,
+				ID:     toolCall.ID,
+				Name:   matchedFunc.Name,
+				Output: fmt.Sprintf("Error: %v", err),
+				Code:   wsErrTool,
 			})
 			continue
 		}
@@ -777,11 +1709,12 @@ func (s *webSession) handleWebToolCalls(app *Application, toolCalls []openai.Too
 				ID:     toolCall.ID,
 				Name:   matchedFunc.Name,
 				Output: fmt.Sprintf("Error: %v", err),
+				Code:   wsErrTool,
 			})
 			continue
 		}
 
-		command, err := prepareCommand(matchedFunc, parsedArgs)
+		command, err := prepareCommand(matchedFunc, parsedArgs, app.toolOutputs)
 		if err != nil {
 			app.appendToolError(toolCall, err, "")
 			s.sendJSON(WSMessage{
@@ -789,6 +1722,7 @@ func (s *webSession) handleWebToolCalls(app *Application, toolCalls []openai.Too
 				ID:     toolCall.ID,
 				Name:   matchedFunc.Name,
 				Output: fmt.Sprintf("Error: %v", err),
+				Code:   wsErrTool,
 			})
 			continue
 		}
@@ -797,19 +1731,27 @@ func (s *webSession) handleWebToolCalls(app *Application, toolCalls []openai.Too
 		askLevel := app.getEffectiveAskLevel()
 		requiresApproval := needsConfirmation(askLevel, isSafe)
 
+		// The preview is shown along with the approval request, as in
+		// the CLI
+		var preview string
+		if requiresApproval && matchedFunc.Preview != "" {
+			preview = runPreview(matchedFunc, parsedArgs, app.toolOutputs)
+		}
+
 		// Send tool call notification to client
 		s.sendJSON(WSMessage{
 			Type:    wsMsgToolCall,
 			ID:      toolCall.ID,
 			Name:    matchedFunc.Name,
 			Command: command,
+			Preview: preview,
 			Safe:    !requiresApproval,
 			Args:    toolCall.Function.Arguments,
 		})
 
 		// Only wait for approval if the function requires it
 		if requiresApproval {
-			approval := <-s.approvalCh
+			approval := s.waitForApproval()
 			if !approval.approved {
 				result := "Command execution cancelled by user."
 				if approval.message != "" {
@@ -837,9 +1779,12 @@ func (s *webSession) handleWebToolCalls(app *Application, toolCalls []openai.Too
 		provider, model, _ := app.parseModel()
 		os.Setenv("ESA_MODEL", fmt.Sprintf("%s/%s", provider, model))
 
-		output, stdinContent, cmdErr := executeShellCommand(expandedCmd, matchedFunc, parsedArgs)
-		result := strings.TrimSpace(string(output))
-		_ = stdinContent
+		result, stdinContent, cmdErr := runFunction(expandedCmd, matchedFunc, parsedArgs, app.jobs)
+		app.debugPrint("Function Execution",
+			fmt.Sprintf("Function: %s", matchedFunc.Name),
+			fmt.Sprintf("Command: %s", command),
+			fmt.Sprintf("Stdin: %s", stdinContent),
+			fmt.Sprintf("Output: %s", result))
 
 		if cmdErr != nil {
 			app.appendToolError(toolCall, cmdErr, fmt.Sprintf("$ %s", command))
@@ -848,17 +1793,18 @@ func (s *webSession) handleWebToolCalls(app *Application, toolCalls []openai.Too
 				ID:     toolCall.ID,
 				Name:   matchedFunc.Name,
 				Output: fmt.Sprintf("Error: %v", cmdErr),
+				Code:   wsErrTool,
 			})
 			continue
 		}
 
-		content := fmt.Sprintf("Command: %s\n\nOutput: \n%s", command, result)
-		app.messages = append(app.messages, openai.ChatCompletionMessage{
-			Role:       "tool",
-			Name:       toolCall.Function.Name,
-			Content:    content,
-			ToolCallID: toolCall.ID,
-		})
+		// Image output is sent to the model as the data URI itself
+		content := result
+		if matchedFunc.OutputType != "image" {
+			content = fmt.Sprintf("Command: %s\n\nOutput: \n%s", command, result)
+			app.toolOutputs.record(matchedFunc.Name, result)
+		}
+		app.appendToolResult(toolCall, content, fmt.Sprintf("$ %s", command), result, matchedFunc.OutputType)
 		app.saveConversationHistory()
 
 		s.sendJSON(WSMessage{
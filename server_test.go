@@ -0,0 +1,809 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestHandleCreateAgent(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	existing := filepath.Join(home, ".config", "esa", "agents", "existing.toml")
+	if err := os.MkdirAll(filepath.Dir(existing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte(`description = "old"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{
+			name:       "create from TOML",
+			query:      "name=notes",
+			body:       "description = \"Notes\"\n[[functions]]\nname = \"list\"\ndescription = \"List notes\"\ncommand = \"ls\"\n",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:        "create from JSON",
+			query:       "name=lister",
+			contentType: "application/json",
+			body:        `{"description": "Lister", "functions": [{"name": "list", "description": "List files", "command": "ls", "timeout": 30}]}`,
+			wantStatus:  http.StatusCreated,
+		},
+		{
+			name:       "invalid name",
+			query:      "name=../evil",
+			body:       `description = "x"`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid TOML",
+			query:      "name=broken",
+			body:       `description = `,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "failed validation",
+			query:      "name=noname",
+			body:       "[[functions]]\ncommand = \"ls\"\n",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "existing agent without force",
+			query:      "name=existing",
+			body:       `description = "new"`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "existing agent with force",
+			query:      "name=existing&force=true",
+			body:       `description = "new"`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "builtin agent without force",
+			query:      "name=default",
+			body:       `description = "mine"`,
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "shell blocks not run",
+			query:      "name=blocks",
+			body:       "[variables]\nmarker = \"{{$touch " + filepath.Join(home, "ran") + "}}\"\n",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "body too large",
+			query:      "name=large",
+			body:       `description = "` + strings.Repeat("a", maxAgentBodySize) + `"`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents", handleListAgents)
+	mux.HandleFunc("POST /api/agents", handleCreateAgent)
+	mux.HandleFunc("/api/agents/", handleGetAgent)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/agents?"+tt.query, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body: %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	// Listing and showing the agent does not run its shell blocks either
+	for _, path := range []string{"/api/agents", "/api/agents/blocks"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s status = %d, want %d (body: %s)", path, rec.Code, http.StatusOK, rec.Body.String())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(home, "ran")); err == nil {
+		t.Error("shell block in the posted agent was run")
+	}
+
+	if _, err := loadAgent(filepath.Join(home, ".config", "esa", "agents", "lister.toml")); err != nil {
+		t.Errorf("agent created from JSON does not load: %v", err)
+	}
+}
+
+func TestRequireSameOrigin(t *testing.T) {
+	handler := requireSameOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantStatus int
+	}{
+		{name: "no origin", method: http.MethodPost, wantStatus: http.StatusOK},
+		{name: "same origin", method: http.MethodPost, origin: "http://example.com", wantStatus: http.StatusOK},
+		{name: "other site", method: http.MethodPost, origin: "http://evil.test", wantStatus: http.StatusForbidden},
+		{name: "other port", method: http.MethodPost, origin: "http://example.com:8081", wantStatus: http.StatusForbidden},
+		{name: "read from other site", method: http.MethodGet, origin: "http://evil.test", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://example.com/api/agents", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSSEConnWriteJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	conn := &sseConn{w: rec, flusher: rec}
+
+	if err := conn.WriteJSON(WSMessage{Type: wsMsgToken, Content: "hi"}); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+
+	want := "event: token\ndata: {\"type\":\"token\",\"content\":\"hi\"}\n\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("WriteJSON() wrote %q, want %q", got, want)
+	}
+	if !rec.Flushed {
+		t.Error("WriteJSON() did not flush the event")
+	}
+}
+
+func TestHandleChatStreamInput(t *testing.T) {
+	sessions := newSessionRegistry()
+	session := &webSession{id: "abc", approvalCh: make(chan confirmResponse, 1)}
+	sessions.add(session)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat/stream/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handleChatStreamInput(w, r, sessions)
+	})
+
+	tests := []struct {
+		name       string
+		id         string
+		body       string
+		wantStatus int
+	}{
+		{name: "unknown session", id: "missing", body: `{"type": "abort"}`, wantStatus: http.StatusNotFound},
+		{name: "unsupported type", id: "abc", body: `{"type": "message"}`, wantStatus: http.StatusBadRequest},
+		{name: "approval", id: "abc", body: `{"type": "approval", "approved": true}`, wantStatus: http.StatusNoContent},
+		{name: "abort", id: "abc", body: `{"type": "abort"}`, wantStatus: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/chat/stream/"+tt.id, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body: %s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	if response := <-session.approvalCh; !response.approved {
+		t.Error("approval was not delivered to the session")
+	}
+	if !session.isAborted() {
+		t.Error("abort was not delivered to the session")
+	}
+}
+
+func TestHandleListHistory(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	cacheDir, err := setupCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := `{"agent_path": "builtin:default", "model": "openai/gpt-4o", "messages": [` +
+		`{"role": "user", "content": "hello"}, {"role": "assistant", "content": "hi"}]}`
+	if err := os.WriteFile(filepath.Join(cacheDir, "abc---default-20240101-120000.json"), []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Conversations started without an ID are saved in index mode
+	if err := os.WriteFile(filepath.Join(cacheDir, "---my-agent-20240102-120000.json"), []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleListHistory(rec, httptest.NewRequest(http.MethodGet, "/api/history", nil))
+
+	var got []HistoryInfo
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("len(history) = %d, want 2", len(got))
+	}
+	slices.SortFunc(got, func(a, b HistoryInfo) int { return strings.Compare(a.FileName, b.FileName) })
+
+	if got[0].Agent != "my-agent" || got[0].ConversationID != "" || got[0].Timestamp != "20240102-120000" {
+		t.Errorf("index mode entry = %+v, want agent my-agent, no conversation ID and timestamp 20240102-120000", got[0])
+	}
+	if got[1].Agent != "default" || got[1].ConversationID != "abc" || got[1].Timestamp != "20240101-120000" {
+		t.Errorf("custom ID entry = %+v, want agent default, conversation ID abc and timestamp 20240101-120000", got[1])
+	}
+	if got[1].Model != "openai/gpt-4o" {
+		t.Errorf("Model = %q, want %q", got[1].Model, "openai/gpt-4o")
+	}
+	if got[1].Query != "hello" {
+		t.Errorf("Query = %q, want %q", got[1].Query, "hello")
+	}
+}
+
+func TestHandleForkHistory(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	cacheDir, err := setupCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := `{"agent_path": "builtin:default", "model": "openai/gpt-4o", "messages": [` +
+		`{"role": "user", "content": "hello"}, {"role": "assistant", "content": "hi"},` +
+		`{"role": "user", "content": "again"}, {"role": "assistant", "content": "hi again"}],` +
+		`"message_models": {"1": "openai/gpt-4o", "3": "openai/gpt-4o-mini"}}`
+	original := filepath.Join(cacheDir, "abc---default-20240101-120000.json")
+	if err := os.WriteFile(original, []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &CLIOptions{ConfigPath: filepath.Join(t.TempDir(), "config.toml")}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/history/{id}/fork", func(w http.ResponseWriter, r *http.Request) {
+		handleForkHistory(w, r, opts)
+	})
+
+	tests := []struct {
+		name         string
+		url          string
+		wantStatus   int
+		wantMessages int
+		wantModels   int
+	}{
+		{name: "whole conversation", url: "/api/history/abc/fork", wantStatus: http.StatusOK, wantMessages: 4, wantModels: 2},
+		{name: "from", url: "/api/history/abc/fork?from=3", wantStatus: http.StatusOK, wantMessages: 2, wantModels: 1},
+		{name: "invalid from", url: "/api/history/abc/fork?from=0", wantStatus: http.StatusBadRequest},
+		{name: "unknown conversation", url: "/api/history/missing/fork", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.url, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				ID string `json:"id"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.ID == "" || resp.ID == "abc" {
+				t.Fatalf("id = %q, want a new conversation ID", resp.ID)
+			}
+
+			forkFile, err := findHistoryFile(cacheDir, resp.ID)
+			if err != nil {
+				t.Fatalf("forked conversation not found: %v", err)
+			}
+			if _, agentName, _ := parseHistoryFilename(filepath.Base(forkFile)); agentName != "default" {
+				t.Errorf("agent = %q, want %q", agentName, "default")
+			}
+			data, err := os.ReadFile(forkFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fork ConversationHistory
+			if err := json.Unmarshal(data, &fork); err != nil {
+				t.Fatal(err)
+			}
+			if len(fork.Messages) != tt.wantMessages {
+				t.Errorf("len(Messages) = %d, want %d", len(fork.Messages), tt.wantMessages)
+			}
+			if len(fork.MessageModels) != tt.wantModels {
+				t.Errorf("len(MessageModels) = %d, want %d", len(fork.MessageModels), tt.wantModels)
+			}
+			if fork.Model != "openai/gpt-4o" {
+				t.Errorf("Model = %q, want %q", fork.Model, "openai/gpt-4o")
+			}
+		})
+	}
+
+	// The original conversation is left as it was
+	if data, err := os.ReadFile(original); err != nil || string(data) != history {
+		t.Errorf("original conversation changed: %s", data)
+	}
+}
+
+func TestExtractConversationID(t *testing.T) {
+	tests := []struct {
+		name        string
+		historyFile string
+		want        string
+	}{
+		{name: "conversation ID", historyFile: "/cache/esa/abc---default-20240101-120000.json", want: "abc"},
+		{name: "no conversation ID", historyFile: "/cache/esa/---default-20240101-120000.json", want: ""},
+		{name: "agent with dashes", historyFile: "abc---my-agent-20240101-120000.json", want: "abc"},
+		{name: "no separator", historyFile: "default-20240101-120000.json", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractConversationID(tt.historyFile); got != tt.want {
+				t.Errorf("extractConversationID(%q) = %q, want %q", tt.historyFile, got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingConn records the messages sent to a session
+type recordingConn struct {
+	messages []WSMessage
+}
+
+func (c *recordingConn) WriteJSON(v any) error {
+	c.messages = append(c.messages, v.(WSMessage))
+	return nil
+}
+
+func (c *recordingConn) Close() error { return nil }
+
+func TestRunWebConversationLoop_FinishReasonNotice(t *testing.T) {
+	tests := []struct {
+		name       string
+		reason     openai.FinishReason
+		wantNotice bool
+	}{
+		{name: "complete response", reason: openai.FinishReasonStop, wantNotice: false},
+		{name: "truncated response", reason: openai.FinishReasonLength, wantNotice: true},
+		{name: "filtered response", reason: openai.FinishReasonContentFilter, wantNotice: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordingConn{}
+			session := &webSession{conn: conn}
+			app := &Application{
+				client: &fakeLLMClient{responses: [][]LLMStreamDelta{
+					{{Content: "partial"}, {FinishReason: tt.reason}},
+				}},
+				modelFlag:  "openai/gpt-4o",
+				config:     &Config{},
+				noSave:     true,
+				debugPrint: createDebugPrinter(false),
+			}
+
+			session.runWebConversationLoop(app, CLIOptions{})
+
+			var types []string
+			for _, msg := range conn.messages {
+				types = append(types, msg.Type)
+			}
+			want := []string{wsMsgToken, wsMsgDone}
+			if tt.wantNotice {
+				want = []string{wsMsgToken, wsMsgNotice, wsMsgDone}
+			}
+			if !slices.Equal(types, want) {
+				t.Errorf("messages = %v, want %v", types, want)
+			}
+		})
+	}
+}
+
+func TestRunWebConversationLoop_EmptyResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		responses    [][]LLMStreamDelta
+		wantRequests int
+		wantTypes    []string
+		wantNotices  []string
+	}{
+		{
+			name:         "empty response is retried",
+			responses:    [][]LLMStreamDelta{{{FinishReason: openai.FinishReasonStop}}, {{Content: "hello"}}},
+			wantRequests: 2,
+			wantTypes:    []string{wsMsgToken, wsMsgDone},
+		},
+		{
+			name:         "still empty after the retry",
+			responses:    [][]LLMStreamDelta{{}, {}},
+			wantRequests: 2,
+			wantTypes:    []string{wsMsgNotice, wsMsgDone},
+			wantNotices:  []string{noResponseNote},
+		},
+		{
+			name:         "empty with a finish reason",
+			responses:    [][]LLMStreamDelta{{{FinishReason: openai.FinishReasonLength}}, {{FinishReason: openai.FinishReasonLength}}},
+			wantRequests: 2,
+			wantTypes:    []string{wsMsgNotice, wsMsgNotice, wsMsgDone},
+			wantNotices:  []string{noResponseNote, finishReasonNote(openai.FinishReasonLength)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordingConn{}
+			session := &webSession{conn: conn}
+			client := &fakeLLMClient{responses: tt.responses}
+			app := &Application{
+				client:     client,
+				modelFlag:  "openai/gpt-4o",
+				config:     &Config{},
+				noSave:     true,
+				debugPrint: createDebugPrinter(false),
+				messages:   []openai.ChatCompletionMessage{{Role: "user", Content: "hi"}},
+			}
+
+			session.runWebConversationLoop(app, CLIOptions{})
+
+			if client.requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", client.requests, tt.wantRequests)
+			}
+			var types, notices []string
+			for _, msg := range conn.messages {
+				types = append(types, msg.Type)
+				if msg.Type == wsMsgNotice {
+					notices = append(notices, msg.Content)
+				}
+			}
+			if !slices.Equal(types, tt.wantTypes) {
+				t.Errorf("messages = %v, want %v", types, tt.wantTypes)
+			}
+			if !slices.Equal(notices, tt.wantNotices) {
+				t.Errorf("notices = %q, want %q", notices, tt.wantNotices)
+			}
+			if tt.wantNotices != nil && len(app.messages) != 1 {
+				t.Errorf("messages = %d, want the empty response to be left out", len(app.messages))
+			}
+		})
+	}
+}
+
+func TestLLMErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "rate limited", err: errors.New("error, status code: 429, message: Too Many Requests"), want: wsErrRateLimited},
+		{name: "other error", err: errors.New("502 Bad Gateway"), want: wsErrLLM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := llmErrorCode(tt.err, wsErrLLM); got != tt.want {
+				t.Errorf("llmErrorCode(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWebConversationLoop_ErrorCode(t *testing.T) {
+	conn := &recordingConn{}
+	session := &webSession{conn: conn}
+	app := &Application{
+		client:     &failingLLMClient{err: errors.New("502 Bad Gateway")},
+		modelFlag:  "openai/gpt-4o",
+		config:     &Config{},
+		noSave:     true,
+		debugPrint: createDebugPrinter(false),
+	}
+
+	session.runWebConversationLoop(app, CLIOptions{})
+
+	if len(conn.messages) != 1 || conn.messages[0].Type != wsMsgError {
+		t.Fatalf("messages = %+v, want a single error", conn.messages)
+	}
+	if conn.messages[0].Code != wsErrLLM {
+		t.Errorf("Code = %q, want %q", conn.messages[0].Code, wsErrLLM)
+	}
+}
+
+func TestRunWebConversationLoop_Usage(t *testing.T) {
+	conn := &recordingConn{}
+	session := &webSession{conn: conn}
+	app := &Application{
+		client: &fakeLLMClient{responses: [][]LLMStreamDelta{
+			{{Content: "first"}, {Usage: &openai.Usage{PromptTokens: 100, CompletionTokens: 20}}},
+			{{Content: "second"}, {Usage: &openai.Usage{PromptTokens: 200, CompletionTokens: 40}}},
+			{{Content: "unreported"}},
+		}},
+		modelFlag: "openai/test-model",
+		config: &Config{ModelPrices: map[string]ModelPrice{
+			"openai/test-model": {Input: 1, Output: 10},
+		}},
+		noSave:     true,
+		debugPrint: createDebugPrinter(false),
+	}
+
+	for range 3 {
+		session.runWebConversationLoop(app, CLIOptions{})
+	}
+
+	var got []WSMessage
+	for _, msg := range conn.messages {
+		if msg.Type == wsMsgUsage {
+			got = append(got, msg)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("usage messages = %d, want 2", len(got))
+	}
+
+	want := []struct {
+		usage   UsageInfo
+		session UsageInfo
+	}{
+		{
+			usage:   UsageInfo{PromptTokens: 100, CompletionTokens: 20, TotalTokens: 120, Cost: 0.0003},
+			session: UsageInfo{PromptTokens: 100, CompletionTokens: 20, TotalTokens: 120, Cost: 0.0003},
+		},
+		{
+			usage:   UsageInfo{PromptTokens: 200, CompletionTokens: 40, TotalTokens: 240, Cost: 0.0006},
+			session: UsageInfo{PromptTokens: 300, CompletionTokens: 60, TotalTokens: 360, Cost: 0.0009},
+		},
+	}
+	for i, w := range want {
+		if !usageInfoEqual(*got[i].Usage, w.usage) {
+			t.Errorf("message %d: Usage = %+v, want %+v", i, *got[i].Usage, w.usage)
+		}
+		if !usageInfoEqual(*got[i].SessionUsage, w.session) {
+			t.Errorf("message %d: SessionUsage = %+v, want %+v", i, *got[i].SessionUsage, w.session)
+		}
+	}
+	if app.usage.responses != 3 || app.usage.unreported != 1 {
+		t.Errorf("app usage responses = %d, unreported = %d, want 3 and 1", app.usage.responses, app.usage.unreported)
+	}
+}
+
+// usageInfoEqual compares usage allowing for rounding in the cost
+func usageInfoEqual(a, b UsageInfo) bool {
+	return a.PromptTokens == b.PromptTokens &&
+		a.CompletionTokens == b.CompletionTokens &&
+		a.TotalTokens == b.TotalTokens &&
+		math.Abs(a.Cost-b.Cost) < 1e-9
+}
+
+func TestRequireToken(t *testing.T) {
+	tokens := serverTokens{full: "full-secret", view: "view-secret"}
+	handler := requireToken(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		header     string
+		cookie     string
+		wantStatus int
+		wantCookie bool
+	}{
+		{name: "no token", method: http.MethodGet, url: "/api/history", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodGet, url: "/api/history", header: "Bearer nope", wantStatus: http.StatusUnauthorized},
+		{name: "view token reads history", method: http.MethodGet, url: "/api/history", header: "Bearer view-secret", wantStatus: http.StatusOK},
+		{name: "view token reads stats", method: http.MethodGet, url: "/api/stats", header: "Bearer view-secret", wantStatus: http.StatusOK},
+		{name: "view token loads the UI", method: http.MethodGet, url: "/?token=view-secret", wantStatus: http.StatusOK, wantCookie: true},
+		{name: "view token cannot chat", method: http.MethodGet, url: "/ws", header: "Bearer view-secret", wantStatus: http.StatusForbidden},
+		{name: "view token cannot stream chat", method: http.MethodPost, url: "/api/chat/stream", header: "Bearer view-secret", wantStatus: http.StatusForbidden},
+		{name: "view token cannot fork", method: http.MethodPost, url: "/api/history/abc/fork", header: "Bearer view-secret", wantStatus: http.StatusForbidden},
+		{name: "full token chats", method: http.MethodGet, url: "/ws", header: "Bearer full-secret", wantStatus: http.StatusOK},
+		{name: "full token in cookie", method: http.MethodPost, url: "/api/agents", cookie: "full-secret", wantStatus: http.StatusOK},
+		{name: "full token in query", method: http.MethodGet, url: "/ws?token=full-secret", wantStatus: http.StatusOK, wantCookie: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: tokenCookie, Value: tt.cookie})
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if gotCookie := rec.Header().Get("Set-Cookie") != ""; gotCookie != tt.wantCookie {
+				t.Errorf("cookie set = %v, want %v", gotCookie, tt.wantCookie)
+			}
+		})
+	}
+
+	// Without an access token the server stays open
+	open := requireToken(serverTokens{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	rec := httptest.NewRecorder()
+	open.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status without tokens = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestHandleForkDuringRun(t *testing.T) {
+	conn := &recordingConn{}
+	app := &Application{
+		historyFile: "abc---default-20240101-120000.json",
+		messages:    []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hello"}},
+		noSave:      true,
+	}
+	session := &webSession{conn: conn, app: app}
+
+	session.runMu.Lock()
+	session.handleFork()
+	session.runMu.Unlock()
+
+	if len(conn.messages) != 1 || conn.messages[0].Type != wsMsgError || conn.messages[0].Code != wsErrInvalidRequest {
+		t.Fatalf("messages = %+v, want an invalid_request error", conn.messages)
+	}
+	if app.historyFile != "abc---default-20240101-120000.json" {
+		t.Errorf("historyFile = %q, want it unchanged", app.historyFile)
+	}
+}
+
+func TestHandleWebToolCalls_ParseOutput(t *testing.T) {
+	conn := &recordingConn{}
+	session := &webSession{conn: conn}
+	app := &Application{
+		agent: Agent{Functions: []FunctionConfig{{
+			Name:        "status",
+			Command:     `echo '{"status": {"state": "ok"}, "noise": [1, 2, 3]}'`,
+			Safe:        true,
+			ParseOutput: "status.state",
+		}}},
+		modelFlag:   "openai/gpt-4o",
+		config:      &Config{},
+		toolOutputs: newToolOutputs(nil),
+		noSave:      true,
+		debugPrint:  createDebugPrinter(false),
+	}
+
+	session.handleWebToolCalls(app, []openai.ToolCall{{
+		ID:       "call_1",
+		Type:     "function",
+		Function: openai.FunctionCall{Name: "status", Arguments: "{}"},
+	}}, CLIOptions{})
+
+	if len(app.messages) != 1 || !strings.HasSuffix(app.messages[0].Content, "Output: \nok") {
+		t.Fatalf("messages = %+v, want the parsed output", app.messages)
+	}
+	if last := conn.messages[len(conn.messages)-1]; last.Type != wsMsgToolResult || last.Output != "ok" {
+		t.Errorf("last message = %+v, want a tool result with the parsed output", last)
+	}
+}
+
+func TestHandleWebToolCalls_Preview(t *testing.T) {
+	tests := []struct {
+		name        string
+		safe        bool
+		wantPreview string
+	}{
+		{name: "sent with the approval request", safe: false, wantPreview: "would delete notes.txt"},
+		{name: "not run for safe functions", safe: true, wantPreview: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordingConn{}
+			session := &webSession{conn: conn, approvalCh: make(chan confirmResponse, 1)}
+			session.approvalCh <- confirmResponse{approved: false}
+			app := &Application{
+				agent: Agent{Functions: []FunctionConfig{{
+					Name:    "delete",
+					Command: "true",
+					Preview: "echo would delete {{path}}",
+					Safe:    tt.safe,
+					Parameters: []ParameterConfig{
+						{Name: "path", Type: "string", Required: true},
+					},
+				}}},
+				modelFlag:   "openai/gpt-4o",
+				config:      &Config{},
+				toolOutputs: newToolOutputs(nil),
+				noSave:      true,
+				debugPrint:  createDebugPrinter(false),
+			}
+
+			session.handleWebToolCalls(app, []openai.ToolCall{{
+				ID:       "call_1",
+				Type:     "function",
+				Function: openai.FunctionCall{Name: "delete", Arguments: `{"path": "notes.txt"}`},
+			}}, CLIOptions{})
+
+			if len(conn.messages) == 0 || conn.messages[0].Type != wsMsgToolCall {
+				t.Fatalf("messages = %+v, want a tool call first", conn.messages)
+			}
+			if got := conn.messages[0].Preview; got != tt.wantPreview {
+				t.Errorf("preview = %q, want %q", got, tt.wantPreview)
+			}
+		})
+	}
+}
+
+func TestSessionRegistryShutdownPendingApproval(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	conn := &recordingConn{}
+	// An unbuffered channel nobody reads from, so that the abort sent
+	// by setAborted cannot end the wait
+	session := &webSession{conn: conn, approvalCh: make(chan confirmResponse), done: make(chan struct{})}
+	app := &Application{
+		agent: Agent{Functions: []FunctionConfig{{
+			Name:    "touch",
+			Command: "touch " + marker,
+		}}},
+		modelFlag:   "openai/gpt-4o",
+		config:      &Config{},
+		toolOutputs: newToolOutputs(nil),
+		noSave:      true,
+		debugPrint:  createDebugPrinter(false),
+	}
+
+	sessions := newSessionRegistry()
+	sessions.add(session)
+	sessions.run(func() {
+		session.handleWebToolCalls(app, []openai.ToolCall{{
+			ID:       "call_1",
+			Type:     "function",
+			Function: openai.FunctionCall{Name: "touch", Arguments: "{}"},
+		}}, CLIOptions{})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sessions.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown() error = %v, want the pending approval to be ended", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("function ran without approval")
+	}
+}
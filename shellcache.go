@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shellCacheDirName is the directory inside the cache directory where
+// persisted {{$...}} block outputs are stored
+const shellCacheDirName = "shell-blocks"
+
+type shellCacheEntry struct {
+	output  string
+	expires time.Time
+}
+
+// shellBlockCache caches the output of {{$...}} blocks in system prompts,
+// keyed by shellCacheKey. Caching is disabled until configured with a
+// positive TTL.
+type shellBlockCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	diskDir   string // empty when outputs are only cached in memory
+	entries   map[string]shellCacheEntry
+	nowFunc   func() time.Time
+	diskReady bool
+}
+
+var shellCache = newShellBlockCache()
+
+func newShellBlockCache() *shellBlockCache {
+	return &shellBlockCache{
+		entries: make(map[string]shellCacheEntry),
+		nowFunc: time.Now,
+	}
+}
+
+// configure sets the TTL for cached outputs and, if diskDir is not
+// empty, also persists outputs to that directory so that they can be
+// reused across runs
+func (c *shellBlockCache) configure(ttl time.Duration, diskDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = ttl
+	c.diskDir = diskDir
+	c.diskReady = false
+}
+
+// get returns the cached output for key if present and not expired
+func (c *shellBlockCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return "", false
+	}
+
+	now := c.nowFunc()
+	if entry, ok := c.entries[key]; ok {
+		if now.Before(entry.expires) {
+			return entry.output, true
+		}
+		delete(c.entries, key)
+	}
+
+	if c.diskDir == "" {
+		return "", false
+	}
+
+	path := c.diskPathInternal(key)
+	info, err := os.Stat(path)
+	if err != nil || now.Sub(info.ModTime()) >= c.ttl {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	output := string(data)
+	c.entries[key] = shellCacheEntry{output: output, expires: info.ModTime().Add(c.ttl)}
+	return output, true
+}
+
+// set stores output in the cache under key
+func (c *shellBlockCache) set(key, output string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.entries[key] = shellCacheEntry{output: output, expires: c.nowFunc().Add(c.ttl)}
+
+	if c.diskDir == "" {
+		return
+	}
+	if !c.diskReady {
+		if err := os.MkdirAll(c.diskDir, 0700); err != nil {
+			return
+		}
+		c.diskReady = true
+	}
+	// Failing to persist only means the block runs again next time
+	_ = os.WriteFile(c.diskPathInternal(key), []byte(output), 0600)
+}
+
+func (c *shellBlockCache) diskPathInternal(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.diskDir, hex.EncodeToString(sum[:]))
+}
+
+// shellVarRegex matches references to environment variables in a
+// shell command, such as $HOME or ${HOME}
+var shellVarRegex = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// shellCacheKey returns the key the output of command is cached under.
+// Blocks such as {{$pwd}} or {{$git branch}} give different output in
+// other directories, so the key holds the working directory along with
+// the values of the environment variables the command references.
+func shellCacheKey(command string) string {
+	cwd, _ := os.Getwd()
+	var key strings.Builder
+	key.WriteString(command + "\x00" + cwd)
+	for _, match := range shellVarRegex.FindAllStringSubmatch(command, -1) {
+		key.WriteString("\x00" + match[1] + "=" + os.Getenv(match[1]))
+	}
+	return key.String()
+}
+
+// configureShellBlocks applies the settings for {{$...}} blocks: the
+// execution timeout and the output cache
+func configureShellBlocks(settings Settings) {
+	timeout := defaultShellBlockTimeout
+	if settings.ShellBlockTimeout > 0 {
+		timeout = time.Duration(settings.ShellBlockTimeout) * time.Second
+	}
+	shellBlockTimeout.Store(int64(timeout))
+
+	ttl := time.Duration(settings.ShellCacheTTL) * time.Second
+
+	diskDir := ""
+	if settings.ShellCachePersist && ttl > 0 {
+		if cacheDir, err := setupCacheDir(); err == nil {
+			diskDir = filepath.Join(cacheDir, shellCacheDirName)
+		}
+	}
+
+	shellCache.configure(ttl, diskDir)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShellBlockCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		persist  bool
+		advance  time.Duration
+		fresh    bool // use a new cache instance for the lookup
+		wantHit  bool
+		wantFile bool
+	}{
+		{name: "disabled", ttl: 0, wantHit: false},
+		{name: "hit within ttl", ttl: time.Minute, advance: 30 * time.Second, wantHit: true},
+		{name: "miss after ttl", ttl: time.Minute, advance: 2 * time.Minute, wantHit: false},
+		{name: "memory only is not shared", ttl: time.Minute, fresh: true, wantHit: false},
+		{name: "persisted is shared", ttl: time.Minute, persist: true, fresh: true, wantHit: true, wantFile: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diskDir := ""
+			if tt.persist {
+				diskDir = filepath.Join(t.TempDir(), shellCacheDirName)
+			}
+
+			now := time.Now()
+			cache := newShellBlockCache()
+			cache.nowFunc = func() time.Time { return now }
+			cache.configure(tt.ttl, diskDir)
+			cache.set("date", "today")
+
+			lookup := cache
+			if tt.fresh {
+				lookup = newShellBlockCache()
+				lookup.configure(tt.ttl, diskDir)
+			}
+			lookup.nowFunc = func() time.Time { return now.Add(tt.advance) }
+
+			output, ok := lookup.get("date")
+			if ok != tt.wantHit {
+				t.Fatalf("get() hit = %v, want %v", ok, tt.wantHit)
+			}
+			if ok && output != "today" {
+				t.Errorf("get() = %q, want %q", output, "today")
+			}
+
+			if tt.persist {
+				entries, _ := os.ReadDir(diskDir)
+				if (len(entries) > 0) != tt.wantFile {
+					t.Errorf("persisted files = %d, want file %v", len(entries), tt.wantFile)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessShellBlocks_Cache(t *testing.T) {
+	shellCache.configure(time.Minute, "")
+	t.Cleanup(func() { shellCache = newShellBlockCache() })
+
+	counter := filepath.Join(t.TempDir(), "count")
+	command := "echo x >> " + counter + "; wc -l < " + counter
+
+	first, _ := processPromptShellBlocks("{{$" + command + "}}")
+	second, _ := processPromptShellBlocks("{{$" + command + "}}")
+	if first != "1" || second != "1" {
+		t.Errorf("cached block outputs = %q, %q, want both %q", first, second, "1")
+	}
+
+	fresh, _ := processPromptShellBlocks("{{$!" + command + "}}")
+	if fresh != "2" {
+		t.Errorf("uncached block output = %q, want %q", fresh, "2")
+	}
+
+	// Blocks outside of system prompts are not cached
+	uncached, _ := processShellBlocks("{{$" + command + "}}")
+	if uncached != "3" {
+		t.Errorf("block output outside a prompt = %q, want %q", uncached, "3")
+	}
+}
+
+func TestShellCacheKey(t *testing.T) {
+	t.Setenv("ESA_TEST_BRANCH", "main")
+	key := shellCacheKey("echo $ESA_TEST_BRANCH")
+
+	t.Setenv("ESA_TEST_BRANCH", "dev")
+	if shellCacheKey("echo $ESA_TEST_BRANCH") == key {
+		t.Error("key did not change with a referenced environment variable")
+	}
+
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key = shellCacheKey("pwd")
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(oldWd) })
+	if shellCacheKey("pwd") == key {
+		t.Error("key did not change with the working directory")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	defaultSpinnerStyle  = "dots"
+	spinnerFrameInterval = 100 * time.Millisecond
+)
+
+// spinnerStyles maps the progress_style setting to its animation frames
+var spinnerStyles = map[string][]string{
+	"dots":    {"⋮", "⋰", "⋯", "⋱"},
+	"line":    {"|", "/", "-", "\\"},
+	"braille": {"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"},
+}
+
+// spinner renders an animated progress indicator on a single terminal line.
+// All writes to the line happen while holding mu so that the animation
+// goroutine never interleaves with start, stop or clear.
+type spinner struct {
+	out    io.Writer
+	frames []string
+
+	mu      sync.Mutex
+	message string
+	lastLen int
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// newSpinner creates a spinner using the named style, falling back to
+// the default style for unknown names
+func newSpinner(style string) *spinner {
+	frames, ok := spinnerStyles[style]
+	if !ok {
+		frames = spinnerStyles[defaultSpinnerStyle]
+	}
+	return &spinner{out: os.Stderr, frames: frames}
+}
+
+// start shows message next to an animated frame until stop or clear is called
+func (s *spinner) start(message string) {
+	s.stop()
+
+	s.mu.Lock()
+	s.message = message
+	s.stopCh = make(chan struct{})
+	s.doneCh = make(chan struct{})
+	s.renderInternal(0)
+	s.mu.Unlock()
+
+	go s.animate(s.stopCh, s.doneCh)
+}
+
+func (s *spinner) animate(stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+
+	ticker := time.NewTicker(spinnerFrameInterval)
+	defer ticker.Stop()
+
+	for frame := 1; ; frame++ {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.renderInternal(frame)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// stop halts the animation but leaves the last frame on screen
+func (s *spinner) stop() {
+	s.mu.Lock()
+	stopCh, doneCh := s.stopCh, s.doneCh
+	s.stopCh, s.doneCh = nil, nil
+	s.mu.Unlock()
+
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	<-doneCh
+}
+
+// clear stops the animation and erases the progress line
+func (s *spinner) clear() {
+	s.stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eraseInternal()
+}
+
+// active reports whether a progress line is currently displayed
+func (s *spinner) active() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastLen > 0
+}
+
+func (s *spinner) renderInternal(frame int) {
+	s.eraseInternal()
+	msg := fmt.Sprintf("%s %s", s.frames[frame%len(s.frames)], s.message)
+	outputColor(colorProgress, color.FgBlue).Fprint(s.out, msg)
+	s.lastLen = len(msg)
+}
+
+func (s *spinner) eraseInternal() {
+	if s.lastLen > 0 {
+		fmt.Fprintf(s.out, "\r%s\r", strings.Repeat(" ", s.lastLen))
+		s.lastLen = 0
+	}
+}
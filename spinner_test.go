@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to write from the
+// spinner's animation goroutine while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSpinner(t *testing.T) {
+	tests := []struct {
+		name       string
+		style      string
+		wantFrames []string
+	}{
+		{name: "dots", style: "dots", wantFrames: []string{"⋮", "⋰"}},
+		{name: "line", style: "line", wantFrames: []string{"|", "/"}},
+		{name: "unknown falls back to dots", style: "stars", wantFrames: []string{"⋮", "⋰"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &syncBuffer{}
+			s := newSpinner(tt.style)
+			s.out = out
+
+			s.start("Calling tool...")
+			time.Sleep(3 * spinnerFrameInterval)
+			s.stop()
+
+			if !s.active() {
+				t.Error("active() = false after stop, want last frame to remain")
+			}
+
+			got := out.String()
+			for _, frame := range tt.wantFrames {
+				if !strings.Contains(got, frame+" Calling tool...") {
+					t.Errorf("output %q does not contain frame %q", got, frame)
+				}
+			}
+
+			s.clear()
+			if s.active() {
+				t.Error("active() = true after clear, want false")
+			}
+			if !strings.HasSuffix(out.String(), "\r") {
+				t.Errorf("output %q does not end with an erased line", out.String())
+			}
+		})
+	}
+}
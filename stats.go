@@ -45,6 +45,7 @@ type StatsCollector struct {
 	agentStats         map[string]AgentStats
 	modelStats         map[string]ModelStats
 	totalConversations int
+	errors             []string // history files that could not be processed
 }
 
 // NewStatsCollector creates a new statistics collector
@@ -64,6 +65,13 @@ func (sc *StatsCollector) ProcessHistoryFile(filePath string, fileName string, f
 		return wrapFileError("read", filePath, err)
 	}
 
+	// Encrypted files that cannot be decrypted are skipped like
+	// unreadable ones
+	historyData, err = decryptHistory(historyData)
+	if err != nil {
+		return nil
+	}
+
 	var history ConversationHistory
 	if err := json.Unmarshal(historyData, &history); err != nil {
 		// Skip files with JSON parsing errors silently
@@ -109,7 +117,7 @@ func (sc *StatsCollector) updateAgentStats(agentPath string) {
 	if strings.HasPrefix(agentPath, "builtin:") {
 		agentName = strings.TrimPrefix(agentPath, "builtin:")
 	} else {
-		agentName = strings.TrimSuffix(filepath.Base(agentPath), ".toml")
+		agentName = agentNameFromPath(agentPath)
 	}
 
 	agentStat := sc.agentStats[agentName]
@@ -128,6 +136,91 @@ func (sc *StatsCollector) updateModelStats(model string) {
 	sc.modelStats[model] = modelStat
 }
 
+// collectStats processes all history files last modified between from
+// and to. A zero from or to leaves that side of the range open.
+func collectStats(from, to time.Time) (*StatsCollector, error) {
+	sortedFiles, fileInfo, err := getSortedHistoryFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheDir, _ := setupCacheDir()
+	collector := NewStatsCollector()
+
+	for _, fileName := range sortedFiles {
+		fileModTime := fileInfo[fileName].ModTime()
+		if (!from.IsZero() && fileModTime.Before(from)) || (!to.IsZero() && fileModTime.After(to)) {
+			continue
+		}
+
+		historyFilePath := filepath.Join(cacheDir, fileName)
+		if err := collector.ProcessHistoryFile(historyFilePath, fileName, fileModTime); err != nil {
+			collector.errors = append(collector.errors, fmt.Sprintf("%s: %v", fileName, err))
+		}
+	}
+
+	return collector, nil
+}
+
+// StatsCount is the number of conversations for a single key
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// StatsSummary is the JSON representation of the collected statistics
+type StatsSummary struct {
+	TotalConversations int          `json:"total_conversations"`
+	Daily              []StatsCount `json:"daily"`
+	Hourly             []StatsCount `json:"hourly"`
+	Agents             []StatsCount `json:"agents"`
+	Models             []StatsCount `json:"models"`
+	Errors             []string     `json:"errors,omitempty"` // history files that were skipped
+}
+
+// Summary returns the collected statistics. Daily and hourly counts are
+// ordered chronologically, agents and models by descending count.
+func (sc *StatsCollector) Summary() StatsSummary {
+	summary := StatsSummary{
+		TotalConversations: sc.totalConversations,
+		Daily:              []StatsCount{},
+		Hourly:             []StatsCount{},
+		Agents:             []StatsCount{},
+		Models:             []StatsCount{},
+		Errors:             sc.errors,
+	}
+
+	for date, stats := range sc.dayStats {
+		summary.Daily = append(summary.Daily, StatsCount{Name: date, Count: stats.Count})
+	}
+	sort.Slice(summary.Daily, func(i, j int) bool {
+		return summary.Daily[i].Name < summary.Daily[j].Name
+	})
+
+	for hour := 0; hour < 24; hour++ {
+		if stats, ok := sc.hourStats[hour]; ok {
+			summary.Hourly = append(summary.Hourly, StatsCount{Name: fmt.Sprintf("%02d", hour), Count: stats.Count})
+		}
+	}
+
+	for name, stats := range sc.agentStats {
+		summary.Agents = append(summary.Agents, StatsCount{Name: name, Count: stats.Count})
+	}
+	for name, stats := range sc.modelStats {
+		summary.Models = append(summary.Models, StatsCount{Name: name, Count: stats.Count})
+	}
+	for _, counts := range [][]StatsCount{summary.Agents, summary.Models} {
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].Count != counts[j].Count {
+				return counts[i].Count > counts[j].Count
+			}
+			return counts[i].Name < counts[j].Name
+		})
+	}
+
+	return summary
+}
+
 // PrintStatistics prints formatted usage statistics
 func (sc *StatsCollector) PrintStatistics(showAll bool) {
 	headerStyle := color.New(color.FgHiCyan, color.Bold).SprintFunc()
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsSummary(t *testing.T) {
+	sc := NewStatsCollector()
+	sc.updateDayStats("2024-01-02")
+	sc.updateDayStats("2024-01-01")
+	sc.updateDayStats("2024-01-02")
+	sc.updateHourStats(14)
+	sc.updateHourStats(9)
+	sc.updateAgentStats("builtin:default")
+	sc.updateAgentStats("/home/user/.config/esa/agents/coder.toml")
+	sc.updateAgentStats("/home/user/.config/esa/agents/coder.toml")
+	sc.updateModelStats("openai/gpt-4o")
+	sc.totalConversations = 3
+
+	summary := sc.Summary()
+
+	tests := []struct {
+		name string
+		got  []StatsCount
+		want []StatsCount
+	}{
+		{
+			name: "daily counts in date order",
+			got:  summary.Daily,
+			want: []StatsCount{{Name: "2024-01-01", Count: 1}, {Name: "2024-01-02", Count: 2}},
+		},
+		{
+			name: "hourly counts in hour order",
+			got:  summary.Hourly,
+			want: []StatsCount{{Name: "09", Count: 1}, {Name: "14", Count: 1}},
+		},
+		{
+			name: "agents by descending count",
+			got:  summary.Agents,
+			want: []StatsCount{{Name: "coder", Count: 2}, {Name: "default", Count: 1}},
+		},
+		{
+			name: "models",
+			got:  summary.Models,
+			want: []StatsCount{{Name: "openai/gpt-4o", Count: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+
+	if summary.TotalConversations != 3 {
+		t.Errorf("TotalConversations = %d, want 3", summary.TotalConversations)
+	}
+}
+
+func TestCollectStatsSkippedFiles(t *testing.T) {
+	cacheHome := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheHome)
+	dir := filepath.Join(cacheHome, "esa")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	history := `{"agent_path":"builtin:default","model":"openai/gpt-4o","messages":[]}`
+	if err := os.WriteFile(filepath.Join(dir, "---default-20240101-120000.json"), []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A dangling symlink is listed but cannot be read
+	if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "---default-20240102-120000.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	collector, err := collectStats(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("collectStats() error = %v", err)
+	}
+	summary := collector.Summary()
+	if summary.TotalConversations != 1 {
+		t.Errorf("TotalConversations = %d, want 1", summary.TotalConversations)
+	}
+	if len(summary.Errors) != 1 || !strings.HasPrefix(summary.Errors[0], "---default-20240102-120000.json: ") {
+		t.Errorf("Errors = %q, want the broken file", summary.Errors)
+	}
+}
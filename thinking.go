@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// defaultThinkingTags are the tags reasoning models wrap their thinking
+// in, unless thinking_tags is set in the config
+var defaultThinkingTags = []string{"think"}
+
+// thinkingFilter separates the thinking that reasoning models write
+// between tags such as <think> and </think> from the rest of a streamed
+// response. Text that may turn out to be the start of a tag is held
+// back until the next chunk shows whether it is one.
+type thinkingFilter struct {
+	tags    []string
+	pending string // possible start of a tag, held back
+	closing string // closing tag when inside a thinking block
+	started bool   // visible text has been written
+}
+
+func newThinkingFilter(tags []string) *thinkingFilter {
+	if len(tags) == 0 {
+		tags = defaultThinkingTags
+	}
+	return &thinkingFilter{tags: tags}
+}
+
+// Write takes a chunk of the streamed response and returns the visible
+// text and the thinking text it holds
+func (f *thinkingFilter) Write(text string) (visible, thinking string) {
+	text = f.pending + text
+	f.pending = ""
+
+	var visibleText, thinkingText strings.Builder
+	for text != "" {
+		if f.closing != "" {
+			if i := strings.Index(text, f.closing); i >= 0 {
+				thinkingText.WriteString(text[:i])
+				text = text[i+len(f.closing):]
+				f.closing = ""
+				continue
+			}
+			text, f.pending = splitPartialTag(text, []string{f.closing})
+			thinkingText.WriteString(text)
+			break
+		}
+
+		start, tag := -1, ""
+		for _, t := range f.tags {
+			if i := strings.Index(text, "<"+t+">"); i >= 0 && (start < 0 || i < start) {
+				start, tag = i, t
+			}
+		}
+		if start >= 0 {
+			visibleText.WriteString(text[:start])
+			text = text[start+len(tag)+2:]
+			f.closing = "</" + tag + ">"
+			continue
+		}
+
+		openings := make([]string, len(f.tags))
+		for i, t := range f.tags {
+			openings[i] = "<" + t + ">"
+		}
+		text, f.pending = splitPartialTag(text, openings)
+		visibleText.WriteString(text)
+		break
+	}
+
+	return f.visible(visibleText.String()), thinkingText.String()
+}
+
+// Flush returns anything held back at the end of the response and
+// resets the filter for the next one
+func (f *thinkingFilter) Flush() (visible, thinking string) {
+	if f.closing != "" {
+		thinking = f.pending
+	} else {
+		visible = f.visible(f.pending)
+	}
+	*f = thinkingFilter{tags: f.tags}
+	return visible, thinking
+}
+
+// visible drops the whitespace left before the answer by thinking that
+// comes first in a response
+func (f *thinkingFilter) visible(text string) string {
+	if !f.started {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		f.started = text != ""
+	}
+	return text
+}
+
+// splitPartialTag splits off the end of text when it could be the start
+// of one of tags, to be held back until more of the response arrives
+func splitPartialTag(text string, tags []string) (rest, partial string) {
+	for i := max(0, len(text)-maxTagLength(tags)); i < len(text); i++ {
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, text[i:]) {
+				return text[:i], text[i:]
+			}
+		}
+	}
+	return text, ""
+}
+
+func maxTagLength(tags []string) int {
+	n := 0
+	for _, tag := range tags {
+		n = max(n, len(tag))
+	}
+	return n
+}
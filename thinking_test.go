@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestThinkingFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		tags         []string
+		input        string
+		wantVisible  string
+		wantThinking string
+	}{
+		{
+			name:        "no thinking",
+			input:       "The answer is 42",
+			wantVisible: "The answer is 42",
+		},
+		{
+			name:         "leading think block",
+			input:        "<think>Let me see.\nSix times seven.</think>\n\nThe answer is 42",
+			wantVisible:  "The answer is 42",
+			wantThinking: "Let me see.\nSix times seven.",
+		},
+		{
+			name:         "block in the middle",
+			input:        "First <think>hmm</think>then",
+			wantVisible:  "First then",
+			wantThinking: "hmm",
+		},
+		{
+			name:         "unterminated block",
+			input:        "<think>still going",
+			wantThinking: "still going",
+		},
+		{
+			name:        "lookalike tag",
+			input:       "Use <thinker> or <th",
+			wantVisible: "Use <thinker> or <th",
+		},
+		{
+			name:         "custom tags",
+			tags:         []string{"reasoning", "think"},
+			input:        "<reasoning>a</reasoning>b<think>c</think>d",
+			wantVisible:  "bd",
+			wantThinking: "ac",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Stream the input a few bytes at a time to split tags
+			// across chunks
+			for _, chunkSize := range []int{1, 2, 5, len(tt.input)} {
+				f := newThinkingFilter(tt.tags)
+				var visible, thinking string
+				for i := 0; i < len(tt.input); i += chunkSize {
+					v, th := f.Write(tt.input[i:min(i+chunkSize, len(tt.input))])
+					visible += v
+					thinking += th
+				}
+				v, th := f.Flush()
+				visible += v
+				thinking += th
+
+				if visible != tt.wantVisible {
+					t.Errorf("chunk size %d: visible = %q, want %q", chunkSize, visible, tt.wantVisible)
+				}
+				if thinking != tt.wantThinking {
+					t.Errorf("chunk size %d: thinking = %q, want %q", chunkSize, thinking, tt.wantThinking)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/sashabaranov/go-openai"
+)
+
+// defaultContextWindows holds the context window, in tokens, of common
+// models
+var defaultContextWindows = map[string]int{
+	"gpt-4o":            128000,
+	"gpt-4o-mini":       128000,
+	"gpt-4.1":           1047576,
+	"gpt-4.1-mini":      1047576,
+	"gpt-4.1-nano":      1047576,
+	"o3":                200000,
+	"o3-mini":           200000,
+	"o4-mini":           200000,
+	"claude-opus-4":     200000,
+	"claude-opus-4-1":   200000,
+	"claude-sonnet-4":   200000,
+	"claude-sonnet-4-5": 200000,
+	"claude-haiku-4-5":  200000,
+	"claude-3-7-sonnet": 200000,
+	"claude-3-5-sonnet": 200000,
+	"claude-3-5-haiku":  200000,
+}
+
+// modelEncodings holds the encodings of OpenAI models the tokenizer
+// does not know about yet
+var modelEncodings = map[string]string{
+	"o1":      tiktoken.MODEL_O200K_BASE,
+	"o1-mini": tiktoken.MODEL_O200K_BASE,
+	"o3":      tiktoken.MODEL_O200K_BASE,
+	"o3-mini": tiktoken.MODEL_O200K_BASE,
+	"o4-mini": tiktoken.MODEL_O200K_BASE,
+}
+
+// messageTokenOverhead approximates the tokens each message adds for
+// its role and framing on top of its content
+const messageTokenOverhead = 4
+
+// tokenizers caches tokenizers by model name as loading one takes a
+// while. Models without a known encoding are stored as nil.
+var tokenizers = struct {
+	sync.Mutex
+	byModel map[string]*tiktoken.Tiktoken
+}{byModel: make(map[string]*tiktoken.Tiktoken)}
+
+func init() {
+	// Use the encodings bundled with the binary rather than
+	// downloading them on first use
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// lookupContextWindow returns the context window of model, given as
+// provider/model
+func lookupContextWindow(modelStr string) (int, bool) {
+	_, model, _ := strings.Cut(modelStr, "/")
+	return lookupModelSnapshot(defaultContextWindows, model)
+}
+
+// tokenizerFor returns the tokenizer of model, given as provider/model,
+// or nil when the model has no known encoding
+func tokenizerFor(modelStr string) *tiktoken.Tiktoken {
+	_, model, _ := strings.Cut(modelStr, "/")
+
+	tokenizers.Lock()
+	defer tokenizers.Unlock()
+
+	tokenizer, ok := tokenizers.byModel[model]
+	if !ok {
+		if encoding, known := lookupModelSnapshot(modelEncodings, model); known {
+			tokenizer, _ = tiktoken.GetEncoding(encoding)
+		} else {
+			tokenizer, _ = tiktoken.EncodingForModel(model)
+		}
+		tokenizers.byModel[model] = tokenizer
+	}
+	return tokenizer
+}
+
+// tokenCounter returns a function counting the tokens in a text for
+// model, given as provider/model. OpenAI models use their tokenizer,
+// other models are estimated at roughly four characters per token.
+func tokenCounter(modelStr string) func(string) int {
+	tokenizer := tokenizerFor(modelStr)
+	if tokenizer == nil {
+		return func(text string) int { return (len(text) + 3) / 4 }
+	}
+	return func(text string) int { return len(tokenizer.EncodeOrdinary(text)) }
+}
+
+// countTokens counts the tokens messages take up in the context of
+// model, given as provider/model
+func countTokens(messages []openai.ChatCompletionMessage, modelStr string) int {
+	count := tokenCounter(modelStr)
+	tokens := 0
+	for _, msg := range messages {
+		tokens += messageTokenOverhead + count(msg.Content)
+		for _, part := range msg.MultiContent {
+			tokens += count(part.Text)
+		}
+		for _, call := range msg.ToolCalls {
+			tokens += count(call.Function.Name) + count(call.Function.Arguments)
+		}
+	}
+	return tokens
+}
+
+// formatTokenCount formats a token count compactly, e.g. 3.2k or 128k
+func formatTokenCount(tokens int) string {
+	switch {
+	case tokens >= 1000000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(tokens)/1e6), ".0") + "M"
+	case tokens >= 10000:
+		return fmt.Sprintf("%dk", tokens/1000)
+	case tokens >= 1000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(tokens)/1e3), ".0") + "k"
+	default:
+		return fmt.Sprintf("%d", tokens)
+	}
+}
+
+// contextUsage returns a short indicator of how much of the context
+// window the conversation takes up, e.g. [3.2k/128k]. Only the token
+// count is shown for models with an unknown context window.
+func contextUsage(messages []openai.ChatCompletionMessage, modelStr string) string {
+	used := formatTokenCount(countTokens(messages, modelStr))
+	if window, ok := lookupContextWindow(modelStr); ok {
+		return fmt.Sprintf("[%s/%s]", used, formatTokenCount(window))
+	}
+	return fmt.Sprintf("[%s]", used)
+}
+
+// contextMessages returns the messages to send to the model. When the
+// conversation is counted to take up more than the context window of
+// the model, which providers would otherwise reject outright, the
+// oldest turns are left out of the request. The conversation itself and
+// its saved history are kept whole. Models with an unknown context
+// window get the full conversation.
+func (app *Application) contextMessages() []openai.ChatCompletionMessage {
+	modelStr := app.currentModelString()
+	window, ok := lookupContextWindow(modelStr)
+	if !ok {
+		return app.messages
+	}
+
+	estimate := countTokens(app.messages, modelStr)
+	if estimate <= window {
+		return app.messages
+	}
+
+	start, end := droppableTurns(app.messages, modelStr, window)
+	if start == end {
+		fmt.Fprintf(os.Stderr, "Warning: conversation is estimated at %s tokens, more than the %s context window of %s\n",
+			formatTokenCount(estimate), formatTokenCount(window), modelStr)
+		return app.messages
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: conversation is estimated at %s tokens, more than the %s context window of %s, leaving the %d oldest messages out of the request\n",
+		formatTokenCount(estimate), formatTokenCount(window), modelStr, end-start)
+	return slices.Concat(app.messages[:start], app.messages[end:])
+}
+
+// droppableTurns returns the range of messages to drop so that the rest
+// fit in limit tokens. Whole turns, starting at a user message, are
+// dropped from the oldest on, keeping the system prompt and the latest
+// turn. An empty range means nothing can be dropped.
+func droppableTurns(messages []openai.ChatCompletionMessage, modelStr string, limit int) (start, end int) {
+	for start < len(messages) && messages[start].Role == openai.ChatMessageRoleSystem {
+		start++
+	}
+
+	var turns []int
+	for idx := start; idx < len(messages); idx++ {
+		if messages[idx].Role == openai.ChatMessageRoleUser {
+			turns = append(turns, idx)
+		}
+	}
+
+	kept := countTokens(messages, modelStr)
+	end = start
+	for _, next := range turns[min(1, len(turns)):] {
+		if kept <= limit {
+			break
+		}
+		kept -= countTokens(messages[end:next], modelStr)
+		end = next
+	}
+	return start, end
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestFormatTokenCount(t *testing.T) {
+	tests := []struct {
+		tokens int
+		want   string
+	}{
+		{tokens: 0, want: "0"},
+		{tokens: 950, want: "950"},
+		{tokens: 1000, want: "1k"},
+		{tokens: 3240, want: "3.2k"},
+		{tokens: 128000, want: "128k"},
+		{tokens: 1047576, want: "1M"},
+		{tokens: 2500000, want: "2.5M"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatTokenCount(tt.tokens); got != tt.want {
+				t.Errorf("formatTokenCount(%d) = %q, want %q", tt.tokens, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCounter(t *testing.T) {
+	tests := []struct {
+		model string
+		text  string
+		want  int
+	}{
+		{model: "openai/gpt-4o", text: "hello world", want: 2},
+		{model: "openai/gpt-4o", text: "Hello, world!", want: 4},
+		{model: "openai/gpt-4", text: "tiktoken is great!", want: 6},
+		{model: "openai/gpt-3.5-turbo", text: "antidisestablishmentarianism", want: 6},
+		{model: "openai/o3-mini", text: "Hello, world!", want: 4},
+		{model: "anthropic/claude-sonnet-4", text: "Hello, world!", want: 4},
+		{model: "ollama/llama3", text: "tiktoken is great!", want: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model+" "+tt.text, func(t *testing.T) {
+			if got := tokenCounter(tt.model)(tt.text); got != tt.want {
+				t.Errorf("tokenCounter(%q)(%q) = %d, want %d", tt.model, tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "tiktoken is great!"},
+		{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{
+			{ID: "1", Function: openai.FunctionCall{Name: "hello", Arguments: "hello world"}},
+		}},
+	}
+
+	// 6 and 1+2 tokens of content plus the overhead of each message
+	want := 6 + 3 + 2*messageTokenOverhead
+	if got := countTokens(messages, "openai/gpt-4"); got != want {
+		t.Errorf("countTokens() = %d, want %d", got, want)
+	}
+}
+
+func TestContextUsage(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: strings.Repeat("a", 4000)},
+		{Role: openai.ChatMessageRoleUser, Content: strings.Repeat("b", 8000)},
+	}
+
+	tests := []struct {
+		name  string
+		model string
+		want  string
+	}{
+		{name: "known model", model: "openai/gpt-4o", want: "[2.5k/128k]"},
+		{name: "dated snapshot", model: "anthropic/claude-sonnet-4-20250514", want: "[3k/200k]"},
+		{name: "unknown model", model: "ollama/qwen3", want: "[3k]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contextUsage(messages, tt.model); got != tt.want {
+				t.Errorf("contextUsage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDroppableTurns(t *testing.T) {
+	long := strings.Repeat("x", 4000) // 1000 tokens
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "system"},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, ToolCalls: []openai.ToolCall{{ID: "1"}}},
+		{Role: openai.ChatMessageRoleTool, ToolCallID: "1", Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+	}
+
+	tests := []struct {
+		name      string
+		limit     int
+		wantStart int
+		wantEnd   int
+	}{
+		{name: "fits", limit: 10000, wantStart: 1, wantEnd: 1},
+		{name: "drop oldest turn", limit: 4000, wantStart: 1, wantEnd: 3},
+		{name: "drop turn with tool calls", limit: 2000, wantStart: 1, wantEnd: 6},
+		{name: "latest turn is kept", limit: 500, wantStart: 1, wantEnd: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := droppableTurns(messages, "ollama/llama3", tt.limit)
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("droppableTurns() = %d, %d, want %d, %d", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestContextMessages(t *testing.T) {
+	defaultContextWindows["test-small"] = 4000
+	t.Cleanup(func() { delete(defaultContextWindows, "test-small") })
+
+	long := strings.Repeat("x", 4000) // 1000 tokens
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "system"},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+		{Role: openai.ChatMessageRoleAssistant, Content: long},
+		{Role: openai.ChatMessageRoleUser, Content: long},
+	}
+	client := &fakeLLMClient{responses: [][]LLMStreamDelta{{{Content: "ok"}}}}
+	app := &Application{
+		client:     client,
+		modelFlag:  "ollama/test-small",
+		config:     &Config{},
+		messages:   slices.Clone(messages),
+		debugPrint: createDebugPrinter(false),
+	}
+
+	stream, err := app.createChatCompletionWithRetry(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	if len(client.lastMessages) != 4 || client.lastMessages[1].Role != openai.ChatMessageRoleUser {
+		t.Errorf("request has %d messages, want the system prompt and the last 3", len(client.lastMessages))
+	}
+	// The conversation, which is what gets saved, is kept whole
+	if len(app.messages) != len(messages) {
+		t.Errorf("len(app.messages) = %d, want %d", len(app.messages), len(messages))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Transcript entry types
+const (
+	transcriptRequest  = "request"
+	transcriptResponse = "response"
+	transcriptToolCall = "tool_call"
+)
+
+// transcriptMu serializes writes to transcript files so that entries
+// from concurrent conversations are not interleaved
+var transcriptMu sync.Mutex
+
+// TranscriptEntry is a single line of the JSONL transcript written with
+// --log-file
+type TranscriptEntry struct {
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"`
+	Conversation string    `json:"conversation,omitempty"`
+	Agent        string    `json:"agent,omitempty"`
+	Model        string    `json:"model,omitempty"`
+
+	// Messages holds the messages added to the conversation since the
+	// previous request, so the first request includes the system
+	// prompt and any loaded history.
+	Messages []openai.ChatCompletionMessage `json:"messages,omitempty"`
+	Message  *openai.ChatCompletionMessage  `json:"message,omitempty"`
+	Usage    *openai.Usage                  `json:"usage,omitempty"`
+	Tool     *TranscriptToolCall            `json:"tool,omitempty"`
+}
+
+// TranscriptToolCall describes a tool call and its result
+type TranscriptToolCall struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+	Command    string `json:"command,omitempty"`
+	Approved   bool   `json:"approved"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// transcriptLogger appends entries to a transcript file. It is
+// independent of the conversation history and shared by all
+// conversations that use the same file.
+type transcriptLogger struct {
+	path   string
+	logged int // number of conversation messages already logged
+	warned bool
+}
+
+func newTranscriptLogger(path string) *transcriptLogger {
+	if path == "" {
+		return nil
+	}
+	return &transcriptLogger{path: expandHomePath(path)}
+}
+
+// write appends entry as a single JSON line. Failures are reported once
+// and do not interrupt the conversation.
+func (t *transcriptLogger) write(entry TranscriptEntry) {
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = appendTranscriptLine(t.path, data)
+	}
+	if err != nil && !t.warned {
+		t.warned = true
+		fmt.Fprintf(os.Stderr, "Warning: failed to write to log file %s: %v\n", t.path, err)
+	}
+}
+
+func appendTranscriptLine(path string, line []byte) error {
+	transcriptMu.Lock()
+	defer transcriptMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// transcriptEntry returns an entry of the given type filled in with the
+// details of the current conversation
+func (app *Application) transcriptEntry(entryType string) TranscriptEntry {
+	entry := TranscriptEntry{
+		Time:  time.Now(),
+		Type:  entryType,
+		Agent: app.agentPath,
+		Model: app.currentModelString(),
+	}
+	if app.historyFile != "" {
+		entry.Conversation = extractConversationID(app.historyFile)
+	}
+	return entry
+}
+
+// logRequest records a request to the model along with the messages
+// added since the previous one
+func (app *Application) logRequest() {
+	if app.transcript == nil {
+		return
+	}
+
+	entry := app.transcriptEntry(transcriptRequest)
+	if app.transcript.logged < len(app.messages) {
+		entry.Messages = app.messages[app.transcript.logged:]
+	}
+	app.transcript.logged = len(app.messages)
+	app.transcript.write(entry)
+}
+
+// logResponse records a response from the model and its token usage.
+// It is called after the response is appended to the conversation.
+func (app *Application) logResponse(msg openai.ChatCompletionMessage, usage *openai.Usage) {
+	if app.transcript == nil {
+		return
+	}
+
+	entry := app.transcriptEntry(transcriptResponse)
+	entry.Message = &msg
+	entry.Usage = usage
+	// The response has been appended to the conversation and should not
+	// be repeated in the next request
+	app.transcript.logged = len(app.messages)
+	app.transcript.write(entry)
+}
+
+// logToolCall records the execution of a tool call
+func (app *Application) logToolCall(toolCall openai.ToolCall, command string, approved bool, output string, elapsed time.Duration, err error) {
+	if app.transcript == nil {
+		return
+	}
+
+	entry := app.transcriptEntry(transcriptToolCall)
+	entry.Tool = &TranscriptToolCall{
+		ID:         toolCall.ID,
+		Name:       toolCall.Function.Name,
+		Arguments:  toolCall.Function.Arguments,
+		Command:    command,
+		Approved:   approved,
+		Output:     output,
+		DurationMs: elapsed.Milliseconds(),
+	}
+	if err != nil {
+		entry.Tool.Error = err.Error()
+	}
+	app.transcript.write(entry)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestTranscriptLogger(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "transcript.jsonl")
+
+	app := &Application{
+		agentPath:   "builtin:default",
+		modelFlag:   "openai/gpt-4o",
+		config:      &Config{},
+		historyFile: filepath.Join(dir, "abc123---default---20250101-120000.json"),
+		transcript:  newTranscriptLogger(logFile),
+		messages: []openai.ChatCompletionMessage{
+			{Role: "system", Content: "system prompt"},
+			{Role: "user", Content: "list files"},
+		},
+	}
+
+	toolCall := openai.ToolCall{
+		ID:       "call_1",
+		Type:     "function",
+		Function: openai.FunctionCall{Name: "ls", Arguments: "{}"},
+	}
+
+	app.logRequest()
+	response := openai.ChatCompletionMessage{Role: "assistant", ToolCalls: []openai.ToolCall{toolCall}}
+	app.messages = append(app.messages, response)
+	app.logResponse(response, &openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15})
+	app.logToolCall(toolCall, "ls", true, "a.txt", 20*time.Millisecond, nil)
+	app.logToolCall(toolCall, "", false, "", 0, errors.New("refused"))
+	app.messages = append(app.messages, openai.ChatCompletionMessage{Role: "tool", Content: "a.txt", ToolCallID: "call_1"})
+	app.logRequest()
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatalf("failed to open log file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	tests := []struct {
+		name         string
+		wantType     string
+		wantMessages int
+		wantTool     string
+		wantError    string
+	}{
+		{name: "first request", wantType: transcriptRequest, wantMessages: 2},
+		{name: "response", wantType: transcriptResponse},
+		{name: "tool call", wantType: transcriptToolCall, wantTool: "ls"},
+		{name: "failed tool call", wantType: transcriptToolCall, wantTool: "ls", wantError: "refused"},
+		{name: "second request", wantType: transcriptRequest, wantMessages: 1},
+	}
+
+	if len(entries) != len(tests) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(tests))
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := entries[i]
+			if entry.Type != tt.wantType {
+				t.Errorf("type = %q, want %q", entry.Type, tt.wantType)
+			}
+			if entry.Model != "openai/gpt-4o" {
+				t.Errorf("model = %q, want %q", entry.Model, "openai/gpt-4o")
+			}
+			if entry.Conversation != "abc123" {
+				t.Errorf("conversation = %q, want %q", entry.Conversation, "abc123")
+			}
+			if len(entry.Messages) != tt.wantMessages {
+				t.Errorf("messages = %d, want %d", len(entry.Messages), tt.wantMessages)
+			}
+			if tt.wantTool != "" {
+				if entry.Tool == nil {
+					t.Fatal("tool is nil")
+				}
+				if entry.Tool.Name != tt.wantTool {
+					t.Errorf("tool name = %q, want %q", entry.Tool.Name, tt.wantTool)
+				}
+				if entry.Tool.Error != tt.wantError {
+					t.Errorf("tool error = %q, want %q", entry.Tool.Error, tt.wantError)
+				}
+			}
+		})
+	}
+
+	if usage := entries[1].Usage; usage == nil || usage.TotalTokens != 15 {
+		t.Errorf("response usage = %+v, want 15 total tokens", usage)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `toml:"input"`
+	Output float64 `toml:"output"`
+}
+
+// defaultModelPrices holds list prices for common models, used to
+// estimate the cost of a session. Prices set in the model_prices
+// section of the config take precedence.
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-4o":            {Input: 2.5, Output: 10},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.6},
+	"gpt-4.1":           {Input: 2, Output: 8},
+	"gpt-4.1-mini":      {Input: 0.4, Output: 1.6},
+	"gpt-4.1-nano":      {Input: 0.1, Output: 0.4},
+	"o3":                {Input: 2, Output: 8},
+	"o3-mini":           {Input: 1.1, Output: 4.4},
+	"o4-mini":           {Input: 1.1, Output: 4.4},
+	"claude-opus-4":     {Input: 15, Output: 75},
+	"claude-opus-4-1":   {Input: 15, Output: 75},
+	"claude-sonnet-4":   {Input: 3, Output: 15},
+	"claude-sonnet-4-5": {Input: 3, Output: 15},
+	"claude-haiku-4-5":  {Input: 1, Output: 5},
+	"claude-3-7-sonnet": {Input: 3, Output: 15},
+	"claude-3-5-sonnet": {Input: 3, Output: 15},
+	"claude-3-5-haiku":  {Input: 0.8, Output: 4},
+}
+
+// lookupModelPrice returns the price of model, given as provider/model.
+// The config is checked for the full name and then the model name
+// before falling back to the built-in prices.
+func lookupModelPrice(config *Config, modelStr string) (ModelPrice, bool) {
+	_, model, _ := strings.Cut(modelStr, "/")
+	if config != nil {
+		if price, ok := config.ModelPrices[modelStr]; ok {
+			return price, true
+		}
+		if price, ok := config.ModelPrices[model]; ok {
+			return price, true
+		}
+	}
+
+	return lookupModelSnapshot(defaultModelPrices, model)
+}
+
+// lookupModelSnapshot looks up a model name in table. Dated snapshots
+// such as claude-3-5-haiku-20241022 share the entry of the model they
+// belong to.
+func lookupModelSnapshot[V any](table map[string]V, model string) (V, bool) {
+	name := model
+	for {
+		if value, ok := table[name]; ok {
+			return value, true
+		}
+		idx := strings.LastIndex(name, "-")
+		if idx < 0 || !isSnapshotSuffix(name[idx+1:]) {
+			break
+		}
+		name = name[:idx]
+	}
+
+	var zero V
+	return zero, false
+}
+
+// isSnapshotSuffix reports whether a model name segment is part of a
+// snapshot date or the latest tag
+func isSnapshotSuffix(segment string) bool {
+	if segment == "latest" {
+		return true
+	}
+	_, err := strconv.Atoi(segment)
+	return err == nil
+}
+
+// sessionUsage accumulates token usage and tool calls over a session.
+// It is kept across conversations started within the same process, as
+// happens when switching agents in the REPL.
+type sessionUsage struct {
+	started          time.Time
+	responses        int
+	unreported       int // responses without token usage
+	promptTokens     int
+	completionTokens int
+	toolCalls        int
+	cost             float64
+	unpriced         int // responses whose model has no known price
+}
+
+// recordUsage adds the usage reported for a response from modelStr
+func (app *Application) recordUsage(modelStr string, usage *openai.Usage) {
+	app.usage.record(app.config, modelStr, usage)
+}
+
+// record adds the usage reported for a response from modelStr
+func (u *sessionUsage) record(config *Config, modelStr string, usage *openai.Usage) {
+	u.responses++
+	if usage == nil {
+		u.unreported++
+		return
+	}
+
+	u.promptTokens += usage.PromptTokens
+	u.completionTokens += usage.CompletionTokens
+
+	cost, ok := responseCost(config, modelStr, usage)
+	if !ok {
+		u.unpriced++
+		return
+	}
+	u.cost += cost
+}
+
+// responseCost estimates the cost in USD of a response from modelStr,
+// reporting false when the price of the model is not known
+func responseCost(config *Config, modelStr string, usage *openai.Usage) (float64, bool) {
+	price, ok := lookupModelPrice(config, modelStr)
+	if !ok {
+		return 0, false
+	}
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6, true
+}
+
+// formatUsageStats returns a summary of the usage of the session
+func formatUsageStats(usage sessionUsage, now time.Time) []string {
+	tokens := fmt.Sprintf("%d (%d prompt, %d completion)",
+		usage.promptTokens+usage.completionTokens, usage.promptTokens, usage.completionTokens)
+	if usage.unreported > 0 {
+		tokens += fmt.Sprintf(", not reported for %d of %d responses", usage.unreported, usage.responses)
+	}
+
+	var cost string
+	switch {
+	case usage.responses == 0:
+		cost = "$0.0000"
+	case usage.unpriced+usage.unreported == usage.responses:
+		cost = "unknown"
+	default:
+		cost = fmt.Sprintf("$%.4f", usage.cost)
+		if usage.unpriced > 0 {
+			cost += fmt.Sprintf(" (excluding %d responses from models without a known price)", usage.unpriced)
+		}
+	}
+
+	return []string{
+		fmt.Sprintf("Responses: %d", usage.responses),
+		fmt.Sprintf("Tokens: %s", tokens),
+		fmt.Sprintf("Tool calls: %d", usage.toolCalls),
+		fmt.Sprintf("Elapsed: %s", now.Sub(usage.started).Round(time.Second)),
+		fmt.Sprintf("Estimated cost: %s", cost),
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLookupModelPrice(t *testing.T) {
+	config := &Config{
+		ModelPrices: map[string]ModelPrice{
+			"openai/gpt-4o": {Input: 1, Output: 2},
+			"llama3":        {Input: 0.5, Output: 0.5},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		model     string
+		wantPrice ModelPrice
+		wantOK    bool
+	}{
+		{name: "config by full name", model: "openai/gpt-4o", wantPrice: ModelPrice{Input: 1, Output: 2}, wantOK: true},
+		{name: "config by model name", model: "ollama/llama3", wantPrice: ModelPrice{Input: 0.5, Output: 0.5}, wantOK: true},
+		{name: "built-in price", model: "openai/gpt-4o-mini", wantPrice: ModelPrice{Input: 0.15, Output: 0.6}, wantOK: true},
+		{name: "dated snapshot", model: "anthropic/claude-sonnet-4-20250514", wantPrice: ModelPrice{Input: 3, Output: 15}, wantOK: true},
+		{name: "other provider", model: "copilot/gpt-4o-2024-08-06", wantPrice: ModelPrice{Input: 2.5, Output: 10}, wantOK: true},
+		{name: "variant is not a snapshot", model: "openai/o3-pro", wantOK: false},
+		{name: "unknown model", model: "ollama/qwen3", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPrice, gotOK := lookupModelPrice(config, tt.model)
+			if gotOK != tt.wantOK {
+				t.Fatalf("lookupModelPrice() ok = %v, want %v", gotOK, tt.wantOK)
+			}
+			if gotPrice != tt.wantPrice {
+				t.Errorf("lookupModelPrice() = %+v, want %+v", gotPrice, tt.wantPrice)
+			}
+		})
+	}
+}
+
+func TestSessionUsage(t *testing.T) {
+	started := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		responses    map[string]*openai.Usage
+		wantContains []string
+	}{
+		{
+			name:         "no responses",
+			wantContains: []string{"Responses: 0", "Estimated cost: $0.0000"},
+		},
+		{
+			name: "priced model",
+			responses: map[string]*openai.Usage{
+				"openai/gpt-4o": {PromptTokens: 1000000, CompletionTokens: 100000},
+			},
+			wantContains: []string{"Tokens: 1100000 (1000000 prompt, 100000 completion)", "Estimated cost: $3.5000"},
+		},
+		{
+			name: "unknown model",
+			responses: map[string]*openai.Usage{
+				"ollama/qwen3": {PromptTokens: 10, CompletionTokens: 5},
+			},
+			wantContains: []string{"Tokens: 15", "Estimated cost: unknown"},
+		},
+		{
+			name: "partially priced",
+			responses: map[string]*openai.Usage{
+				"openai/gpt-4o": {PromptTokens: 1000000},
+				"ollama/qwen3":  {PromptTokens: 10},
+			},
+			wantContains: []string{"Estimated cost: $2.5000 (excluding 1 responses"},
+		},
+		{
+			name: "usage not reported",
+			responses: map[string]*openai.Usage{
+				"openai/gpt-4o": nil,
+			},
+			wantContains: []string{"not reported for 1 of 1 responses", "Estimated cost: unknown"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{config: &Config{}, usage: sessionUsage{started: started}}
+			for model, usage := range tt.responses {
+				app.recordUsage(model, usage)
+			}
+			app.usage.toolCalls = 2
+
+			got := strings.Join(formatUsageStats(app.usage, started.Add(90*time.Second)), "\n")
+			for _, want := range append(tt.wantContains, "Tool calls: 2", "Elapsed: 1m30s") {
+				if !strings.Contains(got, want) {
+					t.Errorf("formatUsageStats() = %q, want to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
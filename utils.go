@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -29,6 +32,19 @@ func expandHomePath(path string) string {
 	return path
 }
 
+// formatElapsed formats a duration for display next to a tool call,
+// using milliseconds for sub-second durations
+func formatElapsed(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
 // CacheError represents errors related to cache directory operations
 type CacheError struct {
 	Operation string
@@ -78,6 +94,16 @@ func openTTY() (*os.File, error) {
 	return os.OpenFile("/dev/tty", os.O_RDWR, 0)
 }
 
+// showPreview prints the output of a preview command above the
+// confirmation prompt
+func showPreview(preview string) {
+	cyan := color.New(color.FgCyan).SprintFunc()
+	fmt.Fprintf(os.Stderr, "%s Preview:\n", cyan("[~]"))
+	if preview != "" {
+		fmt.Fprintln(os.Stderr, preview)
+	}
+}
+
 // confirm prompts the user for confirmation with yes/no/message options
 func confirm(prompt string) confirmResponse {
 	cyan := color.New(color.FgCyan).SprintFunc()
@@ -116,9 +142,37 @@ func confirm(prompt string) confirmResponse {
 	return confirmResponse{approved: response == "y", message: ""}
 }
 
+// xdgDir returns the directory named by the XDG environment variable
+// envar, ignoring relative paths as the XDG spec requires
+func xdgDir(envar string) string {
+	if dir := os.Getenv(envar); filepath.IsAbs(dir) {
+		return dir
+	}
+	return ""
+}
+
+// configHome returns the directory holding the config file and user
+// agents: $XDG_CONFIG_HOME/esa when set and ~/.config/esa otherwise
+func configHome() string {
+	if dir := xdgDir("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "esa")
+	}
+	return expandHomePath("~/.config/esa")
+}
+
+// userCacheDir returns the base cache directory, preferring
+// $XDG_CACHE_HOME on every platform so that it is respected on macOS
+// as well
+func userCacheDir() (string, error) {
+	if dir := xdgDir("XDG_CACHE_HOME"); dir != "" {
+		return dir, nil
+	}
+	return os.UserCacheDir()
+}
+
 // setupCacheDir ensures the cache directory exists and returns its path.
 func setupCacheDir() (string, error) {
-	cacheDir, err := os.UserCacheDir()
+	cacheDir, err := userCacheDir()
 	if err != nil {
 		return "", wrapCacheError("get user cache directory", "", err)
 	}
@@ -216,8 +270,159 @@ func findHistoryFile(cacheDir string, conversation string) (string, error) {
 	}
 }
 
+// historyFilesByRecency returns the names of the history files in
+// cacheDir, most recent first, in the order used by findHistoryFile
+func historyFilesByRecency(cacheDir string) ([]string, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type fileEntry struct {
+		name    string
+		modTime time.Time
+	}
+
+	var files []fileEntry
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			files = append(files, fileEntry{name: entry.Name(), modTime: info.ModTime()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.name
+	}
+	return names, nil
+}
+
+// findHistoryIndexForAgent returns the 1-based index, as accepted by
+// findHistoryFile, of the most recent conversation held with agentName
+func findHistoryIndexForAgent(cacheDir string, agentName string) (int, error) {
+	files, err := historyFilesByRecency(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, file := range files {
+		if _, name, _ := parseHistoryFilename(file); name == agentName {
+			return i + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no history files found for agent %s", agentName)
+}
+
+// findReplHistoryIndex returns the 1-based index, as accepted by
+// findHistoryFile, of the most recent REPL session. When agentName is
+// set only sessions with that agent are considered.
+func findReplHistoryIndex(cacheDir string, agentName string) (int, error) {
+	files, err := historyFilesByRecency(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files are only read when they are not in the index or have
+	// changed since, so that resuming does not decrypt every file
+	index := loadReplIndex(cacheDir)
+	changed := false
+	defer func() {
+		if changed {
+			saveReplIndex(cacheDir, index, files)
+		}
+	}()
+
+	for i, file := range files {
+		if agentName != "" {
+			if _, name, _ := parseHistoryFilename(file); name != agentName {
+				continue
+			}
+		}
+
+		info, err := os.Stat(filepath.Join(cacheDir, file))
+		if err != nil {
+			continue
+		}
+		entry, ok := index[file]
+		if !ok || !entry.ModTime.Equal(info.ModTime()) {
+			repl, err := isReplHistory(filepath.Join(cacheDir, file))
+			if err != nil {
+				continue
+			}
+			entry = replIndexEntry{ModTime: info.ModTime(), Repl: repl}
+			index[file] = entry
+			changed = true
+		}
+		if entry.Repl {
+			return i + 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no REPL sessions found")
+}
+
+// replIndexFile is the file in the cache directory that records which
+// history files are REPL sessions, along with their modification time.
+// It has no .json extension so that it is not taken for a conversation.
+const replIndexFile = "repl-sessions"
+
+type replIndexEntry struct {
+	ModTime time.Time `json:"mod_time"`
+	Repl    bool      `json:"repl"`
+}
+
+// loadReplIndex reads the REPL session index, returning an empty one
+// when it is missing or unreadable
+func loadReplIndex(cacheDir string) map[string]replIndexEntry {
+	index := make(map[string]replIndexEntry)
+	if data, err := os.ReadFile(filepath.Join(cacheDir, replIndexFile)); err == nil {
+		json.Unmarshal(data, &index)
+	}
+	return index
+}
+
+// saveReplIndex writes the REPL session index, dropping the entries of
+// files that are no longer in files
+func saveReplIndex(cacheDir string, index map[string]replIndexEntry, files []string) {
+	kept := make(map[string]replIndexEntry, len(index))
+	for _, file := range files {
+		if entry, ok := index[file]; ok {
+			kept[file] = entry
+		}
+	}
+	if data, err := json.Marshal(kept); err == nil {
+		os.WriteFile(filepath.Join(cacheDir, replIndexFile), data, 0644)
+	}
+}
+
+// isReplHistory reports whether the history file at path is a REPL
+// session
+func isReplHistory(path string) (bool, error) {
+	data, err := readHistoryData(path)
+	if err != nil {
+		return false, err
+	}
+	var history ConversationHistory
+	if err := json.Unmarshal(data, &history); err != nil {
+		return false, err
+	}
+	return history.Repl, nil
+}
+
 func getHistoryFilePath(cacheDir string, opts *CLIOptions) (string, bool) {
 	if !opts.ContinueChat && !opts.RetryChat {
+		if opts.NoSave {
+			return "", false
+		}
 		cacheDir = setupCacheDirWithFallback()
 		return createNewHistoryFile(cacheDir, opts.AgentName, opts.Conversation), false
 	}
@@ -226,6 +431,9 @@ func getHistoryFilePath(cacheDir string, opts *CLIOptions) (string, bool) {
 		return filePath, true
 	}
 
+	if opts.NoSave {
+		return "", false
+	}
 	cacheDir = setupCacheDirWithFallback()
 	return createNewHistoryFile(cacheDir, opts.AgentName, opts.Conversation), false
 }
@@ -259,13 +467,26 @@ func readUserInput(prompt string, multiline bool) (string, error) {
 		color.New(color.FgHiWhite, color.Italic).Fprint(os.Stderr, " (ctrl+d on empty line to complete)\n")
 	}
 
+	return readInput(reader, multiline)
+}
+
+// readInput reads a line from reader, or with multiline every line
+// until ctrl+d on an empty line
+func readInput(reader *bufio.Reader, multiline bool) (string, error) {
 	var result strings.Builder
 
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			if err.Error() == "EOF" {
-				// Ctrl+D pressed
+				// Ctrl+D pressed, keeping anything typed before it on
+				// the same line
+				if multiline && line != "" {
+					if result.Len() > 0 {
+						result.WriteByte('\n')
+					}
+					result.WriteString(line)
+				}
 				break
 			}
 			return "", err
@@ -302,6 +523,104 @@ func readUserInput(prompt string, multiline bool) (string, error) {
 	return result.String(), nil
 }
 
+// pasteEndMarker is entered on a line of its own to end pasted input
+const pasteEndMarker = "EOF"
+
+// Values of the repl_submit setting, which decides when a message typed
+// in the REPL is sent
+const (
+	replSubmitSingleEnter = "single-enter"
+	replSubmitDoubleEnter = "double-enter"
+	replSubmitCtrlD       = "ctrl-d"
+)
+
+// readReplInput reads a message typed in the REPL, using the repl_submit
+// mode to decide when it is complete
+func readReplInput(mode string) (string, error) {
+	// Open /dev/tty for interactive input to bypass piped stdin
+	var input io.Reader = os.Stdin
+	if tty, err := openTTY(); err == nil {
+		defer tty.Close()
+		input = tty
+	}
+	return readReplInputFrom(input, mode)
+}
+
+// readReplInputFrom reads a REPL message from input. Ctrl+d before
+// anything is typed returns io.EOF whatever the mode, so that it always
+// ends the session.
+func readReplInputFrom(input io.Reader, mode string) (string, error) {
+	eof := &eofReader{r: input}
+	reader := bufio.NewReader(eof)
+
+	var text string
+	var err error
+	switch mode {
+	case replSubmitDoubleEnter:
+		// An empty line ends the message
+		text, err = readUntilMarker(reader, "")
+	case replSubmitCtrlD:
+		text, err = readInput(reader, true)
+	default:
+		text, err = readInput(reader, false)
+	}
+	if err == nil && text == "" && eof.seen {
+		return "", io.EOF
+	}
+	return text, err
+}
+
+// eofReader records whether the end of the input was reached
+type eofReader struct {
+	r    io.Reader
+	seen bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.seen = true
+	}
+	return n, err
+}
+
+// readLinesUntil reads lines until one holding only marker or ctrl+d,
+// so that text with several lines in it is read as a single input
+func readLinesUntil(marker string) (string, error) {
+	// Open /dev/tty for interactive input to bypass piped stdin
+	var input io.Reader = os.Stdin
+	if tty, err := openTTY(); err == nil {
+		defer tty.Close()
+		input = tty
+	}
+	return readUntilMarker(bufio.NewReader(input), marker)
+}
+
+// readUntilMarker reads lines from reader until a line holding only
+// marker or the end of the input
+func readUntilMarker(reader *bufio.Reader, marker string) (string, error) {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == marker {
+			break
+		}
+		if err == io.EOF {
+			if line != "" {
+				lines = append(lines, line)
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 // parseHistoryFilename extracts conversation ID, agent name, and timestamp
 // from a history filename. Filenames follow the format:
 //
@@ -338,6 +657,51 @@ func parseHistoryFilename(fileName string) (conversation, agentName, timestampSt
 	return conversation, agentName, timestampStr
 }
 
+// legacyHistoryFileRegex matches history files saved before
+// conversation IDs were added, named {agent}-{YYYYMMDD}-{HHMMSS}.json
+var legacyHistoryFileRegex = regexp.MustCompile(`^[^-].*-\d{8}-\d{6}\.json$`)
+
+// migrateHistory renames the legacy history files in the cache
+// directory. It is run once at startup, before any history is read.
+func migrateHistory() {
+	cacheDir, err := userCacheDir()
+	if err != nil {
+		return
+	}
+	err = migrateHistoryFiles(filepath.Join(cacheDir, "esa"))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Warning: could not rename old history files: %v\n", err)
+	}
+}
+
+// migrateHistoryFiles renames history files in cacheDir that use the
+// legacy naming scheme to ---{agent}-{YYYYMMDD}-{HHMMSS}.json, the name
+// createNewHistoryFile gives files without a conversation ID, so that
+// parseHistoryFilename reads their agent and timestamp. Renaming keeps
+// the modification time, leaving the order of conversations unchanged.
+func migrateHistoryFiles(cacheDir string) error {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.Contains(name, "---") || !legacyHistoryFileRegex.MatchString(name) {
+			continue
+		}
+
+		newPath := filepath.Join(cacheDir, "---"+name)
+		if _, err := os.Stat(newPath); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(cacheDir, name), newPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // getSortedHistoryFiles retrieves and sorts history files by modification time.
 func getSortedHistoryFiles() ([]string, map[string]os.FileInfo, error) {
 	cacheDir, err := setupCacheDir()
@@ -390,14 +754,22 @@ var defaultProviders = map[string]providerInfo{
 	"openai": {
 		baseURL:     "https://api.openai.com/v1",
 		apiKeyEnvar: "OPENAI_API_KEY",
+		streamUsage: true,
 	},
 	"openrouter": {
 		baseURL:     "https://openrouter.ai/api/v1",
 		apiKeyEnvar: "OPENROUTER_API_KEY",
+		streamUsage: true,
+		// Attribution headers recommended by OpenRouter
+		additionalHeaders: map[string]string{
+			"HTTP-Referer": "https://github.com/meain/esa",
+			"X-Title":      "esa",
+		},
 	},
 	"groq": {
 		baseURL:     "https://api.groq.com/openai/v1",
 		apiKeyEnvar: "GROQ_API_KEY",
+		streamUsage: true,
 	},
 	"github": {
 		baseURL:     "https://models.inference.ai.azure.com",
@@ -415,6 +787,21 @@ var defaultProviders = map[string]providerInfo{
 		baseURL:     "https://api.anthropic.com",
 		apiKeyEnvar: "ANTHROPIC_API_KEY",
 	},
+	"perplexity": {
+		baseURL:     "https://api.perplexity.ai",
+		apiKeyEnvar: "PERPLEXITY_API_KEY",
+	},
+	"xai": {
+		baseURL:     "https://api.x.ai/v1",
+		apiKeyEnvar: "XAI_API_KEY",
+		streamUsage: true,
+	},
+	// grok is an alias of xai named after its models
+	"grok": {
+		baseURL:     "https://api.x.ai/v1",
+		apiKeyEnvar: "XAI_API_KEY",
+		streamUsage: true,
+	},
 }
 
 // resolveOllamaHost returns the Ollama providerInfo with proper host URL normalization.
@@ -433,6 +820,7 @@ func resolveOllamaHost() providerInfo {
 		baseURL:          host,
 		apiKeyEnvar:      "OLLAMA_API_KEY",
 		apiKeyCanBeEmpty: true,
+		streamUsage:      true,
 	}
 }
 
@@ -451,21 +839,82 @@ func (info *providerInfo) applyConfigOverrides(config *Config, provider string)
 	if providerCfg.APIKeyEnvar != "" {
 		info.apiKeyEnvar = providerCfg.APIKeyEnvar
 	}
+	if providerCfg.StreamUsage != nil {
+		info.streamUsage = *providerCfg.StreamUsage
+	}
 	if len(providerCfg.AdditionalHeaders) > 0 {
-		if info.additionalHeaders == nil {
-			info.additionalHeaders = make(map[string]string)
+		// Copy the headers so that the defaults shared by all lookups
+		// are not modified
+		headers := make(map[string]string, len(info.additionalHeaders)+len(providerCfg.AdditionalHeaders))
+		for key, value := range info.additionalHeaders {
+			headers[key] = value
 		}
+		info.additionalHeaders = headers
 		for key, value := range providerCfg.AdditionalHeaders {
 			info.additionalHeaders[key] = value
 		}
 	}
 }
 
-func parseModel(modelStr string, agent Agent, config *Config) (provider string, model string, info providerInfo) {
+// applyOpenAIOrganization sets the OpenAI-Organization and
+// OpenAI-Project headers from the openai provider config, falling back
+// to OPENAI_ORG_ID and OPENAI_PROJECT. Headers set explicitly in
+// additional_headers are left as is.
+func (info *providerInfo) applyOpenAIOrganization(config *Config) {
+	var providerCfg ProviderConfig
+	if config != nil {
+		providerCfg = config.Providers["openai"]
+	}
+
+	values := []struct {
+		header, value, envar string
+	}{
+		{"OpenAI-Organization", providerCfg.Organization, "OPENAI_ORG_ID"},
+		{"OpenAI-Project", providerCfg.Project, "OPENAI_PROJECT"},
+	}
+
+	headers := make(map[string]string)
+	for _, v := range values {
+		value := v.value
+		if value == "" {
+			value = os.Getenv(v.envar)
+		}
+		if value == "" || hasHeader(info.additionalHeaders, v.header) {
+			continue
+		}
+		headers[v.header] = value
+	}
+
+	// mergeHeaders copies the headers so that the defaults shared by
+	// all lookups are not modified
+	info.additionalHeaders = mergeHeaders(info.additionalHeaders, headers)
+}
+
+// hasHeader reports whether headers contains name, ignoring case
+func hasHeader(headers map[string]string, name string) bool {
+	for key := range headers {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveModelString returns the model string to use, falling back to
+// the agent and config defaults and resolving model aliases
+func resolveModelString(modelStr string, agent Agent, config *Config) string {
+	resolved, _, _ := resolveModelAlias(modelStr, agent, config)
+	return resolved
+}
+
+// resolveModelAlias is like resolveModelString but also returns the
+// alias the model string was resolved from, if any, so that its
+// settings can be applied
+func resolveModelAlias(modelStr string, agent Agent, config *Config) (string, ModelAlias, bool) {
 	if modelStr == "" {
 		if agent.DefaultModel != "" {
 			modelStr = agent.DefaultModel
-		} else if config.Settings.DefaultModel != "" {
+		} else if config != nil && config.Settings.DefaultModel != "" {
 			modelStr = config.Settings.DefaultModel
 		} else {
 			modelStr = defaultModel
@@ -474,11 +923,91 @@ func parseModel(modelStr string, agent Agent, config *Config) (provider string,
 
 	// Check if the model string is an alias
 	if config != nil {
-		if aliasedModel, ok := config.ModelAliases[modelStr]; ok {
-			modelStr = aliasedModel
+		if alias, ok := config.ModelAliases[modelStr]; ok {
+			return withProviderDefaultModel(alias.Model, config), alias, true
 		}
 	}
 
+	return withProviderDefaultModel(modelStr, config), ModelAlias{}, false
+}
+
+// withProviderDefaultModel fills in the default_model of the provider
+// when the model string names only a provider, as "openai/" or
+// "openai". Model strings it does not apply to are returned as is.
+func withProviderDefaultModel(modelStr string, config *Config) string {
+	if config == nil {
+		return modelStr
+	}
+
+	provider, model, _ := strings.Cut(modelStr, "/")
+	if model != "" {
+		return modelStr
+	}
+	if defaultModel := config.Providers[provider].DefaultModel; defaultModel != "" {
+		return provider + "/" + defaultModel
+	}
+	return modelStr
+}
+
+// knownProviders returns the sorted names of the builtin providers and
+// the providers defined in the config
+func knownProviders(config *Config) []string {
+	providers := []string{"ollama"}
+	for name := range defaultProviders {
+		providers = append(providers, name)
+	}
+	if config != nil {
+		for name := range config.Providers {
+			if !slices.Contains(providers, name) {
+				providers = append(providers, name)
+			}
+		}
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// validateModelString checks that the resolved model string is in the
+// provider/model format and uses a known provider so that mistakes are
+// reported with a helpful message instead of failing later.
+func validateModelString(modelStr string, agent Agent, config *Config) error {
+	resolved := resolveModelString(modelStr, agent, config)
+	providers := strings.Join(knownProviders(config), ", ")
+
+	provider, model, found := strings.Cut(resolved, "/")
+	if found && model == "" && slices.Contains(knownProviders(config), provider) {
+		return fmt.Errorf(
+			"no model given for provider %q: use %s/<model> or set default_model under [providers.%s] in the config",
+			provider, provider, provider,
+		)
+	}
+	if !found || provider == "" || model == "" {
+		// Model names with a tag (e.g. gemma3n:latest) are usually
+		// local Ollama models
+		name := strings.Trim(resolved, "/")
+		suggestion := "openai/" + name
+		if strings.Contains(name, ":") {
+			suggestion = "ollama/" + name
+		}
+		return fmt.Errorf(
+			"invalid model %q: models must be given as provider/model (e.g. %s); known providers: %s",
+			resolved, suggestion, providers,
+		)
+	}
+
+	if !slices.Contains(knownProviders(config), provider) {
+		return fmt.Errorf(
+			"unknown provider %q in model %q; known providers: %s (custom providers can be added under [providers.%s] in the config)",
+			provider, resolved, providers, provider,
+		)
+	}
+
+	return nil
+}
+
+func parseModel(modelStr string, agent Agent, config *Config) (provider string, model string, info providerInfo) {
+	modelStr = resolveModelString(modelStr, agent, config)
+
 	parts := strings.SplitN(modelStr, "/", 2)
 	if len(parts) != 2 {
 		log.Fatalf("invalid model format %q - must be provider/model", modelStr)
@@ -487,7 +1016,16 @@ func parseModel(modelStr string, agent Agent, config *Config) (provider string,
 	provider = parts[0]
 	model = parts[1]
 
-	// Look up default provider info
+	info = lookupProvider(provider, config)
+	info.options = mergeOptions(info.options, agent.ExtraBody)
+	info.options = mergeOptions(info.options, agent.ProviderOptions[provider])
+	return provider, model, info
+}
+
+// lookupProvider returns the settings of a provider, starting from the
+// builtin defaults and applying overrides from the config
+func lookupProvider(provider string, config *Config) providerInfo {
+	var info providerInfo
 	if provider == "ollama" {
 		info = resolveOllamaHost()
 	} else if defaults, ok := defaultProviders[provider]; ok {
@@ -496,6 +1034,12 @@ func parseModel(modelStr string, agent Agent, config *Config) (provider string,
 
 	// Apply config overrides
 	info.applyConfigOverrides(config, provider)
+	if provider == "openai" {
+		info.applyOpenAIOrganization(config)
+	}
+	if config != nil {
+		info.options = config.ProviderOptions[provider]
+	}
 
-	return provider, model, info
+	return info
 }
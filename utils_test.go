@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -279,6 +282,30 @@ func TestGetHistoryFilePath(t *testing.T) {
 				return path == filePath
 			},
 		},
+		{
+			name: "New conversation without saving",
+			opts: &CLIOptions{
+				AgentName: "test-agent",
+				NoSave:    true,
+			},
+			wantExists: false,
+			wantPatternCheck: func(path string) bool {
+				return path == ""
+			},
+		},
+		{
+			name: "Continue existing conversation without saving",
+			opts: &CLIOptions{
+				AgentName:    "test-agent",
+				Conversation: "existing-session",
+				ContinueChat: true,
+				NoSave:       true,
+			},
+			wantExists: true,
+			wantPatternCheck: func(path string) bool {
+				return path == filePath
+			},
+		},
 		{
 			name: "New conversation with numeric ID (index mode)",
 			opts: &CLIOptions{
@@ -379,4 +406,335 @@ func TestParseHistoryFilename(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestFormatElapsed(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		want     string
+	}{
+		{
+			name:     "Sub-second duration",
+			duration: 234567 * time.Microsecond,
+			want:     "235ms",
+		},
+		{
+			name:     "Seconds",
+			duration: 12345 * time.Millisecond,
+			want:     "12.3s",
+		},
+		{
+			name:     "Minutes",
+			duration: 65400 * time.Millisecond,
+			want:     "1m5s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatElapsed(tt.duration); got != tt.want {
+				t.Errorf("formatElapsed() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindHistoryIndexForAgent(t *testing.T) {
+	tempDir := t.TempDir()
+
+	testFiles := map[string]time.Time{
+		"---coder-20240101-110000.json":        time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC),
+		"---default-20240101-120000.json":      time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		"session---coder-20240101-130000.json": time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC),
+		"---git-helper-20240101-140000.json":   time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC),
+	}
+	for filename, modTime := range testFiles {
+		filePath := filepath.Join(tempDir, filename)
+		if err := os.WriteFile(filePath, []byte("{}"), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", filename, err)
+		}
+		os.Chtimes(filePath, modTime, modTime)
+	}
+
+	tests := []struct {
+		name      string
+		agentName string
+		wantIndex int
+		wantError bool
+	}{
+		{name: "most recent conversation for agent", agentName: "coder", wantIndex: 2},
+		{name: "agent name containing dashes", agentName: "git-helper", wantIndex: 1},
+		{name: "older agent conversation", agentName: "default", wantIndex: 3},
+		{name: "agent without conversations", agentName: "writer", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIndex, err := findHistoryIndexForAgent(tempDir, tt.agentName)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("findHistoryIndexForAgent() error = %v, wantError %v", err, tt.wantError)
+			}
+			if gotIndex != tt.wantIndex {
+				t.Errorf("findHistoryIndexForAgent() = %d, want %d", gotIndex, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestFindReplHistoryIndex(t *testing.T) {
+	tempDir := t.TempDir()
+
+	testFiles := []struct {
+		name    string
+		content string
+		modTime time.Time
+	}{
+		{"---coder-20240101-110000.json", `{"repl":true}`, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"---default-20240101-120000.json", `{"repl":true}`, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{"---coder-20240101-130000.json", `{}`, time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"---default-20240101-140000.json", `not json`, time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)},
+	}
+	for _, file := range testFiles {
+		filePath := filepath.Join(tempDir, file.name)
+		if err := os.WriteFile(filePath, []byte(file.content), 0644); err != nil {
+			t.Fatalf("Failed to create test file %s: %v", file.name, err)
+		}
+		os.Chtimes(filePath, file.modTime, file.modTime)
+	}
+
+	tests := []struct {
+		name      string
+		agentName string
+		wantIndex int
+		wantError bool
+	}{
+		{name: "most recent session with any agent", agentName: "", wantIndex: 3},
+		{name: "most recent session with agent", agentName: "coder", wantIndex: 4},
+		{name: "agent without sessions", agentName: "writer", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIndex, err := findReplHistoryIndex(tempDir, tt.agentName)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("findReplHistoryIndex() error = %v, wantError %v", err, tt.wantError)
+			}
+			if gotIndex != tt.wantIndex {
+				t.Errorf("findReplHistoryIndex() = %d, want %d", gotIndex, tt.wantIndex)
+			}
+		})
+	}
+
+	// Files that did not change since they were indexed are not read
+	// again, while changed ones are
+	unchanged := filepath.Join(tempDir, "---default-20240101-120000.json")
+	if err := os.WriteFile(unchanged, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(unchanged, testFiles[1].modTime, testFiles[1].modTime)
+	if got, err := findReplHistoryIndex(tempDir, ""); err != nil || got != 3 {
+		t.Errorf("findReplHistoryIndex() = %d, %v, want 3 from the index", got, err)
+	}
+
+	changed := filepath.Join(tempDir, "---coder-20240101-130000.json")
+	if err := os.WriteFile(changed, []byte(`{"repl":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 1, 13, 30, 0, 0, time.UTC)
+	os.Chtimes(changed, modTime, modTime)
+	if got, err := findReplHistoryIndex(tempDir, ""); err != nil || got != 2 {
+		t.Errorf("findReplHistoryIndex() = %d, %v, want 2 after the file changed", got, err)
+	}
+}
+
+func TestReadUntilMarker(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "blank lines are kept",
+			input: "first paragraph\n\nsecond paragraph\nEOF\n",
+			want:  "first paragraph\n\nsecond paragraph",
+		},
+		{
+			name:  "input after the marker is left",
+			input: "pasted\nEOF\nnext prompt\n",
+			want:  "pasted",
+		},
+		{
+			name:  "end of input",
+			input: "no marker\nlast line",
+			want:  "no marker\nlast line",
+		},
+		{
+			name:  "marker within a line",
+			input: "read until EOF\nEOF\n",
+			want:  "read until EOF",
+		},
+		{
+			name:  "windows line endings",
+			input: "one\r\ntwo\r\nEOF\r\n",
+			want:  "one\ntwo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readUntilMarker(bufio.NewReader(strings.NewReader(tt.input)), "EOF")
+			if err != nil {
+				t.Fatalf("readUntilMarker() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readUntilMarker() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadReplInputFrom(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		input   string
+		want    string
+		wantEOF bool
+	}{
+		{name: "single enter", mode: replSubmitSingleEnter, input: "hello\nnext\n", want: "hello\n"},
+		{name: "single enter ctrl+d", mode: replSubmitSingleEnter, input: "", wantEOF: true},
+		{name: "double enter", mode: replSubmitDoubleEnter, input: "one\ntwo\n\n", want: "one\ntwo"},
+		{name: "double enter ctrl+d", mode: replSubmitDoubleEnter, input: "", wantEOF: true},
+		{name: "double enter empty line", mode: replSubmitDoubleEnter, input: "\n", want: ""},
+		{name: "ctrl-d sends the message", mode: replSubmitCtrlD, input: "one\ntwo\n", want: "one\ntwo"},
+		{name: "ctrl-d on an empty line", mode: replSubmitCtrlD, input: "", wantEOF: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readReplInputFrom(strings.NewReader(tt.input), tt.mode)
+			if tt.wantEOF {
+				if err != io.EOF {
+					t.Fatalf("readReplInputFrom() error = %v, want io.EOF", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readReplInputFrom() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("readReplInputFrom() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	tests := []struct {
+		name          string
+		xdgConfigHome string
+		want          string
+	}{
+		{
+			name: "Unset",
+			want: filepath.Join(home, ".config", "esa"),
+		},
+		{
+			name:          "Absolute",
+			xdgConfigHome: "/opt/config",
+			want:          filepath.Join("/opt/config", "esa"),
+		},
+		{
+			name:          "Relative is ignored",
+			xdgConfigHome: "config",
+			want:          filepath.Join(home, ".config", "esa"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", tt.xdgConfigHome)
+			if got := configHome(); got != tt.want {
+				t.Errorf("configHome() = %q, want %q", got, tt.want)
+			}
+			if got, want := defaultConfigPath(), filepath.Join(tt.want, "config.toml"); got != want {
+				t.Errorf("defaultConfigPath() = %q, want %q", got, want)
+			}
+			if got, want := defaultAgentsDir(), filepath.Join(tt.want, "agents"); got != want {
+				t.Errorf("defaultAgentsDir() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSetupCacheDir_XDGCacheHome(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", dir)
+
+	got, err := setupCacheDir()
+	if err != nil {
+		t.Fatalf("setupCacheDir() error = %v", err)
+	}
+	if want := filepath.Join(dir, "esa"); got != want {
+		t.Errorf("setupCacheDir() = %q, want %q", got, want)
+	}
+}
+
+func TestMigrateHistoryFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"my-agent-20250101-120000.json",      // legacy
+		"conv1---coder-20260321-140500.json", // current, with ID
+		"---default-20260321-140500.json",    // current, no ID
+		"notes.json",                         // unrelated
+	}
+	modTime := time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local)
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := migrateHistoryFiles(dir); err != nil {
+		t.Fatalf("migrateHistoryFiles() error = %v", err)
+	}
+
+	want := []string{
+		"---default-20260321-140500.json",
+		"---my-agent-20250101-120000.json",
+		"conv1---coder-20260321-140500.json",
+		"notes.json",
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Name())
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "---my-agent-20250101-120000.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time = %v, want %v", info.ModTime(), modTime)
+	}
+
+	conv, agent, ts := parseHistoryFilename("---my-agent-20250101-120000.json")
+	if conv != "" || agent != "my-agent" || ts != "20250101-120000" {
+		t.Errorf("parseHistoryFilename() = %q, %q, %q, want \"\", \"my-agent\", \"20250101-120000\"", conv, agent, ts)
+	}
+}
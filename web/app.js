@@ -12,6 +12,7 @@
     var statusEl = document.getElementById("connection-status");
     var approvalModal = document.getElementById("approval-modal");
     var approvalCommand = document.getElementById("approval-command");
+    var approvalPreview = document.getElementById("approval-preview");
     var approveBtn = document.getElementById("approve-btn");
     var denyBtn = document.getElementById("deny-btn");
     var denyMessageInput = document.getElementById("deny-message");
@@ -176,6 +177,9 @@
             case "aborted":
                 handleAborted();
                 break;
+            case "notice":
+                appendNotice(msg.content);
+                break;
             case "error":
                 appendError(msg.content);
                 finishStream();
@@ -311,7 +315,7 @@
 
         if (!msg.safe) {
             pendingApprovalId = msg.id;
-            showApprovalModal(msg.command);
+            showApprovalModal(msg.command, msg.preview);
         }
     }
 
@@ -346,8 +350,10 @@
     }
 
     // -- Approval Modal --
-    function showApprovalModal(command) {
+    function showApprovalModal(command, preview) {
         approvalCommand.textContent = "$ " + command;
+        approvalPreview.textContent = preview || "";
+        approvalPreview.classList.toggle("hidden", !preview);
         denyMessageInput.value = "";
         approvalModal.classList.remove("hidden");
         approveBtn.focus();
@@ -438,6 +444,15 @@
         scheduleMinimap();
     }
 
+    function appendNotice(text) {
+        var noticeDiv = document.createElement("div");
+        noticeDiv.className = "message-notice";
+        noticeDiv.textContent = text;
+        messagesEl.appendChild(noticeDiv);
+        scrollToBottom();
+        scheduleMinimap();
+    }
+
     // -- Minimap --
     function rebuildMinimap() {
         if (!minimapEl) return;